@@ -73,6 +73,11 @@ func isBinaryOp(op string) bool {
 	return binaryOps[op]
 }
 
+// IsBinaryOp returns true if op is a known binary operator such as '+', 'and' or 'default'.
+func IsBinaryOp(op string) bool {
+	return isBinaryOp(op)
+}
+
 func binaryOpPriority(op string) int {
 	op = strings.ToLower(op)
 	return binaryOpPriorities[op]
@@ -210,3 +215,22 @@ func binaryOpEvalNumber(op string, left, right float64, isBool bool) float64 {
 }
 
 var nan = math.NaN()
+
+// BinaryOpMatching returns binaryop.Matching for be.
+//
+// The returned value can be used for applying be to vectors of series via binaryop.Matching.Apply.
+func BinaryOpMatching(be *BinaryOpExpr) *binaryop.Matching {
+	m := &binaryop.Matching{
+		Op:                strings.ToLower(be.Op),
+		Bool:              be.Bool,
+		GroupModifier:     strings.ToLower(be.GroupModifier.Op),
+		GroupModifierArgs: be.GroupModifier.Args,
+		JoinModifier:      strings.ToLower(be.JoinModifier.Op),
+		JoinModifierArgs:  be.JoinModifier.Args,
+		KeepMetricNames:   be.KeepMetricNames,
+	}
+	if be.JoinModifierPrefix != nil {
+		m.JoinModifierPrefix = be.JoinModifierPrefix.S
+	}
+	return m
+}
@@ -1,6 +1,7 @@
 package metricsql
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -124,3 +125,26 @@ func TestIsBinaryOpBoolModifierError(t *testing.T) {
 	f("without")
 	f("123")
 }
+
+func TestBinaryOpMatching(t *testing.T) {
+	f := func(q, resultExpected string) {
+		t.Helper()
+		e, err := Parse(q)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", q, err)
+		}
+		be, ok := e.(*BinaryOpExpr)
+		if !ok {
+			t.Fatalf("expecting BinaryOpExpr; got %T", e)
+		}
+		result := fmt.Sprintf("%+v", *BinaryOpMatching(be))
+		if result != resultExpected {
+			t.Fatalf("unexpected result\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+	f(`a + b`, `{Op:+ Bool:false GroupModifier: GroupModifierArgs:[] JoinModifier: JoinModifierArgs:[] JoinModifierPrefix: KeepMetricNames:false}`)
+	f(`a > BOOL b`, `{Op:> Bool:true GroupModifier: GroupModifierArgs:[] JoinModifier: JoinModifierArgs:[] JoinModifierPrefix: KeepMetricNames:false}`)
+	f(`a AND ON(x) b`, `{Op:and Bool:false GroupModifier:on GroupModifierArgs:[x] JoinModifier: JoinModifierArgs:[] JoinModifierPrefix: KeepMetricNames:false}`)
+	f(`a * ignoring(x,y) group_left(z) prefix "p_" b`, `{Op:* Bool:false GroupModifier:ignoring GroupModifierArgs:[x y] JoinModifier:group_left JoinModifierArgs:[z] JoinModifierPrefix:p_ KeepMetricNames:false}`)
+	f(`(a - b) keep_metric_names`, `{Op:- Bool:false GroupModifier: GroupModifierArgs:[] JoinModifier: JoinModifierArgs:[] JoinModifierPrefix: KeepMetricNames:true}`)
+}
@@ -0,0 +1,297 @@
+package binaryop
+
+import (
+	"fmt"
+	"math"
+)
+
+// The functions below apply binary operations to slices of values.
+//
+// They store the result for left[i] and right[i] into dst[i].
+// dst, left and right must have the same length. dst may be the same slice as left or right.
+//
+// NaN handling is identical to the corresponding functions for a single pair of values.
+
+// PlusSlice stores left + right into dst.
+func PlusSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = left[i] + right[i]
+	}
+}
+
+// MinusSlice stores left - right into dst.
+func MinusSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = left[i] - right[i]
+	}
+}
+
+// MulSlice stores left * right into dst.
+func MulSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = left[i] * right[i]
+	}
+}
+
+// DivSlice stores left / right into dst.
+func DivSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = left[i] / right[i]
+	}
+}
+
+// ModSlice stores mod(left, right) into dst.
+func ModSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = math.Mod(left[i], right[i])
+	}
+}
+
+// PowSlice stores pow(left, right) into dst. See Pow for details.
+func PowSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = Pow(left[i], right[i])
+	}
+}
+
+// Atan2Slice stores atan2(left, right) into dst.
+func Atan2Slice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = math.Atan2(left[i], right[i])
+	}
+}
+
+// EqSlice stores Eq(left, right) into dst.
+func EqSlice(dst []bool, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = Eq(left[i], right[i])
+	}
+}
+
+// NeqSlice stores Neq(left, right) into dst.
+func NeqSlice(dst []bool, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = Neq(left[i], right[i])
+	}
+}
+
+// GtSlice stores left > right into dst.
+func GtSlice(dst []bool, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = left[i] > right[i]
+	}
+}
+
+// LtSlice stores left < right into dst.
+func LtSlice(dst []bool, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = left[i] < right[i]
+	}
+}
+
+// GteSlice stores left >= right into dst.
+func GteSlice(dst []bool, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = left[i] >= right[i]
+	}
+}
+
+// LteSlice stores left <= right into dst.
+func LteSlice(dst []bool, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = left[i] <= right[i]
+	}
+}
+
+// EqBoolSlice stores the result of `left == bool right` into dst.
+//
+// It stores 1 if Eq(left, right) is true and 0 otherwise.
+func EqBoolSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = cmpBool(Eq(left[i], right[i]))
+	}
+}
+
+// NeqBoolSlice stores the result of `left != bool right` into dst.
+//
+// It stores 1 if Neq(left, right) is true and 0 otherwise.
+func NeqBoolSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = cmpBool(Neq(left[i], right[i]))
+	}
+}
+
+// GtBoolSlice stores the result of `left > bool right` into dst.
+//
+// It stores 1 if left > right and 0 otherwise.
+func GtBoolSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = cmpBool(left[i] > right[i])
+	}
+}
+
+// LtBoolSlice stores the result of `left < bool right` into dst.
+//
+// It stores 1 if left < right and 0 otherwise.
+func LtBoolSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = cmpBool(left[i] < right[i])
+	}
+}
+
+// GteBoolSlice stores the result of `left >= bool right` into dst.
+//
+// It stores 1 if left >= right and 0 otherwise.
+func GteBoolSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = cmpBool(left[i] >= right[i])
+	}
+}
+
+// LteBoolSlice stores the result of `left <= bool right` into dst.
+//
+// It stores 1 if left <= right and 0 otherwise.
+func LteBoolSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = cmpBool(left[i] <= right[i])
+	}
+}
+
+func cmpBool(ok bool) float64 {
+	if ok {
+		return 1
+	}
+	return 0
+}
+
+// EqFilterSlice stores the result of `left == right` into dst.
+//
+// It stores left if Eq(left, right) is true. Otherwise NaN is stored.
+func EqFilterSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = cmpFilter(Eq(left[i], right[i]), left[i])
+	}
+}
+
+// NeqFilterSlice stores the result of `left != right` into dst.
+//
+// It stores left if Neq(left, right) is true. Otherwise NaN is stored.
+func NeqFilterSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = cmpFilter(Neq(left[i], right[i]), left[i])
+	}
+}
+
+// GtFilterSlice stores the result of `left > right` into dst.
+//
+// It stores left if left > right. Otherwise NaN is stored.
+func GtFilterSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = cmpFilter(left[i] > right[i], left[i])
+	}
+}
+
+// LtFilterSlice stores the result of `left < right` into dst.
+//
+// It stores left if left < right. Otherwise NaN is stored.
+func LtFilterSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = cmpFilter(left[i] < right[i], left[i])
+	}
+}
+
+// GteFilterSlice stores the result of `left >= right` into dst.
+//
+// It stores left if left >= right. Otherwise NaN is stored.
+func GteFilterSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = cmpFilter(left[i] >= right[i], left[i])
+	}
+}
+
+// LteFilterSlice stores the result of `left <= right` into dst.
+//
+// It stores left if left <= right. Otherwise NaN is stored.
+func LteFilterSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = cmpFilter(left[i] <= right[i], left[i])
+	}
+}
+
+func cmpFilter(ok bool, left float64) float64 {
+	if ok {
+		return left
+	}
+	return nan
+}
+
+// DefaultSlice stores Default(left, right) into dst.
+func DefaultSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = Default(left[i], right[i])
+	}
+}
+
+// IfSlice stores If(left, right) into dst.
+func IfSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = If(left[i], right[i])
+	}
+}
+
+// IfnotSlice stores Ifnot(left, right) into dst.
+func IfnotSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = Ifnot(left[i], right[i])
+	}
+}
+
+// AndSlice stores And(left, right) into dst.
+func AndSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = And(left[i], right[i])
+	}
+}
+
+// OrSlice stores Or(left, right) into dst.
+func OrSlice(dst, left, right []float64) {
+	checkSliceLens(dst, left, right)
+	for i := range dst {
+		dst[i] = Or(left[i], right[i])
+	}
+}
+
+func checkSliceLens[T any](dst []T, left, right []float64) {
+	if len(left) != len(dst) || len(right) != len(dst) {
+		panic(fmt.Errorf("BUG: dst, left and right must have the same length; got %d, %d and %d", len(dst), len(left), len(right)))
+	}
+}
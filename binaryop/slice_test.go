@@ -0,0 +1,173 @@
+package binaryop
+
+import (
+	"math"
+	"testing"
+)
+
+// getTestValuePairs returns all the pairs of values with special cases such as NaN, Inf and zero.
+func getTestValuePairs() ([]float64, []float64) {
+	values := []float64{nan, math.Inf(1), math.Inf(-1), 0, -0.5, 1, 2, 3.5, -10}
+	var left, right []float64
+	for _, l := range values {
+		for _, r := range values {
+			left = append(left, l)
+			right = append(right, r)
+		}
+	}
+	return left, right
+}
+
+func equalValues(a, b float64) bool {
+	if math.IsNaN(a) {
+		return math.IsNaN(b)
+	}
+	return a == b
+}
+
+func TestArithSlice(t *testing.T) {
+	f := func(name string, sf func(dst, left, right []float64), scalar func(left, right float64) float64) {
+		t.Helper()
+		left, right := getTestValuePairs()
+		dst := make([]float64, len(left))
+		sf(dst, left, right)
+		for i := range dst {
+			if vExpected := scalar(left[i], right[i]); !equalValues(dst[i], vExpected) {
+				t.Fatalf("%s(%v, %v): got %v; want %v", name, left[i], right[i], dst[i], vExpected)
+			}
+		}
+	}
+	f("PlusSlice", PlusSlice, Plus)
+	f("MinusSlice", MinusSlice, Minus)
+	f("MulSlice", MulSlice, Mul)
+	f("DivSlice", DivSlice, Div)
+	f("ModSlice", ModSlice, Mod)
+	f("PowSlice", PowSlice, Pow)
+	f("Atan2Slice", Atan2Slice, Atan2)
+	f("DefaultSlice", DefaultSlice, Default)
+	f("IfSlice", IfSlice, If)
+	f("IfnotSlice", IfnotSlice, Ifnot)
+	f("AndSlice", AndSlice, And)
+	f("OrSlice", OrSlice, Or)
+}
+
+func TestCmpSlice(t *testing.T) {
+	f := func(name string, sf func(dst []bool, left, right []float64), bf, ff func(dst, left, right []float64), scalar func(left, right float64) bool) {
+		t.Helper()
+		left, right := getTestValuePairs()
+		dst := make([]bool, len(left))
+		dstBool := make([]float64, len(left))
+		dstFilter := make([]float64, len(left))
+		sf(dst, left, right)
+		bf(dstBool, left, right)
+		ff(dstFilter, left, right)
+		for i := range dst {
+			ok := scalar(left[i], right[i])
+			if dst[i] != ok {
+				t.Fatalf("%s(%v, %v): got %v; want %v", name, left[i], right[i], dst[i], ok)
+			}
+			vBoolExpected := float64(0)
+			if ok {
+				vBoolExpected = 1
+			}
+			if !equalValues(dstBool[i], vBoolExpected) {
+				t.Fatalf("%s bool(%v, %v): got %v; want %v", name, left[i], right[i], dstBool[i], vBoolExpected)
+			}
+			vFilterExpected := nan
+			if ok {
+				vFilterExpected = left[i]
+			}
+			if !equalValues(dstFilter[i], vFilterExpected) {
+				t.Fatalf("%s filter(%v, %v): got %v; want %v", name, left[i], right[i], dstFilter[i], vFilterExpected)
+			}
+		}
+	}
+	f("EqSlice", EqSlice, EqBoolSlice, EqFilterSlice, Eq)
+	f("NeqSlice", NeqSlice, NeqBoolSlice, NeqFilterSlice, Neq)
+	f("GtSlice", GtSlice, GtBoolSlice, GtFilterSlice, Gt)
+	f("LtSlice", LtSlice, LtBoolSlice, LtFilterSlice, Lt)
+	f("GteSlice", GteSlice, GteBoolSlice, GteFilterSlice, Gte)
+	f("LteSlice", LteSlice, LteBoolSlice, LteFilterSlice, Lte)
+}
+
+func TestSliceInPlace(t *testing.T) {
+	left := []float64{1, nan, 3}
+	right := []float64{10, 20, nan}
+	DefaultSlice(left, left, right)
+	expected := []float64{1, 20, 3}
+	for i := range left {
+		if !equalValues(left[i], expected[i]) {
+			t.Fatalf("unexpected value at position %d; got %v; want %v", i, left[i], expected[i])
+		}
+	}
+}
+
+func TestSliceLenMismatch(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("expecting panic for slices with different lengths")
+		}
+	}()
+	PlusSlice(make([]float64, 2), []float64{1, 2}, []float64{1})
+}
+
+func getBenchValues(n int) ([]float64, []float64) {
+	left := make([]float64, n)
+	right := make([]float64, n)
+	for i := range left {
+		left[i] = float64(i % 100)
+		right[i] = float64((i * 7) % 100)
+		if i%10 == 0 {
+			right[i] = math.NaN()
+		}
+	}
+	return left, right
+}
+
+// BenchmarkPlusPerValue measures per-value calls via function value for comparison with BenchmarkPlusSlice.
+func BenchmarkPlusPerValue(b *testing.B) {
+	left, right := getBenchValues(1000)
+	dst := make([]float64, len(left))
+	f := Plus
+	b.ReportAllocs()
+	b.SetBytes(int64(len(left)))
+	for b.Loop() {
+		for i := range dst {
+			dst[i] = f(left[i], right[i])
+		}
+	}
+}
+
+func BenchmarkPlusSlice(b *testing.B) {
+	benchmarkSlice(b, PlusSlice)
+}
+
+func BenchmarkDivSlice(b *testing.B) {
+	benchmarkSlice(b, DivSlice)
+}
+
+func BenchmarkGtBoolSlice(b *testing.B) {
+	benchmarkSlice(b, GtBoolSlice)
+}
+
+func BenchmarkEqFilterSlice(b *testing.B) {
+	benchmarkSlice(b, EqFilterSlice)
+}
+
+func BenchmarkDefaultSlice(b *testing.B) {
+	benchmarkSlice(b, DefaultSlice)
+}
+
+func BenchmarkIfSlice(b *testing.B) {
+	benchmarkSlice(b, IfSlice)
+}
+
+func benchmarkSlice(b *testing.B, f func(dst, left, right []float64)) {
+	left, right := getBenchValues(1000)
+	dst := make([]float64, len(left))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(left)))
+	for b.Loop() {
+		f(dst, left, right)
+	}
+}
@@ -0,0 +1,629 @@
+package binaryop
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Label is a label for time series.
+type Label struct {
+	// Name is label name.
+	Name string
+
+	// Value is label value.
+	Value string
+}
+
+// Series is a time series with values at the same points as other series passed to Matching.Apply.
+//
+// Missing values must be set to NaN.
+type Series struct {
+	// Labels contains series labels. The metric name is stored in the `__name__` label.
+	Labels []Label
+
+	// Values contains series values.
+	Values []float64
+}
+
+// Matching contains the binary operation together with vector matching modifiers.
+//
+// It mirrors the corresponding fields of metricsql.BinaryOpExpr. Use metricsql.BinaryOpMatching for obtaining it.
+type Matching struct {
+	// Op is the binary operation such as `+`, `>`, `and`, `default`, etc.
+	Op string
+
+	// Bool is set to true if `bool` modifier is present.
+	Bool bool
+
+	// GroupModifier is an optional `on` or `ignoring` modifier.
+	GroupModifier string
+
+	// GroupModifierArgs contains label names for GroupModifier.
+	GroupModifierArgs []string
+
+	// JoinModifier is an optional `group_left` or `group_right` modifier.
+	JoinModifier string
+
+	// JoinModifierArgs contains label names for JoinModifier.
+	JoinModifierArgs []string
+
+	// JoinModifierPrefix is an optional prefix for labels copied via JoinModifierArgs.
+	JoinModifierPrefix string
+
+	// KeepMetricNames is set to true if metric names must be kept in the output series.
+	KeepMetricNames bool
+}
+
+// Apply applies m.Op to the matching series from left and right and returns the result.
+//
+// A series without labels at any side is treated as a scalar, which matches all the series at another side
+// if m contains no `on`, `ignoring`, `group_left` and `group_right` modifiers.
+//
+// Metric names are dropped from the output series unless m.KeepMetricNames is set
+// or m.Op is a comparison operation without `bool` modifier or one of `and`, `or`, `unless`, `default`, `if` and `ifnot`.
+//
+// Series with only NaN values may be returned for arithmetic and comparison operations.
+//
+// An error is returned if one-to-one, many-to-one or one-to-many matching rules are violated
+// or if the output contains series with duplicate labels.
+//
+// left and right aren't modified.
+func (m *Matching) Apply(left, right []*Series) ([]*Series, error) {
+	op := strings.ToLower(m.Op)
+	var rvs []*Series
+	switch op {
+	case "and":
+		rvs = m.and(copySeries(left), right)
+	case "or":
+		rvs = m.or(copySeries(left), right)
+	case "unless":
+		rvs = m.unless(copySeries(left), right)
+	case "default":
+		rvs = m.defaultOp(copySeries(left), right)
+	case "if":
+		rvs = m.ifOp(copySeries(left), right)
+	case "ifnot":
+		rvs = m.ifnot(copySeries(left), right)
+	default:
+		f := getSliceFunc(op, m.Bool)
+		if f == nil {
+			return nil, fmt.Errorf("unsupported binary operation %q", m.Op)
+		}
+		var err error
+		rvs, err = m.vector(f, left, right)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := checkDuplicateSeries(rvs); err != nil {
+		return nil, err
+	}
+	return rvs, nil
+}
+
+// getSliceFunc returns a slice function for the given arithmetic or comparison op.
+//
+// nil is returned for unknown op.
+func getSliceFunc(op string, isBool bool) func(dst, left, right []float64) {
+	switch op {
+	case "+":
+		return PlusSlice
+	case "-":
+		return MinusSlice
+	case "*":
+		return MulSlice
+	case "/":
+		return DivSlice
+	case "%":
+		return ModSlice
+	case "^":
+		return PowSlice
+	case "atan2":
+		return Atan2Slice
+	}
+	if isBool {
+		switch op {
+		case "==":
+			return EqBoolSlice
+		case "!=":
+			return NeqBoolSlice
+		case ">":
+			return GtBoolSlice
+		case "<":
+			return LtBoolSlice
+		case ">=":
+			return GteBoolSlice
+		case "<=":
+			return LteBoolSlice
+		}
+		return nil
+	}
+	switch op {
+	case "==":
+		return EqFilterSlice
+	case "!=":
+		return NeqFilterSlice
+	case ">":
+		return GtFilterSlice
+	case "<":
+		return LtFilterSlice
+	case ">=":
+		return GteFilterSlice
+	case "<=":
+		return LteFilterSlice
+	}
+	return nil
+}
+
+func isScalar(ss []*Series) bool {
+	return len(ss) == 1 && len(ss[0].Labels) == 0
+}
+
+// vector applies f to the matching series from left and right.
+func (m *Matching) vector(f func(dst, left, right []float64), left, right []*Series) ([]*Series, error) {
+	var lefts, rights, dsts []*Series
+	if m.GroupModifier == "" && m.JoinModifier == "" && (isScalar(left) || isScalar(right)) {
+		// Fast path: `scalar op vector` or `vector op scalar`
+		if isScalar(left) {
+			for _, sRight := range right {
+				lefts = append(lefts, left[0])
+				rights = append(rights, sRight)
+				dsts = append(dsts, m.newDst(sRight.Labels))
+			}
+		} else {
+			for _, sLeft := range left {
+				lefts = append(lefts, sLeft)
+				rights = append(rights, right[0])
+				dsts = append(dsts, m.newDst(sLeft.Labels))
+			}
+		}
+	} else {
+		// Slow path: `vector op vector` with optional `on`, `ignoring`, `group_left` and `group_right` modifiers.
+		mLeft, keys := m.groupByMatchingKey(left)
+		mRight, _ := m.groupByMatchingKey(right)
+		for _, k := range keys {
+			ssLeft := mLeft[k]
+			ssRight := mRight[k]
+			if len(ssRight) == 0 {
+				continue
+			}
+			switch strings.ToLower(m.JoinModifier) {
+			case "group_left":
+				sRight, err := m.ensureSingleSeries(ssRight, "right")
+				if err != nil {
+					return nil, err
+				}
+				for _, sLeft := range ssLeft {
+					dst := m.newDst(sLeft.Labels)
+					dst.Labels = m.copyJoinLabels(dst.Labels, sRight.Labels)
+					lefts = append(lefts, sLeft)
+					rights = append(rights, sRight)
+					dsts = append(dsts, dst)
+				}
+			case "group_right":
+				sLeft, err := m.ensureSingleSeries(ssLeft, "left")
+				if err != nil {
+					return nil, err
+				}
+				for _, sRight := range ssRight {
+					dst := m.newDst(sRight.Labels)
+					dst.Labels = m.copyJoinLabels(dst.Labels, sLeft.Labels)
+					lefts = append(lefts, sLeft)
+					rights = append(rights, sRight)
+					dsts = append(dsts, dst)
+				}
+			default:
+				sLeft, err := m.ensureSingleSeries(ssLeft, "left")
+				if err != nil {
+					return nil, err
+				}
+				sRight, err := m.ensureSingleSeries(ssRight, "right")
+				if err != nil {
+					return nil, err
+				}
+				dst := m.newDst(sLeft.Labels)
+				switch strings.ToLower(m.GroupModifier) {
+				case "on":
+					dst.Labels = filterLabels(dst.Labels, func(name string) bool {
+						return containsString(m.GroupModifierArgs, name)
+					})
+				case "ignoring":
+					dst.Labels = filterLabels(dst.Labels, func(name string) bool {
+						return !containsString(m.GroupModifierArgs, name)
+					})
+				}
+				lefts = append(lefts, sLeft)
+				rights = append(rights, sRight)
+				dsts = append(dsts, dst)
+			}
+		}
+	}
+	for i, dst := range dsts {
+		leftValues := lefts[i].Values
+		rightValues := rights[i].Values
+		if len(leftValues) != len(rightValues) {
+			return nil, fmt.Errorf("series %s and %s have different number of values: %d vs %d",
+				labelsString(lefts[i].Labels), labelsString(rights[i].Labels), len(leftValues), len(rightValues))
+		}
+		dst.Values = make([]float64, len(leftValues))
+		f(dst.Values, leftValues, rightValues)
+		if m.Bool && isCmp(m.Op) {
+			// Comparisons with bool modifier return 0 or 1 for every pair of values,
+			// while missing points on the left side must remain missing.
+			for j, v := range leftValues {
+				if math.IsNaN(v) {
+					dst.Values[j] = nan
+				}
+			}
+		}
+	}
+	return dsts, nil
+}
+
+// newDst returns the output series with the given labels.
+//
+// The metric name is dropped if required.
+func (m *Matching) newDst(labels []Label) *Series {
+	labels = append([]Label{}, labels...)
+	keepMetricName := m.KeepMetricNames || (isCmp(m.Op) && !m.Bool)
+	if !keepMetricName {
+		labels = setLabel(labels, "__name__", "")
+	}
+	return &Series{
+		Labels: labels,
+	}
+}
+
+func isCmp(op string) bool {
+	switch op {
+	case "==", "!=", ">", "<", ">=", "<=":
+		return true
+	default:
+		return false
+	}
+}
+
+// copyJoinLabels copies labels from group_left() or group_right() list from src to dst.
+func (m *Matching) copyJoinLabels(dst, src []Label) []Label {
+	for _, name := range m.JoinModifierArgs {
+		dst = setLabel(dst, m.JoinModifierPrefix+name, getLabelValue(src, name))
+	}
+	return dst
+}
+
+// ensureSingleSeries returns a single series from ss.
+//
+// Series with non-overlapping points are merged into a single series. Otherwise an error is returned.
+func (m *Matching) ensureSingleSeries(ss []*Series, side string) (*Series, error) {
+	if len(ss) == 1 {
+		return ss[0], nil
+	}
+	dst := &Series{
+		Labels: ss[0].Labels,
+		Values: append([]float64{}, ss[0].Values...),
+	}
+	for _, s := range ss[1:] {
+		for i, v := range s.Values {
+			if math.IsNaN(v) {
+				continue
+			}
+			if i >= len(dst.Values) || !math.IsNaN(dst.Values[i]) {
+				return nil, fmt.Errorf("duplicate series on the %s side of `%s`: %s and %s; "+
+					"make sure the series have unique labels after applying `on(...)` or `ignoring(...)` modifiers",
+					side, m.Op, labelsString(ss[0].Labels), labelsString(s.Labels))
+			}
+			dst.Values[i] = v
+		}
+	}
+	return dst, nil
+}
+
+// groupByMatchingKey groups ss by labels used for matching series.
+//
+// It also returns sorted keys for the groups.
+func (m *Matching) groupByMatchingKey(ss []*Series) (map[string][]*Series, []string) {
+	isOn := strings.ToLower(m.GroupModifier) == "on"
+	filter := func(name string) bool {
+		if name == "__name__" {
+			return false
+		}
+		if isOn {
+			return containsString(m.GroupModifierArgs, name)
+		}
+		return !containsString(m.GroupModifierArgs, name)
+	}
+	groups := make(map[string][]*Series)
+	var keys []string
+	for _, s := range ss {
+		k := labelsString(filterLabels(s.Labels, filter))
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], s)
+	}
+	sort.Strings(keys)
+	return groups, keys
+}
+
+// seriesByKey returns series from groups for the given key.
+//
+// If groups contain only a scalar, then it is returned for any key.
+func seriesByKey(groups map[string][]*Series, key string) []*Series {
+	if ss := groups[key]; ss != nil {
+		return ss
+	}
+	if len(groups) != 1 {
+		return nil
+	}
+	for _, ss := range groups {
+		if isScalar(ss) {
+			return ss
+		}
+	}
+	return nil
+}
+
+func (m *Matching) and(left, right []*Series) []*Series {
+	mLeft, keys := m.groupByMatchingKey(left)
+	mRight, _ := m.groupByMatchingKey(right)
+	var rvs []*Series
+	for _, k := range keys {
+		ssRight := mRight[k]
+		if ssRight == nil {
+			continue
+		}
+		rvs = append(rvs, addRightNaNsToLeft(mLeft[k], ssRight)...)
+	}
+	return rvs
+}
+
+func (m *Matching) or(left, right []*Series) []*Series {
+	mLeft, _ := m.groupByMatchingKey(left)
+	mRight, keys := m.groupByMatchingKey(right)
+	rvs := append([]*Series{}, left...)
+	for _, k := range keys {
+		ssRight := mRight[k]
+		ssLeft := mLeft[k]
+		if ssLeft == nil {
+			rvs = append(rvs, copySeries(ssRight)...)
+			continue
+		}
+		fillLeftNaNsWithRightValues(ssLeft, ssRight)
+	}
+	return rvs
+}
+
+func (m *Matching) unless(left, right []*Series) []*Series {
+	mLeft, keys := m.groupByMatchingKey(left)
+	mRight, _ := m.groupByMatchingKey(right)
+	var rvs []*Series
+	for _, k := range keys {
+		ssLeft := mLeft[k]
+		ssRight := mRight[k]
+		if ssRight == nil {
+			rvs = append(rvs, ssLeft...)
+			continue
+		}
+		rvs = append(rvs, addLeftNaNsIfNoRightNaNs(ssLeft, ssRight)...)
+	}
+	return rvs
+}
+
+func (m *Matching) defaultOp(left, right []*Series) []*Series {
+	if len(left) == 0 {
+		return copySeries(right)
+	}
+	mLeft, keys := m.groupByMatchingKey(left)
+	mRight, _ := m.groupByMatchingKey(right)
+	var rvs []*Series
+	for _, k := range keys {
+		ssLeft := mLeft[k]
+		rvs = append(rvs, ssLeft...)
+		if ssRight := seriesByKey(mRight, k); ssRight != nil {
+			fillLeftNaNsWithRightValues(ssLeft, ssRight)
+		}
+	}
+	return rvs
+}
+
+func (m *Matching) ifOp(left, right []*Series) []*Series {
+	mLeft, keys := m.groupByMatchingKey(left)
+	mRight, _ := m.groupByMatchingKey(right)
+	var rvs []*Series
+	for _, k := range keys {
+		ssRight := seriesByKey(mRight, k)
+		if ssRight == nil {
+			continue
+		}
+		rvs = append(rvs, addRightNaNsToLeft(mLeft[k], ssRight)...)
+	}
+	return rvs
+}
+
+func (m *Matching) ifnot(left, right []*Series) []*Series {
+	mLeft, keys := m.groupByMatchingKey(left)
+	mRight, _ := m.groupByMatchingKey(right)
+	var rvs []*Series
+	for _, k := range keys {
+		ssLeft := mLeft[k]
+		ssRight := seriesByKey(mRight, k)
+		if ssRight == nil {
+			rvs = append(rvs, ssLeft...)
+			continue
+		}
+		rvs = append(rvs, addLeftNaNsIfNoRightNaNs(ssLeft, ssRight)...)
+	}
+	return rvs
+}
+
+// fillLeftNaNsWithRightValues fills NaN values in ssLeft with the first non-NaN values from ssRight at the same points.
+func fillLeftNaNsWithRightValues(ssLeft, ssRight []*Series) {
+	for _, sLeft := range ssLeft {
+		for i, v := range sLeft.Values {
+			if !math.IsNaN(v) {
+				continue
+			}
+			for _, sRight := range ssRight {
+				if i < len(sRight.Values) && !math.IsNaN(sRight.Values[i]) {
+					sLeft.Values[i] = sRight.Values[i]
+					break
+				}
+			}
+		}
+	}
+}
+
+// addRightNaNsToLeft sets values in ssLeft to NaN at points where all the ssRight have NaN values.
+//
+// Series with only NaN values are removed from the result.
+func addRightNaNsToLeft(ssLeft, ssRight []*Series) []*Series {
+	for _, sLeft := range ssLeft {
+		for i := range sLeft.Values {
+			hasValue := false
+			for _, sRight := range ssRight {
+				if i < len(sRight.Values) && !math.IsNaN(sRight.Values[i]) {
+					hasValue = true
+					break
+				}
+			}
+			if !hasValue {
+				sLeft.Values[i] = nan
+			}
+		}
+	}
+	return removeEmptySeries(ssLeft)
+}
+
+// addLeftNaNsIfNoRightNaNs sets values in ssLeft to NaN at points where at least a single ssRight has non-NaN value.
+//
+// Series with only NaN values are removed from the result.
+func addLeftNaNsIfNoRightNaNs(ssLeft, ssRight []*Series) []*Series {
+	for _, sLeft := range ssLeft {
+		for i := range sLeft.Values {
+			for _, sRight := range ssRight {
+				if i < len(sRight.Values) && !math.IsNaN(sRight.Values[i]) {
+					sLeft.Values[i] = nan
+					break
+				}
+			}
+		}
+	}
+	return removeEmptySeries(ssLeft)
+}
+
+func removeEmptySeries(ss []*Series) []*Series {
+	var rvs []*Series
+	for _, s := range ss {
+		for _, v := range s.Values {
+			if !math.IsNaN(v) {
+				rvs = append(rvs, s)
+				break
+			}
+		}
+	}
+	return rvs
+}
+
+// copySeries returns a copy of ss, which can be modified without modifying ss.
+func copySeries(ss []*Series) []*Series {
+	dst := make([]*Series, len(ss))
+	for i, s := range ss {
+		dst[i] = &Series{
+			Labels: append([]Label{}, s.Labels...),
+			Values: append([]float64{}, s.Values...),
+		}
+	}
+	return dst
+}
+
+// checkDuplicateSeries returns an error if ss contain series with identical labels.
+func checkDuplicateSeries(ss []*Series) error {
+	seen := make(map[string]bool, len(ss))
+	for _, s := range ss {
+		key := labelsString(s.Labels)
+		if seen[key] {
+			return fmt.Errorf("duplicate output series %s", key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+func getLabelValue(labels []Label, name string) string {
+	for _, label := range labels {
+		if label.Name == name {
+			return label.Value
+		}
+	}
+	return ""
+}
+
+// setLabel sets the label with the given name to value in labels and returns the result.
+//
+// The label is removed if value is empty.
+func setLabel(labels []Label, name, value string) []Label {
+	for i, label := range labels {
+		if label.Name == name {
+			if value == "" {
+				return append(labels[:i:i], labels[i+1:]...)
+			}
+			labels[i].Value = value
+			return labels
+		}
+	}
+	if value == "" {
+		return labels
+	}
+	return append(labels, Label{
+		Name:  name,
+		Value: value,
+	})
+}
+
+func filterLabels(labels []Label, filter func(name string) bool) []Label {
+	var dst []Label
+	for _, label := range labels {
+		if filter(label.Name) {
+			dst = append(dst, label)
+		}
+	}
+	return dst
+}
+
+// labelsString returns string representation for labels sorted by name.
+func labelsString(labels []Label) string {
+	labels = append([]Label{}, labels...)
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	var b []byte
+	b = append(b, getLabelValue(labels, "__name__")...)
+	b = append(b, '{')
+	n := 0
+	for _, label := range labels {
+		if label.Name == "__name__" {
+			continue
+		}
+		if n > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, label.Name...)
+		b = append(b, '=')
+		b = strconv.AppendQuote(b, label.Value)
+		n++
+	}
+	b = append(b, '}')
+	return string(b)
+}
+
+func containsString(a []string, s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+package binaryop
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+// newTestSeries returns a series from `metric{label="value",...}` labels and values.
+func newTestSeries(s string, values ...float64) *Series {
+	var labels []Label
+	name, rest, _ := strings.Cut(s, "{")
+	if name != "" {
+		labels = append(labels, Label{
+			Name:  "__name__",
+			Value: name,
+		})
+	}
+	rest = strings.TrimSuffix(rest, "}")
+	if rest != "" {
+		for _, kv := range strings.Split(rest, ",") {
+			k, v, _ := strings.Cut(kv, "=")
+			labels = append(labels, Label{
+				Name:  k,
+				Value: strings.Trim(v, `"`),
+			})
+		}
+	}
+	return &Series{
+		Labels: labels,
+		Values: values,
+	}
+}
+
+func formatSeries(ss []*Series) string {
+	var a []string
+	for _, s := range ss {
+		a = append(a, fmt.Sprintf("%s %v", labelsString(s.Labels), s.Values))
+	}
+	return strings.Join(a, "\n")
+}
+
+func TestMatchingApplySuccess(t *testing.T) {
+	f := func(m *Matching, left, right []*Series, resultExpected string) {
+		t.Helper()
+		leftOrig := formatSeries(left)
+		rightOrig := formatSeries(right)
+		result, err := m.Apply(left, right)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if s := formatSeries(result); s != resultExpected {
+			t.Fatalf("unexpected result\ngot\n%s\nwant\n%s", s, resultExpected)
+		}
+		if s := formatSeries(left); s != leftOrig {
+			t.Fatalf("left series must not be modified\ngot\n%s\nwant\n%s", s, leftOrig)
+		}
+		if s := formatSeries(right); s != rightOrig {
+			t.Fatalf("right series must not be modified\ngot\n%s\nwant\n%s", s, rightOrig)
+		}
+	}
+	nan := math.NaN()
+	requests := []*Series{
+		newTestSeries(`requests{job="api",instance="a"}`, 10, 20),
+		newTestSeries(`requests{job="api",instance="b"}`, 30, nan),
+		newTestSeries(`requests{job="web",instance="c"}`, 50, 60),
+	}
+	errors := []*Series{
+		newTestSeries(`errors{job="api",instance="a"}`, 1, 2),
+		newTestSeries(`errors{job="web",instance="c"}`, nan, 3),
+	}
+	jobInfo := []*Series{
+		newTestSeries(`job_info{job="api",team="x"}`, 1, 1),
+		newTestSeries(`job_info{job="web",team="y"}`, 1, 1),
+	}
+
+	// scalar op vector
+	f(&Matching{Op: "*"}, []*Series{newTestSeries(``, 2, 3)}, errors, `{instance="a",job="api"} [2 6]
+{instance="c",job="web"} [NaN 9]`)
+	f(&Matching{Op: "-"}, errors, []*Series{newTestSeries(``, 1, 1)}, `{instance="a",job="api"} [0 1]
+{instance="c",job="web"} [NaN 2]`)
+
+	// one-to-one matching
+	f(&Matching{Op: "/"}, errors, requests, `{instance="a",job="api"} [0.1 0.1]
+{instance="c",job="web"} [NaN 0.05]`)
+	f(&Matching{Op: "+", KeepMetricNames: true}, errors, requests, `errors{instance="a",job="api"} [11 22]
+errors{instance="c",job="web"} [NaN 63]`)
+	f(&Matching{Op: "+", GroupModifier: "on", GroupModifierArgs: []string{"instance"}}, errors, requests, `{instance="a"} [11 22]
+{instance="c"} [NaN 63]`)
+	f(&Matching{Op: "+", GroupModifier: "ignoring", GroupModifierArgs: []string{"job"}}, errors, requests, `{instance="a"} [11 22]
+{instance="c"} [NaN 63]`)
+
+	// comparisons
+	f(&Matching{Op: ">"}, requests, []*Series{newTestSeries(``, 20, 20)}, `requests{instance="a",job="api"} [NaN NaN]
+requests{instance="b",job="api"} [30 NaN]
+requests{instance="c",job="web"} [50 60]`)
+	f(&Matching{Op: ">", Bool: true}, requests, []*Series{newTestSeries(``, 20, 20)}, `{instance="a",job="api"} [0 0]
+{instance="b",job="api"} [1 NaN]
+{instance="c",job="web"} [1 1]`)
+
+	// many-to-one matching
+	f(&Matching{
+		Op:                "*",
+		GroupModifier:     "on",
+		GroupModifierArgs: []string{"job"},
+		JoinModifier:      "group_left",
+		JoinModifierArgs:  []string{"team"},
+	}, requests, jobInfo, `{instance="a",job="api",team="x"} [10 20]
+{instance="b",job="api",team="x"} [30 NaN]
+{instance="c",job="web",team="y"} [50 60]`)
+	f(&Matching{
+		Op:                 "*",
+		GroupModifier:      "on",
+		GroupModifierArgs:  []string{"job"},
+		JoinModifier:       "group_left",
+		JoinModifierArgs:   []string{"team"},
+		JoinModifierPrefix: "info_",
+		KeepMetricNames:    true,
+	}, requests, jobInfo, `requests{info_team="x",instance="a",job="api"} [10 20]
+requests{info_team="x",instance="b",job="api"} [30 NaN]
+requests{info_team="y",instance="c",job="web"} [50 60]`)
+
+	// one-to-many matching
+	f(&Matching{
+		Op:                "+",
+		GroupModifier:     "on",
+		GroupModifierArgs: []string{"job"},
+		JoinModifier:      "group_right",
+		JoinModifierArgs:  []string{"team"},
+	}, jobInfo, requests, `{instance="a",job="api",team="x"} [11 21]
+{instance="b",job="api",team="x"} [31 NaN]
+{instance="c",job="web",team="y"} [51 61]`)
+
+	// series with non-overlapping points on the `one` side are merged
+	f(&Matching{Op: "+", GroupModifier: "on", GroupModifierArgs: []string{"job"}}, []*Series{
+		newTestSeries(`a{job="x",instance="1"}`, 1, nan),
+		newTestSeries(`a{job="x",instance="2"}`, nan, 2),
+	}, []*Series{
+		newTestSeries(`b{job="x"}`, 10, 10),
+	}, `{job="x"} [11 12]`)
+
+	// logical set operations
+	f(&Matching{Op: "and"}, requests, errors, `requests{instance="a",job="api"} [10 20]
+requests{instance="c",job="web"} [NaN 60]`)
+	f(&Matching{Op: "and", GroupModifier: "on", GroupModifierArgs: []string{"job"}}, requests, errors, `requests{instance="a",job="api"} [10 20]
+requests{instance="b",job="api"} [30 NaN]
+requests{instance="c",job="web"} [NaN 60]`)
+	f(&Matching{Op: "or"}, errors, requests, `errors{instance="a",job="api"} [1 2]
+errors{instance="c",job="web"} [50 3]
+requests{instance="b",job="api"} [30 NaN]`)
+	f(&Matching{Op: "unless"}, requests, errors, `requests{instance="b",job="api"} [30 NaN]
+requests{instance="c",job="web"} [50 NaN]`)
+
+	// MetricsQL-specific operations
+	f(&Matching{Op: "default"}, errors, []*Series{newTestSeries(``, 0, 0)}, `errors{instance="a",job="api"} [1 2]
+errors{instance="c",job="web"} [0 3]`)
+	f(&Matching{Op: "default"}, nil, []*Series{newTestSeries(``, 42, 42)}, `{} [42 42]`)
+	f(&Matching{Op: "if"}, requests, errors, `requests{instance="a",job="api"} [10 20]
+requests{instance="c",job="web"} [NaN 60]`)
+	f(&Matching{Op: "ifnot"}, requests, errors, `requests{instance="b",job="api"} [30 NaN]
+requests{instance="c",job="web"} [50 NaN]`)
+	f(&Matching{Op: "if"}, requests, []*Series{newTestSeries(``, nan, 1)}, `requests{instance="a",job="api"} [NaN 20]
+requests{instance="c",job="web"} [NaN 60]`)
+}
+
+func TestMatchingApplyFailure(t *testing.T) {
+	f := func(m *Matching, left, right []*Series) {
+		t.Helper()
+		result, err := m.Apply(left, right)
+		if err == nil {
+			t.Fatalf("expecting non-nil error; got result\n%s", formatSeries(result))
+		}
+	}
+	requests := []*Series{
+		newTestSeries(`requests{job="api",instance="a"}`, 10, 20),
+		newTestSeries(`requests{job="api",instance="b"}`, 30, 40),
+	}
+	jobInfo := []*Series{
+		newTestSeries(`job_info{job="api",team="x"}`, 1, 1),
+	}
+
+	// unsupported operation
+	f(&Matching{Op: "foo"}, requests, jobInfo)
+
+	// many-to-one matching without group_left
+	f(&Matching{Op: "*", GroupModifier: "on", GroupModifierArgs: []string{"job"}}, requests, jobInfo)
+
+	// many-to-many matching
+	f(&Matching{
+		Op:                "*",
+		GroupModifier:     "on",
+		GroupModifierArgs: []string{"job"},
+		JoinModifier:      "group_left",
+	}, requests, requests)
+
+	// group_right with many series on the left side
+	f(&Matching{
+		Op:                "*",
+		GroupModifier:     "on",
+		GroupModifierArgs: []string{"job"},
+		JoinModifier:      "group_right",
+	}, requests, jobInfo)
+
+	// duplicate output series after dropping metric names
+	f(&Matching{Op: "+"}, []*Series{
+		newTestSeries(`a{job="x"}`, 1),
+		newTestSeries(`b{job="x"}`, 2),
+	}, []*Series{
+		newTestSeries(``, 1),
+	})
+
+	// different number of values
+	f(&Matching{Op: "+"}, []*Series{
+		newTestSeries(`a{job="x"}`, 1, 2),
+	}, []*Series{
+		newTestSeries(`b{job="x"}`, 1),
+	})
+}
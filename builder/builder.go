@@ -0,0 +1,693 @@
+// Package builder implements fluent API for building MetricsQL expressions.
+//
+// Usage:
+//
+//	q, err := builder.Metric("http_requests_total").Where("job", "=", "api").Rate("5m").Sum().By("job").Query()
+//	if err != nil {
+//	    // invalid expression
+//	}
+//	// q contains `sum(rate(http_requests_total{job="api"}[5m])) by(job)`
+//
+// Builders are immutable, so they can be reused for building multiple expressions.
+// The first error is kept in the builder and is returned from Expr or Query.
+package builder
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/VictoriaMetrics/metricsql"
+)
+
+// Builder builds MetricsQL expression.
+//
+// Use Metric, Selector, Number, String, Func or Aggr for creating Builder.
+type Builder struct {
+	e   metricsql.Expr
+	err error
+}
+
+func newBuilder(e metricsql.Expr) *Builder {
+	return &Builder{
+		e: e,
+	}
+}
+
+func errorf(format string, args ...any) *Builder {
+	return &Builder{
+		err: fmt.Errorf(format, args...),
+	}
+}
+
+// Metric returns Builder for series selector with the given metric name, e.g. `http_requests_total`.
+func Metric(name string) *Builder {
+	if name == "" {
+		return errorf("metric name cannot be empty")
+	}
+	me := &metricsql.MetricExpr{
+		LabelFilterss: [][]metricsql.LabelFilter{{{
+			Label: "__name__",
+			Value: name,
+		}}},
+	}
+	return newBuilder(me)
+}
+
+// Selector returns Builder for series selector without metric name.
+//
+// Label filters must be added to it via Where.
+func Selector() *Builder {
+	me := &metricsql.MetricExpr{}
+	return newBuilder(me)
+}
+
+// Number returns Builder for the given number.
+func Number(n float64) *Builder {
+	ne := &metricsql.NumberExpr{
+		N: n,
+	}
+	return newBuilder(ne)
+}
+
+// String returns Builder for the given string literal.
+func String(s string) *Builder {
+	se := &metricsql.StringExpr{
+		S: s,
+	}
+	return newBuilder(se)
+}
+
+// Func returns Builder for the call of rollup or transform function with the given name and args, e.g. `abs(x)`.
+//
+// Use Aggr for aggregate functions.
+func Func(name string, args ...*Builder) *Builder {
+	if !metricsql.IsRollupFunc(name) && !metricsql.IsTransformFunc(name) {
+		if metricsql.IsAggrFunc(name) {
+			return errorf("%q is aggregate function; use Aggr for it", name)
+		}
+		return errorf("unknown function %q", name)
+	}
+	exprs, err := getExprs(args)
+	if err != nil {
+		return &Builder{
+			err: err,
+		}
+	}
+	fe := &metricsql.FuncExpr{
+		Name: name,
+		Args: exprs,
+	}
+	return newBuilder(fe)
+}
+
+// Aggr returns Builder for the call of aggregate function with the given name and args, e.g. `topk(3, x)`.
+//
+// Use By, Without and Limit for setting modifiers on the returned Builder.
+func Aggr(name string, args ...*Builder) *Builder {
+	if !metricsql.IsAggrFunc(name) {
+		return errorf("unknown aggregate function %q", name)
+	}
+	exprs, err := getExprs(args)
+	if err != nil {
+		return &Builder{
+			err: err,
+		}
+	}
+	ae := &metricsql.AggrFuncExpr{
+		Name: name,
+		Args: exprs,
+	}
+	return newBuilder(ae)
+}
+
+func getExprs(bs []*Builder) ([]metricsql.Expr, error) {
+	exprs := make([]metricsql.Expr, len(bs))
+	for i, b := range bs {
+		if b == nil {
+			return nil, fmt.Errorf("arg #%d cannot be nil", i+1)
+		}
+		if b.err != nil {
+			return nil, b.err
+		}
+		exprs[i] = b.e
+	}
+	return exprs, nil
+}
+
+// Err returns the first error occurred when building the expression.
+func (b *Builder) Err() error {
+	return b.err
+}
+
+// Expr returns the built expression.
+//
+// The expression is obtained by parsing string representation of the built tree with metricsql.Parse,
+// so it is always valid. Error is returned if the expression is invalid.
+func (b *Builder) Expr() (metricsql.Expr, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	q := b.e.AppendString(nil)
+	e, err := metricsql.Parse(string(q))
+	if err != nil {
+		return nil, fmt.Errorf("cannot build valid expression from %s: %w", q, err)
+	}
+	return e, nil
+}
+
+// Query returns string representation of the built expression.
+func (b *Builder) Query() (string, error) {
+	e, err := b.Expr()
+	if err != nil {
+		return "", err
+	}
+	return string(e.AppendString(nil)), nil
+}
+
+// Where adds `label op value` filter to series selector, where op is one of `=`, `!=`, `=~` or `!~`.
+//
+// The filter is added to every `or` group of the selector. See OrWhere.
+func (b *Builder) Where(label, op, value string) *Builder {
+	return b.addLabelFilter("Where", label, op, value, false)
+}
+
+// OrWhere adds new `or` group with `label op value` filter to series selector, e.g. `x{a="b" or c="d"}`.
+//
+// The metric name is added to the new group, so it is applied to all the groups.
+func (b *Builder) OrWhere(label, op, value string) *Builder {
+	return b.addLabelFilter("OrWhere", label, op, value, true)
+}
+
+func (b *Builder) addLabelFilter(method, label, op, value string, newGroup bool) *Builder {
+	if b.err != nil {
+		return b
+	}
+	me, ok := b.e.(*metricsql.MetricExpr)
+	if !ok {
+		return errorf("%s can be applied only to series selector; got %s", method, b.e.AppendString(nil))
+	}
+	lf, err := newLabelFilter(label, op, value)
+	if err != nil {
+		return &Builder{
+			err: err,
+		}
+	}
+
+	lfss := make([][]metricsql.LabelFilter, 0, len(me.LabelFilterss)+1)
+	for _, lfs := range me.LabelFilterss {
+		lfss = append(lfss, append([]metricsql.LabelFilter{}, lfs...))
+	}
+	if newGroup || len(lfss) == 0 {
+		var lfs []metricsql.LabelFilter
+		if len(lfss) > 0 {
+			if mlf := getMetricNameFilter(lfss[0]); mlf != nil {
+				lfs = append(lfs, *mlf)
+			}
+		}
+		lfss = append(lfss, lfs)
+		lfss[len(lfss)-1] = addLabelFilter(lfss[len(lfss)-1], lf)
+	} else {
+		for i := range lfss {
+			lfss[i] = addLabelFilter(lfss[i], lf)
+		}
+	}
+	meNew := &metricsql.MetricExpr{
+		LabelFilterss: lfss,
+	}
+	return newBuilder(meNew)
+}
+
+func newLabelFilter(label, op, value string) (*metricsql.LabelFilter, error) {
+	if label == "" {
+		return nil, fmt.Errorf("label name cannot be empty")
+	}
+	lf := &metricsql.LabelFilter{
+		Label: label,
+		Value: value,
+	}
+	switch op {
+	case "=":
+	case "!=":
+		lf.IsNegative = true
+	case "=~":
+		lf.IsRegexp = true
+	case "!~":
+		lf.IsNegative = true
+		lf.IsRegexp = true
+	default:
+		return nil, fmt.Errorf("unsupported label filter op %q for label %q; want `=`, `!=`, `=~` or `!~`", op, label)
+	}
+	if lf.IsRegexp {
+		if _, err := metricsql.CompileRegexpAnchored(value); err != nil {
+			return nil, fmt.Errorf("invalid regexp %q for label %q: %w", value, label, err)
+		}
+	}
+	return lf, nil
+}
+
+// addLabelFilter adds lf to lfs.
+//
+// The metric name filter must be the first in lfs, so `__name__="..."` filter is added to the front of lfs
+// if lfs has no metric name yet.
+func addLabelFilter(lfs []metricsql.LabelFilter, lf *metricsql.LabelFilter) []metricsql.LabelFilter {
+	if isMetricNameFilter(lf) && getMetricNameFilter(lfs) == nil {
+		return append([]metricsql.LabelFilter{*lf}, lfs...)
+	}
+	return append(lfs, *lf)
+}
+
+func getMetricNameFilter(lfs []metricsql.LabelFilter) *metricsql.LabelFilter {
+	if len(lfs) == 0 || !isMetricNameFilter(&lfs[0]) {
+		return nil
+	}
+	return &lfs[0]
+}
+
+func isMetricNameFilter(lf *metricsql.LabelFilter) bool {
+	return lf.Label == "__name__" && !lf.IsRegexp && !lf.IsNegative
+}
+
+// Window sets lookbehind window for the expression, e.g. `x[5m]`.
+//
+// Subquery with the default step such as `sum(x)[5m:]` is created for expressions other than series selectors.
+func (b *Builder) Window(window string) *Builder {
+	if b.err != nil {
+		return b
+	}
+	re, err := setWindow(b.e, window)
+	if err != nil {
+		return &Builder{
+			err: err,
+		}
+	}
+	return newBuilder(re)
+}
+
+func setWindow(e metricsql.Expr, window string) (*metricsql.RollupExpr, error) {
+	de, err := newDuration(window)
+	if err != nil {
+		return nil, fmt.Errorf("invalid window: %w", err)
+	}
+	if _, err := de.NonNegativeDuration(1); err != nil {
+		return nil, fmt.Errorf("invalid window: %w", err)
+	}
+	var re metricsql.RollupExpr
+	if t, ok := e.(*metricsql.RollupExpr); ok {
+		if t.Window != nil || t.Step != nil || t.InheritStep {
+			return nil, fmt.Errorf("lookbehind window is already set for %s", e.AppendString(nil))
+		}
+		re = *t
+	} else {
+		re.Expr = e
+	}
+	re.Window = de
+	if _, ok := re.Expr.(*metricsql.MetricExpr); !ok {
+		re.InheritStep = true
+	}
+	return &re, nil
+}
+
+// Offset sets offset for the expression, e.g. `x offset 1h`.
+func (b *Builder) Offset(offset string) *Builder {
+	if b.err != nil {
+		return b
+	}
+	de, err := newDuration(offset)
+	if err != nil {
+		return errorf("invalid offset: %w", err)
+	}
+	var re metricsql.RollupExpr
+	if t, ok := b.e.(*metricsql.RollupExpr); ok {
+		if t.Offset != nil {
+			return errorf("offset is already set for %s", b.e.AppendString(nil))
+		}
+		re = *t
+	} else {
+		re.Expr = b.e
+	}
+	re.Offset = de
+	return newBuilder(&re)
+}
+
+func newDuration(s string) (*metricsql.DurationExpr, error) {
+	de, err := metricsql.NewDurationExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	if de.IsTemplate() || strings.Contains(de.String(), "$") {
+		return nil, fmt.Errorf("duration %q cannot refer to WITH templates or params", s)
+	}
+	return de, nil
+}
+
+// Rollup applies rollup function with the given name to the expression with the given lookbehind window,
+// e.g. `rate(x[5m])`.
+//
+// args contain additional args for the rollup function such as phi for `quantile_over_time(phi, x[5m])`.
+func (b *Builder) Rollup(funcName, window string, args ...*Builder) *Builder {
+	if b.err != nil {
+		return b
+	}
+	if !metricsql.IsRollupFunc(funcName) {
+		return errorf("unknown rollup function %q", funcName)
+	}
+	re, err := setWindow(b.e, window)
+	if err != nil {
+		return &Builder{
+			err: err,
+		}
+	}
+	return applyFunc(funcName, re, args)
+}
+
+// Rate returns `rate(x[window])` for the expression x.
+func (b *Builder) Rate(window string) *Builder {
+	return b.Rollup("rate", window)
+}
+
+// Increase returns `increase(x[window])` for the expression x.
+func (b *Builder) Increase(window string) *Builder {
+	return b.Rollup("increase", window)
+}
+
+// Apply applies rollup or transform function with the given name to the expression, e.g. `abs(x)`.
+//
+// The expression is passed as the series arg to transform functions, while args are passed around it in the given order,
+// e.g. `clamp_max(x, 10)` or `histogram_quantile(0.9, x)`. The expression is passed as the rollup arg to rollup functions.
+func (b *Builder) Apply(funcName string, args ...*Builder) *Builder {
+	if b.err != nil {
+		return b
+	}
+	if !metricsql.IsRollupFunc(funcName) && !metricsql.IsTransformFunc(funcName) {
+		if metricsql.IsAggrFunc(funcName) {
+			return errorf("%q is aggregate function; use Aggr for it", funcName)
+		}
+		return errorf("unknown function %q", funcName)
+	}
+	return applyFunc(funcName, b.e, args)
+}
+
+func applyFunc(funcName string, e metricsql.Expr, args []*Builder) *Builder {
+	exprs, err := getExprs(args)
+	if err != nil {
+		return &Builder{
+			err: err,
+		}
+	}
+	fe := &metricsql.FuncExpr{
+		Name: funcName,
+		Args: make([]metricsql.Expr, len(exprs)+1),
+	}
+	idx := metricsql.GetRollupArgIdx(fe)
+	if idx < 0 {
+		idx = metricsql.GetTransformArgIdx(fe)
+		if idx < 0 {
+			return errorf("%s() doesn't accept series args", funcName)
+		}
+	}
+	if idx > len(exprs) {
+		return errorf("%s() needs %d args before the expression; got %d args", funcName, idx, len(exprs))
+	}
+	copy(fe.Args, exprs[:idx])
+	fe.Args[idx] = e
+	copy(fe.Args[idx+1:], exprs[idx:])
+	return newBuilder(fe)
+}
+
+// Aggr applies aggregate function with the given name to the expression.
+//
+// args are passed before the expression, e.g. `topk(3, x)`.
+func (b *Builder) Aggr(name string, args ...*Builder) *Builder {
+	if b.err != nil {
+		return b
+	}
+	argsNew := append([]*Builder{}, args...)
+	argsNew = append(argsNew, b)
+	return Aggr(name, argsNew...)
+}
+
+// Sum returns `sum(x)` for the expression x.
+func (b *Builder) Sum() *Builder {
+	return b.Aggr("sum")
+}
+
+// Avg returns `avg(x)` for the expression x.
+func (b *Builder) Avg() *Builder {
+	return b.Aggr("avg")
+}
+
+// Min returns `min(x)` for the expression x.
+func (b *Builder) Min() *Builder {
+	return b.Aggr("min")
+}
+
+// Max returns `max(x)` for the expression x.
+func (b *Builder) Max() *Builder {
+	return b.Aggr("max")
+}
+
+// Count returns `count(x)` for the expression x.
+func (b *Builder) Count() *Builder {
+	return b.Aggr("count")
+}
+
+// By sets `by(labels)` modifier for aggregate function.
+func (b *Builder) By(labels ...string) *Builder {
+	return b.setAggrModifier("by", labels)
+}
+
+// Without sets `without(labels)` modifier for aggregate function.
+func (b *Builder) Without(labels ...string) *Builder {
+	return b.setAggrModifier("without", labels)
+}
+
+func (b *Builder) setAggrModifier(op string, labels []string) *Builder {
+	if b.err != nil {
+		return b
+	}
+	ae, ok := b.e.(*metricsql.AggrFuncExpr)
+	if !ok {
+		return errorf("`%s` modifier can be applied only to aggregate function; got %s", op, b.e.AppendString(nil))
+	}
+	if ae.Modifier.Op != "" {
+		return errorf("`%s` modifier is already set for %s", ae.Modifier.Op, b.e.AppendString(nil))
+	}
+	if err := checkLabels(labels); err != nil {
+		return &Builder{
+			err: err,
+		}
+	}
+	aeNew := *ae
+	aeNew.Modifier = metricsql.ModifierExpr{
+		Op:   op,
+		Args: append([]string{}, labels...),
+	}
+	return newBuilder(&aeNew)
+}
+
+// Limit sets `limit n` modifier for aggregate function.
+func (b *Builder) Limit(n int) *Builder {
+	if b.err != nil {
+		return b
+	}
+	ae, ok := b.e.(*metricsql.AggrFuncExpr)
+	if !ok {
+		return errorf("`limit` modifier can be applied only to aggregate function; got %s", b.e.AppendString(nil))
+	}
+	if n <= 0 {
+		return errorf("limit must be positive; got %d", n)
+	}
+	aeNew := *ae
+	aeNew.Limit = n
+	return newBuilder(&aeNew)
+}
+
+// BinaryOp returns `x op other` for the expression x, where op is binary operator such as `+`, `>` or `and`.
+func (b *Builder) BinaryOp(op string, other *Builder) *Builder {
+	if b.err != nil {
+		return b
+	}
+	if !metricsql.IsBinaryOp(op) {
+		return errorf("unknown binary operator %q", op)
+	}
+	exprs, err := getExprs([]*Builder{other})
+	if err != nil {
+		return &Builder{
+			err: err,
+		}
+	}
+	be := &metricsql.BinaryOpExpr{
+		Op:    strings.ToLower(op),
+		Left:  b.e,
+		Right: exprs[0],
+	}
+	return newBuilder(be)
+}
+
+// Add returns `x + other` for the expression x.
+func (b *Builder) Add(other *Builder) *Builder {
+	return b.BinaryOp("+", other)
+}
+
+// Sub returns `x - other` for the expression x.
+func (b *Builder) Sub(other *Builder) *Builder {
+	return b.BinaryOp("-", other)
+}
+
+// Mul returns `x * other` for the expression x.
+func (b *Builder) Mul(other *Builder) *Builder {
+	return b.BinaryOp("*", other)
+}
+
+// Div returns `x / other` for the expression x.
+func (b *Builder) Div(other *Builder) *Builder {
+	return b.BinaryOp("/", other)
+}
+
+// Gt returns `x > other` for the expression x.
+func (b *Builder) Gt(other *Builder) *Builder {
+	return b.BinaryOp(">", other)
+}
+
+// Lt returns `x < other` for the expression x.
+func (b *Builder) Lt(other *Builder) *Builder {
+	return b.BinaryOp("<", other)
+}
+
+// And returns `x and other` for the expression x.
+func (b *Builder) And(other *Builder) *Builder {
+	return b.BinaryOp("and", other)
+}
+
+// Or returns `x or other` for the expression x.
+//
+// Use OrWhere for `or` filters inside series selector.
+func (b *Builder) Or(other *Builder) *Builder {
+	return b.BinaryOp("or", other)
+}
+
+// Unless returns `x unless other` for the expression x.
+func (b *Builder) Unless(other *Builder) *Builder {
+	return b.BinaryOp("unless", other)
+}
+
+// Bool sets `bool` modifier for comparison operator.
+func (b *Builder) Bool() *Builder {
+	if b.err != nil {
+		return b
+	}
+	be, ok := b.e.(*metricsql.BinaryOpExpr)
+	if !ok || !metricsql.IsBinaryOpCmp(be.Op) {
+		return errorf("`bool` modifier can be applied only to comparison operator; got %s", b.e.AppendString(nil))
+	}
+	beNew := *be
+	beNew.Bool = true
+	return newBuilder(&beNew)
+}
+
+// On sets `on(labels)` modifier for binary operator.
+func (b *Builder) On(labels ...string) *Builder {
+	return b.setGroupModifier("on", labels)
+}
+
+// Ignoring sets `ignoring(labels)` modifier for binary operator.
+func (b *Builder) Ignoring(labels ...string) *Builder {
+	return b.setGroupModifier("ignoring", labels)
+}
+
+func (b *Builder) setGroupModifier(op string, labels []string) *Builder {
+	if b.err != nil {
+		return b
+	}
+	be, ok := b.e.(*metricsql.BinaryOpExpr)
+	if !ok {
+		return errorf("`%s` modifier can be applied only to binary operator; got %s", op, b.e.AppendString(nil))
+	}
+	if be.GroupModifier.Op != "" {
+		return errorf("`%s` modifier is already set for %s", be.GroupModifier.Op, b.e.AppendString(nil))
+	}
+	if err := checkLabels(labels); err != nil {
+		return &Builder{
+			err: err,
+		}
+	}
+	beNew := *be
+	beNew.GroupModifier = metricsql.ModifierExpr{
+		Op:   op,
+		Args: append([]string{}, labels...),
+	}
+	return newBuilder(&beNew)
+}
+
+// GroupLeft sets `group_left(labels)` modifier for binary operator.
+//
+// On or Ignoring must be called before GroupLeft.
+func (b *Builder) GroupLeft(labels ...string) *Builder {
+	return b.setJoinModifier("group_left", labels)
+}
+
+// GroupRight sets `group_right(labels)` modifier for binary operator.
+//
+// On or Ignoring must be called before GroupRight.
+func (b *Builder) GroupRight(labels ...string) *Builder {
+	return b.setJoinModifier("group_right", labels)
+}
+
+func (b *Builder) setJoinModifier(op string, labels []string) *Builder {
+	if b.err != nil {
+		return b
+	}
+	be, ok := b.e.(*metricsql.BinaryOpExpr)
+	if !ok {
+		return errorf("`%s` modifier can be applied only to binary operator; got %s", op, b.e.AppendString(nil))
+	}
+	if be.GroupModifier.Op == "" {
+		return errorf("`%s` modifier requires `on` or `ignoring` modifier for %s", op, b.e.AppendString(nil))
+	}
+	if be.JoinModifier.Op != "" {
+		return errorf("`%s` modifier is already set for %s", be.JoinModifier.Op, b.e.AppendString(nil))
+	}
+	switch be.Op {
+	case "and", "or", "unless":
+		return errorf("`%s` modifier cannot be applied to `%s` operator", op, be.Op)
+	}
+	if err := checkLabels(labels); err != nil {
+		return &Builder{
+			err: err,
+		}
+	}
+	beNew := *be
+	beNew.JoinModifier = metricsql.ModifierExpr{
+		Op:   op,
+		Args: append([]string{}, labels...),
+	}
+	return newBuilder(&beNew)
+}
+
+// KeepMetricNames sets `keep_metric_names` modifier for function or binary operator.
+func (b *Builder) KeepMetricNames() *Builder {
+	if b.err != nil {
+		return b
+	}
+	switch t := b.e.(type) {
+	case *metricsql.FuncExpr:
+		feNew := *t
+		feNew.KeepMetricNames = true
+		return newBuilder(&feNew)
+	case *metricsql.BinaryOpExpr:
+		beNew := *t
+		beNew.KeepMetricNames = true
+		return newBuilder(&beNew)
+	default:
+		return errorf("`keep_metric_names` modifier can be applied only to function or binary operator; got %s", b.e.AppendString(nil))
+	}
+}
+
+func checkLabels(labels []string) error {
+	for _, label := range labels {
+		if label == "" {
+			return fmt.Errorf("label name cannot be empty")
+		}
+	}
+	return nil
+}
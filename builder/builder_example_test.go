@@ -0,0 +1,25 @@
+package builder_test
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/VictoriaMetrics/metricsql/builder"
+)
+
+func ExampleMetric() {
+	q, err := builder.Metric("http_requests_total").
+		Where("job", "=", "api").
+		Where("status", "=~", "5..").
+		Rate("5m").
+		Sum().
+		By("job").
+		Query()
+	if err != nil {
+		log.Fatalf("cannot build query: %s", err)
+	}
+	fmt.Println(q)
+
+	// Output:
+	// sum(rate(http_requests_total{job="api",status=~"5.."}[5m])) by(job)
+}
@@ -0,0 +1,176 @@
+package builder
+
+import (
+	"testing"
+)
+
+func TestBuilderSuccess(t *testing.T) {
+	f := func(b *Builder, resultExpected string) {
+		t.Helper()
+
+		result, err := b.Query()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if result != resultExpected {
+			t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+
+	// series selectors
+	f(Metric("foo"), `foo`)
+	f(Metric("foo").Where("job", "=", "api").Where("instance", "!~", "host-.+"), `foo{job="api",instance!~"host-.+"}`)
+	f(Metric("foo").Where("job", "=", `a"b`), `foo{job="a\"b"}`)
+	f(Metric("foo").Where("job", "=", "a").OrWhere("job", "=~", "b|c"), `foo{job="a" or job=~"b|c"}`)
+	f(Metric("foo").OrWhere("job", "=", "a").Where("env", "!=", "dev"), `foo{env!="dev" or job="a",env!="dev"}`)
+	f(Selector().Where("job", "=", "api"), `{job="api"}`)
+	f(Selector().Where("job", "=", "api").Where("__name__", "=", "foo"), `foo{job="api"}`)
+	f(Selector().Where("__name__", "=~", "foo|bar"), `{__name__=~"foo|bar"}`)
+
+	// rollups
+	f(Metric("foo").Rate("5m"), `rate(foo[5m])`)
+	f(Metric("foo").Increase("1h").Sum(), `sum(increase(foo[1h]))`)
+	f(Metric("foo").Offset("1h").Rate("5m"), `rate(foo[5m] offset 1h)`)
+	f(Metric("foo").Rollup("quantile_over_time", "10m", Number(0.9)), `quantile_over_time(0.9, foo[10m])`)
+	f(Metric("foo").Rollup("quantiles_over_time", "10m", String("phi"), Number(0.5), Number(0.9)), `quantiles_over_time("phi", 0.5, 0.9, foo[10m])`)
+	f(Metric("foo").Rate("5m").Max().Rollup("max_over_time", "1h"), `max_over_time(max(rate(foo[5m]))[1h:])`)
+	f(Metric("foo").Window("5m * 2").Apply("rate"), `rate(foo[5m * 2])`)
+	f(Metric("foo").Rate("1i"), `rate(foo[1i])`)
+
+	// aggregates
+	f(Metric("foo").Where("job", "=", "a").Rate("5m").Sum().By("job"), `sum(rate(foo{job="a"}[5m])) by(job)`)
+	f(Metric("foo").Avg().Without("instance", "pod"), `avg(foo) without(instance,pod)`)
+	f(Metric("foo").Aggr("topk", Number(3)), `topk(3, foo)`)
+	f(Aggr("count_values", String("value"), Metric("foo")), `count_values("value", foo)`)
+	f(Metric("foo").Sum().By("job").Limit(10), `sum(foo) by(job) limit 10`)
+
+	// functions
+	f(Metric("foo").Apply("abs"), `abs(foo)`)
+	f(Metric("foo").Apply("clamp_max", Number(10)), `clamp_max(foo, 10)`)
+	f(Func("histogram_quantile", Number(0.99), Metric("foo_bucket").Rate("5m").Sum().By("le")), `histogram_quantile(0.99, sum(rate(foo_bucket[5m])) by(le))`)
+	f(Func("time"), `time()`)
+	f(Metric("foo").Apply("abs").KeepMetricNames(), `abs(foo) keep_metric_names`)
+	f(Metric("foo_bucket").Apply("histogram_quantile", Number(0.9)), `histogram_quantile(0.9, foo_bucket)`)
+	f(Metric("foo_bucket").Apply("histogram_share", Number(0.5)), `histogram_share(0.5, foo_bucket)`)
+	f(Metric("foo_bucket").Apply("histogram_quantiles", String("phi"), Number(0.5), Number(0.9)), `histogram_quantiles("phi", 0.5, 0.9, foo_bucket)`)
+	f(Metric("foo_bucket").Apply("histogram_fraction", Number(0), Number(0.5)), `histogram_fraction(0, 0.5, foo_bucket)`)
+	f(Metric("foo_bucket").Apply("buckets_limit", Number(10)), `buckets_limit(10, foo_bucket)`)
+	f(Metric("foo").Apply("range_quantile", Number(0.9)), `range_quantile(0.9, foo)`)
+	f(Metric("foo").Apply("range_trim_spikes", Number(0.1)), `range_trim_spikes(0.1, foo)`)
+	f(Metric("foo").Apply("limit_offset", Number(10), Number(5)), `limit_offset(10, 5, foo)`)
+	f(Metric("foo").Apply("label_set", String("job"), String("api")), `label_set(foo, "job", "api")`)
+	f(Metric("foo").Apply("union", Metric("bar")), `union(foo, bar)`)
+
+	// binary operators
+	f(Metric("foo").Add(Number(1)), `foo + 1`)
+	f(Metric("foo").Mul(Number(2)).Add(Metric("bar")), `(foo * 2) + bar`)
+	f(Metric("foo").Div(Metric("bar").Sub(Number(1))), `foo / (bar - 1)`)
+	f(Metric("foo").Gt(Number(10)).Bool(), `foo >bool 10`)
+	f(Metric("foo").Lt(Number(10)), `foo < 10`)
+	f(Metric("foo").And(Metric("bar")).Or(Metric("baz")).Unless(Metric("x")), `((foo and bar) or baz) unless x`)
+	f(Metric("foo").Div(Metric("bar")).On("job").GroupLeft("instance"), `foo / on(job) group_left(instance) bar`)
+	f(Metric("foo").Div(Metric("bar")).Ignoring("pod").GroupRight(), `foo / ignoring(pod) group_right() bar`)
+	f(Metric("foo").BinaryOp("DEFAULT", Number(0)), `foo default 0`)
+	f(Number(1).Add(Number(2)), `3`)
+}
+
+func TestBuilderReuse(t *testing.T) {
+	base := Metric("foo").Where("job", "=", "a")
+	q1, err := base.Where("env", "=", "prod").Query()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	q2, err := base.OrWhere("env", "=", "dev").Rate("5m").Query()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	q3, err := base.Query()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if q1 != `foo{job="a",env="prod"}` {
+		t.Fatalf("unexpected q1: %s", q1)
+	}
+	if q2 != `rate(foo{job="a" or env="dev"}[5m])` {
+		t.Fatalf("unexpected q2: %s", q2)
+	}
+	if q3 != `foo{job="a"}` {
+		t.Fatalf("unexpected q3: %s", q3)
+	}
+}
+
+func TestBuilderFailure(t *testing.T) {
+	f := func(b *Builder) {
+		t.Helper()
+
+		result, err := b.Query()
+		if err == nil {
+			t.Fatalf("expecting non-nil error; got %s", result)
+		}
+		if b.Err() == nil {
+			// The error is detected when parsing the built expression.
+			return
+		}
+		if _, err := b.Expr(); err == nil {
+			t.Fatalf("expecting non-nil error from Expr()")
+		}
+	}
+
+	// invalid selectors
+	f(Metric(""))
+	f(Metric("foo").Where("", "=", "a"))
+	f(Metric("foo").Where("job", "==", "a"))
+	f(Metric("foo").Where("job", "=~", "("))
+	f(Metric("foo").Rate("5m").Where("job", "=", "a"))
+	f(Metric("foo").Sum().OrWhere("job", "=", "a"))
+
+	// invalid functions
+	f(Func("unknown_func", Metric("foo")))
+	f(Func("sum", Metric("foo")))
+	f(Aggr("rate", Metric("foo")))
+	f(Metric("foo").Apply("unknown_func"))
+	f(Metric("foo").Apply("sum"))
+	f(Metric("foo").Rollup("abs", "5m"))
+	f(Metric("foo").Aggr("unknown_aggr"))
+	f(Func("abs", nil))
+	f(Func("abs", Metric("")))
+
+	// missing args before the expression
+	f(Metric("foo").Rollup("quantile_over_time", "5m"))
+	f(Metric("foo").Apply("count_values_over_time"))
+	f(Metric("foo").Apply("histogram_quantile"))
+	f(Metric("foo").Apply("limit_offset", Number(10)))
+
+	// functions without series args
+	f(Metric("foo").Apply("time"))
+	f(Metric("foo").Apply("timezone_offset"))
+
+	// invalid durations
+	f(Metric("foo").Rate("5 minutes"))
+	f(Metric("foo").Rate("-5m"))
+	f(Metric("foo").Rate("w"))
+	f(Metric("foo").Rate("$w"))
+	f(Metric("foo").Window("5m").Rate("5m"))
+	f(Metric("foo").Offset("foo"))
+	f(Metric("foo").Offset("1h").Offset("2h"))
+
+	// invalid modifiers
+	f(Metric("foo").By("job"))
+	f(Metric("foo").Sum().By("job").Without("instance"))
+	f(Metric("foo").Sum().By(""))
+	f(Metric("foo").Limit(10))
+	f(Metric("foo").Sum().Limit(0))
+	f(Metric("foo").Bool())
+	f(Metric("foo").Add(Number(1)).Bool())
+	f(Metric("foo").On("job"))
+	f(Metric("foo").Add(Metric("bar")).On("job").Ignoring("pod"))
+	f(Metric("foo").Add(Metric("bar")).GroupLeft())
+	f(Metric("foo").And(Metric("bar")).On("job").GroupLeft())
+	f(Metric("foo").Add(Metric("bar")).On("job").GroupLeft().GroupRight())
+	f(Metric("foo").Sum().KeepMetricNames())
+
+	// invalid binary operators
+	f(Metric("foo").BinaryOp("**", Number(1)))
+	f(Metric("foo").Add(nil))
+	f(Metric("foo").Add(Metric("")))
+}
@@ -0,0 +1,46 @@
+// Command metricsql provides command-line tools for MetricsQL queries.
+//
+// Usage:
+//
+//	metricsql test <test_file>...
+//
+// See `metricsql test -help` for details.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes the command with the given args and returns the exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		printUsage(stderr)
+		return 2
+	}
+	switch args[0] {
+	case "test":
+		return runTestCommand(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		printUsage(stdout)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n", args[0])
+		printUsage(stderr)
+		return 2
+	}
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, `Usage: metricsql <command> [args]
+
+Commands:
+  test <test_file>...  run unit tests for MetricsQL expressions from the given test files
+  help                 show this help
+`)
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/VictoriaMetrics/metricsql/eval"
+	"gopkg.in/yaml.v3"
+)
+
+// testFile is a file with unit tests for MetricsQL expressions.
+//
+// It uses the same structure as `promtool test rules` files with `promql_expr_test` sections.
+// The file must be in YAML format. JSON files are accepted too, since JSON is a subset of YAML.
+type testFile struct {
+	// RuleFiles and EvaluationInterval are accepted for compatibility with `promtool test rules` files.
+	// They are ignored, since only `promql_expr_test` sections are supported.
+	RuleFiles          []string `yaml:"rule_files"`
+	EvaluationInterval string   `yaml:"evaluation_interval"`
+
+	Tests []testGroup `yaml:"tests"`
+}
+
+// testGroup contains input series and expression tests over these series.
+type testGroup struct {
+	// Name is an optional name for the group.
+	Name string `yaml:"name"`
+
+	// Interval is the interval between samples of input series. It is 1m by default.
+	Interval string `yaml:"interval"`
+
+	// InputSeries contains input series for the expressions.
+	InputSeries []inputSeries `yaml:"input_series"`
+
+	// ExprTests contains expressions to test.
+	ExprTests []exprTest `yaml:"promql_expr_test"`
+}
+
+type inputSeries struct {
+	// Series contains series labels in the form `metric{label="value",...}`.
+	Series string `yaml:"series"`
+
+	// Values contains sample values in the expanding notation such as `1+1x10 _x3 stale 5`.
+	Values string `yaml:"values"`
+}
+
+type exprTest struct {
+	// Expr is MetricsQL expression to test.
+	Expr string `yaml:"expr"`
+
+	// EvalTime is the time for the evaluation of the expression relative to the first sample of input series.
+	EvalTime string `yaml:"eval_time"`
+
+	// ExpSamples contains expected results.
+	ExpSamples []expSample `yaml:"exp_samples"`
+}
+
+type expSample struct {
+	// Labels contains series labels in the form `metric{label="value",...}`.
+	Labels string `yaml:"labels"`
+
+	// Value is the expected value.
+	//
+	// NaN value matches missing series, since VictoriaMetrics drops series with NaN values from query results.
+	Value expValue `yaml:"value"`
+}
+
+// expValue is the expected value for expSample.
+//
+// It accepts YAML special values such as `.nan`, `.inf` and `-.inf` in addition to values
+// accepted by strconv.ParseFloat such as `NaN`, `+Inf` and `-Inf`.
+type expValue float64
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (ev *expValue) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: value must be a number", node.Line)
+	}
+	s := node.Value
+	switch strings.ToLower(s) {
+	case ".nan":
+		s = "NaN"
+	case ".inf", "+.inf":
+		s = "+Inf"
+	case "-.inf":
+		s = "-Inf"
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("line %d: cannot parse value %q: %w", node.Line, node.Value, err)
+	}
+	*ev = expValue(v)
+	return nil
+}
+
+// defaultTestInterval is the default interval between samples of input series.
+const defaultTestInterval = 60_000
+
+// testQueryStep is the step for instant queries in tests.
+//
+// It equals to the default step for instant queries in VictoriaMetrics.
+const testQueryStep = 5 * 60_000
+
+func runTestCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		fmt.Fprintf(stderr, `Usage: metricsql test <test_file>...
+
+Runs unit tests for MetricsQL expressions from the given test files.
+
+Test files have the same structure as files for "promtool test rules" with "promql_expr_test" sections.
+They must be in YAML or JSON format. For example:
+
+  tests:
+    - interval: 1m
+      input_series:
+        - series: 'requests_total{job="api"}'
+          values: '0+10x10'
+      promql_expr_test:
+        - expr: increase(requests_total[5m])
+          eval_time: 10m
+          exp_samples:
+            - labels: '{job="api"}'
+              value: 50
+
+Series values support the following notation:
+  a+bxn  a, a+b, a+2*b, ..., a+n*b
+  a-bxn  a, a-b, a-2*b, ..., a-n*b
+  axn    n+1 copies of a
+  _      missing sample
+  _xn    n missing samples
+
+Staleness markers aren't supported, so "stale" values are rejected.
+
+Expected values may be NaN (".nan" or "NaN"). Such values match missing series,
+since VictoriaMetrics drops series with NaN values from query results.
+`)
+		if len(args) == 0 {
+			return 2
+		}
+		return 0
+	}
+	failed := false
+	for _, path := range args {
+		fmt.Fprintf(stdout, "Running tests from %s\n", path)
+		failures, err := runTestFile(path, stdout)
+		if err != nil {
+			fmt.Fprintf(stdout, "  ERROR: %s\n", err)
+			failed = true
+			continue
+		}
+		if failures > 0 {
+			fmt.Fprintf(stdout, "  FAILED: %d test(s)\n", failures)
+			failed = true
+			continue
+		}
+		fmt.Fprintf(stdout, "  SUCCESS\n")
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// runTestFile runs tests from the file at the given path and writes failures to w.
+//
+// It returns the number of failed expression tests.
+func runTestFile(path string, w io.Writer) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	tf, err := parseTestFile(data)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q: %w", path, err)
+	}
+	return runTests(tf, w)
+}
+
+func parseTestFile(data []byte) (*testFile, error) {
+	var tf testFile
+	d := yaml.NewDecoder(bytes.NewReader(data))
+	d.KnownFields(true)
+	if err := d.Decode(&tf); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("the test file is empty")
+		}
+		return nil, err
+	}
+	return &tf, nil
+}
+
+// runTests runs tests from tf and writes failures to w.
+//
+// It returns the number of failed expression tests.
+func runTests(tf *testFile, w io.Writer) (int, error) {
+	failures := 0
+	for i := range tf.Tests {
+		tg := &tf.Tests[i]
+		groupName := tg.Name
+		if groupName == "" {
+			groupName = fmt.Sprintf("#%d", i+1)
+		}
+		ss, err := tg.getInputSeries()
+		if err != nil {
+			return failures, fmt.Errorf("group %s: %w", groupName, err)
+		}
+		for j := range tg.ExprTests {
+			et := &tg.ExprTests[j]
+			diffs, err := et.run(ss)
+			if err != nil {
+				return failures, fmt.Errorf("group %s: expr %q at %s: %w", groupName, et.Expr, et.EvalTime, err)
+			}
+			if len(diffs) > 0 {
+				failures++
+				fmt.Fprintf(w, "  group %s: expr %q at %s:\n", groupName, et.Expr, et.EvalTime)
+				for _, diff := range diffs {
+					fmt.Fprintf(w, "    %s\n", diff)
+				}
+			}
+		}
+	}
+	return failures, nil
+}
+
+func (tg *testGroup) getInputSeries() ([]eval.Series, error) {
+	interval := int64(defaultTestInterval)
+	if tg.Interval != "" {
+		d, err := metricsql.PositiveDurationValue(tg.Interval, 0)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse interval: %w", err)
+		}
+		if d == 0 {
+			return nil, fmt.Errorf("interval must be positive")
+		}
+		interval = d
+	}
+	ss := make([]eval.Series, 0, len(tg.InputSeries))
+	for _, is := range tg.InputSeries {
+		labels, err := parseLabels(is.Series)
+		if err != nil {
+			return nil, err
+		}
+		values, err := parseSeriesValues(is.Values)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse values for %s: %w", is.Series, err)
+		}
+		s := eval.Series{
+			Labels: labels,
+		}
+		for i, v := range values {
+			if math.IsNaN(v) {
+				// Missing sample
+				continue
+			}
+			s.Timestamps = append(s.Timestamps, int64(i)*interval)
+			s.Values = append(s.Values, v)
+		}
+		ss = append(ss, s)
+	}
+	return ss, nil
+}
+
+// run evaluates et.Expr over ss and returns differences between the actual and the expected results.
+func (et *exprTest) run(ss []eval.Series) ([]string, error) {
+	e, err := metricsql.Parse(et.Expr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse expr: %w", err)
+	}
+	evalTime, err := metricsql.PositiveDurationValue(et.EvalTime, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse eval_time: %w", err)
+	}
+	cfg := &eval.Config{
+		Start: evalTime,
+		End:   evalTime,
+		Step:  testQueryStep,
+	}
+	result, err := eval.Exec(e, ss, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot evaluate expr: %w", err)
+	}
+	got := make(map[string]float64, len(result))
+	for _, s := range result {
+		got[eval.LabelsString(s.Labels)] = s.Values[0]
+	}
+	want := make(map[string]float64, len(et.ExpSamples))
+	for _, es := range et.ExpSamples {
+		labels, err := parseLabels(es.Labels)
+		if err != nil {
+			return nil, err
+		}
+		key := eval.LabelsString(labels)
+		if _, ok := want[key]; ok {
+			return nil, fmt.Errorf("duplicate expected sample for %s", key)
+		}
+		want[key] = float64(es.Value)
+	}
+	return getSamplesDiff(got, want), nil
+}
+
+// getSamplesDiff returns human-readable differences between got and want samples.
+func getSamplesDiff(got, want map[string]float64) []string {
+	var diffs []string
+	for key, vWant := range want {
+		vGot, ok := got[key]
+		if !ok && math.IsNaN(vWant) {
+			// VictoriaMetrics drops series with NaN values from query results.
+			continue
+		}
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("missing:    %s %s", key, formatValue(vWant)))
+			continue
+		}
+		if !almostEqual(vGot, vWant) {
+			diffs = append(diffs, fmt.Sprintf("mismatch:   %s got %s; want %s", key, formatValue(vGot), formatValue(vWant)))
+		}
+	}
+	for key, vGot := range got {
+		if _, ok := want[key]; !ok {
+			diffs = append(diffs, fmt.Sprintf("unexpected: %s %s", key, formatValue(vGot)))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+func almostEqual(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	if a == b {
+		return true
+	}
+	return math.Abs(a-b) <= 1e-9*math.Max(math.Abs(a), math.Abs(b))
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// parseLabels parses labels in the form `metric{label="value",...}`.
+func parseLabels(s string) ([]eval.Label, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "{}" {
+		return nil, nil
+	}
+	e, err := metricsql.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse labels %q: %w", s, err)
+	}
+	me, ok := e.(*metricsql.MetricExpr)
+	if !ok || len(me.LabelFilterss) != 1 {
+		return nil, fmt.Errorf("labels %q must have the form `metric{label=\"value\",...}`", s)
+	}
+	var labels []eval.Label
+	for _, lf := range me.LabelFilterss[0] {
+		if lf.IsNegative || lf.IsRegexp {
+			return nil, fmt.Errorf("labels %q must contain only `label=\"value\"` pairs", s)
+		}
+		if lf.Value == "" {
+			continue
+		}
+		labels = append(labels, eval.Label{
+			Name:  lf.Label,
+			Value: lf.Value,
+		})
+	}
+	return labels, nil
+}
+
+// parseSeriesValues parses series values in the expanding notation used by `promtool test rules`.
+//
+// Missing samples are returned as NaN.
+func parseSeriesValues(s string) ([]float64, error) {
+	var values []float64
+	for _, item := range strings.Fields(s) {
+		if item == "_" {
+			values = append(values, math.NaN())
+			continue
+		}
+		if item == "stale" {
+			return nil, fmt.Errorf("staleness markers aren't supported; use `_` for missing samples")
+		}
+		n := strings.LastIndexByte(item, 'x')
+		if n < 0 {
+			v, err := strconv.ParseFloat(item, 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse value %q: %w", item, err)
+			}
+			values = append(values, v)
+			continue
+		}
+		count, err := strconv.ParseUint(item[n+1:], 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse repeat count in %q: %w", item, err)
+		}
+		if item[:n] == "_" {
+			for i := uint64(0); i < count; i++ {
+				values = append(values, math.NaN())
+			}
+			continue
+		}
+		start, delta, err := parseStartDelta(item[:n])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %q: %w", item, err)
+		}
+		for i := uint64(0); i <= count; i++ {
+			values = append(values, start+float64(i)*delta)
+		}
+	}
+	return values, nil
+}
+
+// parseStartDelta parses `a+b`, `a-b` and `a` into the start value and the delta.
+func parseStartDelta(s string) (float64, float64, error) {
+	n := -1
+	for i := 1; i < len(s); i++ {
+		if (s[i] == '+' || s[i] == '-') && s[i-1] != 'e' && s[i-1] != 'E' {
+			n = i
+			break
+		}
+	}
+	if n < 0 {
+		start, err := strconv.ParseFloat(s, 64)
+		return start, 0, err
+	}
+	start, err := strconv.ParseFloat(s[:n], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	delta, err := strconv.ParseFloat(s[n+1:], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if s[n] == '-' {
+		delta = -delta
+	}
+	return start, delta, nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSeriesValuesSuccess(t *testing.T) {
+	f := func(s, resultExpected string) {
+		t.Helper()
+		values, err := parseSeriesValues(s)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", s, err)
+		}
+		a := make([]string, len(values))
+		for i, v := range values {
+			if math.IsNaN(v) {
+				a[i] = "_"
+			} else {
+				a[i] = formatValue(v)
+			}
+		}
+		if result := strings.Join(a, " "); result != resultExpected {
+			t.Fatalf("unexpected result for %q; got %q; want %q", s, result, resultExpected)
+		}
+	}
+
+	f(``, ``)
+	f(`1 2 3`, `1 2 3`)
+	f(`-2+4x3`, `-2 2 6 10`)
+	f(`1-2x4`, `1 -1 -3 -5 -7`)
+	f(`1x4`, `1 1 1 1 1`)
+	f(`1 _x3`, `1 _ _ _`)
+	f(`_ 1.5e3+1e-1x2`, `_ 1500 1500.1 1500.2`)
+	f(`1e+3-1e+2x1`, `1000 900`)
+	f(`-Inf Inf`, `-Inf +Inf`)
+	f(`0+1x0`, `0`)
+}
+
+func TestParseSeriesValuesFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		values, err := parseSeriesValues(s)
+		if err == nil {
+			t.Fatalf("expecting non-nil error for %q; got %v", s, values)
+		}
+	}
+
+	f(`foo`)
+	f(`1+x3`)
+	f(`1+1x`)
+	f(`1+1x-1`)
+	f(`1+1x1.5`)
+	f(`x3`)
+	f(`1*2x3`)
+
+	// staleness markers
+	f(`1 stale`)
+	f(`stalex3`)
+}
+
+func TestRunTests(t *testing.T) {
+	f := func(data string, failuresExpected int, outputExpected string) {
+		t.Helper()
+		tf, err := parseTestFile([]byte(data))
+		if err != nil {
+			t.Fatalf("cannot parse test file: %s", err)
+		}
+		var bb bytes.Buffer
+		failures, err := runTests(tf, &bb)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if failures != failuresExpected {
+			t.Fatalf("unexpected number of failures; got %d; want %d; output:\n%s", failures, failuresExpected, bb.String())
+		}
+		if output := bb.String(); output != outputExpected {
+			t.Fatalf("unexpected output\ngot\n%s\nwant\n%s", output, outputExpected)
+		}
+	}
+
+	// successful tests
+	f(`{"tests": [{
+		"interval": "1m",
+		"input_series": [
+			{"series": "requests_total{job=\"api\",instance=\"a\"}", "values": "0+10x10"},
+			{"series": "requests_total{job=\"api\",instance=\"b\"}", "values": "0+20x10"},
+			{"series": "up{job=\"api\",instance=\"a\"}", "values": "1x10"},
+			{"series": "up{job=\"api\",instance=\"b\"}", "values": "1x5 0x4"}
+		],
+		"promql_expr_test": [
+			{
+				"expr": "sum(increase(requests_total[5m])) by (job)",
+				"eval_time": "10m",
+				"exp_samples": [{"labels": "{job=\"api\"}", "value": 150}]
+			},
+			{
+				"expr": "WITH (q(m) = rate(m[5m]) keep_metric_names) q(requests_total)",
+				"eval_time": "10m",
+				"exp_samples": [
+					{"labels": "requests_total{job=\"api\",instance=\"a\"}", "value": 0.16666666666666666},
+					{"labels": "requests_total{job=\"api\",instance=\"b\"}", "value": 0.3333333333333333}
+				]
+			},
+			{
+				"expr": "up == 0",
+				"eval_time": "10m",
+				"exp_samples": [{"labels": "up{job=\"api\",instance=\"b\"}", "value": 0}]
+			},
+			{
+				"expr": "up{job=\"missing\"} default 0",
+				"eval_time": "1m",
+				"exp_samples": [{"labels": "", "value": 0}]
+			},
+			{
+				"expr": "up == 0",
+				"eval_time": "1m"
+			}
+		]
+	}]}`, 0, "")
+
+	// YAML test file with NaN expected values
+	f(`
+rule_files: []
+evaluation_interval: 1m
+tests:
+  - interval: 30s
+    input_series:
+      - series: 'temperature{room="kitchen"}'
+        values: '20 22 _ 24'
+      - series: 'temperature{room="bedroom"}'
+        values: '18x3'
+    promql_expr_test:
+      - expr: (temperature - 18) / (temperature - 18)
+        eval_time: 1m
+        exp_samples:
+          - labels: '{room="kitchen"}'
+            value: 1
+          - labels: '{room="bedroom"}'
+            value: .nan
+      - expr: temperature{room="bedroom"} - 18
+        eval_time: 1m
+        exp_samples:
+          - labels: '{room="bedroom"}'
+            value: 0
+      - expr: 1 / (temperature{room="bedroom"} - 18)
+        eval_time: 1m
+        exp_samples:
+          - labels: '{room="bedroom"}'
+            value: +.inf
+      - expr: absent(missing)
+        eval_time: 1m
+        exp_samples:
+          - labels: '{}'
+            value: 1
+          - labels: 'missing{}'
+            value: NaN
+`, 0, "")
+
+	// failed tests
+	f(`{"tests": [{
+		"name": "failing",
+		"input_series": [
+			{"series": "up{job=\"api\",instance=\"a\"}", "values": "1x10"},
+			{"series": "up{job=\"api\",instance=\"b\"}", "values": "1x10"}
+		],
+		"promql_expr_test": [
+			{
+				"expr": "up",
+				"eval_time": "5m",
+				"exp_samples": [
+					{"labels": "up{job=\"api\",instance=\"a\"}", "value": 2},
+					{"labels": "up{job=\"api\",instance=\"c\"}", "value": 1}
+				]
+			},
+			{
+				"expr": "sum(up)",
+				"eval_time": "5m",
+				"exp_samples": [{"labels": "{}", "value": 2}]
+			},
+			{
+				"expr": "sum(up)",
+				"eval_time": "5m",
+				"exp_samples": [{"labels": "{}", "value": "NaN"}]
+			}
+		]
+	}]}`, 2, `  group failing: expr "up" at 5m:
+    mismatch:   up{instance="a",job="api"} got 1; want 2
+    missing:    up{instance="c",job="api"} 1
+    unexpected: up{instance="b",job="api"} 1
+  group failing: expr "sum(up)" at 5m:
+    mismatch:   {} got 2; want NaN
+`)
+}
+
+func TestRunTestsFailure(t *testing.T) {
+	f := func(data string) {
+		t.Helper()
+		tf, err := parseTestFile([]byte(data))
+		if err != nil {
+			return
+		}
+		var bb bytes.Buffer
+		if _, err := runTests(tf, &bb); err == nil {
+			t.Fatalf("expecting non-nil error for %s", data)
+		}
+	}
+
+	// invalid json
+	f(`{"tests": [`)
+
+	// invalid yaml
+	f("tests:\n  - name: [")
+
+	// empty file
+	f(``)
+
+	// unknown field
+	f(`{"tests": [{"unknown_field": 1}]}`)
+	f("tests:\n  - alert_rule_test: []")
+
+	// invalid expected value
+	f(`{"tests": [{"promql_expr_test": [{"expr": "up", "eval_time": "1m", "exp_samples": [{"labels": "up", "value": "foo"}]}]}]}`)
+	f(`{"tests": [{"promql_expr_test": [{"expr": "up", "eval_time": "1m", "exp_samples": [{"labels": "up", "value": [1]}]}]}]}`)
+
+	// staleness markers
+	f(`{"tests": [{"input_series": [{"series": "up", "values": "1 stale"}]}]}`)
+
+	// invalid interval
+	f(`{"tests": [{"interval": "foo"}]}`)
+
+	// invalid series
+	f(`{"tests": [{"input_series": [{"series": "up{", "values": "1"}]}]}`)
+	f(`{"tests": [{"input_series": [{"series": "up{job=~\"a\"}", "values": "1"}]}]}`)
+	f(`{"tests": [{"input_series": [{"series": "up", "values": "foo"}]}]}`)
+
+	// invalid expr
+	f(`{"tests": [{"promql_expr_test": [{"expr": "sum(", "eval_time": "1m"}]}]}`)
+
+	// invalid eval_time
+	f(`{"tests": [{"promql_expr_test": [{"expr": "up", "eval_time": "-1m"}]}]}`)
+
+	// unsupported function
+	f(`{"tests": [{"promql_expr_test": [{"expr": "outliersk(1, up)", "eval_time": "1m"}]}]}`)
+
+	// duplicate expected samples
+	f(`{"tests": [{"promql_expr_test": [{"expr": "up", "eval_time": "1m", "exp_samples": [{"labels": "up"}, {"labels": "up"}]}]}]}`)
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatalf("cannot write %q: %s", path, err)
+		}
+		return path
+	}
+	okPath := writeFile("ok.json", `{"tests": [{
+		"input_series": [{"series": "up", "values": "1x5"}],
+		"promql_expr_test": [{"expr": "up", "eval_time": "1m", "exp_samples": [{"labels": "up", "value": 1}]}]
+	}]}`)
+	okYAMLPath := writeFile("ok.yml", `
+tests:
+  - input_series:
+      - series: up
+        values: 1x5
+    promql_expr_test:
+      - expr: up
+        eval_time: 1m
+        exp_samples:
+          - labels: up
+            value: 1
+`)
+	failPath := writeFile("fail.json", `{"tests": [{
+		"input_series": [{"series": "up", "values": "1x5"}],
+		"promql_expr_test": [{"expr": "up", "eval_time": "1m", "exp_samples": [{"labels": "up", "value": 0}]}]
+	}]}`)
+
+	f := func(args []string, exitCodeExpected int) {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		exitCode := run(args, &stdout, &stderr)
+		if exitCode != exitCodeExpected {
+			t.Fatalf("unexpected exit code for %q; got %d; want %d\nstdout:\n%s\nstderr:\n%s", args, exitCode, exitCodeExpected, stdout.String(), stderr.String())
+		}
+	}
+
+	f(nil, 2)
+	f([]string{"unknown"}, 2)
+	f([]string{"help"}, 0)
+	f([]string{"test"}, 2)
+	f([]string{"test", "-help"}, 0)
+	f([]string{"test", okPath}, 0)
+	f([]string{"test", okYAMLPath}, 0)
+	f([]string{"test", failPath}, 1)
+	f([]string{"test", okPath, failPath}, 1)
+	f([]string{"test", filepath.Join(dir, "missing.json")}, 1)
+}
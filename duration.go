@@ -0,0 +1,359 @@
+package metricsql
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Duration arithmetic such as `rate(x[5m * 2])`, `x offset (1h + 30m)` or `x[step() * 4]` is stored in DurationExpr.expr.
+//
+// The expression consists of BinaryOpExpr with `+`, `-`, `*`, `/` and `%` operations, DurationExpr operands
+// with durations, numbers, params and WITH template references, and FuncExpr with `step()`.
+// Durations and numbers are evaluated in seconds, so `5m * 2` equals to `10m`, while `5m + 30` equals to `5m30s`.
+
+// NewDurationExpr returns DurationExpr for the given s.
+//
+// s may contain a duration such as `5m`, `-1h30m` or `2i`, a number of seconds such as `300`,
+// or duration arithmetic such as `5m * 2` or `step() * 4`. s may also contain `$name` params (see ParseWithParams)
+// and WITH template references such as `w`. IsTemplate returns true for the latter case.
+func NewDurationExpr(s string) (*DurationExpr, error) {
+	var p parser
+	p.lex.Init(s)
+	p.lex.mode = parseModeParams
+	if err := p.lex.Next(); err != nil {
+		return nil, fmt.Errorf("cannot parse duration %q: %w", s, err)
+	}
+	e, err := p.parseDurationArithSum(nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse duration %q: %w", s, err)
+	}
+	if !isEOF(p.lex.Token) {
+		return nil, fmt.Errorf("unparsed data at the end of duration %q: %q%s", s, p.lex.Token, p.lex.sTail)
+	}
+	de := newDurationArithExpr(e)
+	if err := checkDurationArithExpr(de, false); err != nil {
+		return nil, err
+	}
+	return de, nil
+}
+
+// DurationExprFromMillis returns DurationExpr for the given duration in milliseconds.
+//
+// The duration is formatted with the biggest unit, which represents it exactly, e.g. `30s`, `5m` or `1h`.
+func DurationExprFromMillis(ms int64) *DurationExpr {
+	return &DurationExpr{
+		s: formatDurationMsecs(ms),
+	}
+}
+
+// String returns string representation of de.
+func (de *DurationExpr) String() string {
+	if de == nil {
+		return ""
+	}
+	return de.s
+}
+
+// IsStepRelative returns true if de depends on the query step.
+//
+// This is the case for durations with `i` suffix such as `2i`, `$__interval` and `$__rate_interval`
+// in queries parsed with ParseGrafana, and duration arithmetic with `step()`.
+func (de *DurationExpr) IsStepRelative() bool {
+	if de == nil {
+		return false
+	}
+	if de.expr != nil {
+		return isStepRelativeDurationArithExpr(de.expr)
+	}
+	if de.needsParsing {
+		return false
+	}
+	if name, _ := getDurationParamName(de); name != "" {
+		return name == "__interval" || name == "__rate_interval"
+	}
+	return strings.ContainsAny(de.s, "iI")
+}
+
+func isStepRelativeDurationArithExpr(e Expr) bool {
+	switch t := e.(type) {
+	case *DurationExpr:
+		return t.IsStepRelative()
+	case *BinaryOpExpr:
+		return isStepRelativeDurationArithExpr(t.Left) || isStepRelativeDurationArithExpr(t.Right)
+	default:
+		// step()
+		return true
+	}
+}
+
+// IsTemplate returns true if de refers to WITH template, which isn't expanded yet.
+//
+// Durations returned from Parse never refer to WITH templates, since they are expanded during parsing.
+func (de *DurationExpr) IsTemplate() bool {
+	if de == nil {
+		return false
+	}
+	if de.expr != nil {
+		return isTemplateDurationArithExpr(de.expr)
+	}
+	return de.needsParsing
+}
+
+func isTemplateDurationArithExpr(e Expr) bool {
+	switch t := e.(type) {
+	case *DurationExpr:
+		return t.IsTemplate()
+	case *BinaryOpExpr:
+		return isTemplateDurationArithExpr(t.Left) || isTemplateDurationArithExpr(t.Right)
+	default:
+		return false
+	}
+}
+
+// formatDurationMsecs formats ms with the biggest unit, which represents ms exactly, e.g. `30s`, `5m` or `1h`.
+func formatDurationMsecs(ms int64) string {
+	switch {
+	case ms == 0:
+		return "0s"
+	case ms%(3600*1000) == 0:
+		return strconv.FormatInt(ms/(3600*1000), 10) + "h"
+	case ms%(60*1000) == 0:
+		return strconv.FormatInt(ms/(60*1000), 10) + "m"
+	case ms%1000 == 0:
+		return strconv.FormatInt(ms/1000, 10) + "s"
+	default:
+		return strconv.FormatInt(ms, 10) + "ms"
+	}
+}
+
+func isDurationArithOp(op string) bool {
+	switch op {
+	case "+", "-", "*", "/", "%":
+		return true
+	default:
+		return false
+	}
+}
+
+// newDurationArithExpr returns DurationExpr for the given duration arithmetic e.
+//
+// e is returned as is if it is already DurationExpr without arithmetic.
+func newDurationArithExpr(e Expr) *DurationExpr {
+	if de, ok := e.(*DurationExpr); ok {
+		return de
+	}
+	return &DurationExpr{
+		s:    string(e.AppendString(nil)),
+		expr: e,
+	}
+}
+
+func negateDurationArithExpr(e Expr) Expr {
+	if de, ok := e.(*DurationExpr); ok && de.expr == nil && !de.needsParsing && !strings.HasPrefix(de.s, "-") {
+		return &DurationExpr{
+			s: "-" + de.s,
+		}
+	}
+	return &BinaryOpExpr{
+		Op: "-",
+		Left: &DurationExpr{
+			s: "0s",
+		},
+		Right: e,
+	}
+}
+
+// expandDurationArithExpr expands WITH templates in duration arithmetic e.
+//
+// e isn't modified, since it may belong to WITH template.
+func expandDurationArithExpr(was []*withArgExpr, e Expr) (Expr, error) {
+	switch t := e.(type) {
+	case *DurationExpr:
+		de, err := expandDuration(was, t)
+		if err != nil {
+			return nil, err
+		}
+		if de.expr != nil {
+			return de.expr, nil
+		}
+		return de, nil
+	case *BinaryOpExpr:
+		left, err := expandDurationArithExpr(was, t.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := expandDurationArithExpr(was, t.Right)
+		if err != nil {
+			return nil, err
+		}
+		be := &BinaryOpExpr{
+			Op:    t.Op,
+			Left:  left,
+			Right: right,
+		}
+		return be, nil
+	default:
+		return e, nil
+	}
+}
+
+// toDurationArithExpr converts arithmetic expression e such as `5m * 2` to duration arithmetic.
+//
+// This is used for WITH templates, which are parsed as regular expressions.
+func toDurationArithExpr(e Expr) (Expr, error) {
+	switch t := e.(type) {
+	case *DurationExpr:
+		if t.needsParsing {
+			return nil, fmt.Errorf("unexpected unexpanded duration %q", t.s)
+		}
+		if t.expr != nil {
+			return t.expr, nil
+		}
+		return t, nil
+	case *NumberExpr:
+		if math.IsNaN(t.N) || math.IsInf(t.N, 0) {
+			return nil, fmt.Errorf("duration cannot contain non-finite number %s", t.AppendString(nil))
+		}
+		s := t.s
+		if s == "" {
+			s = strconv.FormatFloat(t.N, 'g', -1, 64)
+		}
+		return newDurationExpr(s)
+	case *ParamExpr:
+		de := &DurationExpr{
+			s: string(appendParam(nil, t.Name)),
+		}
+		return de, nil
+	case *FuncExpr:
+		if strings.ToLower(t.Name) != "step" || len(t.Args) > 0 || t.KeepMetricNames {
+			return nil, fmt.Errorf("unsupported function in duration: %s; only step() is supported", t.AppendString(nil))
+		}
+		fe := &FuncExpr{
+			Name: "step",
+		}
+		return fe, nil
+	case *parensExpr:
+		if len(*t) != 1 {
+			return nil, fmt.Errorf("unexpected list in duration: %s", t.AppendString(nil))
+		}
+		return toDurationArithExpr((*t)[0])
+	case *BinaryOpExpr:
+		if !isDurationArithOp(t.Op) || t.Bool || t.GroupModifier.Op != "" || t.JoinModifier.Op != "" || t.KeepMetricNames {
+			return nil, fmt.Errorf("unsupported operation in duration: %s; only +, -, *, / and %% are supported", t.AppendString(nil))
+		}
+		left, err := toDurationArithExpr(t.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := toDurationArithExpr(t.Right)
+		if err != nil {
+			return nil, err
+		}
+		be := &BinaryOpExpr{
+			Op:    t.Op,
+			Left:  left,
+			Right: right,
+		}
+		return be, nil
+	default:
+		return nil, fmt.Errorf("unsupported expression in duration: %s", e.AppendString(nil))
+	}
+}
+
+// checkDurationArithExpr verifies de if it doesn't depend on step and contains no params.
+//
+// Duration arithmetic depending on step is verified during evaluation by DurationExpr.NonNegativeDuration.
+func checkDurationArithExpr(de *DurationExpr, mustBePositive bool) error {
+	if de == nil || !isStaticDurationArithExpr(de) {
+		return nil
+	}
+	// Single-token durations such as `5m-10m` are verified in the same way as `5m - 10m`.
+	d, err := de.DurationErr(0)
+	if err != nil {
+		return err
+	}
+	if mustBePositive && d < 0 {
+		return fmt.Errorf("duration %s cannot be negative; got %dms", de.s, d)
+	}
+	return nil
+}
+
+func isStaticDurationArithExpr(e Expr) bool {
+	switch t := e.(type) {
+	case *DurationExpr:
+		if t.expr != nil {
+			return isStaticDurationArithExpr(t.expr)
+		}
+		return !t.needsParsing && !strings.Contains(t.s, "$") && !t.IsStepRelative()
+	case *BinaryOpExpr:
+		return isStaticDurationArithExpr(t.Left) && isStaticDurationArithExpr(t.Right)
+	default:
+		// step()
+		return false
+	}
+}
+
+// evalDurationArithExpr returns the duration in milliseconds for duration arithmetic e and the given step in milliseconds.
+//
+// Error is returned if the result isn't finite.
+func evalDurationArithExpr(e Expr, step int64) (int64, error) {
+	secs, err := evalDurationArithSeconds(e, step)
+	if err != nil {
+		return 0, err
+	}
+	ms := secs * 1e3
+	if math.IsNaN(ms) || math.IsInf(ms, 0) {
+		return 0, fmt.Errorf("duration must be finite; got %v", ms)
+	}
+	if ms > math.MaxInt64 || ms < math.MinInt64 {
+		return 0, fmt.Errorf("duration %vms is out of range", ms)
+	}
+	return int64(ms), nil
+}
+
+func evalDurationArithSeconds(e Expr, step int64) (float64, error) {
+	switch t := e.(type) {
+	case *DurationExpr:
+		if t.expr != nil {
+			return evalDurationArithSeconds(t.expr, step)
+		}
+		if t.needsParsing {
+			return 0, fmt.Errorf("duration %q must be already parsed", t.s)
+		}
+		d, err := DurationValue(t.s, step)
+		if err != nil {
+			return 0, err
+		}
+		return float64(d) / 1e3, nil
+	case *FuncExpr:
+		// step()
+		return float64(step) / 1e3, nil
+	case *BinaryOpExpr:
+		left, err := evalDurationArithSeconds(t.Left, step)
+		if err != nil {
+			return 0, err
+		}
+		right, err := evalDurationArithSeconds(t.Right, step)
+		if err != nil {
+			return 0, err
+		}
+		switch t.Op {
+		case "+":
+			return left + right, nil
+		case "-":
+			return left - right, nil
+		case "*":
+			return left * right, nil
+		case "/":
+			return left / right, nil
+		case "%":
+			return math.Mod(left, right), nil
+		default:
+			return 0, fmt.Errorf("unsupported operation %q in duration", t.Op)
+		}
+	default:
+		return 0, fmt.Errorf("unsupported expression in duration: %s", e.AppendString(nil))
+	}
+}
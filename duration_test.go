@@ -0,0 +1,180 @@
+package metricsql
+
+import (
+	"testing"
+)
+
+func TestDurationArithExprDuration(t *testing.T) {
+	f := func(s string, step, windowExpected, offsetExpected int64) {
+		t.Helper()
+
+		e, err := Parse(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %s: %s", s, err)
+		}
+		re, ok := e.(*RollupExpr)
+		if !ok {
+			t.Fatalf("unexpected expression type for %s; got %T; want *RollupExpr", s, e)
+		}
+		window, err := re.Window.NonNegativeDuration(step)
+		if err != nil {
+			t.Fatalf("unexpected error when evaluating window for %s: %s", s, err)
+		}
+		if window != windowExpected {
+			t.Fatalf("unexpected window for %s; got %d; want %d", s, window, windowExpected)
+		}
+		if d := re.Window.Duration(step); d != windowExpected {
+			t.Fatalf("unexpected Duration() for window in %s; got %d; want %d", s, d, windowExpected)
+		}
+		if offset := re.Offset.Duration(step); offset != offsetExpected {
+			t.Fatalf("unexpected offset for %s; got %d; want %d", s, offset, offsetExpected)
+		}
+	}
+
+	f(`x[5m]`, 1000, 300_000, 0)
+	f(`x[5m * 2]`, 1000, 600_000, 0)
+	f(`x[5m + 30]`, 1000, 330_000, 0)
+	f(`x[(1h + 30m) / 2] offset (1h + 30m)`, 1000, 2_700_000, 5_400_000)
+	f(`x[step() * 4] offset -(step() % 7s)`, 15_000, 60_000, -1_000)
+	f(`x[1i * 2 + 1m]`, 30_000, 120_000, 0)
+	f(`x[$__interval * 3]`, 10_000, 30_000, 0)
+	f(`with (w = 5m, f(x, d) = x[d * 2] offset (d - 1m)) f(x, w)`, 1000, 600_000, 240_000)
+}
+
+func TestDurationArithExprNonNegativeDurationError(t *testing.T) {
+	f := func(s string, step int64) {
+		t.Helper()
+
+		e, err := Parse(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %s: %s", s, err)
+		}
+		re := e.(*RollupExpr)
+		if d, err := re.Window.NonNegativeDuration(step); err == nil {
+			t.Fatalf("expecting non-nil error for %s; got %d", s, d)
+		}
+	}
+
+	// negative results
+	f(`x[5m - step()]`, 600_000)
+	f(`x[1m - 2i]`, 60_000)
+
+	// non-finite results
+	f(`x[5m / (step() - 1m)]`, 60_000)
+	f(`x[5m % (1i - 1m)]`, 60_000)
+}
+
+func TestDurationArithExprDurationErr(t *testing.T) {
+	f := func(s string, step int64) {
+		t.Helper()
+
+		e, err := Parse(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %s: %s", s, err)
+		}
+		re := e.(*RollupExpr)
+		if d, err := re.Offset.DurationErr(step); err == nil {
+			t.Fatalf("expecting non-nil error for %s; got %d", s, d)
+		}
+		if d := re.Offset.Duration(step); d != 0 {
+			t.Fatalf("expecting zero Duration() for %s; got %d", s, d)
+		}
+	}
+
+	f(`x offset (1h / (step() - 60s))`, 60_000)
+	f(`x offset (1h % (1i - 1m))`, 60_000)
+	f(`x offset -(step() / 0)`, 60_000)
+}
+
+func TestNewDurationExprSuccess(t *testing.T) {
+	f := func(s, resultExpected string, isStepRelative, isTemplate bool) {
+		t.Helper()
+
+		de, err := NewDurationExpr(s)
+		if err != nil {
+			t.Fatalf("unexpected error in NewDurationExpr(%q): %s", s, err)
+		}
+		if result := de.String(); result != resultExpected {
+			t.Fatalf("unexpected String() for %q; got %q; want %q", s, result, resultExpected)
+		}
+		if result := string(de.AppendString(nil)); result != resultExpected {
+			t.Fatalf("unexpected AppendString() for %q; got %q; want %q", s, result, resultExpected)
+		}
+		if v := de.IsStepRelative(); v != isStepRelative {
+			t.Fatalf("unexpected IsStepRelative() for %q; got %v; want %v", s, v, isStepRelative)
+		}
+		if v := de.IsTemplate(); v != isTemplate {
+			t.Fatalf("unexpected IsTemplate() for %q; got %v; want %v", s, v, isTemplate)
+		}
+	}
+
+	f("5m", "5m", false, false)
+	f("-1h30m", "-1h30m", false, false)
+	f("300", "300", false, false)
+	f("1.5s", "1.5s", false, false)
+	f("2i", "2i", true, false)
+	f("$__interval", "1i", true, false)
+	f("5m*2", "5m * 2", false, false)
+	f("(1h + 30m) / 2", "(1h + 30m) / 2", false, false)
+	f("step() * 4", "step() * 4", true, false)
+	f("5m + 1i", "5m + 1i", true, false)
+	f("$w", "$w", false, false)
+	f("w", "w", false, true)
+	f("w * 2", "w * 2", false, true)
+}
+
+func TestNewDurationExprFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+
+		de, err := NewDurationExpr(s)
+		if err == nil {
+			t.Fatalf("expecting non-nil error in NewDurationExpr(%q); got %s", s, de)
+		}
+	}
+
+	f("")
+	f("5 minutes")
+	f("5m]")
+	f("5m *")
+	f("foo()")
+	f("1h / 0")
+	f(`"5m"`)
+}
+
+func TestDurationExprFromMillis(t *testing.T) {
+	f := func(ms int64, resultExpected string) {
+		t.Helper()
+
+		de := DurationExprFromMillis(ms)
+		if result := de.String(); result != resultExpected {
+			t.Fatalf("unexpected result for %d; got %q; want %q", ms, result, resultExpected)
+		}
+		if d := de.Duration(123); d != ms {
+			t.Fatalf("unexpected duration for %q; got %d; want %d", resultExpected, d, ms)
+		}
+		if de.IsStepRelative() || de.IsTemplate() {
+			t.Fatalf("unexpected step-relative or template duration for %d", ms)
+		}
+	}
+
+	f(0, "0s")
+	f(1, "1ms")
+	f(1500, "1500ms")
+	f(30_000, "30s")
+	f(90_000, "90s")
+	f(300_000, "5m")
+	f(7_200_000, "2h")
+	f(-3_600_000, "-1h")
+	f(86_400_000, "24h")
+}
+
+func TestDurationExprNil(t *testing.T) {
+	var de *DurationExpr
+	if s := de.String(); s != "" {
+		t.Fatalf("unexpected String() for nil DurationExpr: %q", s)
+	}
+	if de.IsStepRelative() || de.IsTemplate() {
+		t.Fatalf("unexpected step-relative or template nil DurationExpr")
+	}
+}
@@ -0,0 +1,336 @@
+package eval
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/VictoriaMetrics/metricsql/rollup"
+)
+
+// aggrFunc calculates the aggregate at every point for the series from a single group.
+type aggrFunc func(tss []*timeseries) []float64
+
+var aggrFuncs = map[string]aggrFunc{
+	"avg":    newAggrFunc(aggrAvg),
+	"count":  newAggrFunc(aggrCount),
+	"group":  newAggrFunc(aggrGroup),
+	"max":    newAggrFunc(aggrMax),
+	"median": newAggrFunc(aggrMedian),
+	"min":    newAggrFunc(aggrMin),
+	"stddev": newAggrFunc(aggrStddev),
+	"stdvar": newAggrFunc(aggrStdvar),
+	"sum":    newAggrFunc(aggrSum),
+}
+
+// newAggrFunc returns aggrFunc, which calls f on non-NaN values at every point.
+//
+// NaN is returned for points without non-NaN values.
+func newAggrFunc(f func(values []float64) float64) aggrFunc {
+	return func(tss []*timeseries) []float64 {
+		dst := make([]float64, len(tss[0].values))
+		values := make([]float64, 0, len(tss))
+		for i := range dst {
+			values = values[:0]
+			for _, ts := range tss {
+				if v := ts.values[i]; !math.IsNaN(v) {
+					values = append(values, v)
+				}
+			}
+			if len(values) == 0 {
+				dst[i] = nan
+				continue
+			}
+			dst[i] = f(values)
+		}
+		return dst
+	}
+}
+
+func evalAggrFuncExpr(ec *evalConfig, ae *metricsql.AggrFuncExpr) ([]*timeseries, error) {
+	funcName := strings.ToLower(ae.Name)
+	switch funcName {
+	case "topk", "bottomk":
+		return evalAggrTopK(ec, ae, funcName == "topk")
+	case "count_values":
+		return evalAggrCountValues(ec, ae)
+	case "quantile":
+		if len(ae.Args) != 2 {
+			return nil, fmt.Errorf("unexpected number of args for %s; got %d; want 2", ae.AppendString(nil), len(ae.Args))
+		}
+		phis, err := evalScalarArg(ec, ae.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		af := func(tss []*timeseries) []float64 {
+			dst := make([]float64, len(phis))
+			values := make([]float64, len(tss))
+			for i := range dst {
+				for j, ts := range tss {
+					values[j] = ts.values[i]
+				}
+				dst[i] = rollup.Quantile(phis[i], values)
+			}
+			return dst
+		}
+		return evalAggr(ec, ae, ae.Args[1], af)
+	}
+	af := aggrFuncs[funcName]
+	if af == nil {
+		return nil, fmt.Errorf("unsupported aggregate function %q", funcName)
+	}
+	if len(ae.Args) != 1 {
+		return nil, fmt.Errorf("unexpected number of args for %s; got %d; want 1", ae.AppendString(nil), len(ae.Args))
+	}
+	return evalAggr(ec, ae, ae.Args[0], af)
+}
+
+// evalAggr evaluates arg, groups the results according to ae.Modifier and calls af per every group.
+func evalAggr(ec *evalConfig, ae *metricsql.AggrFuncExpr, arg metricsql.Expr, af aggrFunc) ([]*timeseries, error) {
+	tss, err := evalExpr(ec, arg)
+	if err != nil {
+		return nil, err
+	}
+	groups := groupSeries(tss, &ae.Modifier)
+	groups = limitGroups(groups, ae.Limit)
+	rvs := make([]*timeseries, 0, len(groups))
+	for _, g := range groups {
+		rvs = append(rvs, &timeseries{
+			labels: g.labels,
+			values: af(g.tss),
+		})
+	}
+	return rvs, nil
+}
+
+type seriesGroup struct {
+	key    string
+	labels []Label
+	tss    []*timeseries
+}
+
+// groupSeries groups tss according to the `by (...)` or `without (...)` modifier.
+//
+// The returned groups are sorted by their labels.
+func groupSeries(tss []*timeseries, modifier *metricsql.ModifierExpr) []*seriesGroup {
+	filter := getGroupingFilter(modifier)
+	m := make(map[string]*seriesGroup)
+	for _, ts := range tss {
+		key := getLabelsKey(ts.labels, filter)
+		g := m[key]
+		if g == nil {
+			g = &seriesGroup{
+				key:    key,
+				labels: filterLabels(ts.labels, filter),
+			}
+			m[key] = g
+		}
+		g.tss = append(g.tss, ts)
+	}
+	groups := make([]*seriesGroup, 0, len(m))
+	for _, g := range m {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].key < groups[j].key
+	})
+	return groups
+}
+
+// getGroupingFilter returns a filter for labels, which must be kept in the output series of aggregate functions.
+func getGroupingFilter(modifier *metricsql.ModifierExpr) func(name string) bool {
+	switch strings.ToLower(modifier.Op) {
+	case "by":
+		return func(name string) bool {
+			return containsString(modifier.Args, name)
+		}
+	case "without":
+		return func(name string) bool {
+			return name != "__name__" && !containsString(modifier.Args, name)
+		}
+	default:
+		return func(_ string) bool {
+			return false
+		}
+	}
+}
+
+func limitGroups(groups []*seriesGroup, limit int) []*seriesGroup {
+	if limit > 0 && len(groups) > limit {
+		groups = groups[:limit]
+	}
+	return groups
+}
+
+func evalAggrTopK(ec *evalConfig, ae *metricsql.AggrFuncExpr, isTop bool) ([]*timeseries, error) {
+	if len(ae.Args) != 2 {
+		return nil, fmt.Errorf("unexpected number of args for %s; got %d; want 2", ae.AppendString(nil), len(ae.Args))
+	}
+	ks, err := evalScalarArg(ec, ae.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	tss, err := evalExpr(ec, ae.Args[1])
+	if err != nil {
+		return nil, err
+	}
+	sortSeriesByLabels(tss)
+	groups := limitGroups(groupSeries(tss, &ae.Modifier), ae.Limit)
+	var rvs []*timeseries
+	for _, g := range groups {
+		dsts := make([]*timeseries, len(g.tss))
+		for i, ts := range g.tss {
+			dsts[i] = &timeseries{
+				labels: ts.copyLabels(),
+				values: make([]float64, len(ts.values)),
+			}
+		}
+		idxs := make([]int, 0, len(g.tss))
+		for i := range ks {
+			idxs = idxs[:0]
+			for j, ts := range g.tss {
+				dsts[j].values[i] = nan
+				if !math.IsNaN(ts.values[i]) {
+					idxs = append(idxs, j)
+				}
+			}
+			sort.SliceStable(idxs, func(a, b int) bool {
+				va := g.tss[idxs[a]].values[i]
+				vb := g.tss[idxs[b]].values[i]
+				if isTop {
+					return va > vb
+				}
+				return va < vb
+			})
+			k := ks[i]
+			if math.IsNaN(k) || k < 0 {
+				k = 0
+			}
+			for n, j := range idxs {
+				if float64(n) >= k {
+					break
+				}
+				dsts[j].values[i] = g.tss[j].values[i]
+			}
+		}
+		for _, dst := range dsts {
+			if !isAllNaN(dst.values) {
+				rvs = append(rvs, dst)
+			}
+		}
+	}
+	return rvs, nil
+}
+
+func evalAggrCountValues(ec *evalConfig, ae *metricsql.AggrFuncExpr) ([]*timeseries, error) {
+	if len(ae.Args) != 2 {
+		return nil, fmt.Errorf("unexpected number of args for %s; got %d; want 2", ae.AppendString(nil), len(ae.Args))
+	}
+	dstLabel, err := evalStringArg(ae.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	tss, err := evalExpr(ec, ae.Args[1])
+	if err != nil {
+		return nil, err
+	}
+	groups := limitGroups(groupSeries(tss, &ae.Modifier), ae.Limit)
+	var rvs []*timeseries
+	for _, g := range groups {
+		m := make(map[float64]*timeseries)
+		var vs []float64
+		for _, ts := range g.tss {
+			for i, v := range ts.values {
+				if math.IsNaN(v) {
+					continue
+				}
+				dst := m[v]
+				if dst == nil {
+					labels := append([]Label{}, g.labels...)
+					labels = setLabel(labels, dstLabel, strconv.FormatFloat(v, 'g', -1, 64))
+					dst = &timeseries{
+						labels: labels,
+						values: make([]float64, len(ts.values)),
+					}
+					for j := range dst.values {
+						dst.values[j] = nan
+					}
+					m[v] = dst
+					vs = append(vs, v)
+				}
+				if math.IsNaN(dst.values[i]) {
+					dst.values[i] = 0
+				}
+				dst.values[i]++
+			}
+		}
+		sort.Float64s(vs)
+		for _, v := range vs {
+			rvs = append(rvs, m[v])
+		}
+	}
+	return rvs, nil
+}
+
+func sortSeriesByLabels(tss []*timeseries) {
+	sort.SliceStable(tss, func(i, j int) bool {
+		return LabelsString(tss[i].labels) < LabelsString(tss[j].labels)
+	})
+}
+
+func aggrSum(values []float64) float64 {
+	sum := float64(0)
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+
+func aggrAvg(values []float64) float64 {
+	return aggrSum(values) / float64(len(values))
+}
+
+func aggrCount(values []float64) float64 {
+	return float64(len(values))
+}
+
+func aggrGroup(_ []float64) float64 {
+	return 1
+}
+
+func aggrMin(values []float64) float64 {
+	minValue := values[0]
+	for _, v := range values[1:] {
+		minValue = math.Min(minValue, v)
+	}
+	return minValue
+}
+
+func aggrMax(values []float64) float64 {
+	maxValue := values[0]
+	for _, v := range values[1:] {
+		maxValue = math.Max(maxValue, v)
+	}
+	return maxValue
+}
+
+func aggrMedian(values []float64) float64 {
+	return rollup.Quantile(0.5, values)
+}
+
+func aggrStddev(values []float64) float64 {
+	return math.Sqrt(aggrStdvar(values))
+}
+
+func aggrStdvar(values []float64) float64 {
+	avg := aggrAvg(values)
+	sum := float64(0)
+	for _, v := range values {
+		d := v - avg
+		sum += d * d
+	}
+	return sum / float64(len(values))
+}
@@ -0,0 +1,43 @@
+package eval
+
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/VictoriaMetrics/metricsql/binaryop"
+)
+
+func evalBinaryOpExpr(ec *evalConfig, be *metricsql.BinaryOpExpr) ([]*timeseries, error) {
+	left, err := evalExpr(ec, be.Left)
+	if err != nil {
+		return nil, err
+	}
+	right, err := evalExpr(ec, be.Right)
+	if err != nil {
+		return nil, err
+	}
+	m := metricsql.BinaryOpMatching(be)
+	ss, err := m.Apply(toBinaryOpSeries(left), toBinaryOpSeries(right))
+	if err != nil {
+		return nil, fmt.Errorf("cannot evaluate %s: %w", be.AppendString(nil), err)
+	}
+	rvs := make([]*timeseries, len(ss))
+	for i, s := range ss {
+		rvs[i] = &timeseries{
+			labels: s.Labels,
+			values: s.Values,
+		}
+	}
+	return rvs, nil
+}
+
+func toBinaryOpSeries(tss []*timeseries) []*binaryop.Series {
+	ss := make([]*binaryop.Series, len(tss))
+	for i, ts := range tss {
+		ss[i] = &binaryop.Series{
+			Labels: ts.labels,
+			Values: ts.values,
+		}
+	}
+	return ss
+}
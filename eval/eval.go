@@ -0,0 +1,387 @@
+// Package eval implements in-memory reference evaluator for MetricsQL expressions.
+//
+// It evaluates expressions parsed with metricsql.Parse over the given set of series
+// without the need in running VictoriaMetrics. This may be used as a test oracle
+// for alerting rules, recording rules and dashboards.
+//
+// Usage:
+//
+//	e, err := metricsql.Parse(`sum(rate(http_requests_total[5m])) by (job)`)
+//	if err != nil {
+//	    // parse error
+//	}
+//	result, err := eval.Exec(e, series, &eval.Config{Start: start, End: end, Step: step})
+//	if err != nil {
+//	    // evaluation error
+//	}
+package eval
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/VictoriaMetrics/metricsql/binaryop"
+)
+
+var nan = math.NaN()
+
+// Label is a label for time series.
+type Label = binaryop.Label
+
+// Series is a time series.
+type Series struct {
+	// Labels contains series labels. The metric name must be stored in the `__name__` label.
+	Labels []Label
+
+	// Timestamps contains sample timestamps in milliseconds.
+	//
+	// Timestamps must be sorted in ascending order.
+	Timestamps []int64
+
+	// Values contains sample values for the corresponding Timestamps.
+	Values []float64
+}
+
+// MetricName returns the metric name for s.
+func (s *Series) MetricName() string {
+	return getLabelValue(s.Labels, "__name__")
+}
+
+// String returns string representation of s labels.
+func (s *Series) String() string {
+	return LabelsString(s.Labels)
+}
+
+// LabelsString returns Prometheus-like string representation for labels, i.e. `metric{label1="value1",label2="value2"}`.
+//
+// Labels are sorted by name.
+func LabelsString(labels []Label) string {
+	labels = sortedLabels(labels)
+	var b strings.Builder
+	metricName := getLabelValue(labels, "__name__")
+	b.WriteString(metricName)
+	b.WriteByte('{')
+	n := 0
+	for _, label := range labels {
+		if label.Name == "__name__" {
+			continue
+		}
+		if n > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", label.Name, label.Value)
+		n++
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Config contains configuration for Exec.
+type Config struct {
+	// Start is the start of the time range for the evaluation in milliseconds.
+	Start int64
+
+	// End is the end of the time range for the evaluation in milliseconds.
+	End int64
+
+	// Step is the interval between points on the [Start ... End] time range in milliseconds.
+	//
+	// Step must be positive.
+	Step int64
+
+	// LookbackDelta limits the distance to the sample before the lookbehind window for rollup functions
+	// in milliseconds.
+	//
+	// There is no limit if LookbackDelta is zero.
+	LookbackDelta int64
+}
+
+// Exec evaluates e over ss on the time range specified by cfg.
+//
+// The result contains series with values at cfg.Start, cfg.Start+cfg.Step, ..., cfg.End.
+// Values at points without data are set to NaN. Series without values at all the points are dropped.
+// The returned series are sorted by labels unless e is `sort(...)` or `sort_desc(...)`.
+//
+// e must be obtained via metricsql.Parse.
+func Exec(e metricsql.Expr, ss []Series, cfg *Config) ([]Series, error) {
+	if cfg.Step <= 0 {
+		return nil, fmt.Errorf("step must be positive; got %dms", cfg.Step)
+	}
+	if cfg.Start > cfg.End {
+		return nil, fmt.Errorf("start=%d cannot exceed end=%d", cfg.Start, cfg.End)
+	}
+	tss, err := newStorage(ss)
+	if err != nil {
+		return nil, err
+	}
+	ec := &evalConfig{
+		start:         cfg.Start,
+		end:           cfg.End,
+		step:          cfg.Step,
+		lookbackDelta: cfg.LookbackDelta,
+		storage:       tss,
+	}
+	rvs, err := evalExpr(ec, e)
+	if err != nil {
+		return nil, err
+	}
+	timestamps := ec.getTimestamps()
+	result := make([]Series, 0, len(rvs))
+	for _, ts := range rvs {
+		if isAllNaN(ts.values) {
+			continue
+		}
+		result = append(result, Series{
+			Labels:     sortedLabels(ts.labels),
+			Timestamps: append([]int64{}, timestamps...),
+			Values:     ts.values,
+		})
+	}
+	if !isSortFunc(e) {
+		sort.SliceStable(result, func(i, j int) bool {
+			return LabelsString(result[i].Labels) < LabelsString(result[j].Labels)
+		})
+	}
+	return result, nil
+}
+
+func isSortFunc(e metricsql.Expr) bool {
+	fe, ok := e.(*metricsql.FuncExpr)
+	if !ok {
+		return false
+	}
+	switch strings.ToLower(fe.Name) {
+	case "sort", "sort_desc":
+		return true
+	default:
+		return false
+	}
+}
+
+// evalConfig contains the time range for evaluating expressions.
+type evalConfig struct {
+	start         int64
+	end           int64
+	step          int64
+	lookbackDelta int64
+
+	storage []*rawSeries
+}
+
+func (ec *evalConfig) pointsLen() int {
+	return int((ec.end-ec.start)/ec.step) + 1
+}
+
+func (ec *evalConfig) getTimestamps() []int64 {
+	timestamps := make([]int64, ec.pointsLen())
+	for i := range timestamps {
+		timestamps[i] = ec.start + int64(i)*ec.step
+	}
+	return timestamps
+}
+
+func (ec *evalConfig) newConstSeries(v float64) *timeseries {
+	values := make([]float64, ec.pointsLen())
+	for i := range values {
+		values[i] = v
+	}
+	return &timeseries{
+		values: values,
+	}
+}
+
+// timeseries is a series with values at points defined by evalConfig.
+type timeseries struct {
+	labels []Label
+	values []float64
+}
+
+func (ts *timeseries) copyLabels() []Label {
+	return append([]Label{}, ts.labels...)
+}
+
+func isScalar(tss []*timeseries) bool {
+	return len(tss) == 1 && len(tss[0].labels) == 0
+}
+
+func evalExpr(ec *evalConfig, e metricsql.Expr) ([]*timeseries, error) {
+	switch t := e.(type) {
+	case *metricsql.NumberExpr:
+		return []*timeseries{ec.newConstSeries(t.N)}, nil
+	case *metricsql.DurationExpr:
+		d, err := t.DurationErr(ec.step)
+		if err != nil {
+			return nil, err
+		}
+		return []*timeseries{ec.newConstSeries(float64(d) / 1e3)}, nil
+	case *metricsql.StringExpr:
+		return nil, fmt.Errorf("cannot evaluate string %q outside function args", t.S)
+	case *metricsql.MetricExpr:
+		return evalRollupFunc(ec, "default_rollup", nil, nil, &metricsql.RollupExpr{Expr: t}, false)
+	case *metricsql.RollupExpr:
+		if _, ok := t.Expr.(*metricsql.MetricExpr); !ok && !t.ForSubquery() && t.Window == nil {
+			// `(q) offset d` or `(q) @ t`
+			return evalShiftedExpr(ec, t)
+		}
+		return evalRollupFunc(ec, "default_rollup", nil, nil, t, false)
+	case *metricsql.FuncExpr:
+		if metricsql.IsRollupFunc(t.Name) {
+			return evalRollupFuncExpr(ec, t)
+		}
+		return evalTransformFuncExpr(ec, t)
+	case *metricsql.AggrFuncExpr:
+		return evalAggrFuncExpr(ec, t)
+	case *metricsql.BinaryOpExpr:
+		return evalBinaryOpExpr(ec, t)
+	default:
+		return nil, fmt.Errorf("unsupported expression %s", e.AppendString(nil))
+	}
+}
+
+// evalShiftedExpr evaluates re.Expr on the time range shifted by `offset` and `@` modifiers from re.
+func evalShiftedExpr(ec *evalConfig, re *metricsql.RollupExpr) ([]*timeseries, error) {
+	offset, err := re.Offset.DurationErr(ec.step)
+	if err != nil {
+		return nil, fmt.Errorf("cannot evaluate offset in %s: %w", re.AppendString(nil), err)
+	}
+	ecNew := *ec
+	if re.At != nil {
+		at, err := evalAt(ec, re)
+		if err != nil {
+			return nil, err
+		}
+		ecNew.start = at
+		ecNew.end = at
+	}
+	ecNew.start -= offset
+	ecNew.end -= offset
+	tss, err := evalExpr(&ecNew, re.Expr)
+	if err != nil {
+		return nil, err
+	}
+	if re.At != nil {
+		// Spread the value calculated at the `@` time over all the points.
+		for _, ts := range tss {
+			v := ts.values[0]
+			ts.values = ec.newConstSeries(v).values
+		}
+	}
+	return tss, nil
+}
+
+// evalAt returns the timestamp in milliseconds from the `@` modifier in re.
+func evalAt(ec *evalConfig, re *metricsql.RollupExpr) (int64, error) {
+	values, err := evalScalarArg(ec, re.At)
+	if err != nil {
+		return 0, fmt.Errorf("cannot evaluate `@` modifier in %s: %w", re.AppendString(nil), err)
+	}
+	return int64(values[0] * 1e3), nil
+}
+
+// evalScalarArg evaluates e, which must return a single series, and returns its values.
+func evalScalarArg(ec *evalConfig, e metricsql.Expr) ([]float64, error) {
+	tss, err := evalExpr(ec, e)
+	if err != nil {
+		return nil, err
+	}
+	if len(tss) != 1 {
+		return nil, fmt.Errorf("%s must return a single series; got %d series", e.AppendString(nil), len(tss))
+	}
+	return tss[0].values, nil
+}
+
+// evalStringArg returns the string from e, which must be metricsql.StringExpr.
+func evalStringArg(e metricsql.Expr) (string, error) {
+	se, ok := e.(*metricsql.StringExpr)
+	if !ok {
+		return "", fmt.Errorf("expecting string arg; got %s", e.AppendString(nil))
+	}
+	return se.S, nil
+}
+
+func isAllNaN(values []float64) bool {
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func getLabelValue(labels []Label, name string) string {
+	for _, label := range labels {
+		if label.Name == name {
+			return label.Value
+		}
+	}
+	return ""
+}
+
+// setLabel sets the label with the given name to value in labels and returns the result.
+//
+// The label is removed if value is empty.
+func setLabel(labels []Label, name, value string) []Label {
+	for i, label := range labels {
+		if label.Name == name {
+			if value == "" {
+				return append(labels[:i:i], labels[i+1:]...)
+			}
+			labels[i].Value = value
+			return labels
+		}
+	}
+	if value == "" {
+		return labels
+	}
+	return append(labels, Label{
+		Name:  name,
+		Value: value,
+	})
+}
+
+func removeMetricName(labels []Label) []Label {
+	return setLabel(labels, "__name__", "")
+}
+
+func sortedLabels(labels []Label) []Label {
+	labels = append([]Label{}, labels...)
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	return labels
+}
+
+// getLabelsKey returns a key for labels, which are accepted by filter.
+func getLabelsKey(labels []Label, filter func(name string) bool) string {
+	var b strings.Builder
+	for _, label := range sortedLabels(labels) {
+		if !filter(label.Name) {
+			continue
+		}
+		fmt.Fprintf(&b, "%q=%q,", label.Name, label.Value)
+	}
+	return b.String()
+}
+
+// filterLabels returns labels, which are accepted by filter.
+func filterLabels(labels []Label, filter func(name string) bool) []Label {
+	var dst []Label
+	for _, label := range labels {
+		if filter(label.Name) {
+			dst = append(dst, label)
+		}
+	}
+	return dst
+}
+
+func containsString(a []string, s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
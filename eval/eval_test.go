@@ -0,0 +1,413 @@
+package eval
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/VictoriaMetrics/metricsql"
+)
+
+// newTestSeries returns a series with the given labels and samples at the given interval in seconds starting from zero.
+func newTestSeries(labels string, interval int64, values ...float64) Series {
+	var s Series
+	for _, kv := range strings.Split(labels, ",") {
+		n := strings.Index(kv, "=")
+		s.Labels = append(s.Labels, Label{
+			Name:  kv[:n],
+			Value: kv[n+1:],
+		})
+	}
+	for i, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		s.Timestamps = append(s.Timestamps, int64(i)*interval*1000)
+		s.Values = append(s.Values, v)
+	}
+	return s
+}
+
+func formatSeries(ss []Series) string {
+	var lines []string
+	for _, s := range ss {
+		var values []string
+		for _, v := range s.Values {
+			values = append(values, fmt.Sprintf("%g", math.Round(v*1e6)/1e6))
+		}
+		lines = append(lines, fmt.Sprintf("%s [%s]", LabelsString(s.Labels), strings.Join(values, " ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+var testSeries = []Series{
+	newTestSeries("__name__=requests_total,job=api,instance=a", 15, 0, 10, 20, 30, 40, 50, 60, 70, 80),
+	newTestSeries("__name__=requests_total,job=api,instance=b", 15, 0, 20, 40, 60, 80, 100, 120, 140, 160),
+	newTestSeries("__name__=requests_total,job=web,instance=c", 15, 100, 130, 160, 10, 40, 70, 100, 130, 160),
+	newTestSeries("__name__=temperature,room=kitchen", 30, 20, 22, 21, 25, 24),
+	newTestSeries("__name__=temperature,room=bedroom", 30, 18, 18, 19, 19, 20),
+	newTestSeries("__name__=room_info,room=kitchen,floor=1", 30, 1, 1, 1, 1, 1),
+	newTestSeries("__name__=room_info,room=bedroom,floor=2", 30, 1, 1, 1, 1, 1),
+}
+
+func TestExecSuccess(t *testing.T) {
+	f := func(q string, start, end, step int64, resultExpected string) {
+		t.Helper()
+		e, err := metricsql.Parse(q)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", q, err)
+		}
+		cfg := &Config{
+			Start: start * 1000,
+			End:   end * 1000,
+			Step:  step * 1000,
+		}
+		result, err := Exec(e, testSeries, cfg)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", q, err)
+		}
+		for _, s := range result {
+			if len(s.Timestamps) != len(s.Values) {
+				t.Fatalf("unexpected number of timestamps for %q; got %d; want %d", q, len(s.Timestamps), len(s.Values))
+			}
+		}
+		if s := formatSeries(result); s != resultExpected {
+			t.Fatalf("unexpected result for %q\ngot\n%s\nwant\n%s", q, s, resultExpected)
+		}
+	}
+
+	// constants
+	f(`1`, 0, 60, 30, `{} [1 1 1]`)
+	f(`time()`, 0, 60, 30, `{} [0 30 60]`)
+	f(`1m`, 0, 0, 30, `{} [60]`)
+
+	// series selectors
+	f(`temperature`, 0, 120, 60, `temperature{room="bedroom"} [18 19 20]
+temperature{room="kitchen"} [20 21 24]`)
+	f(`temperature{room="kitchen"}`, 30, 30, 30, `temperature{room="kitchen"} [22]`)
+	f(`temperature{room=~"kit.+"}`, 30, 30, 30, `temperature{room="kitchen"} [22]`)
+	f(`temperature{room!~"kit.+"}`, 30, 30, 30, `temperature{room="bedroom"} [18]`)
+	f(`temperature{room!="kitchen"}`, 30, 30, 30, `temperature{room="bedroom"} [18]`)
+	f(`{room="kitchen" or instance="a"}`, 30, 30, 30, `requests_total{instance="a",job="api"} [20]
+room_info{floor="1",room="kitchen"} [1]
+temperature{room="kitchen"} [22]`)
+	f(`temperature{missing=""}`, 30, 30, 30, `temperature{room="bedroom"} [18]
+temperature{room="kitchen"} [22]`)
+	f(`temperature{room="garage"}`, 30, 30, 30, ``)
+
+	// staleness: the last sample is at 120s, while the scrape interval is 30s
+	f(`temperature{room="kitchen"}`, 120, 300, 60, `temperature{room="kitchen"} [24 NaN NaN NaN]`)
+
+	// rollups
+	f(`rate(requests_total{instance="a"}[1m])`, 60, 120, 60, `{instance="a",job="api"} [0.666667 0.666667]`)
+	f(`increase(requests_total{instance="a"}[1m])`, 60, 120, 60, `{instance="a",job="api"} [40 40]`)
+	f(`increase(requests_total{instance="c"}[1m])`, 60, 120, 60, `{instance="c",job="web"} [100 120]`)
+	f(`rate(requests_total{instance="c"}[2m])`, 120, 120, 60, `{instance="c",job="web"} [1.833333]`)
+	f(`irate(requests_total{instance="c"}[1m])`, 45, 45, 60, `{instance="c",job="web"} [0.666667]`)
+	f(`resets(requests_total{instance="c"}[2m])`, 120, 120, 60, `{instance="c",job="web"} [1]`)
+	f(`changes(temperature{room="bedroom"}[1m])`, 120, 120, 60, `{room="bedroom"} [1]`)
+	f(`delta(temperature{room="kitchen"}[1m])`, 120, 120, 60, `{room="kitchen"} [3]`)
+	f(`idelta(temperature{room="kitchen"}[1m])`, 120, 120, 60, `{room="kitchen"} [-1]`)
+	f(`deriv(requests_total{instance="a"}[1m])`, 120, 120, 60, `{instance="a",job="api"} [0.666667]`)
+	f(`max_over_time(temperature{room="kitchen"}[2m])`, 120, 120, 60, `temperature{room="kitchen"} [25]`)
+	f(`min_over_time(temperature{room="kitchen"}[2m])`, 120, 120, 60, `temperature{room="kitchen"} [21]`)
+	f(`avg_over_time(temperature{room="kitchen"}[2m])`, 120, 120, 60, `temperature{room="kitchen"} [23]`)
+	f(`sum_over_time(temperature{room="kitchen"}[2m])`, 120, 120, 60, `{room="kitchen"} [92]`)
+	f(`count_over_time(temperature{room="kitchen"}[2m])`, 120, 120, 60, `{room="kitchen"} [4]`)
+	f(`quantile_over_time(0.5, temperature{room="kitchen"}[2m])`, 120, 120, 60, `temperature{room="kitchen"} [23]`)
+	f(`stddev_over_time(temperature{room="bedroom"}[1m])`, 120, 120, 60, `{room="bedroom"} [0.5]`)
+	f(`timestamp(temperature{room="kitchen"})`, 100, 100, 60, `{room="kitchen"} [90]`)
+	f(`increase_prometheus(requests_total{instance="c"}[1m])`, 120, 120, 60, `{instance="c",job="web"} [90]`)
+	f(`delta_prometheus(temperature{room="kitchen"}[1m])`, 120, 120, 60, `{room="kitchen"} [-1]`)
+	f(`lifetime(temperature{room="kitchen"}[2m])`, 120, 120, 60, `{room="kitchen"} [120]`)
+	f(`rollup_candlestick(temperature{room="kitchen"}[2m])`, 120, 120, 60, `temperature{rollup="close",room="kitchen"} [25]
+temperature{rollup="high",room="kitchen"} [25]
+temperature{rollup="low",room="kitchen"} [20]
+temperature{rollup="open",room="kitchen"} [20]`)
+	f(`quantiles_over_time("phi", 0.5, 0.9, temperature{room="kitchen"}[2m])`, 120, 120, 60, `temperature{phi="0.5",room="kitchen"} [23]
+temperature{phi="0.9",room="kitchen"} [24.7]`)
+	f(`histogram_over_time(temperature{room="kitchen"}[1m])`, 60, 120, 60, `{room="kitchen",vmrange="1.896e+01...2.154e+01"} [1 NaN]
+{room="kitchen",vmrange="2.154e+01...2.448e+01"} [1 1]
+{room="kitchen",vmrange="2.448e+01...2.783e+01"} [NaN 1]`)
+	f(`absent_over_time(temperature{room="garage"}[1m])`, 60, 60, 60, `{room="garage"} [1]`)
+	f(`absent_over_time(temperature[1m])`, 60, 60, 60, ``)
+	f(`last_over_time(temperature{room="kitchen"}[1h])`, 1000, 1000, 60, `temperature{room="kitchen"} [24]`)
+	f(`rate(requests_total{instance="a"}[1m]) keep_metric_names`, 60, 60, 60, `requests_total{instance="a",job="api"} [0.666667]`)
+
+	// offset and @ modifiers
+	f(`temperature{room="kitchen"} offset 1m`, 120, 120, 60, `temperature{room="kitchen"} [21]`)
+	f(`max_over_time(temperature{room="kitchen"}[1m] offset 1m)`, 120, 120, 60, `temperature{room="kitchen"} [22]`)
+	f(`temperature{room="kitchen"} @ 90`, 0, 60, 30, `temperature{room="kitchen"} [25 25 25]`)
+	f(`temperature{room="kitchen"} @ end()`, 0, 60, 30, `temperature{room="kitchen"} [21 21 21]`)
+	f(`temperature{room="kitchen"} @ start() offset -1m`, 0, 60, 30, `temperature{room="kitchen"} [21 21 21]`)
+
+	f(`(temperature{room="kitchen"} + 1) offset 1m`, 120, 120, 60, `{room="kitchen"} [22]`)
+	f(`(temperature{room="kitchen"} + 1) @ 90`, 0, 60, 60, `{room="kitchen"} [26 26]`)
+
+	// subqueries
+	f(`max_over_time(rate(requests_total{instance="c"}[30s])[2m:30s])`, 120, 120, 60, `{instance="c",job="web"} [2]`)
+	f(`min_over_time(sum(requests_total)[1m:15s])`, 90, 90, 60, `{} [100]`)
+	f(`temperature{room="kitchen"}[1m:30s]`, 60, 60, 60, `temperature{room="kitchen"} [21]`)
+	f(`rate(sum(requests_total{job="api"}))`, 60, 60, 15, `{} [2]`)
+
+	// aggregates
+	f(`sum(requests_total) by (job)`, 60, 60, 60, `{job="api"} [120]
+{job="web"} [40]`)
+	f(`sum(requests_total) without (instance)`, 60, 60, 60, `{job="api"} [120]
+{job="web"} [40]`)
+	f(`sum(requests_total) by (job) limit 1`, 60, 60, 60, `{job="api"} [120]`)
+	f(`avg(temperature)`, 0, 0, 60, `{} [19]`)
+	f(`min(temperature)`, 0, 0, 60, `{} [18]`)
+	f(`max(temperature)`, 0, 0, 60, `{} [20]`)
+	f(`count(requests_total)`, 0, 0, 60, `{} [3]`)
+	f(`group(requests_total) by (job)`, 0, 0, 60, `{job="api"} [1]
+{job="web"} [1]`)
+	f(`stddev(temperature)`, 0, 0, 60, `{} [1]`)
+	f(`stdvar(temperature)`, 0, 0, 60, `{} [1]`)
+	f(`quantile(0.5, requests_total)`, 60, 60, 60, `{} [40]`)
+	f(`median(requests_total)`, 60, 60, 60, `{} [40]`)
+	f(`topk(1, requests_total)`, 0, 60, 60, `requests_total{instance="b",job="api"} [NaN 80]
+requests_total{instance="c",job="web"} [100 NaN]`)
+	f(`bottomk(1, requests_total) by (job)`, 60, 60, 60, `requests_total{instance="a",job="api"} [40]
+requests_total{instance="c",job="web"} [40]`)
+	f(`count_values("value", temperature)`, 0, 0, 60, `{value="18"} [1]
+{value="20"} [1]`)
+
+	// binary operations
+	f(`temperature + 1`, 0, 0, 60, `{room="bedroom"} [19]
+{room="kitchen"} [21]`)
+	f(`2 * temperature`, 0, 0, 60, `{room="bedroom"} [36]
+{room="kitchen"} [40]`)
+	f(`temperature > 19`, 0, 60, 60, `temperature{room="kitchen"} [20 21]`)
+	f(`temperature > bool 19`, 0, 0, 60, `{room="bedroom"} [0]
+{room="kitchen"} [1]`)
+	f(`(temperature + 1) keep_metric_names`, 0, 0, 60, `temperature{room="bedroom"} [19]
+temperature{room="kitchen"} [21]`)
+	f(`temperature - on(room) temperature`, 0, 0, 60, `{room="bedroom"} [0]
+{room="kitchen"} [0]`)
+	f(`temperature * on(room) group_left(floor) room_info`, 0, 0, 60, `{floor="1",room="kitchen"} [20]
+{floor="2",room="bedroom"} [18]`)
+	f(`temperature * on(room) group_left(floor) prefix "room_" room_info`, 0, 0, 60, `{room="bedroom",room_floor="2"} [18]
+{room="kitchen",room_floor="1"} [20]`)
+	f(`room_info * on(room) group_right(floor) temperature`, 0, 0, 60, `{floor="1",room="kitchen"} [20]
+{floor="2",room="bedroom"} [18]`)
+	f(`temperature / ignoring(floor) room_info`, 0, 0, 60, `{room="bedroom"} [18]
+{room="kitchen"} [20]`)
+	f(`temperature and temperature{room="kitchen"}`, 0, 0, 60, `temperature{room="kitchen"} [20]`)
+	f(`temperature unless temperature{room="kitchen"}`, 0, 0, 60, `temperature{room="bedroom"} [18]`)
+	f(`temperature{room="kitchen"} or room_info`, 0, 0, 60, `room_info{floor="1",room="kitchen"} [1]
+room_info{floor="2",room="bedroom"} [1]
+temperature{room="kitchen"} [20]`)
+	f(`(temperature > 19) default 0`, 0, 0, 60, `temperature{room="bedroom"} [0]
+temperature{room="kitchen"} [20]`)
+	f(`temperature if temperature > 19`, 0, 0, 60, `temperature{room="kitchen"} [20]`)
+	f(`temperature ifnot temperature > 19`, 0, 0, 60, `temperature{room="bedroom"} [18]`)
+	f(`temperature{room="garage"} default 42`, 0, 0, 60, `{} [42]`)
+	f(`sum(temperature{room="garage"}) or vector(42)`, 0, 0, 60, `{} [42]`)
+	f(`2 ^ 3 + time()`, 0, 0, 60, `{} [8]`)
+
+	// transform functions
+	f(`abs(-temperature{room="kitchen"})`, 0, 0, 60, `{room="kitchen"} [20]`)
+	f(`abs(temperature{room="kitchen"}) keep_metric_names`, 0, 0, 60, `temperature{room="kitchen"} [20]`)
+	f(`clamp_max(temperature, 19)`, 0, 0, 60, `{room="bedroom"} [18]
+{room="kitchen"} [19]`)
+	f(`clamp(temperature, 18.5, 19)`, 0, 0, 60, `{room="bedroom"} [18.5]
+{room="kitchen"} [19]`)
+	f(`round(temperature / 7, 0.5)`, 0, 0, 60, `{room="bedroom"} [2.5]
+{room="kitchen"} [3]`)
+	f(`round(temperature / 7, 0.1)`, 0, 0, 60, `{room="bedroom"} [2.6]
+{room="kitchen"} [2.9]`)
+	f(`scalar(temperature{room="kitchen"}) * 2`, 0, 0, 60, `{} [40]`)
+	f(`scalar(temperature)`, 0, 0, 60, ``)
+	f(`absent(temperature{room="garage",floor=~"1|2"})`, 0, 0, 60, `{room="garage"} [1]`)
+	f(`absent(temperature)`, 0, 0, 60, ``)
+	f(`sort_desc(temperature)`, 0, 0, 60, `temperature{room="kitchen"} [20]
+temperature{room="bedroom"} [18]`)
+	f(`sort(temperature)`, 0, 0, 60, `temperature{room="bedroom"} [18]
+temperature{room="kitchen"} [20]`)
+	f(`label_set(temperature{room="kitchen"}, "a", "b")`, 0, 0, 60, `temperature{a="b",room="kitchen"} [20]`)
+	f(`label_del(room_info{room="kitchen"}, "floor")`, 0, 0, 60, `room_info{room="kitchen"} [1]`)
+	f(`label_keep(room_info{room="kitchen"}, "floor")`, 0, 0, 60, `{floor="1"} [1]`)
+	f(`label_replace(temperature{room="kitchen"}, "short", "$1", "room", "(.{3}).*")`, 0, 0, 60, `temperature{room="kitchen",short="kit"} [20]`)
+	f(`union(temperature{room="kitchen"}, room_info{room="kitchen"})`, 0, 0, 60, `room_info{floor="1",room="kitchen"} [1]
+temperature{room="kitchen"} [20]`)
+
+	// WITH templates
+	f(`WITH (t(r) = temperature{room=r}) t("kitchen") - t("bedroom")`, 0, 0, 60, ``)
+	f(`WITH (t(r) = temperature{room=r}) t("kitchen") - ignoring(room) t("bedroom")`, 0, 0, 60, `{} [2]`)
+}
+
+func TestExecFailure(t *testing.T) {
+	f := func(q string) {
+		t.Helper()
+		e, err := metricsql.Parse(q)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", q, err)
+		}
+		cfg := &Config{
+			Start: 0,
+			End:   60_000,
+			Step:  60_000,
+		}
+		result, err := Exec(e, testSeries, cfg)
+		if err == nil {
+			t.Fatalf("expecting non-nil error for %q; got\n%s", q, formatSeries(result))
+		}
+	}
+
+	// unsupported functions
+	f(`aggr_over_time("min_over_time", temperature[1m])`)
+	f(`quantiles_over_time(0.5, temperature[1m])`)
+	f(`histogram_quantile(0.5, temperature)`)
+	f(`outliersk(1, temperature)`)
+
+	// duplicate series after dropping metric names
+	f(`abs(label_del({__name__=~"temperature|room_info",room="kitchen"}, "floor"))`)
+
+	// many-to-many matching
+	f(`temperature + on() room_info`)
+	f(`temperature * on() group_left room_info`)
+
+	// strings outside function args
+	f(`"foo"`)
+
+	// series for scalar args
+	f(`quantile(temperature, temperature)`)
+
+	// non-finite duration arithmetic
+	f(`rate(temperature[5m / (step() - step())])`)
+	f(`temperature offset (1h / (step() - 60s))`)
+	f(`(temperature * 2) offset (1h / (step() - 60s))`)
+}
+
+func TestExecShardingPlan(t *testing.T) {
+	ss := []Series{
+		newTestSeries("__name__=foo,job=api,instance=a,shard=1", 30, 1, 2, 3, 4, 5),
+		newTestSeries("__name__=foo,job=api,instance=b,shard=2", 30, 10, 20, 30, 40, 50),
+		newTestSeries("__name__=foo,job=web,instance=c,shard=1", 30, 7, 7, 7, 7, 7),
+		newTestSeries("__name__=foo,job=web,instance=d,shard=2", 30, 8, 6, 4, 2, 0),
+		newTestSeries("__name__=bar,job=api,instance=a,shard=1", 30, 100, 0, 100, 0, 100),
+		newTestSeries("__name__=bar,job=api,instance=b,shard=2", 30, 3, 3, 3, 3, 3),
+	}
+	cfg := &Config{
+		Start: 0,
+		End:   120_000,
+		Step:  30_000,
+	}
+	f := func(q string) {
+		t.Helper()
+		e, err := metricsql.Parse(q)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", q, err)
+		}
+		resultExpected, err := Exec(e, ss, cfg)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", q, err)
+		}
+		sp, err := metricsql.AnalyzeSharding(e, "shard")
+		if err != nil {
+			t.Fatalf("cannot analyze sharding for %q: %s", q, err)
+		}
+
+		// Evaluate shard expressions on every shard and collect their results under ShardResultName.
+		var shardResults []Series
+		for i, se := range sp.ShardExprs {
+			for _, shard := range []string{"1", "2"} {
+				var shardSeries []Series
+				for _, s := range ss {
+					if getLabelValue(s.Labels, "shard") == shard {
+						shardSeries = append(shardSeries, s)
+					}
+				}
+				result, err := Exec(se, shardSeries, cfg)
+				if err != nil {
+					t.Fatalf("unexpected error for shard expr %s: %s", se.AppendString(nil), err)
+				}
+				for _, s := range result {
+					labels := setLabel(append([]Label{}, s.Labels...), "__name__", metricsql.ShardResultName(i))
+					shardResults = append(shardResults, newSeriesFromResult(labels, s))
+				}
+			}
+		}
+		result, err := Exec(sp.MergeExpr, shardResults, cfg)
+		if err != nil {
+			t.Fatalf("unexpected error for merge expr %s: %s", sp.MergeExpr.AppendString(nil), err)
+		}
+		if s, sExpected := formatSeries(result), formatSeries(resultExpected); s != sExpected {
+			t.Fatalf("unexpected merged result for %q\ngot\n%s\nwant\n%s", q, s, sExpected)
+		}
+	}
+
+	// shard-local expressions
+	f(`foo`)
+	f(`{__name__=~"foo|bar"}`)
+	f(`rate(foo[1m])`)
+	f(`sum(foo) by (shard)`)
+
+	// aggregate pushdown with identically labeled partial results on every shard
+	f(`sum(foo)`)
+	f(`sum(foo) by (job)`)
+	f(`sum(foo) without (instance, shard)`)
+	f(`min(foo) by (job)`)
+	f(`max(foo)`)
+	f(`count(foo) by (job)`)
+	f(`group(foo) by (job)`)
+	f(`avg(foo) by (job)`)
+
+	// topk and bottomk over series with distinct metric names and equal labels
+	f(`topk(2, {__name__=~"foo|bar"})`)
+	f(`bottomk(1, {__name__=~"foo|bar"}) by (job)`)
+
+	// evaluation over merged results
+	f(`sum(foo) / sum(bar)`)
+	f(`foo / on(job, instance) bar`)
+	f(`quantile(0.5, foo)`)
+}
+
+// newSeriesFromResult returns the series with the given labels and non-NaN samples from s.
+func newSeriesFromResult(labels []Label, s Series) Series {
+	rs := Series{
+		Labels: labels,
+	}
+	for i, v := range s.Values {
+		if math.IsNaN(v) {
+			continue
+		}
+		rs.Timestamps = append(rs.Timestamps, s.Timestamps[i])
+		rs.Values = append(rs.Values, v)
+	}
+	return rs
+}
+
+func TestExecInvalidConfig(t *testing.T) {
+	e, err := metricsql.Parse(`temperature`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f := func(cfg *Config, ss []Series) {
+		t.Helper()
+		if _, err := Exec(e, ss, cfg); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+
+	f(&Config{Start: 0, End: 60_000, Step: 0}, testSeries)
+	f(&Config{Start: 60_000, End: 0, Step: 1000}, testSeries)
+
+	cfg := &Config{Start: 0, End: 60_000, Step: 1000}
+	f(cfg, []Series{{
+		Labels:     []Label{{Name: "__name__", Value: "temperature"}},
+		Timestamps: []int64{1, 2},
+		Values:     []float64{1},
+	}})
+	f(cfg, []Series{{
+		Labels:     []Label{{Name: "__name__", Value: "temperature"}},
+		Timestamps: []int64{2, 1},
+		Values:     []float64{1, 2},
+	}})
+	f(cfg, []Series{
+		newTestSeries("__name__=temperature", 10, 1),
+		newTestSeries("__name__=temperature", 10, 2),
+	})
+}
@@ -0,0 +1,246 @@
+package eval
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/VictoriaMetrics/metricsql/rollup"
+)
+
+func evalRollupFuncExpr(ec *evalConfig, fe *metricsql.FuncExpr) ([]*timeseries, error) {
+	funcName := strings.ToLower(fe.Name)
+	if funcName == "absent_over_time" {
+		// The output series for absent_over_time() doesn't depend on input series, so evaluate it like absent().
+		return evalAbsent(ec, fe)
+	}
+	idx := metricsql.GetRollupArgIdx(fe)
+	if idx < 0 || idx >= len(fe.Args) {
+		return nil, fmt.Errorf("missing rollup arg for %s", fe.AppendString(nil))
+	}
+	var re *metricsql.RollupExpr
+	switch t := fe.Args[idx].(type) {
+	case *metricsql.RollupExpr:
+		re = t
+	case *metricsql.MetricExpr:
+		re = &metricsql.RollupExpr{
+			Expr: t,
+		}
+	default:
+		// Non-selector arg is implicitly converted into a subquery with the current step.
+		re = &metricsql.RollupExpr{
+			Expr:        t,
+			InheritStep: true,
+		}
+	}
+	// args contain constant args for rollup functions with outputs depending on args such as quantiles_over_time().
+	var args []any
+	var params [][]float64
+	for i, arg := range fe.Args {
+		if i == idx {
+			continue
+		}
+		if se, ok := arg.(*metricsql.StringExpr); ok {
+			args = append(args, se.S)
+			continue
+		}
+		values, err := evalScalarArg(ec, arg)
+		if err != nil {
+			return nil, fmt.Errorf("cannot evaluate arg #%d for %s: %w", i+1, fe.AppendString(nil), err)
+		}
+		args = append(args, values[0])
+		params = append(params, values)
+	}
+	return evalRollupFunc(ec, funcName, args, params, re, fe.KeepMetricNames)
+}
+
+func evalRollupFunc(ec *evalConfig, funcName string, args []any, params [][]float64, re *metricsql.RollupExpr, keepMetricNames bool) ([]*timeseries, error) {
+	if rollup.IsUnsupported(funcName) {
+		return nil, fmt.Errorf("rollup function %q isn't supported by the rollup package", funcName)
+	}
+	nfs := rollup.GetMultiFunc(funcName, args...)
+	if rf := rollup.GetFunc(funcName); rf != nil {
+		nfs = []rollup.NamedFunc{{
+			Func: rf,
+		}}
+	}
+	if nfs == nil {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("invalid args for rollup function %q: %v", funcName, args)
+		}
+		return nil, fmt.Errorf("unsupported rollup function %q", funcName)
+	}
+
+	// Calculate timestamps for the evaluation of the rollup function.
+	timestamps := ec.getTimestamps()
+	if re.At != nil {
+		at, err := evalAt(ec, re)
+		if err != nil {
+			return nil, err
+		}
+		for i := range timestamps {
+			timestamps[i] = at
+		}
+	}
+	offset, err := re.Offset.DurationErr(ec.step)
+	if err != nil {
+		return nil, fmt.Errorf("cannot evaluate offset in %s: %w", re.AppendString(nil), err)
+	}
+	for i := range timestamps {
+		timestamps[i] -= offset
+	}
+	window, err := re.Window.NonNegativeDuration(ec.step)
+	if err != nil {
+		return nil, fmt.Errorf("cannot evaluate window in %s: %w", re.AppendString(nil), err)
+	}
+
+	var rss []*rawSeries
+	step := ec.step
+	if re.ForSubquery() {
+		rss, step, err = evalSubquery(ec, re, timestamps, window)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		me, ok := re.Expr.(*metricsql.MetricExpr)
+		if !ok {
+			return nil, fmt.Errorf("lookbehind window can be applied only to series selectors; use subquery instead of %s", re.AppendString(nil))
+		}
+		rss, err = selectSeries(ec, me)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tss := make([]*timeseries, 0, len(rss))
+	for _, rs := range rss {
+		values := rs.values
+		if rollup.RemovesCounterResets(funcName) {
+			values = rollup.RemoveCounterResets(values)
+		}
+		scrapeInterval := rollup.GetScrapeInterval(rs.timestamps, step)
+		maxPrevInterval := rollup.GetMaxPrevInterval(scrapeInterval)
+		w := window
+		if w <= 0 {
+			w = ec.step
+			if rollup.CanAdjustWindow(funcName) && w < maxPrevInterval {
+				w = maxPrevInterval
+			}
+		}
+		cfg := &rollup.Config{
+			Window:          w,
+			Step:            ec.step,
+			MaxPrevInterval: maxPrevInterval,
+			LookbackDelta:   ec.lookbackDelta,
+		}
+		for _, nf := range nfs {
+			dstValues := make([]float64, len(timestamps))
+			for i, t := range timestamps {
+				rw := cfg.NewWindow(rs.timestamps, values, t)
+				for _, param := range params {
+					rw.Params = append(rw.Params, param[i])
+				}
+				dstValues[i] = nf.Func(rw)
+			}
+			if isAllNaN(dstValues) {
+				continue
+			}
+			labels := append([]Label{}, rs.labels...)
+			if !keepMetricNames && !rollup.KeepsMetricName(funcName) {
+				labels = removeMetricName(labels)
+			}
+			if nf.Name != "" {
+				labelName := nf.Label
+				if labelName == "" {
+					labelName = "rollup"
+				}
+				labels = setLabel(labels, labelName, nf.Name)
+			}
+			tss = append(tss, &timeseries{
+				labels: labels,
+				values: dstValues,
+			})
+		}
+	}
+	if err := checkDuplicateSeries(tss); err != nil {
+		return nil, fmt.Errorf("cannot evaluate %s(%s): %w", funcName, re.AppendString(nil), err)
+	}
+	return tss, nil
+}
+
+// evalSubquery evaluates the subquery re with the given lookbehind window for the given timestamps.
+//
+// It returns the subquery results as raw series together with the subquery step.
+func evalSubquery(ec *evalConfig, re *metricsql.RollupExpr, timestamps []int64, window int64) ([]*rawSeries, int64, error) {
+	step := ec.step
+	if re.Step != nil {
+		d, err := re.Step.NonNegativeDuration(ec.step)
+		if err != nil {
+			return nil, 0, fmt.Errorf("cannot evaluate subquery step in %s: %w", re.AppendString(nil), err)
+		}
+		if d > 0 {
+			step = d
+		}
+	}
+	if window <= 0 {
+		window = ec.step
+	}
+	tMin := timestamps[0]
+	tMax := timestamps[0]
+	for _, t := range timestamps {
+		tMin = min(tMin, t)
+		tMax = max(tMax, t)
+	}
+	// Align subquery points to the multiple of step like VictoriaMetrics does.
+	start := tMin - window
+	start -= mod(start, step)
+	ecSQ := &evalConfig{
+		start:         start,
+		end:           max(tMax, start),
+		step:          step,
+		lookbackDelta: ec.lookbackDelta,
+		storage:       ec.storage,
+	}
+	tss, err := evalExpr(ecSQ, re.Expr)
+	if err != nil {
+		return nil, 0, err
+	}
+	sqTimestamps := ecSQ.getTimestamps()
+	rss := make([]*rawSeries, 0, len(tss))
+	for _, ts := range tss {
+		rs := &rawSeries{
+			labels: ts.labels,
+		}
+		for i, v := range ts.values {
+			if math.IsNaN(v) {
+				continue
+			}
+			rs.timestamps = append(rs.timestamps, sqTimestamps[i])
+			rs.values = append(rs.values, v)
+		}
+		rss = append(rss, rs)
+	}
+	return rss, step, nil
+}
+
+func mod(a, b int64) int64 {
+	m := a % b
+	if m < 0 {
+		m += b
+	}
+	return m
+}
+
+// checkDuplicateSeries returns an error if tss contain series with identical labels.
+func checkDuplicateSeries(tss []*timeseries) error {
+	seen := make(map[string]bool, len(tss))
+	for _, ts := range tss {
+		key := LabelsString(ts.labels)
+		if seen[key] {
+			return fmt.Errorf("duplicate output series %s", key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
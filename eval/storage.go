@@ -0,0 +1,66 @@
+package eval
+
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/metricsql"
+)
+
+// rawSeries is a series with raw samples.
+type rawSeries struct {
+	labels     []Label
+	timestamps []int64
+	values     []float64
+}
+
+// newStorage validates ss and converts them to rawSeries.
+func newStorage(ss []Series) ([]*rawSeries, error) {
+	rss := make([]*rawSeries, 0, len(ss))
+	seen := make(map[string]bool, len(ss))
+	for i := range ss {
+		s := &ss[i]
+		if len(s.Timestamps) != len(s.Values) {
+			return nil, fmt.Errorf("series %s has %d timestamps and %d values; they must be equal", s, len(s.Timestamps), len(s.Values))
+		}
+		for j := 1; j < len(s.Timestamps); j++ {
+			if s.Timestamps[j] <= s.Timestamps[j-1] {
+				return nil, fmt.Errorf("series %s has unsorted or duplicate timestamps %d and %d", s, s.Timestamps[j-1], s.Timestamps[j])
+			}
+		}
+		labels := filterLabels(s.Labels, func(name string) bool { return true })
+		for _, label := range labels {
+			if label.Value == "" {
+				return nil, fmt.Errorf("series %s has empty value for label %q", s, label.Name)
+			}
+		}
+		key := LabelsString(labels)
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate series %s", key)
+		}
+		seen[key] = true
+		rss = append(rss, &rawSeries{
+			labels:     labels,
+			timestamps: s.Timestamps,
+			values:     s.Values,
+		})
+	}
+	return rss, nil
+}
+
+// selectSeries returns series from ec.storage matching me.
+func selectSeries(ec *evalConfig, me *metricsql.MetricExpr) ([]*rawSeries, error) {
+	if len(me.LabelFilterss) == 0 {
+		return nil, fmt.Errorf("series selector %s must contain at least a single label filter", me.AppendString(nil))
+	}
+	m, err := metricsql.NewMatcher(me.LabelFilterss)
+	if err != nil {
+		return nil, err
+	}
+	var rss []*rawSeries
+	for _, rs := range ec.storage {
+		if m.Match(rs.labels) {
+			rss = append(rss, rs)
+		}
+	}
+	return rss, nil
+}
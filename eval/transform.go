@@ -0,0 +1,358 @@
+package eval
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/VictoriaMetrics/metricsql"
+)
+
+// mathFuncs contains transform functions, which calculate the result per every value.
+var mathFuncs = map[string]func(v float64) float64{
+	"abs":   math.Abs,
+	"acos":  math.Acos,
+	"acosh": math.Acosh,
+	"asin":  math.Asin,
+	"asinh": math.Asinh,
+	"atan":  math.Atan,
+	"atanh": math.Atanh,
+	"ceil":  math.Ceil,
+	"cos":   math.Cos,
+	"cosh":  math.Cosh,
+	"deg": func(v float64) float64 {
+		return v * 180 / math.Pi
+	},
+	"exp":   math.Exp,
+	"floor": math.Floor,
+	"ln":    math.Log,
+	"log2":  math.Log2,
+	"log10": math.Log10,
+	"rad": func(v float64) float64 {
+		return v * math.Pi / 180
+	},
+	"sgn": func(v float64) float64 {
+		switch {
+		case v < 0:
+			return -1
+		case v > 0:
+			return 1
+		default:
+			return v
+		}
+	},
+	"sin":  math.Sin,
+	"sinh": math.Sinh,
+	"sqrt": math.Sqrt,
+	"tan":  math.Tan,
+	"tanh": math.Tanh,
+}
+
+// paramFuncs contains transform functions, which calculate the result per every value
+// with additional scalar params.
+var paramFuncs = map[string]struct {
+	minParams int
+	maxParams int
+	f         func(v float64, params []float64) float64
+}{
+	"clamp": {2, 2, func(v float64, params []float64) float64 {
+		if params[0] > params[1] {
+			return nan
+		}
+		return math.Min(math.Max(v, params[0]), params[1])
+	}},
+	"clamp_max": {1, 1, func(v float64, params []float64) float64 {
+		return math.Min(v, params[0])
+	}},
+	"clamp_min": {1, 1, func(v float64, params []float64) float64 {
+		return math.Max(v, params[0])
+	}},
+	"round": {0, 1, func(v float64, params []float64) float64 {
+		nearest := float64(1)
+		if len(params) > 0 {
+			nearest = params[0]
+		}
+		return metricsql.RoundToNearest(v, nearest)
+	}},
+}
+
+func evalTransformFuncExpr(ec *evalConfig, fe *metricsql.FuncExpr) ([]*timeseries, error) {
+	funcName := strings.ToLower(fe.Name)
+	if f := mathFuncs[funcName]; f != nil {
+		if err := expectArgsCount(fe, 1, 1); err != nil {
+			return nil, err
+		}
+		return evalValuesTransform(ec, fe, func(v float64, _ []float64) float64 {
+			return f(v)
+		})
+	}
+	if pf, ok := paramFuncs[funcName]; ok {
+		if err := expectArgsCount(fe, pf.minParams+1, pf.maxParams+1); err != nil {
+			return nil, err
+		}
+		return evalValuesTransform(ec, fe, pf.f)
+	}
+	switch funcName {
+	case "", "union":
+		var rvs []*timeseries
+		for _, arg := range fe.Args {
+			tss, err := evalExpr(ec, arg)
+			if err != nil {
+				return nil, err
+			}
+			rvs = append(rvs, tss...)
+		}
+		if err := checkDuplicateSeries(rvs); err != nil {
+			return nil, fmt.Errorf("cannot evaluate %s: %w", fe.AppendString(nil), err)
+		}
+		return rvs, nil
+	case "time", "start", "end", "step", "pi":
+		if err := expectArgsCount(fe, 0, 0); err != nil {
+			return nil, err
+		}
+		ts := ec.newConstSeries(0)
+		for i, t := range ec.getTimestamps() {
+			switch funcName {
+			case "time":
+				ts.values[i] = float64(t) / 1e3
+			case "start":
+				ts.values[i] = float64(ec.start) / 1e3
+			case "end":
+				ts.values[i] = float64(ec.end) / 1e3
+			case "step":
+				ts.values[i] = float64(ec.step) / 1e3
+			case "pi":
+				ts.values[i] = math.Pi
+			}
+		}
+		return []*timeseries{ts}, nil
+	case "scalar":
+		if err := expectArgsCount(fe, 1, 1); err != nil {
+			return nil, err
+		}
+		tss, err := evalExpr(ec, fe.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(tss) != 1 {
+			return []*timeseries{ec.newConstSeries(nan)}, nil
+		}
+		return []*timeseries{{values: tss[0].values}}, nil
+	case "vector":
+		if err := expectArgsCount(fe, 1, 1); err != nil {
+			return nil, err
+		}
+		return evalExpr(ec, fe.Args[0])
+	case "absent":
+		return evalAbsent(ec, fe)
+	case "sort", "sort_desc":
+		return evalSort(ec, fe, funcName == "sort_desc")
+	case "label_set", "label_del", "label_keep", "label_replace":
+		return evalLabelFunc(ec, fe, funcName)
+	default:
+		return nil, fmt.Errorf("unsupported function %q", fe.Name)
+	}
+}
+
+func expectArgsCount(fe *metricsql.FuncExpr, minArgs, maxArgs int) error {
+	if len(fe.Args) < minArgs || len(fe.Args) > maxArgs {
+		if minArgs == maxArgs {
+			return fmt.Errorf("unexpected number of args for %s; got %d; want %d", fe.AppendString(nil), len(fe.Args), minArgs)
+		}
+		return fmt.Errorf("unexpected number of args for %s; got %d; want from %d to %d", fe.AppendString(nil), len(fe.Args), minArgs, maxArgs)
+	}
+	return nil
+}
+
+// evalValuesTransform applies f to every value of series returned by fe.Args[0].
+//
+// Other args of fe are passed to f as params.
+func evalValuesTransform(ec *evalConfig, fe *metricsql.FuncExpr, f func(v float64, params []float64) float64) ([]*timeseries, error) {
+	tss, err := evalExpr(ec, fe.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	paramss := make([][]float64, 0, len(fe.Args)-1)
+	for _, arg := range fe.Args[1:] {
+		values, err := evalScalarArg(ec, arg)
+		if err != nil {
+			return nil, err
+		}
+		paramss = append(paramss, values)
+	}
+	params := make([]float64, len(paramss))
+	rvs := make([]*timeseries, len(tss))
+	for i, ts := range tss {
+		labels := ts.copyLabels()
+		if !fe.KeepMetricNames {
+			labels = removeMetricName(labels)
+		}
+		dst := &timeseries{
+			labels: labels,
+			values: make([]float64, len(ts.values)),
+		}
+		for j, v := range ts.values {
+			for k, values := range paramss {
+				params[k] = values[j]
+			}
+			dst.values[j] = f(v, params)
+		}
+		rvs[i] = dst
+	}
+	if err := checkDuplicateSeries(rvs); err != nil {
+		return nil, fmt.Errorf("cannot evaluate %s: %w", fe.AppendString(nil), err)
+	}
+	return rvs, nil
+}
+
+// evalAbsent returns a series with 1 values at points where fe.Args[0] returns no data.
+//
+// The labels for the returned series are obtained from `label="value"` filters of the series selector arg.
+func evalAbsent(ec *evalConfig, fe *metricsql.FuncExpr) ([]*timeseries, error) {
+	if err := expectArgsCount(fe, 1, 1); err != nil {
+		return nil, err
+	}
+	tss, err := evalExpr(ec, fe.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	dst := ec.newConstSeries(1)
+	for _, ts := range tss {
+		for i, v := range ts.values {
+			if !math.IsNaN(v) {
+				dst.values[i] = nan
+			}
+		}
+	}
+	if isAllNaN(dst.values) {
+		return nil, nil
+	}
+	if me := getAbsentArgMetricExpr(fe.Args[0]); me != nil && len(me.LabelFilterss) == 1 {
+		for _, lf := range me.LabelFilterss[0] {
+			if lf.Label == "__name__" || lf.IsNegative || lf.IsRegexp {
+				continue
+			}
+			dst.labels = setLabel(dst.labels, lf.Label, lf.Value)
+		}
+	}
+	return []*timeseries{dst}, nil
+}
+
+func getAbsentArgMetricExpr(e metricsql.Expr) *metricsql.MetricExpr {
+	switch t := e.(type) {
+	case *metricsql.MetricExpr:
+		return t
+	case *metricsql.RollupExpr:
+		return getAbsentArgMetricExpr(t.Expr)
+	default:
+		return nil
+	}
+}
+
+// evalSort sorts series by their last non-NaN value.
+func evalSort(ec *evalConfig, fe *metricsql.FuncExpr, isDesc bool) ([]*timeseries, error) {
+	if err := expectArgsCount(fe, 1, 1); err != nil {
+		return nil, err
+	}
+	tss, err := evalExpr(ec, fe.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	lastValue := func(ts *timeseries) float64 {
+		for i := len(ts.values) - 1; i >= 0; i-- {
+			if v := ts.values[i]; !math.IsNaN(v) {
+				return v
+			}
+		}
+		return nan
+	}
+	sort.SliceStable(tss, func(i, j int) bool {
+		a := lastValue(tss[i])
+		b := lastValue(tss[j])
+		if isDesc {
+			return a > b
+		}
+		return a < b
+	})
+	return tss, nil
+}
+
+func evalLabelFunc(ec *evalConfig, fe *metricsql.FuncExpr, funcName string) ([]*timeseries, error) {
+	if len(fe.Args) == 0 {
+		return nil, fmt.Errorf("missing series arg for %s", fe.AppendString(nil))
+	}
+	args := make([]string, len(fe.Args)-1)
+	for i, arg := range fe.Args[1:] {
+		s, err := evalStringArg(arg)
+		if err != nil {
+			return nil, fmt.Errorf("cannot evaluate arg #%d for %s: %w", i+2, fe.AppendString(nil), err)
+		}
+		args[i] = s
+	}
+	var f func(labels []Label) []Label
+	switch funcName {
+	case "label_set":
+		if len(args)%2 != 0 {
+			return nil, fmt.Errorf("%s must have even number of label args", fe.AppendString(nil))
+		}
+		f = func(labels []Label) []Label {
+			for i := 0; i < len(args); i += 2 {
+				labels = setLabel(labels, args[i], args[i+1])
+			}
+			return labels
+		}
+	case "label_del":
+		f = func(labels []Label) []Label {
+			return filterLabels(labels, func(name string) bool {
+				return !containsString(args, name)
+			})
+		}
+	case "label_keep":
+		f = func(labels []Label) []Label {
+			return filterLabels(labels, func(name string) bool {
+				return containsString(args, name)
+			})
+		}
+	case "label_replace":
+		if len(args) != 4 {
+			return nil, fmt.Errorf("unexpected number of args for %s; got %d; want 5", fe.AppendString(nil), len(fe.Args))
+		}
+		dstLabel, replacement, srcLabel := args[0], args[1], args[2]
+		re, err := metricsql.CompileRegexpAnchored(args[3])
+		if err != nil {
+			return nil, fmt.Errorf("cannot compile regexp %q in %s: %w", args[3], fe.AppendString(nil), err)
+		}
+		f = func(labels []Label) []Label {
+			return labelReplace(labels, dstLabel, replacement, srcLabel, re)
+		}
+	default:
+		panic(fmt.Errorf("BUG: unexpected label function %q", funcName))
+	}
+	tss, err := evalExpr(ec, fe.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	rvs := make([]*timeseries, len(tss))
+	for i, ts := range tss {
+		rvs[i] = &timeseries{
+			labels: f(ts.copyLabels()),
+			values: ts.values,
+		}
+	}
+	if err := checkDuplicateSeries(rvs); err != nil {
+		return nil, fmt.Errorf("cannot evaluate %s: %w", fe.AppendString(nil), err)
+	}
+	return rvs, nil
+}
+
+func labelReplace(labels []Label, dstLabel, replacement, srcLabel string, re *regexp.Regexp) []Label {
+	src := getLabelValue(labels, srcLabel)
+	match := re.FindStringSubmatchIndex(src)
+	if match == nil {
+		return labels
+	}
+	value := re.ExpandString(nil, replacement, src, match)
+	return setLabel(labels, dstLabel, string(value))
+}
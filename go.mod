@@ -2,7 +2,10 @@ module github.com/VictoriaMetrics/metricsql
 
 go 1.24.2
 
-require github.com/VictoriaMetrics/metrics v1.35.3
+require (
+	github.com/VictoriaMetrics/metrics v1.35.3
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/valyala/fastrand v1.1.0 // indirect
@@ -0,0 +1,285 @@
+package metricsql
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseGrafana parses s containing Grafana variables.
+//
+// In addition to `$__interval` and `$__rate_interval`, the following Grafana global variables are supported:
+// `$__interval_ms`, `$__range`, `$__range_s`, `$__range_ms`, `$__from` and `$__to`.
+// Dashboard variables can be referred as `$var`, `${var}` or `${var:format}`, where format is one of
+// `regex`, `pipe`, `csv` or `raw`.
+//
+// Variables are accepted in place of numbers, label filter values, lookbehind windows, steps and offsets,
+// e.g. `rate(foo{job=$job}[$__rate_interval]) > $threshold`. Variables inside quoted label filter values
+// such as `foo{instance=~"$instance"}` are kept as is.
+//
+// Unlike Parse, variables are kept as placeholders in the returned Expr, so its string representation
+// contains the original variables. For example, `$__rate_interval` isn't substituted with `1i`.
+// The returned Expr cannot be evaluated until variables are substituted with actual values via InterpolateGrafana.
+func ParseGrafana(s string) (Expr, error) {
+	return parse(s, parseModeGrafana)
+}
+
+// GrafanaVars contains values for Grafana variables. See InterpolateGrafana.
+type GrafanaVars struct {
+	// From is the start of the dashboard time range.
+	From time.Time
+
+	// To is the end of the dashboard time range.
+	To time.Time
+
+	// Interval is the value for `$__interval` and `$__interval_ms`.
+	Interval time.Duration
+
+	// RateInterval is the value for `$__rate_interval`.
+	//
+	// Interval is used if RateInterval is zero.
+	RateInterval time.Duration
+
+	// Vars contains values for dashboard variables by their names without the leading `$`.
+	//
+	// Multi-value variables may contain multiple values.
+	Vars map[string][]string
+}
+
+// InterpolateGrafana returns a copy of e with Grafana variables substituted with values from gv.
+//
+// e is usually obtained via ParseGrafana. The returned Expr doesn't contain variables, so it can be evaluated.
+// Variables are substituted in the same way as Grafana does for Prometheus datasource:
+//
+//   - multi-value variables are allowed only in label filter values. Their values are escaped and joined
+//     into `(v1|v2)` for `=~` and `!~` filters.
+//   - `${var:regex}` escapes values and joins them into `(v1|v2)`, `${var:pipe}` joins them into `v1|v2`,
+//     while `${var:csv}` and `${var:raw}` join them into `v1,v2`.
+//   - variables inside quoted label filter values are substituted too. Unknown variables there are left as is.
+//   - durations such as `$__interval` are converted to seconds in place of numbers.
+//   - `$__interval_ms` and `$__range_ms` are converted to milliseconds in place of durations,
+//     while `$__from` and `$__to` are converted to seconds in `@` modifier.
+//
+// Error is returned if e contains unknown variables outside quoted strings or if variable values are invalid
+// for their positions. e isn't modified.
+func InterpolateGrafana(e Expr, gv *GrafanaVars) (Expr, error) {
+	gr := &grafanaResolver{
+		gv: gv,
+	}
+	return bindParamsWithResolver(e, gr)
+}
+
+var grafanaBuiltinVars = map[string]bool{
+	"__interval":      true,
+	"__interval_ms":   true,
+	"__rate_interval": true,
+	"__range":         true,
+	"__range_s":       true,
+	"__range_ms":      true,
+	"__from":          true,
+	"__to":            true,
+}
+
+var grafanaVarFormats = map[string]bool{
+	"regex": true,
+	"pipe":  true,
+	"csv":   true,
+	"raw":   true,
+}
+
+func checkGrafanaVarName(name string) error {
+	varName, format, _ := strings.Cut(name, ":")
+	if strings.HasPrefix(varName, "__") && !grafanaBuiltinVars[varName] {
+		return fmt.Errorf("unsupported Grafana variable $%s", varName)
+	}
+	if format != "" && !grafanaVarFormats[format] {
+		return fmt.Errorf("unsupported format %q for Grafana variable $%s", format, varName)
+	}
+	return nil
+}
+
+// grafanaResolver is paramResolver for InterpolateGrafana.
+type grafanaResolver struct {
+	gv *GrafanaVars
+}
+
+func (gr *grafanaResolver) numberValue(name string) (float64, error) {
+	s, err := gr.singleValue(name)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		return n, nil
+	}
+	// Durations are treated as seconds in place of numbers.
+	d, err := DurationValue(s, 0)
+	if err != nil {
+		return 0, fmt.Errorf("Grafana variable $%s must contain number or duration; got %q", name, s)
+	}
+	return float64(d) / 1e3, nil
+}
+
+func (gr *grafanaResolver) timestampValue(name string) (float64, error) {
+	switch name {
+	case "__from":
+		return float64(gr.gv.From.UnixMilli()) / 1e3, nil
+	case "__to":
+		return float64(gr.gv.To.UnixMilli()) / 1e3, nil
+	default:
+		return gr.numberValue(name)
+	}
+}
+
+func (gr *grafanaResolver) durationValue(name string) (string, error) {
+	varName, _, _ := strings.Cut(name, ":")
+	switch varName {
+	case "__from", "__to":
+		return "", fmt.Errorf("Grafana variable $%s contains timestamp, so it cannot be used as duration", varName)
+	}
+	s, err := gr.singleValue(name)
+	if err != nil {
+		return "", err
+	}
+	switch varName {
+	case "__interval_ms", "__range_ms":
+		// Bare numbers are treated as seconds in place of durations.
+		s += "ms"
+	}
+	return s, nil
+}
+
+func (gr *grafanaResolver) labelValue(name string, isRegexp bool) (string, error) {
+	varName, format, _ := strings.Cut(name, ":")
+	values, err := gr.getValues(varName)
+	if err != nil {
+		return "", err
+	}
+	switch format {
+	case "":
+		if len(values) == 1 {
+			return values[0], nil
+		}
+		if !isRegexp {
+			return "", fmt.Errorf("multi-value Grafana variable $%s can be used only in `=~` and `!~` filters", varName)
+		}
+		return joinGrafanaRegexValues(values), nil
+	case "regex":
+		return joinGrafanaRegexValues(values), nil
+	case "pipe":
+		return strings.Join(values, "|"), nil
+	case "csv", "raw":
+		return strings.Join(values, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported format %q for Grafana variable $%s", format, varName)
+	}
+}
+
+func (gr *grafanaResolver) interpolateLabelValue(s string, isRegexp bool) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var b []byte
+	for {
+		n := strings.IndexByte(s, '$')
+		if n < 0 {
+			break
+		}
+		b = append(b, s[:n]...)
+		s = s[n:]
+		m, name := scanParam(s)
+		varName, _, _ := strings.Cut(name, ":")
+		if m == 0 || !gr.hasVar(varName) {
+			// Leave unknown variables as is.
+			b = append(b, '$')
+			s = s[1:]
+			continue
+		}
+		v, err := gr.labelValue(name, isRegexp)
+		if err != nil {
+			return "", err
+		}
+		b = append(b, v...)
+		s = s[m:]
+	}
+	b = append(b, s...)
+	return string(b), nil
+}
+
+func (gr *grafanaResolver) hasVar(name string) bool {
+	if grafanaBuiltinVars[name] {
+		return true
+	}
+	_, ok := gr.gv.Vars[name]
+	return ok
+}
+
+// singleValue returns the value for the variable in place of a number or a duration.
+func (gr *grafanaResolver) singleValue(name string) (string, error) {
+	varName, format, _ := strings.Cut(name, ":")
+	if format != "" && format != "raw" {
+		return "", fmt.Errorf("format %q cannot be used for Grafana variable $%s outside label filters", format, varName)
+	}
+	values, err := gr.getValues(varName)
+	if err != nil {
+		return "", err
+	}
+	if len(values) != 1 {
+		return "", fmt.Errorf("Grafana variable $%s must have a single value outside label filters; got %d values", varName, len(values))
+	}
+	return values[0], nil
+}
+
+func (gr *grafanaResolver) getValues(name string) ([]string, error) {
+	if grafanaBuiltinVars[name] {
+		return []string{gr.gv.getBuiltinValue(name)}, nil
+	}
+	values, ok := gr.gv.Vars[name]
+	if !ok {
+		return nil, fmt.Errorf("missing value for Grafana variable $%s", name)
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("Grafana variable $%s has no values", name)
+	}
+	return values, nil
+}
+
+func (gv *GrafanaVars) getBuiltinValue(name string) string {
+	rangeMs := gv.To.Sub(gv.From).Milliseconds()
+	switch name {
+	case "__interval":
+		return formatDurationMsecs(gv.Interval.Milliseconds())
+	case "__interval_ms":
+		return strconv.FormatInt(gv.Interval.Milliseconds(), 10)
+	case "__rate_interval":
+		if gv.RateInterval == 0 {
+			return formatDurationMsecs(gv.Interval.Milliseconds())
+		}
+		return formatDurationMsecs(gv.RateInterval.Milliseconds())
+	case "__range":
+		return strconv.FormatInt(int64(math.Round(float64(rangeMs)/1e3)), 10) + "s"
+	case "__range_s":
+		return strconv.FormatInt(int64(math.Round(float64(rangeMs)/1e3)), 10)
+	case "__range_ms":
+		return strconv.FormatInt(rangeMs, 10)
+	case "__from":
+		return strconv.FormatInt(gv.From.UnixMilli(), 10)
+	case "__to":
+		return strconv.FormatInt(gv.To.UnixMilli(), 10)
+	default:
+		panic(fmt.Errorf("BUG: unexpected Grafana variable $%s", name))
+	}
+}
+
+func joinGrafanaRegexValues(values []string) string {
+	if len(values) == 1 {
+		return regexp.QuoteMeta(values[0])
+	}
+	a := make([]string, len(values))
+	for i, v := range values {
+		a[i] = regexp.QuoteMeta(v)
+	}
+	return "(" + strings.Join(a, "|") + ")"
+}
@@ -0,0 +1,203 @@
+package metricsql
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseGrafanaSuccess(t *testing.T) {
+	another := func(s, resultExpected string) {
+		t.Helper()
+
+		e, err := ParseGrafana(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %s: %s", s, err)
+		}
+		result := string(e.AppendString(nil))
+		if result != resultExpected {
+			t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+
+		// Verify that the result is parsed into the same string
+		e, err = ParseGrafana(result)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %s: %s", result, err)
+		}
+		result2 := string(e.AppendString(nil))
+		if result2 != result {
+			t.Fatalf("unexpected result after parsing %s;\ngot\n%s\nwant\n%s", result, result2, result)
+		}
+	}
+	same := func(s string) {
+		t.Helper()
+		another(s, s)
+	}
+
+	same(`foo`)
+	same(`rate(foo[$__interval])`)
+	same(`rate(foo[$__rate_interval])`)
+	same(`increase(foo[$__range])`)
+	same(`rate(foo[5m:$__interval])`)
+	same(`foo offset $__range`)
+	same(`foo offset -$__rate_interval`)
+	same(`foo * $__interval_ms`)
+	same(`foo / $__range_s`)
+	same(`foo @ $__to`)
+	same(`timestamp(foo) - ($__from / 1000)`)
+	same(`foo{job=$job}`)
+	same(`foo{job=~${job:regex},instance=~${instance:pipe}}`)
+	another(`foo{job=~${job}}`, `foo{job=~$job}`)
+	same(`foo{job=~"$job",instance=~"${instance:regex}"}`)
+	same(`topk($k, rate(foo[$w]))`)
+	another(`with (w = $__rate_interval) rate(foo[w])`, `rate(foo[$__rate_interval])`)
+	another(`sum(rate(foo{job=~"$job"}[$__rate_interval])) by (job) / $__interval`, `sum(rate(foo{job=~"$job"}[$__rate_interval])) by(job) / $__interval`)
+}
+
+func TestParseGrafanaFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+
+		e, err := ParseGrafana(s)
+		if err == nil {
+			t.Fatalf("expecting non-nil error when parsing %s; got %s", s, e.AppendString(nil))
+		}
+	}
+
+	f(`$__foo`)
+	f(`rate(foo[$__range_foo])`)
+	f(`foo{job=${job:unknown}}`)
+	f(`foo{job=${job:}}`)
+	f(`foo{__name__=$name}`)
+
+	// formats aren't supported by ParseWithParams
+	e, err := ParseWithParams(`foo{job=${job:regex}}`)
+	if err == nil {
+		t.Fatalf("expecting non-nil error in ParseWithParams; got %s", e.AppendString(nil))
+	}
+}
+
+func TestInterpolateGrafanaSuccess(t *testing.T) {
+	gv := &GrafanaVars{
+		From:     time.UnixMilli(1700000000000),
+		To:       time.UnixMilli(1700003600000),
+		Interval: 30 * time.Second,
+		Vars: map[string][]string{
+			"job":       {"api"},
+			"instances": {"host-1:9100", "host.2"},
+			"k":         {"5"},
+			"w":         {"10m"},
+			"empty":     {""},
+		},
+	}
+	f := func(s, resultExpected string) {
+		t.Helper()
+
+		e, err := ParseGrafana(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %s: %s", s, err)
+		}
+		sOrig := string(e.AppendString(nil))
+		eResult, err := InterpolateGrafana(e, gv)
+		if err != nil {
+			t.Fatalf("unexpected error in InterpolateGrafana(%s): %s", s, err)
+		}
+		result := string(eResult.AppendString(nil))
+		if result != resultExpected {
+			t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+
+		// Make sure the original e didn't change
+		if s := string(e.AppendString(nil)); s != sOrig {
+			t.Fatalf("the original expression has been changed;\ngot\n%s\nwant\n%s", s, sOrig)
+		}
+
+		// Make sure the result can be parsed with Parse
+		eParsed, err := Parse(result)
+		if err != nil {
+			t.Fatalf("cannot parse the result %s: %s", result, err)
+		}
+		if s := string(eParsed.AppendString(nil)); s != result {
+			t.Fatalf("unexpected string after parsing the result;\ngot\n%s\nwant\n%s", s, result)
+		}
+	}
+
+	// global variables
+	f(`rate(foo[$__interval])`, `rate(foo[30s])`)
+	f(`rate(foo[$__rate_interval])`, `rate(foo[30s])`)
+	f(`increase(foo[$__range]) offset -$__interval`, `increase(foo[3600s]) offset -30s`)
+	f(`foo / $__range_s + $__interval_ms`, `(foo / 3600) + 30000`)
+	f(`foo * $__interval`, `foo * 30`)
+	f(`foo @ $__to`, `foo @ 1.7000036e+09`)
+	f(`foo @ ($__from + 60)`, `foo @ 1.70000006e+09`)
+	f(`rate(foo[5m] @ $__from)`, `rate(foo[5m] @ 1.7e+09)`)
+	f(`foo > $__from`, `foo > 1.7e+12`)
+	f(`foo[$__range_ms]`, `foo[3600000ms]`)
+	f(`rate(foo[$__interval_ms]) offset $__interval_ms`, `rate(foo[30000ms]) offset 30000ms`)
+	f(`rate(foo[$__range_s])`, `rate(foo[3600])`)
+
+	// dashboard variables
+	f(`foo{job=$job}`, `foo{job="api"}`)
+	f(`foo{job="$job",x="a$job-${job}"}`, `foo{job="api",x="aapi-api"}`)
+	f(`foo{instance=~$instances}`, `foo{instance=~"(host-1:9100|host\\.2)"}`)
+	f(`foo{instance=~"$instances"}`, `foo{instance=~"(host-1:9100|host\\.2)"}`)
+	f(`foo{instance!~"${instances:pipe}"}`, `foo{instance!~"host-1:9100|host.2"}`)
+	f(`foo{instance="${instances:csv}"}`, `foo{instance="host-1:9100,host.2"}`)
+	f(`foo{job=~${job:regex}}`, `foo{job=~"api"}`)
+	f(`foo{job=$empty}`, `foo{job=""}`)
+	f(`topk($k, rate(foo[$w]))`, `topk(5, rate(foo[10m]))`)
+
+	// unknown variables inside strings are left as is
+	f(`foo{job="$unknown",x="$1"}`, `foo{job="$unknown",x="$1"}`)
+	f(`label_replace(foo{job="$job"}, "x", "$1", "job", "(.+)")`, `label_replace(foo{job="api"}, "x", "$1", "job", "(.+)")`)
+
+	// rate interval
+	gv.RateInterval = 90 * time.Second
+	f(`rate(foo[$__rate_interval])`, `rate(foo[90s])`)
+}
+
+func TestInterpolateGrafanaFailure(t *testing.T) {
+	gv := &GrafanaVars{
+		Interval: time.Minute,
+		Vars: map[string][]string{
+			"multi": {"a", "b"},
+			"none":  {},
+			"str":   {"foo"},
+			"neg":   {"-5m"},
+		},
+	}
+	f := func(s string) {
+		t.Helper()
+
+		e, err := ParseGrafana(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %s: %s", s, err)
+		}
+		eResult, err := InterpolateGrafana(e, gv)
+		if err == nil {
+			t.Fatalf("expecting non-nil error in InterpolateGrafana(%s); got %s", s, eResult.AppendString(nil))
+		}
+	}
+
+	// missing variables
+	f(`foo{job=$job}`)
+	f(`foo > $x`)
+	f(`rate(foo[$w])`)
+	f(`foo{job=$none}`)
+
+	// multi-value variables outside regexp filters
+	f(`foo{job=$multi}`)
+	f(`foo{job="$multi"}`)
+	f(`foo > $multi`)
+	f(`rate(foo[$multi])`)
+
+	// invalid values
+	f(`foo > $str`)
+	f(`rate(foo[$str])`)
+	f(`rate(foo[$neg])`)
+	f(`foo > ${str:regex}`)
+
+	// timestamps in place of durations
+	f(`rate(foo[$__from])`)
+	f(`foo offset $__to`)
+	f(`foo[5m:$__to]`)
+}
@@ -0,0 +1,228 @@
+package histogram
+
+import (
+	"math"
+)
+
+// Quantile returns phi-quantile over buckets like histogram_quantile() does.
+//
+// NaN is returned if buckets contain no observations.
+func Quantile(phi float64, buckets []Bucket) float64 {
+	q, _, _ := QuantileWithBounds(phi, buckets)
+	return q
+}
+
+// QuantileWithBounds returns phi-quantile over buckets together with the lower and the upper bounds
+// of the bucket containing the quantile.
+//
+// The bounds are returned by histogram_quantile() when the bounds label arg is passed to it.
+func QuantileWithBounds(phi float64, buckets []Bucket) (float64, float64, float64) {
+	if math.IsNaN(phi) {
+		return nan, nan, nan
+	}
+	buckets = Normalize(buckets)
+	vLast := float64(0)
+	if len(buckets) > 0 {
+		vLast = buckets[len(buckets)-1].Count
+	}
+	if vLast == 0 || math.IsNaN(vLast) {
+		return nan, nan, nan
+	}
+	if phi < 0 {
+		return math.Inf(-1), math.Inf(-1), buckets[0].Count
+	}
+	if phi > 1 {
+		return math.Inf(1), vLast, math.Inf(1)
+	}
+	vReq := vLast * phi
+	vPrev := float64(0)
+	lePrev := float64(0)
+	for _, b := range buckets {
+		v := b.Count
+		le := b.Le
+		if v <= 0 {
+			// Skip empty buckets.
+			lePrev = le
+			continue
+		}
+		if v < vReq {
+			vPrev = v
+			lePrev = le
+			continue
+		}
+		if math.IsInf(le, 0) {
+			break
+		}
+		if v == vPrev {
+			return lePrev, lePrev, v
+		}
+		vv := lePrev + (le-lePrev)*(vReq-vPrev)/(v-vPrev)
+		return vv, lePrev, le
+	}
+	// The quantile is in the +Inf bucket, so return the upper bound of the previous bucket.
+	return lePrev, lePrev, math.Inf(1)
+}
+
+// Quantiles returns quantiles for every phi in phis over buckets like histogram_quantiles() does.
+func Quantiles(phis []float64, buckets []Bucket) []float64 {
+	dst := make([]float64, len(phis))
+	for i, phi := range phis {
+		dst[i] = Quantile(phi, buckets)
+	}
+	return dst
+}
+
+// Share returns the share of observations smaller or equal to le like histogram_share() does.
+//
+// The result is in the range [0...1]. NaN is returned if buckets are empty.
+func Share(le float64, buckets []Bucket) float64 {
+	q, _, _ := ShareWithBounds(le, buckets)
+	return q
+}
+
+// ShareWithBounds returns the share of observations smaller or equal to leReq together with the lower and the upper bounds
+// for the share.
+//
+// The bounds are returned by histogram_share() when the bounds label arg is passed to it.
+func ShareWithBounds(leReq float64, buckets []Bucket) (float64, float64, float64) {
+	if math.IsNaN(leReq) || len(buckets) == 0 {
+		return nan, nan, nan
+	}
+	buckets = Normalize(buckets)
+	if leReq < 0 {
+		return 0, 0, 0
+	}
+	if math.IsInf(leReq, 1) {
+		return 1, 1, 1
+	}
+	var vPrev, lePrev float64
+	for _, b := range buckets {
+		v := b.Count
+		le := b.Le
+		if leReq >= le {
+			vPrev = v
+			lePrev = le
+			continue
+		}
+		// precondition: lePrev <= leReq < le
+		vLast := buckets[len(buckets)-1].Count
+		lower := vPrev / vLast
+		if math.IsInf(le, 1) {
+			return lower, lower, 1
+		}
+		if lePrev == leReq {
+			return lower, lower, lower
+		}
+		upper := v / vLast
+		q := lower + (v-vPrev)/vLast*(leReq-lePrev)/(le-lePrev)
+		return q, lower, upper
+	}
+	// precondition: leReq > leLast
+	return 1, 1, 1
+}
+
+// Fraction returns the share of observations on the (lower ... upper] range like histogram_fraction() does.
+func Fraction(lower, upper float64, buckets []Bucket) float64 {
+	return Share(upper, buckets) - Share(lower, buckets)
+}
+
+// Avg returns the average value over observations like histogram_avg() does.
+//
+// Observations are assumed to be located in the middle of buckets. The +Inf bucket is ignored.
+func Avg(buckets []Bucket) float64 {
+	buckets = Normalize(buckets)
+	lePrev := float64(0)
+	vPrev := float64(0)
+	sum := float64(0)
+	weightTotal := float64(0)
+	for _, b := range buckets {
+		if math.IsInf(b.Le, 0) {
+			continue
+		}
+		n := (b.Le + lePrev) / 2
+		weight := b.Count - vPrev
+		sum += n * weight
+		weightTotal += weight
+		lePrev = b.Le
+		vPrev = b.Count
+	}
+	if weightTotal == 0 {
+		return nan
+	}
+	return sum / weightTotal
+}
+
+// Stddev returns the standard deviation over observations like histogram_stddev() does.
+//
+// Observations are assumed to be located in the middle of buckets. The +Inf bucket is ignored.
+func Stddev(buckets []Bucket) float64 {
+	buckets = Normalize(buckets)
+	lePrev := float64(0)
+	vPrev := float64(0)
+	sum := float64(0)
+	sum2 := float64(0)
+	weightTotal := float64(0)
+	for _, b := range buckets {
+		if math.IsInf(b.Le, 0) {
+			continue
+		}
+		n := (b.Le + lePrev) / 2
+		weight := b.Count - vPrev
+		sum += n * weight
+		sum2 += n * n * weight
+		weightTotal += weight
+		lePrev = b.Le
+		vPrev = b.Count
+	}
+	if weightTotal == 0 {
+		return nan
+	}
+	avg := sum / weightTotal
+	avg2 := sum2 / weightTotal
+	stdvar := avg2 - avg*avg
+	if stdvar < 0 {
+		// Correct possible calculation error.
+		stdvar = 0
+	}
+	return math.Sqrt(stdvar)
+}
+
+// Limit returns up to limit buckets like buckets_limit() does.
+//
+// Adjacent buckets with the smallest number of observations are merged until the limit is reached.
+// The first and the last buckets are always preserved for better accuracy for min and max values,
+// so at least 3 buckets are returned if buckets contain 3 or more items. nil is returned if limit isn't positive.
+func Limit(limit int, buckets []Bucket) []Bucket {
+	if limit <= 0 {
+		return nil
+	}
+	if limit < 3 {
+		// Preserve the first and the last bucket for better accuracy for min and max values.
+		limit = 3
+	}
+	buckets = Normalize(buckets)
+	if len(buckets) <= limit {
+		return buckets
+	}
+	hits := make([]float64, len(buckets))
+	countPrev := float64(0)
+	for i, b := range buckets {
+		hits[i] = b.Count - countPrev
+		countPrev = b.Count
+	}
+	for len(buckets) > limit {
+		minIdx := 1
+		minMergeHits := hits[1] + hits[2]
+		for i := 1; i < len(buckets)-2; i++ {
+			if mergeHits := hits[i] + hits[i+1]; mergeHits < minMergeHits {
+				minIdx = i
+				minMergeHits = mergeHits
+			}
+		}
+		// Merge the bucket at minIdx into the next bucket.
+		hits[minIdx+1] += hits[minIdx]
+		hits = append(hits[:minIdx], hits[minIdx+1:]...)
+		buckets = append(buckets[:minIdx], buckets[minIdx+1:]...)
+	}
+	return buckets
+}
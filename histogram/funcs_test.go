@@ -0,0 +1,141 @@
+package histogram
+
+import (
+	"math"
+	"testing"
+)
+
+var testBuckets = []Bucket{{0.1, 10}, {0.5, 30}, {1, 40}, {inf, 50}}
+
+func isEqualValue(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	if a == b {
+		return true
+	}
+	return math.Abs(a-b) <= 1e-12*math.Max(1, math.Abs(b))
+}
+
+func TestQuantileWithBounds(t *testing.T) {
+	f := func(phi float64, buckets []Bucket, qExpected, lowerExpected, upperExpected float64) {
+		t.Helper()
+		q, lower, upper := QuantileWithBounds(phi, buckets)
+		if !isEqualValue(q, qExpected) || !isEqualValue(lower, lowerExpected) || !isEqualValue(upper, upperExpected) {
+			t.Fatalf("unexpected result for phi=%v over %s; got %v [%v...%v]; want %v [%v...%v]",
+				phi, formatBuckets(buckets), q, lower, upper, qExpected, lowerExpected, upperExpected)
+		}
+		if q := Quantile(phi, buckets); !isEqualValue(q, qExpected) {
+			t.Fatalf("unexpected Quantile result for phi=%v over %s; got %v; want %v", phi, formatBuckets(buckets), q, qExpected)
+		}
+	}
+	f(0.5, testBuckets, 0.4, 0.1, 0.5)
+	f(0, testBuckets, 0, 0, 0.1)
+	f(0.1, testBuckets, 0.05, 0, 0.1)
+	f(0.8, testBuckets, 1, 0.5, 1)
+
+	// the quantile falls into +Inf bucket
+	f(0.9, testBuckets, 1, 1, inf)
+	f(1, testBuckets, 1, 1, inf)
+
+	// phi outside [0...1]
+	f(-1, testBuckets, math.Inf(-1), math.Inf(-1), 10)
+	f(2, testBuckets, inf, 50, inf)
+	f(nan, testBuckets, nan, nan, nan)
+
+	// empty buckets
+	f(0.5, nil, nan, nan, nan)
+	f(0.5, []Bucket{{0.1, 0}, {inf, 0}}, nan, nan, nan)
+
+	// broken buckets
+	f(0.5, []Bucket{{1, 40}, {0.1, 10}, {inf, 50}, {0.5, 45}}, 0.3, 0.1, 0.5)
+
+	// leading empty buckets
+	f(0.5, []Bucket{{0.1, 0}, {0.5, 0}, {1, 10}, {inf, 10}}, 0.75, 0.5, 1)
+}
+
+func TestQuantiles(t *testing.T) {
+	result := Quantiles([]float64{0.1, 0.5, 0.9}, testBuckets)
+	resultExpected := []float64{0.05, 0.4, 1}
+	for i := range result {
+		if !isEqualValue(result[i], resultExpected[i]) {
+			t.Fatalf("unexpected result; got %v; want %v", result, resultExpected)
+		}
+	}
+}
+
+func TestShareWithBounds(t *testing.T) {
+	f := func(le float64, buckets []Bucket, qExpected, lowerExpected, upperExpected float64) {
+		t.Helper()
+		q, lower, upper := ShareWithBounds(le, buckets)
+		if !isEqualValue(q, qExpected) || !isEqualValue(lower, lowerExpected) || !isEqualValue(upper, upperExpected) {
+			t.Fatalf("unexpected result for le=%v over %s; got %v [%v...%v]; want %v [%v...%v]",
+				le, formatBuckets(buckets), q, lower, upper, qExpected, lowerExpected, upperExpected)
+		}
+		if q := Share(le, buckets); !isEqualValue(q, qExpected) {
+			t.Fatalf("unexpected Share result for le=%v over %s; got %v; want %v", le, formatBuckets(buckets), q, qExpected)
+		}
+	}
+	f(0.5, testBuckets, 0.6, 0.6, 0.6)
+	f(0.75, testBuckets, 0.7, 0.6, 0.8)
+	f(0.05, testBuckets, 0.1, 0, 0.2)
+	f(2, testBuckets, 0.8, 0.8, 1)
+	f(-1, testBuckets, 0, 0, 0)
+	f(inf, testBuckets, 1, 1, 1)
+	f(nan, testBuckets, nan, nan, nan)
+	f(0.5, nil, nan, nan, nan)
+
+	// le exceeds all the buckets
+	f(2, []Bucket{{0.1, 10}, {1, 20}}, 1, 1, 1)
+}
+
+func TestFraction(t *testing.T) {
+	f := func(lower, upper, resultExpected float64) {
+		t.Helper()
+		result := Fraction(lower, upper, testBuckets)
+		if !isEqualValue(result, resultExpected) {
+			t.Fatalf("unexpected fraction for (%v...%v]; got %v; want %v", lower, upper, result, resultExpected)
+		}
+	}
+	f(0.1, 0.75, 0.5)
+	f(math.Inf(-1), 0.5, 0.6)
+	f(0.5, inf, 0.4)
+	f(0.5, 0.5, 0)
+}
+
+func TestAvgStddev(t *testing.T) {
+	f := func(buckets []Bucket, avgExpected, stddevExpected float64) {
+		t.Helper()
+		if avg := Avg(buckets); !isEqualValue(avg, avgExpected) {
+			t.Fatalf("unexpected avg for %s; got %v; want %v", formatBuckets(buckets), avg, avgExpected)
+		}
+		if stddev := Stddev(buckets); !isEqualValue(stddev, stddevExpected) {
+			t.Fatalf("unexpected stddev for %s; got %v; want %v", formatBuckets(buckets), stddev, stddevExpected)
+		}
+	}
+	f(testBuckets, 0.35, math.Sqrt(0.06375))
+	f([]Bucket{{1, 10}, {inf, 10}}, 0.5, 0)
+	f(nil, nan, nan)
+	f([]Bucket{{inf, 10}}, nan, nan)
+}
+
+func TestLimit(t *testing.T) {
+	f := func(limit int, buckets []Bucket, resultExpected string) {
+		t.Helper()
+		result := formatBuckets(Limit(limit, buckets))
+		if result != resultExpected {
+			t.Fatalf("unexpected result for limit=%d\ngot\n%s\nwant\n%s", limit, result, resultExpected)
+		}
+	}
+	f(0, testBuckets, "")
+	f(10, testBuckets, "0.1:10 0.5:30 1:40 +Inf:50 ")
+	f(4, testBuckets, "0.1:10 0.5:30 1:40 +Inf:50 ")
+	f(3, testBuckets, "0.1:10 1:40 +Inf:50 ")
+
+	// the first and the last buckets are preserved
+	f(1, testBuckets, "0.1:10 1:40 +Inf:50 ")
+
+	// buckets with the smallest number of hits are merged
+	buckets := []Bucket{{1, 5}, {2, 6}, {3, 20}, {4, 21}, {5, 40}, {inf, 41}}
+	f(4, buckets, "1:5 4:21 5:40 +Inf:41 ")
+}
@@ -0,0 +1,226 @@
+// Package histogram implements MetricsQL histogram functions over bucket sets.
+//
+// Prometheus-style histograms consist of cumulative buckets with `le` label, which are represented by Bucket.
+// VictoriaMetrics histograms consist of non-cumulative buckets with `vmrange` label, which are represented by VMRangeBucket.
+// VMRange buckets can be converted to `le` buckets via VMRangeToLE in the same way as prometheus_buckets() does.
+//
+// All the functions accept buckets for a single point of a single histogram, e.g. values for distinct `le` labels
+// of series with otherwise identical labels at the given timestamp. The results are identical to VictoriaMetrics.
+package histogram
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var nan = math.NaN()
+
+// Bucket is a cumulative histogram bucket.
+type Bucket struct {
+	// Le is the upper bound of the bucket. It may be +Inf.
+	Le float64
+
+	// Count is the number of observations smaller or equal to Le.
+	Count float64
+}
+
+// VMRangeBucket is a non-cumulative VictoriaMetrics histogram bucket.
+type VMRangeBucket struct {
+	// Start is the exclusive lower bound of the bucket.
+	Start float64
+
+	// End is the inclusive upper bound of the bucket.
+	End float64
+
+	// Count is the number of observations on the (Start ... End] range.
+	Count float64
+}
+
+// ParseLE parses `le` label value such as `0.5` or `+Inf`.
+func ParseLE(s string) (float64, error) {
+	le, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse le=%q: %w", s, err)
+	}
+	if math.IsNaN(le) {
+		return 0, fmt.Errorf("le cannot be NaN")
+	}
+	return le, nil
+}
+
+// ParseVMRange parses `vmrange` label value such as `1.000e+00...1.136e+00`.
+//
+// It returns the start and the end of the range.
+func ParseVMRange(s string) (float64, float64, error) {
+	startStr, endStr, ok := strings.Cut(s, "...")
+	if !ok {
+		return 0, 0, fmt.Errorf("missing `...` in vmrange=%q", s)
+	}
+	start, err := strconv.ParseFloat(startStr, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot parse start of vmrange=%q: %w", s, err)
+	}
+	end, err := strconv.ParseFloat(endStr, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot parse end of vmrange=%q: %w", s, err)
+	}
+	if math.IsNaN(start) || math.IsNaN(end) || start > end {
+		return 0, 0, fmt.Errorf("invalid vmrange=%q; start must be smaller or equal to end", s)
+	}
+	return start, end, nil
+}
+
+// FormatVMRange returns `vmrange` label value for the given range in the same format as VictoriaMetrics uses.
+func FormatVMRange(start, end float64) string {
+	return fmt.Sprintf("%s...%s", formatVMRangeBound(start), formatVMRangeBound(end))
+}
+
+func formatVMRangeBound(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	if math.IsInf(v, -1) {
+		return "-Inf"
+	}
+	return fmt.Sprintf("%.3e", v)
+}
+
+// Normalize returns a copy of buckets prepared for histogram functions.
+//
+// The buckets are sorted by Le, buckets with identical Le are merged and counts are fixed to be monotonically
+// non-decreasing by substituting NaN or too big counts with the count of the next bucket.
+func Normalize(buckets []Bucket) []Bucket {
+	dst := append([]Bucket{}, buckets...)
+	sort.SliceStable(dst, func(i, j int) bool {
+		return dst[i].Le < dst[j].Le
+	})
+	dst = mergeSameLE(dst)
+	fixBrokenBuckets(dst)
+	return dst
+}
+
+// mergeSameLE merges buckets with identical Le values in the sorted buckets.
+func mergeSameLE(buckets []Bucket) []Bucket {
+	if len(buckets) == 0 {
+		return buckets
+	}
+	dst := buckets[:1]
+	for _, b := range buckets[1:] {
+		last := &dst[len(dst)-1]
+		if b.Le != last.Le {
+			dst = append(dst, b)
+			continue
+		}
+		last.Count += b.Count
+	}
+	return dst
+}
+
+// fixBrokenBuckets makes counts in the sorted buckets monotonically non-decreasing.
+//
+// The next bucket includes all the previous buckets, so its count cannot be smaller than the count for the previous bucket.
+// Lower bucket counts are substituted with upper bucket counts if the lower counts are NaN or bigger than the upper counts.
+func fixBrokenBuckets(buckets []Bucket) {
+	if len(buckets) < 2 {
+		return
+	}
+	vNext := buckets[len(buckets)-1].Count
+	for i := len(buckets) - 2; i >= 0; i-- {
+		v := buckets[i].Count
+		if math.IsNaN(v) || v > vNext {
+			buckets[i].Count = vNext
+		} else {
+			vNext = v
+		}
+	}
+}
+
+// VMRangeToLE converts VictoriaMetrics buckets to cumulative buckets in the same way as prometheus_buckets() does.
+//
+// Gaps between vmrange buckets are filled with empty buckets and the +Inf bucket is added if it is missing.
+// Buckets with zero, negative or NaN counts are skipped.
+func VMRangeToLE(buckets []VMRangeBucket) []Bucket {
+	bs := append([]VMRangeBucket{}, buckets...)
+	sort.SliceStable(bs, func(i, j int) bool {
+		return bs[i].End < bs[j].End
+	})
+	var dst []Bucket
+	uniq := make(map[float64]int)
+	addBucket := func(le, count float64) {
+		if idx, ok := uniq[le]; ok {
+			dst[idx].Count += count
+			return
+		}
+		uniq[le] = len(dst)
+		dst = append(dst, Bucket{
+			Le:    le,
+			Count: count,
+		})
+	}
+	prevEnd := float64(0)
+	isLastZero := true
+	for _, b := range bs {
+		if isZeroCount(b.Count) {
+			// Skip empty buckets. They are substituted by the gap-filling buckets below.
+			prevEnd = b.End
+			isLastZero = true
+			continue
+		}
+		if b.Start != prevEnd {
+			// There is a gap between the previous bucket and the current bucket
+			// or the previous bucket was skipped because it was empty.
+			addBucket(b.Start, 0)
+		}
+		addBucket(b.End, b.Count)
+		prevEnd = b.End
+		isLastZero = false
+	}
+	if len(dst) > 0 && !isLastZero && !math.IsInf(prevEnd, 1) {
+		addBucket(math.Inf(1), 0)
+	}
+	sort.SliceStable(dst, func(i, j int) bool {
+		return dst[i].Le < dst[j].Le
+	})
+	count := float64(0)
+	for i := range dst {
+		count += dst[i].Count
+		dst[i].Count = count
+	}
+	return dst
+}
+
+func isZeroCount(v float64) bool {
+	return math.IsNaN(v) || v <= 0
+}
+
+// LEToVMRange converts cumulative buckets to VictoriaMetrics buckets.
+//
+// The first bucket starts at 0 if its Le is positive. Otherwise it starts at -Inf.
+// Empty buckets are skipped, since VictoriaMetrics doesn't store them.
+func LEToVMRange(buckets []Bucket) []VMRangeBucket {
+	buckets = Normalize(buckets)
+	var dst []VMRangeBucket
+	start := math.Inf(-1)
+	if len(buckets) > 0 && buckets[0].Le > 0 {
+		start = 0
+	}
+	countPrev := float64(0)
+	for _, b := range buckets {
+		count := b.Count - countPrev
+		if count > 0 {
+			dst = append(dst, VMRangeBucket{
+				Start: start,
+				End:   b.Le,
+				Count: count,
+			})
+		}
+		if !math.IsNaN(b.Count) {
+			countPrev = b.Count
+		}
+		start = b.Le
+	}
+	return dst
+}
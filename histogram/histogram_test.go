@@ -0,0 +1,165 @@
+package histogram
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+var inf = math.Inf(1)
+
+func formatBuckets(buckets []Bucket) string {
+	var s string
+	for _, b := range buckets {
+		s += fmt.Sprintf("%g:%g ", b.Le, b.Count)
+	}
+	return s
+}
+
+func formatVMRangeBuckets(buckets []VMRangeBucket) string {
+	var s string
+	for _, b := range buckets {
+		s += fmt.Sprintf("%s:%g ", FormatVMRange(b.Start, b.End), b.Count)
+	}
+	return s
+}
+
+func TestParseLESuccess(t *testing.T) {
+	f := func(s string, leExpected float64) {
+		t.Helper()
+		le, err := ParseLE(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", s, err)
+		}
+		if le != leExpected {
+			t.Fatalf("unexpected le for %q; got %v; want %v", s, le, leExpected)
+		}
+	}
+	f("0", 0)
+	f("0.5", 0.5)
+	f("1e3", 1000)
+	f("+Inf", inf)
+	f("-Inf", math.Inf(-1))
+}
+
+func TestParseLEFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		if le, err := ParseLE(s); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q; got %v", s, le)
+		}
+	}
+	f("")
+	f("foo")
+	f("NaN")
+}
+
+func TestParseVMRangeSuccess(t *testing.T) {
+	f := func(s string, startExpected, endExpected float64) {
+		t.Helper()
+		start, end, err := ParseVMRange(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", s, err)
+		}
+		if start != startExpected || end != endExpected {
+			t.Fatalf("unexpected range for %q; got %v...%v; want %v...%v", s, start, end, startExpected, endExpected)
+		}
+		if x := FormatVMRange(start, end); x != s {
+			t.Fatalf("unexpected FormatVMRange result; got %q; want %q", x, s)
+		}
+	}
+	f("1.000e+00...1.136e+00", 1, 1.136)
+	f("0.000e+00...1.000e-09", 0, 1e-9)
+	f("1.000e+18...+Inf", 1e18, inf)
+}
+
+func TestParseVMRangeFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		if start, end, err := ParseVMRange(s); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q; got %v...%v", s, start, end)
+		}
+	}
+	f("")
+	f("1.000e+00")
+	f("foo...1")
+	f("1...bar")
+	f("2...1")
+	f("NaN...1")
+}
+
+func TestNormalize(t *testing.T) {
+	f := func(buckets []Bucket, resultExpected string) {
+		t.Helper()
+		bucketsOrig := formatBuckets(buckets)
+		result := formatBuckets(Normalize(buckets))
+		if result != resultExpected {
+			t.Fatalf("unexpected result\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+		if s := formatBuckets(buckets); s != bucketsOrig {
+			t.Fatalf("buckets must not be modified; got %s; want %s", s, bucketsOrig)
+		}
+	}
+	f(nil, "")
+
+	// unsorted buckets
+	f([]Bucket{{inf, 50}, {0.1, 10}, {1, 40}, {0.5, 30}}, "0.1:10 0.5:30 1:40 +Inf:50 ")
+
+	// non-monotonic buckets
+	f([]Bucket{{0.1, 10}, {0.5, 45}, {1, 40}, {inf, 50}}, "0.1:10 0.5:40 1:40 +Inf:50 ")
+
+	// NaN buckets
+	f([]Bucket{{0.1, nan}, {0.5, 30}, {inf, 50}}, "0.1:30 0.5:30 +Inf:50 ")
+
+	// buckets with identical le
+	f([]Bucket{{0.5, 10}, {0.5, 20}, {inf, 30}}, "0.5:30 +Inf:30 ")
+}
+
+func TestVMRangeToLE(t *testing.T) {
+	f := func(buckets []VMRangeBucket, resultExpected string) {
+		t.Helper()
+		result := formatBuckets(VMRangeToLE(buckets))
+		if result != resultExpected {
+			t.Fatalf("unexpected result\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+	f(nil, "")
+	f([]VMRangeBucket{{1, 2, 0}}, "")
+	f([]VMRangeBucket{{1, 2, 4}, {0.5, 1, 3}}, "0.5:0 1:3 2:7 +Inf:7 ")
+
+	// the first bucket starts at zero
+	f([]VMRangeBucket{{0, 1, 3}, {1, 2, 4}}, "1:3 2:7 +Inf:7 ")
+
+	// gaps between buckets
+	f([]VMRangeBucket{{1, 2, 1}, {5, 10, 2}}, "1:0 2:1 5:1 10:3 +Inf:3 ")
+
+	// empty buckets
+	f([]VMRangeBucket{{1, 2, 5}, {2, 3, 0}, {3, 4, 2}, {4, 5, nan}}, "1:0 2:5 4:7 ")
+
+	// the last bucket ends with +Inf
+	f([]VMRangeBucket{{1, 2, 5}, {2, inf, 1}}, "1:0 2:5 +Inf:6 ")
+}
+
+func TestLEToVMRange(t *testing.T) {
+	f := func(buckets []Bucket, resultExpected string) {
+		t.Helper()
+		result := formatVMRangeBuckets(LEToVMRange(buckets))
+		if result != resultExpected {
+			t.Fatalf("unexpected result\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+	f(nil, "")
+	f([]Bucket{{0.1, 10}, {0.5, 30}, {1, 40}, {inf, 50}},
+		"0.000e+00...1.000e-01:10 1.000e-01...5.000e-01:20 5.000e-01...1.000e+00:10 1.000e+00...+Inf:10 ")
+
+	// empty buckets are skipped
+	f([]Bucket{{-1, 2}, {0.5, 2}, {1, 5}}, "-Inf...-1.000e+00:2 5.000e-01...1.000e+00:3 ")
+
+	// conversion back to le buckets
+	buckets := []Bucket{{0.1, 10}, {0.5, 30}, {1, 40}, {inf, 50}}
+	result := formatBuckets(VMRangeToLE(LEToVMRange(buckets)))
+	resultExpected := "0.1:10 0.5:30 1:40 +Inf:50 "
+	if result != resultExpected {
+		t.Fatalf("unexpected result\ngot\n%s\nwant\n%s", result, resultExpected)
+	}
+}
@@ -21,8 +21,25 @@ type lexer struct {
 	sTail string
 
 	err error
+
+	// mode defines the allowed placeholders such as `$name` params.
+	mode parseMode
 }
 
+// parseMode defines placeholders, which are accepted by the parser.
+type parseMode int
+
+const (
+	// parseModeDefault accepts only `$__interval` and `$__rate_interval`, which are substituted with `1i`. See Parse.
+	parseModeDefault parseMode = iota
+
+	// parseModeParams additionally accepts `$name` and `${name}` params. See ParseWithParams.
+	parseModeParams
+
+	// parseModeGrafana accepts Grafana variables, which are kept as placeholders. See ParseGrafana.
+	parseModeGrafana
+)
+
 func (lex *lexer) Context() string {
 	return fmt.Sprintf("%s%s", lex.Token, lex.sTail)
 }
@@ -111,6 +128,16 @@ again:
 		token = s[:n]
 		goto tokenFoundLabel
 	}
+	// Grafana variables must be checked before durations, since scanDuration accepts `$__interval`.
+	if lex.mode == parseModeGrafana {
+		if n, name := scanParam(s); n > 0 {
+			if err := checkGrafanaVarName(name); err != nil {
+				return "", err
+			}
+			lex.sTail = s[n:]
+			return "${" + name + "}", nil
+		}
+	}
 	if n := scanDuration(s); n > 0 {
 		token = s[:n]
 		goto tokenFoundLabel
@@ -130,6 +157,18 @@ again:
 		lex.sTail = s[len("$__rate_interval"):]
 		return "$__interval", nil
 	}
+	if lex.mode == parseModeParams {
+		if n, name := scanParam(s); n > 0 {
+			if strings.HasPrefix(name, "__") {
+				return "", fmt.Errorf("param names starting with `__` are reserved; got %q", s[:n])
+			}
+			if strings.Contains(name, ":") {
+				return "", fmt.Errorf("param formats are supported only by ParseGrafana; got %q", s[:n])
+			}
+			lex.sTail = s[n:]
+			return "${" + name + "}", nil
+		}
+	}
 	return "", fmt.Errorf("cannot recognize %q", s)
 
 tokenFoundLabel:
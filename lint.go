@@ -0,0 +1,277 @@
+package metricsql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Warning represents a problem found in MetricsQL expression, which doesn't prevent from executing it,
+// but which may lead to unexpected results.
+type Warning struct {
+	// Kind is the kind of the warning.
+	Kind WarningKind
+
+	// Expr is the expression the warning relates to.
+	Expr Expr
+
+	// Msg is human-readable description of the problem.
+	Msg string
+}
+
+// String returns string representation of w.
+func (w *Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Expr.AppendString(nil), w.Msg)
+}
+
+// WarningKind is the kind of Warning.
+type WarningKind int
+
+const (
+	// WarningKindMetricType is set for functions, which are inappropriate for the type of the metric passed to them.
+	WarningKindMetricType WarningKind = iota
+
+	// WarningKindPrometheusDivergence is set for functions, which have different semantics in MetricsQL and PromQL.
+	WarningKindPrometheusDivergence
+
+	// WarningKindAlias is set for functions, which are aliases for other functions or expressions.
+	WarningKindAlias
+
+	// WarningKindDeprecated is set for functions, which are scheduled for removal.
+	WarningKindDeprecated
+)
+
+// String returns string representation of wk.
+func (wk WarningKind) String() string {
+	switch wk {
+	case WarningKindMetricType:
+		return "metric_type"
+	case WarningKindPrometheusDivergence:
+		return "prometheus_divergence"
+	case WarningKindAlias:
+		return "alias"
+	case WarningKindDeprecated:
+		return "deprecated"
+	default:
+		return fmt.Sprintf("WarningKind(%d)", int(wk))
+	}
+}
+
+// ParseWithWarnings parses MetricsQL query s in the same way as Parse does
+// and returns warnings for the parsed expression obtained via CheckFunctions.
+func ParseWithWarnings(s string) (Expr, []Warning, error) {
+	e, err := Parse(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e, CheckFunctions(e), nil
+}
+
+// Lint returns all the warnings for e.
+//
+// It returns warnings from CheckFunctions and from CheckMetricTypes if md isn't nil.
+func Lint(e Expr, md MetricsMetadata) []Warning {
+	ws := CheckFunctions(e)
+	if md != nil {
+		ws = append(ws, CheckMetricTypes(e, md)...)
+	}
+	return ws
+}
+
+// CheckFunctions returns warnings for functions in e, which are deprecated, which are aliases for other functions
+// or which have different semantics in MetricsQL and PromQL.
+func CheckFunctions(e Expr) []Warning {
+	var ws []Warning
+	VisitAll(e, func(expr Expr) {
+		var funcName string
+		switch t := expr.(type) {
+		case *FuncExpr:
+			funcName = t.Name
+		case *AggrFuncExpr:
+			funcName = t.Name
+		default:
+			return
+		}
+		funcName = strings.ToLower(funcName)
+		if msg, ok := deprecatedFuncs[funcName]; ok {
+			ws = append(ws, Warning{
+				Kind: WarningKindDeprecated,
+				Expr: expr,
+				Msg:  fmt.Sprintf("%s() is deprecated: %s", funcName, msg),
+			})
+		}
+		if msg, ok := aliasFuncs[funcName]; ok {
+			ws = append(ws, Warning{
+				Kind: WarningKindAlias,
+				Expr: expr,
+				Msg:  fmt.Sprintf("%s() is an alias: %s", funcName, msg),
+			})
+		}
+		if msg, ok := prometheusDivergentFuncs[funcName]; ok {
+			ws = append(ws, Warning{
+				Kind: WarningKindPrometheusDivergence,
+				Expr: expr,
+				Msg:  fmt.Sprintf("%s() differs from PromQL: %s", funcName, msg),
+			})
+		}
+	})
+	return ws
+}
+
+// prometheusDivergentFuncs contains functions, which have different semantics in MetricsQL and in PromQL,
+// together with the explanation of the difference.
+var prometheusDivergentFuncs = map[string]string{
+	"changes": "it takes into account the change between the last sample before the lookbehind window and the first sample on the window; " +
+		"use changes_prometheus() for Prometheus-compatible results",
+	"delta": "it takes into account the last sample before the lookbehind window and doesn't extrapolate the result to window bounds; " +
+		"use delta_prometheus() for Prometheus-compatible results",
+	"holt_winters": "Prometheus 3 renamed this function to double_exponential_smoothing() and requires a feature flag for it",
+	"increase": "it takes into account the last sample before the lookbehind window and doesn't extrapolate the result to window bounds, " +
+		"so it returns integer results for integer counters; use increase_prometheus() for Prometheus-compatible results",
+	"rate": "it takes into account the last sample before the lookbehind window and doesn't extrapolate the result to window bounds; " +
+		"use rate_prometheus() for Prometheus-compatible results",
+	"timestamp": "it is a rollup function, which returns the timestamp of the last raw sample on the lookbehind window, " +
+		"so timestamp(f(m)) is implicitly converted to timestamp(f(m)[1i:1i]) for non-selector args",
+}
+
+// aliasFuncs contains functions, which are aliases for other functions or expressions,
+// together with the equivalent expression.
+var aliasFuncs = map[string]string{
+	"median":              "median(q) is equivalent to quantile(0.5, q)",
+	"median_over_time":    "median_over_time(m[d]) is equivalent to quantile_over_time(0.5, m[d])",
+	"share_eq_over_time":  "share_eq_over_time(m[d], eq) is equivalent to count_eq_over_time(m[d], eq) / count_over_time(m[d])",
+	"share_gt_over_time":  "share_gt_over_time(m[d], gt) is equivalent to count_gt_over_time(m[d], gt) / count_over_time(m[d])",
+	"share_le_over_time":  "share_le_over_time(m[d], le) is equivalent to count_le_over_time(m[d], le) / count_over_time(m[d])",
+	"sum2":                "sum2(q) is equivalent to sum(q ^ 2)",
+	"timestamp_with_name": "timestamp_with_name(m[d]) is equivalent to timestamp(m[d]) keep_metric_names",
+	"tlast_over_time":     "tlast_over_time(m[d]) is equivalent to timestamp(m[d])",
+}
+
+// deprecatedFuncs contains functions scheduled for removal, together with the recommended replacement.
+//
+// There are no such functions at the moment.
+var deprecatedFuncs = map[string]string{}
+
+// CheckMetricTypes returns warnings for rollup functions in e, which are inappropriate
+// for the type of the metric passed to them according to md.
+//
+// For example, `rate(temperature)` is reported if temperature is a gauge, while `avg_over_time(requests_total[5m])`
+// is reported if requests_total is a counter.
+//
+// The metric is looked up through `label_*` functions, which preserve series identity.
+// Metrics with unknown types and series selectors without a single metric name are skipped.
+func CheckMetricTypes(e Expr, md MetricsMetadata) []Warning {
+	var ws []Warning
+	VisitAll(e, func(expr Expr) {
+		fe, ok := expr.(*FuncExpr)
+		if !ok {
+			return
+		}
+		idx := GetRollupArgIdx(fe)
+		if idx < 0 || idx >= len(fe.Args) {
+			return
+		}
+		metricName := getRollupArgMetricName(fe.Args[idx])
+		if metricName == "" {
+			return
+		}
+		funcName := strings.ToLower(fe.Name)
+		mt := md.GetMetricType(metricName)
+		switch mt {
+		case MetricTypeCounter:
+			if gaugeRollupFuncs[funcName] {
+				ws = append(ws, Warning{
+					Kind: WarningKindMetricType,
+					Expr: fe,
+					Msg:  fmt.Sprintf("%s() is applied to counter %q; %s() is intended for gauges; consider using rate() or increase() instead", funcName, metricName, funcName),
+				})
+			}
+		case MetricTypeGauge, MetricTypeSummary:
+			if counterRollupFuncs[funcName] {
+				ws = append(ws, Warning{
+					Kind: WarningKindMetricType,
+					Expr: fe,
+					Msg:  fmt.Sprintf("%s() is applied to %s %q; %s() is intended for counters; consider using deriv() or delta() instead", funcName, mt, metricName, funcName),
+				})
+			}
+		case MetricTypeHistogram:
+			ws = append(ws, Warning{
+				Kind: WarningKindMetricType,
+				Expr: fe,
+				Msg:  fmt.Sprintf("%s() is applied to histogram %q, which has no series with this name; use %s_bucket, %s_sum or %s_count instead", funcName, metricName, metricName, metricName, metricName),
+			})
+		}
+	})
+	return ws
+}
+
+// getRollupArgMetricName returns metric name for the series passed to rollup function via arg.
+//
+// An empty string is returned if the metric name cannot be determined.
+func getRollupArgMetricName(arg Expr) string {
+	switch t := arg.(type) {
+	case *MetricExpr:
+		return t.getMetricName()
+	case *RollupExpr:
+		return getRollupArgMetricName(t.Expr)
+	case *FuncExpr:
+		if !isSeriesPreservingLabelFunc(t.Name) || len(t.Args) == 0 {
+			return ""
+		}
+		return getRollupArgMetricName(t.Args[0])
+	default:
+		return ""
+	}
+}
+
+// isSeriesPreservingLabelFunc returns true if funcName modifies labels for input series without changing their values.
+func isSeriesPreservingLabelFunc(funcName string) bool {
+	switch strings.ToLower(funcName) {
+	case "label_copy", "label_del", "label_graphite_group", "label_join", "label_keep", "label_lowercase",
+		"label_map", "label_match", "label_mismatch", "label_move", "label_replace", "label_set",
+		"label_transform", "label_uppercase", "labels_equal":
+		return true
+	default:
+		return false
+	}
+}
+
+// counterRollupFuncs contains rollup functions, which make sense only for counters.
+var counterRollupFuncs = map[string]bool{
+	"increase":            true,
+	"increase_prometheus": true,
+	"increase_pure":       true,
+	"irate":               true,
+	"rate":                true,
+	"rate_prometheus":     true,
+	"resets":              true,
+	"rollup_increase":     true,
+	"rollup_rate":         true,
+}
+
+// gaugeRollupFuncs contains rollup functions, which make sense only for gauges.
+var gaugeRollupFuncs = map[string]bool{
+	"avg_over_time":       true,
+	"delta":               true,
+	"delta_prometheus":    true,
+	"deriv":               true,
+	"deriv_fast":          true,
+	"geomean_over_time":   true,
+	"histogram_over_time": true,
+	"holt_winters":        true,
+	"idelta":              true,
+	"ideriv":              true,
+	"integrate":           true,
+	"mad_over_time":       true,
+	"median_over_time":    true,
+	"predict_linear":      true,
+	"quantile_over_time":  true,
+	"quantiles_over_time": true,
+	"rate_over_sum":       true,
+	"rollup_delta":        true,
+	"rollup_deriv":        true,
+	"stddev_over_time":    true,
+	"stdvar_over_time":    true,
+	"sum2_over_time":      true,
+	"sum_over_time":       true,
+	"zscore_over_time":    true,
+}
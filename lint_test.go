@@ -0,0 +1,198 @@
+package metricsql
+
+import (
+	"testing"
+)
+
+func TestCheckMetricTypes(t *testing.T) {
+	md := MetricsMetadata{
+		"requests_total": MetricTypeCounter,
+		"temperature":    MetricTypeGauge,
+		"latency":        MetricTypeHistogram,
+		"duration":       MetricTypeSummary,
+	}
+	f := func(q string, warningsExpected []string) {
+		t.Helper()
+		e, err := Parse(q)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", q, err)
+		}
+		ws := CheckMetricTypes(e, md)
+		if len(ws) != len(warningsExpected) {
+			t.Fatalf("unexpected number of warnings for %q; got %d; want %d; warnings: %v", q, len(ws), len(warningsExpected), ws)
+		}
+		for i, w := range ws {
+			s := string(w.Expr.AppendString(nil))
+			if s != warningsExpected[i] {
+				t.Fatalf("unexpected expression for warning #%d in %q; got %s; want %s", i, q, s, warningsExpected[i])
+			}
+		}
+	}
+
+	// valid usage
+	f(`requests_total`, nil)
+	f(`rate(requests_total[5m])`, nil)
+	f(`sum(increase(requests_total)) by (job)`, nil)
+	f(`avg_over_time(temperature[1h])`, nil)
+	f(`deriv(temperature[1h])`, nil)
+	f(`rate(latency_bucket[5m])`, nil)
+	f(`rate(duration_count[5m])`, nil)
+	f(`max_over_time(duration[5m])`, nil)
+	f(`count_over_time(requests_total[5m]) + count_over_time(temperature[5m])`, nil)
+	f(`quantile_over_time(0.9, temperature[5m])`, nil)
+
+	// unknown metrics
+	f(`rate(unknown[5m])`, nil)
+	f(`rate({__name__=~"temperature"}[5m])`, nil)
+	f(`rate({__name__="temperature" or __name__="requests_total"}[5m])`, nil)
+
+	// non-series-preserving functions
+	f(`rate(abs(temperature))`, nil)
+	f(`rate(sum(temperature)[5m:])`, nil)
+
+	// invalid usage
+	f(`rate(temperature[5m])`, []string{`rate(temperature[5m])`})
+	f(`irate(temperature{job="foo"}[5m] offset 1h)`, []string{`irate(temperature{job="foo"}[5m] offset 1h)`})
+	f(`increase(duration[5m])`, []string{`increase(duration[5m])`})
+	f(`avg_over_time(requests_total[5m])`, []string{`avg_over_time(requests_total[5m])`})
+	f(`quantile_over_time(0.9, latency_bucket[5m])`, []string{`quantile_over_time(0.9, latency_bucket[5m])`})
+	f(`rate(latency[5m])`, []string{`rate(latency[5m])`})
+	f(`sum(rate(temperature)) / sum(delta(requests_total[1h]))`, []string{`rate(temperature)`, `delta(requests_total[1h])`})
+
+	// subqueries and label_* functions preserving series identity
+	f(`rate(temperature[5m:1m])`, []string{`rate(temperature[5m:1m])`})
+	f(`rate(label_set(temperature, "foo", "bar")[5m:])`, []string{`rate(label_set(temperature, "foo", "bar")[5m:])`})
+	f(`deriv(label_replace(label_del(requests_total, "x"), "a", "$1", "b", "(.+)"))`, []string{`deriv(label_replace(label_del(requests_total, "x"), "a", "$1", "b", "(.+)"))`})
+}
+
+func TestWarningString(t *testing.T) {
+	e, err := Parse(`rate(temperature[5m])`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ws := CheckMetricTypes(e, MetricsMetadata{
+		"temperature": MetricTypeGauge,
+	})
+	if len(ws) != 1 {
+		t.Fatalf("unexpected number of warnings; got %d; want 1", len(ws))
+	}
+	s := ws[0].String()
+	sExpected := `rate(temperature[5m]): rate() is applied to gauge "temperature"; rate() is intended for counters; consider using deriv() or delta() instead`
+	if s != sExpected {
+		t.Fatalf("unexpected warning;\ngot\n%s\nwant\n%s", s, sExpected)
+	}
+}
+
+func TestCheckFunctions(t *testing.T) {
+	f := func(q string, warningsExpected []string) {
+		t.Helper()
+		e, err := Parse(q)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", q, err)
+		}
+		ws := CheckFunctions(e)
+		if len(ws) != len(warningsExpected) {
+			t.Fatalf("unexpected number of warnings for %q; got %d; want %d; warnings: %v", q, len(ws), len(warningsExpected), ws)
+		}
+		for i, w := range ws {
+			s := w.Kind.String() + " " + string(w.Expr.AppendString(nil))
+			if s != warningsExpected[i] {
+				t.Fatalf("unexpected warning #%d for %q; got %s; want %s", i, q, s, warningsExpected[i])
+			}
+		}
+	}
+
+	f(`foo`, nil)
+	f(`sum(rate_prometheus(foo[5m])) by (job)`, nil)
+	f(`increase_prometheus(foo[1h]) + delta_prometheus(bar[1h])`, nil)
+	f(`quantile(0.5, foo) + (foo, bar)`, nil)
+
+	f(`rate(foo[5m])`, []string{`prometheus_divergence rate(foo[5m])`})
+	f(`sum(INCREASE(foo[1h])) by (job)`, []string{`prometheus_divergence INCREASE(foo[1h])`})
+	f(`changes(foo) or delta(bar)`, []string{`prometheus_divergence changes(foo)`, `prometheus_divergence delta(bar)`})
+	f(`median(foo)`, []string{`alias median(foo)`})
+	f(`median_over_time(rate(foo)[1h:])`, []string{`prometheus_divergence rate(foo)`, `alias median_over_time(rate(foo)[1h:])`})
+	f(`timestamp_with_name(foo)`, []string{`alias timestamp_with_name(foo)`})
+	f(`tlast_over_time(foo[5m])`, []string{`alias tlast_over_time(foo[5m])`})
+	f(`sum2(foo) by (job)`, []string{`alias sum2(foo) by(job)`})
+	f(`share_le_over_time(foo[5m], 10)`, []string{`alias share_le_over_time(foo[5m], 10)`})
+}
+
+func TestCheckFunctionsKnownFuncs(t *testing.T) {
+	f := func(tableName string, m map[string]string) {
+		t.Helper()
+		for funcName, msg := range m {
+			if !IsRollupFunc(funcName) && !IsTransformFunc(funcName) && !IsAggrFunc(funcName) {
+				t.Fatalf("unknown function %q in %s", funcName, tableName)
+			}
+			if msg == "" {
+				t.Fatalf("missing explanation for %q in %s", funcName, tableName)
+			}
+		}
+	}
+	f("prometheusDivergentFuncs", prometheusDivergentFuncs)
+	f("aliasFuncs", aliasFuncs)
+	f("deprecatedFuncs", deprecatedFuncs)
+}
+
+func TestCheckFunctionsDeprecated(t *testing.T) {
+	deprecatedFuncs["geomean"] = "use exp(avg(ln(x))) instead"
+	defer delete(deprecatedFuncs, "geomean")
+
+	e, err := Parse(`geomean(foo)`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ws := CheckFunctions(e)
+	if len(ws) != 1 {
+		t.Fatalf("unexpected number of warnings; got %d; want 1", len(ws))
+	}
+	if ws[0].Kind != WarningKindDeprecated {
+		t.Fatalf("unexpected warning kind; got %s; want %s", ws[0].Kind, WarningKindDeprecated)
+	}
+	s := ws[0].String()
+	sExpected := `geomean(foo): geomean() is deprecated: use exp(avg(ln(x))) instead`
+	if s != sExpected {
+		t.Fatalf("unexpected warning;\ngot\n%s\nwant\n%s", s, sExpected)
+	}
+}
+
+func TestParseWithWarnings(t *testing.T) {
+	e, ws, err := ParseWithWarnings(`sum(rate(foo[5m])) / sum(median(bar))`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s := string(e.AppendString(nil))
+	sExpected := `sum(rate(foo[5m])) / sum(median(bar))`
+	if s != sExpected {
+		t.Fatalf("unexpected expression; got %s; want %s", s, sExpected)
+	}
+	if len(ws) != 2 {
+		t.Fatalf("unexpected number of warnings; got %d; want 2", len(ws))
+	}
+
+	e, ws, err = ParseWithWarnings(`rate(`)
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if e != nil || ws != nil {
+		t.Fatalf("expecting nil expression and warnings; got %v, %v", e, ws)
+	}
+}
+
+func TestLint(t *testing.T) {
+	e, err := Parse(`rate(temperature[5m])`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ws := Lint(e, nil)
+	if len(ws) != 1 || ws[0].Kind != WarningKindPrometheusDivergence {
+		t.Fatalf("unexpected warnings without metadata: %v", ws)
+	}
+	ws = Lint(e, MetricsMetadata{
+		"temperature": MetricTypeGauge,
+	})
+	if len(ws) != 2 || ws[0].Kind != WarningKindPrometheusDivergence || ws[1].Kind != WarningKindMetricType {
+		t.Fatalf("unexpected warnings with metadata: %v", ws)
+	}
+}
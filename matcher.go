@@ -0,0 +1,117 @@
+package metricsql
+
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/metricsql/binaryop"
+)
+
+// Matcher matches label sets against label filters from series selector such as `foo{bar="baz" or x=~"y.+"}`.
+//
+// Matcher is safe to use from concurrently running goroutines.
+type Matcher struct {
+	lmss [][]labelMatcher
+}
+
+type labelMatcher struct {
+	label      string
+	value      string
+	isNegative bool
+
+	// ri is set for `=~` and `!~` filters.
+	ri *RegexpInfo
+}
+
+// NewMatcher returns Matcher for the given lfss. See MetricExpr.LabelFilterss for details on lfss.
+//
+// Regexps in lfss are anchored to the start and the end of label values in the same way as CompileRegexpAnchored does.
+// Error is returned if lfss contain invalid regexps or params, which aren't bound via Bind.
+func NewMatcher(lfss [][]LabelFilter) (*Matcher, error) {
+	lmss := make([][]labelMatcher, len(lfss))
+	for i, lfs := range lfss {
+		lms := make([]labelMatcher, len(lfs))
+		for j := range lfs {
+			lf := &lfs[j]
+			if lf.Param != "" {
+				return nil, fmt.Errorf("label filter %s contains unbound param", lf.AppendString(nil))
+			}
+			lm := labelMatcher{
+				label:      lf.Label,
+				value:      lf.Value,
+				isNegative: lf.IsNegative,
+			}
+			if lf.IsRegexp {
+				ri, err := AnalyzeRegexp(lf.Value)
+				if err != nil {
+					return nil, fmt.Errorf("cannot compile regexp in %s: %w", lf.AppendString(nil), err)
+				}
+				lm.ri = ri
+			}
+			lms[j] = lm
+		}
+		lmss[i] = lms
+	}
+	m := &Matcher{
+		lmss: lmss,
+	}
+	return m, nil
+}
+
+// Match returns true if labels match m.
+//
+// labels must contain the metric name in `__name__` label. Missing labels are treated as labels with empty values,
+// so `{foo=""}` matches labels without `foo` label like Prometheus does.
+// labels match m if they match all the filters in at least a single `or` group. Matcher without filters matches any labels.
+//
+// Match doesn't allocate memory for typical label filters.
+func (m *Matcher) Match(labels []binaryop.Label) bool {
+	if len(m.lmss) == 0 {
+		return true
+	}
+	for _, lms := range m.lmss {
+		if matchLabelMatchers(lms, labels) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchLabelMatchers(lms []labelMatcher, labels []binaryop.Label) bool {
+	for i := range lms {
+		if !lms[i].match(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (lm *labelMatcher) match(labels []binaryop.Label) bool {
+	v := getLabelValue(labels, lm.label)
+	var ok bool
+	if lm.ri != nil {
+		ok = lm.ri.Match(v)
+	} else {
+		ok = v == lm.value
+	}
+	return ok != lm.isNegative
+}
+
+func getLabelValue(labels []binaryop.Label, name string) string {
+	for i := range labels {
+		if labels[i].Name == name {
+			return labels[i].Value
+		}
+	}
+	return ""
+}
+
+// Matches returns true if labels match me. See Matcher.Match for details.
+//
+// Use NewMatcher for matching multiple label sets against me, since it avoids regexp analysis on every call.
+func (me *MetricExpr) Matches(labels []binaryop.Label) (bool, error) {
+	m, err := NewMatcher(me.LabelFilterss)
+	if err != nil {
+		return false, err
+	}
+	return m.Match(labels), nil
+}
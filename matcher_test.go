@@ -0,0 +1,172 @@
+package metricsql
+
+import (
+	"testing"
+
+	"github.com/VictoriaMetrics/metricsql/binaryop"
+)
+
+func TestMetricExprMatches(t *testing.T) {
+	f := func(q string, labels []binaryop.Label, resultExpected bool) {
+		t.Helper()
+		e, err := Parse(q)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", q, err)
+		}
+		me, ok := e.(*MetricExpr)
+		if !ok {
+			t.Fatalf("expecting MetricExpr for %q; got %T", q, e)
+		}
+		result, err := me.Matches(labels)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", q, err)
+		}
+		if result != resultExpected {
+			t.Fatalf("unexpected result for %q on %v; got %v; want %v", q, labels, result, resultExpected)
+		}
+	}
+
+	labels := []binaryop.Label{
+		{Name: "__name__", Value: "http_requests_total"},
+		{Name: "job", Value: "api"},
+		{Name: "instance", Value: "host-1:9100"},
+	}
+
+	// metric name
+	f(`http_requests_total`, labels, true)
+	f(`foo`, labels, false)
+	f(`{__name__="http_requests_total"}`, labels, true)
+	f(`{__name__=~"http_.+"}`, labels, true)
+	f(`{__name__!~"http_.+",job="api"}`, labels, false)
+	f(`{job="api"}`, labels, true)
+
+	// equality filters
+	f(`http_requests_total{job="api"}`, labels, true)
+	f(`http_requests_total{job="web"}`, labels, false)
+	f(`http_requests_total{job!="web"}`, labels, true)
+	f(`http_requests_total{job!="api"}`, labels, false)
+	f(`http_requests_total{job="api",instance="host-2:9100"}`, labels, false)
+
+	// regexp filters are anchored
+	f(`http_requests_total{job=~"api|web"}`, labels, true)
+	f(`http_requests_total{job=~"ap"}`, labels, false)
+	f(`http_requests_total{job=~"a.*"}`, labels, true)
+	f(`http_requests_total{instance=~"host-[0-9]+:9100"}`, labels, true)
+	f(`http_requests_total{instance=~"host-[0-9]+"}`, labels, false)
+	f(`http_requests_total{job!~"api|web"}`, labels, false)
+	f(`http_requests_total{job!~"db"}`, labels, true)
+	f(`http_requests_total{job=~"(?i)API"}`, labels, true)
+
+	// missing labels are treated as labels with empty values
+	f(`http_requests_total{env=""}`, labels, true)
+	f(`http_requests_total{job=""}`, labels, false)
+	f(`http_requests_total{env!=""}`, labels, false)
+	f(`http_requests_total{env=~".*"}`, labels, true)
+	f(`http_requests_total{env=~".+"}`, labels, false)
+	f(`http_requests_total{env!~"prod"}`, labels, true)
+	f(`http_requests_total{env=~"prod|"}`, labels, true)
+
+	// or groups
+	f(`{job="web" or instance="host-1:9100"}`, labels, true)
+	f(`{job="web" or instance="host-2:9100"}`, labels, false)
+	f(`http_requests_total{job="web" or job="api"}`, labels, true)
+	f(`foo{job="web" or job="api"}`, labels, false)
+}
+
+func TestMetricExprMatchesFailure(t *testing.T) {
+	e, err := ParseWithParams(`foo{job=$job}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	labels := []binaryop.Label{
+		{Name: "__name__", Value: "foo"},
+	}
+	if _, err := e.(*MetricExpr).Matches(labels); err == nil {
+		t.Fatalf("expecting non-nil error for unbound param")
+	}
+
+	lfss := [][]LabelFilter{{
+		{
+			Label:    "job",
+			Value:    "a(",
+			IsRegexp: true,
+		},
+	}}
+	if _, err := NewMatcher(lfss); err == nil {
+		t.Fatalf("expecting non-nil error for invalid regexp")
+	}
+}
+
+func TestMatcherEmpty(t *testing.T) {
+	m, err := NewMatcher(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !m.Match(nil) {
+		t.Fatalf("matcher without filters must match any labels")
+	}
+}
+
+func TestMatcherMatchNoAllocs(t *testing.T) {
+	e, err := Parse(`http_requests_total{job=~"api|web",instance=~"host-.*",env!="prod" or job="db"}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	m, err := NewMatcher(e.(*MetricExpr).LabelFilterss)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	labels := []binaryop.Label{
+		{Name: "__name__", Value: "http_requests_total"},
+		{Name: "job", Value: "web"},
+		{Name: "instance", Value: "host-1:9100"},
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		if !m.Match(labels) {
+			panic("BUG: labels must match")
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("unexpected allocations; got %v; want 0", allocs)
+	}
+}
+
+func TestMatcherMatchNewlines(t *testing.T) {
+	f := func(re, value string) {
+		t.Helper()
+		lfss := [][]LabelFilter{{
+			{
+				Label:    "foo",
+				Value:    re,
+				IsRegexp: true,
+			},
+		}}
+		m, err := NewMatcher(lfss)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", re, err)
+		}
+		reAnchored, err := CompileRegexpAnchored(re)
+		if err != nil {
+			t.Fatalf("cannot compile %q: %s", re, err)
+		}
+		labels := []binaryop.Label{
+			{Name: "foo", Value: value},
+		}
+		result := m.Match(labels)
+		resultExpected := reAnchored.MatchString(value)
+		if result != resultExpected {
+			t.Fatalf("unexpected result for %q on %q; got %v; want %v", re, value, result, resultExpected)
+		}
+	}
+
+	f(`.*`, "a\nb")
+	f(`.+`, "a\nb")
+	f(`.+`, "\n")
+	f(`foo.*`, "foo\n")
+	f(`foo.+`, "foo\nbar")
+	f(`.*foo`, "\nfoo")
+	f(`.*foo.*`, "a\nfoo")
+	f(`(?s).*`, "a\nb")
+	f(`(?s)foo.*`, "foo\n")
+	f(`foo|bar`, "foo\n")
+}
@@ -0,0 +1,127 @@
+package metricsql
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// MetricType is the type of a metric as reported by Prometheus metadata API.
+//
+// See https://prometheus.io/docs/prometheus/latest/querying/api/#querying-metric-metadata
+type MetricType string
+
+// Metric types recognized by CheckMetricTypes.
+const (
+	MetricTypeUnknown   MetricType = "unknown"
+	MetricTypeCounter   MetricType = "counter"
+	MetricTypeGauge     MetricType = "gauge"
+	MetricTypeHistogram MetricType = "histogram"
+	MetricTypeSummary   MetricType = "summary"
+)
+
+// MetricsMetadata maps metric names to their types.
+type MetricsMetadata map[string]MetricType
+
+// ParseMetricsMetadata parses metrics metadata from data.
+//
+// data must contain either the full response from Prometheus `/api/v1/metadata` API
+// or the contents of its `data` field, e.g.:
+//
+//	{"status":"success","data":{"http_requests_total":[{"type":"counter","help":"...","unit":""}]}}
+//
+// Metric types are lowercased. Types unknown to MetricsQL such as `info` or `stateset`
+// are stored as is.
+func ParseMetricsMetadata(data []byte) (MetricsMetadata, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("cannot parse metrics metadata: %w", err)
+	}
+
+	// The API response is detected by the string `status` field, since the contents of `data` field
+	// contain only arrays of entries. This allows parsing metadata for metrics named `status` or `data`.
+	var status string
+	if err := json.Unmarshal(fields["status"], &status); err == nil {
+		if status != "success" {
+			return nil, fmt.Errorf("unexpected status in metrics metadata response: %q; want %q", status, "success")
+		}
+		rawData, ok := fields["data"]
+		if !ok {
+			return nil, fmt.Errorf("missing `data` field in metrics metadata response")
+		}
+		data = rawData
+	}
+	var m map[string][]metricMetadataEntry
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("cannot parse metrics metadata: %w", err)
+	}
+	if m == nil {
+		return nil, fmt.Errorf("metrics metadata must be JSON object; got %q", data)
+	}
+	md := make(MetricsMetadata, len(m))
+	for metricName, entries := range m {
+		if len(entries) == 0 {
+			continue
+		}
+		// Prometheus may return multiple entries per metric if targets disagree on the type.
+		// Use the type only if all the entries agree on it.
+		mt := MetricType(strings.ToLower(entries[0].Type))
+		for _, entry := range entries[1:] {
+			if MetricType(strings.ToLower(entry.Type)) != mt {
+				mt = MetricTypeUnknown
+				break
+			}
+		}
+		md[metricName] = mt
+	}
+	return md, nil
+}
+
+type metricMetadataEntry struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// ReadMetricsMetadataFile reads metrics metadata from the file at the given path.
+//
+// See ParseMetricsMetadata for the supported file format.
+func ReadMetricsMetadataFile(path string) (MetricsMetadata, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	md, err := ParseMetricsMetadata(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %w", path, err)
+	}
+	return md, nil
+}
+
+// GetMetricType returns the type for the given metricName.
+//
+// Series for histograms and summaries such as `foo_bucket`, `foo_sum` and `foo_count`
+// are reported as counters if the metadata contains `foo` histogram or summary.
+//
+// MetricTypeUnknown is returned if md has no type for the given metricName.
+func (md MetricsMetadata) GetMetricType(metricName string) MetricType {
+	if mt, ok := md[metricName]; ok {
+		return mt
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		baseName, ok := strings.CutSuffix(metricName, suffix)
+		if !ok {
+			continue
+		}
+		switch md[baseName] {
+		case MetricTypeHistogram:
+			return MetricTypeCounter
+		case MetricTypeSummary:
+			if suffix != "_bucket" {
+				return MetricTypeCounter
+			}
+		}
+	}
+	return MetricTypeUnknown
+}
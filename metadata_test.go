@@ -0,0 +1,100 @@
+package metricsql
+
+import (
+	"testing"
+)
+
+func TestParseMetricsMetadataSuccess(t *testing.T) {
+	f := func(data string, mdExpected MetricsMetadata) {
+		t.Helper()
+		md, err := ParseMetricsMetadata([]byte(data))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(md) != len(mdExpected) {
+			t.Fatalf("unexpected number of entries; got %d; want %d", len(md), len(mdExpected))
+		}
+		for metricName, mtExpected := range mdExpected {
+			if mt := md[metricName]; mt != mtExpected {
+				t.Fatalf("unexpected type for %q; got %q; want %q", metricName, mt, mtExpected)
+			}
+		}
+	}
+
+	f(`{}`, MetricsMetadata{})
+	f(`{"status":"success","data":{}}`, MetricsMetadata{})
+	f(`{"status":"success","data":{"foo":[{"type":"counter","help":"","unit":""}],"bar":[{"type":"Gauge"}]}}`, MetricsMetadata{
+		"foo": MetricTypeCounter,
+		"bar": MetricTypeGauge,
+	})
+	f(`{"foo":[{"type":"histogram"}],"bar":[{"type":"summary"}],"baz":[]}`, MetricsMetadata{
+		"foo": MetricTypeHistogram,
+		"bar": MetricTypeSummary,
+	})
+
+	// metrics named `status` and `data`
+	f(`{"status":[{"type":"gauge"}],"data":[{"type":"counter"}]}`, MetricsMetadata{
+		"status": MetricTypeGauge,
+		"data":   MetricTypeCounter,
+	})
+	f(`{"status":"success","data":{"status":[{"type":"gauge"}],"data":[{"type":"counter"}]}}`, MetricsMetadata{
+		"status": MetricTypeGauge,
+		"data":   MetricTypeCounter,
+	})
+
+	// conflicting types
+	f(`{"foo":[{"type":"counter"},{"type":"gauge"}],"bar":[{"type":"gauge"},{"type":"gauge"}]}`, MetricsMetadata{
+		"foo": MetricTypeUnknown,
+		"bar": MetricTypeGauge,
+	})
+}
+
+func TestParseMetricsMetadataFailure(t *testing.T) {
+	f := func(data string) {
+		t.Helper()
+		md, err := ParseMetricsMetadata([]byte(data))
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		if md != nil {
+			t.Fatalf("expecting nil metadata; got %v", md)
+		}
+	}
+
+	f(``)
+	f(`[]`)
+	f(`{"status":"error","error":"foo"}`)
+	f(`{"foo":"bar"}`)
+	f(`{"status":"success"}`)
+	f(`{"status":"success","data":[]}`)
+	f(`{"status":"success","data":null}`)
+}
+
+func TestMetricsMetadataGetMetricType(t *testing.T) {
+	md := MetricsMetadata{
+		"requests_total": MetricTypeCounter,
+		"temperature":    MetricTypeGauge,
+		"latency":        MetricTypeHistogram,
+		"duration":       MetricTypeSummary,
+	}
+	f := func(metricName string, mtExpected MetricType) {
+		t.Helper()
+		mt := md.GetMetricType(metricName)
+		if mt != mtExpected {
+			t.Fatalf("unexpected type for %q; got %q; want %q", metricName, mt, mtExpected)
+		}
+	}
+
+	f("requests_total", MetricTypeCounter)
+	f("temperature", MetricTypeGauge)
+	f("latency", MetricTypeHistogram)
+	f("latency_bucket", MetricTypeCounter)
+	f("latency_sum", MetricTypeCounter)
+	f("latency_count", MetricTypeCounter)
+	f("duration", MetricTypeSummary)
+	f("duration_sum", MetricTypeCounter)
+	f("duration_count", MetricTypeCounter)
+	f("duration_bucket", MetricTypeUnknown)
+	f("temperature_sum", MetricTypeUnknown)
+	f("missing", MetricTypeUnknown)
+}
@@ -2,6 +2,7 @@ package metricsql
 
 import (
 	"fmt"
+	"math"
 	"sort"
 	"strings"
 )
@@ -13,11 +14,18 @@ import (
 //   - Adds missing filters to `foo{filters1} op bar{filters2}`
 //     according to https://utcc.utoronto.ca/~cks/space/blog/sysadmin/PrometheusLabelNonOptimization
 //     I.e. such query is converted to `foo{filters1, filters2} op bar{filters1, filters2}`
+//   - Simplifies algebraic expressions such as `x * 1`, `x + 0`, `x / 1`, `x ^ 1`, `--x`, `x and x`, `x or x`,
+//     `abs(abs(x))`, `sort(sort(x))`, `sum(sum(x) by (a)) by (a)`, `label_set(label_set(x, "a", "b"), "c", "d")`
+//     and `clamp_min(clamp_min(x, 1), 2)`. No-op arithmetic operations are removed only if this doesn't change
+//     metric names in the result.
+//
+// Regexp label filters can be additionally simplified via OptimizeRegexpFilters.
 func Optimize(e Expr) Expr {
-	if !canOptimize(e) {
+	if !canOptimize(e) && !canSimplify(e) {
 		return e
 	}
 	eCopy := Clone(e)
+	eCopy = simplifyExpr(eCopy)
 	optimizeInplace(eCopy)
 	return eCopy
 }
@@ -47,7 +55,7 @@ func canOptimize(e Expr) bool {
 // Clone clones the given expression e and returns the cloned copy.
 func Clone(e Expr) Expr {
 	s := e.AppendString(nil)
-	eCopy, err := Parse(string(s))
+	eCopy, err := parse(string(s), parseModeGrafana)
 	if err != nil {
 		panic(fmt.Errorf("BUG: cannot parse the expression %q: %w", s, err))
 	}
@@ -694,20 +702,393 @@ func getTransformArgIdxForOptimization(funcName string, args []Expr) int {
 		"label_match", "label_mismatch", "label_move", "label_replace", "label_set", "label_transform",
 		"label_uppercase", "labels_equal", "range_normalize", "", "union":
 		panic(fmt.Errorf("BUG: %s must be already handled", funcName))
-	case "drop_common_labels":
+	case "drop_common_labels", "ru":
 		return -1
 	case "absent", "scalar":
 		return -1
-	case "end", "now", "pi", "ru", "start", "step", "time":
-		return -1
-	case "limit_offset", "histogram_fraction":
-		return 2
-	case "buckets_limit", "histogram_quantile", "histogram_share", "range_quantile",
-		"range_trim_outliers", "range_trim_spikes", "range_trim_zscore":
-		return 1
-	case "histogram_quantiles":
-		return len(args) - 1
 	default:
-		return 0
+		fe := &FuncExpr{
+			Name: funcName,
+			Args: args,
+		}
+		return GetTransformArgIdx(fe)
+	}
+}
+
+// simplifyExpr applies algebraic simplifications to e and returns the result.
+//
+// e may be modified in place. The simplifications preserve the query result including metric names,
+// e.g. `x * 1` is simplified to `x` only if x doesn't return metric names, since `x * 1` drops them.
+func simplifyExpr(e Expr) Expr {
+	switch t := e.(type) {
+	case *RollupExpr:
+		t.Expr = simplifyExpr(t.Expr)
+		if t.At != nil {
+			t.At = simplifyExpr(t.At)
+		}
+		return t
+	case *FuncExpr:
+		simplifyArgs(t.Args)
+		if eNew := simplifyFuncExpr(t); eNew != nil {
+			return simplifyExpr(eNew)
+		}
+		return t
+	case *AggrFuncExpr:
+		simplifyArgs(t.Args)
+		if eNew := simplifyAggrFuncExpr(t); eNew != nil {
+			return simplifyExpr(eNew)
+		}
+		return t
+	case *BinaryOpExpr:
+		t.Left = simplifyExpr(t.Left)
+		t.Right = simplifyExpr(t.Right)
+		if eNew := simplifyBinaryOpExpr(t); eNew != nil {
+			return simplifyExpr(eNew)
+		}
+		return t
+	default:
+		return e
+	}
+}
+
+func simplifyArgs(args []Expr) {
+	for i, arg := range args {
+		args[i] = simplifyExpr(arg)
+	}
+}
+
+// canSimplify returns true if simplifyExpr can simplify e.
+func canSimplify(e Expr) bool {
+	ok := false
+	VisitAll(e, func(expr Expr) {
+		if ok {
+			return
+		}
+		switch t := expr.(type) {
+		case *FuncExpr:
+			ok = simplifyFuncExpr(t) != nil
+		case *AggrFuncExpr:
+			ok = simplifyAggrFuncExpr(t) != nil
+		case *BinaryOpExpr:
+			ok = simplifyBinaryOpExpr(t) != nil
+		}
+	})
+	return ok
+}
+
+// simplifyBinaryOpExpr returns simplified be or nil if be cannot be simplified.
+//
+// be isn't modified.
+func simplifyBinaryOpExpr(be *BinaryOpExpr) Expr {
+	if be.Bool || be.GroupModifier.Op != "" || be.JoinModifier.Op != "" {
+		return nil
+	}
+	switch strings.ToLower(be.Op) {
+	case "and", "or":
+		// `x and x` and `x or x` are equivalent to x.
+		if isSameExpr(be.Left, be.Right) {
+			return be.Left
+		}
+		return nil
+	}
+	x := getArithNoopOperand(be)
+	if x == nil {
+		return nil
+	}
+	if be.KeepMetricNames || dropsMetricName(x) {
+		return x
+	}
+	return nil
+}
+
+// getArithNoopOperand returns x for `x * 1`, `1 * x`, `x + 0`, `0 + x`, `x - 0`, `x / 1`, `x ^ 1` and `--x`.
+//
+// nil is returned if be isn't a no-op arithmetic operation.
+func getArithNoopOperand(be *BinaryOpExpr) Expr {
+	ln, lok := be.Left.(*NumberExpr)
+	rn, rok := be.Right.(*NumberExpr)
+	switch be.Op {
+	case "*":
+		if rok && rn.N == 1 {
+			return be.Left
+		}
+		if lok && ln.N == 1 {
+			return be.Right
+		}
+	case "+":
+		if rok && rn.N == 0 {
+			return be.Left
+		}
+		if lok && ln.N == 0 {
+			return be.Right
+		}
+	case "-":
+		if rok && rn.N == 0 {
+			return be.Left
+		}
+		if lok && ln.N == 0 {
+			// `--x` is parsed into `0 - (0 - x)`.
+			inner, ok := be.Right.(*BinaryOpExpr)
+			if !ok || inner.Op != "-" || inner.Bool || inner.GroupModifier.Op != "" || inner.JoinModifier.Op != "" {
+				return nil
+			}
+			if n, ok := inner.Left.(*NumberExpr); ok && n.N == 0 && (!be.KeepMetricNames || inner.KeepMetricNames) {
+				return inner.Right
+			}
+		}
+	case "/", "^":
+		if rok && rn.N == 1 {
+			return be.Left
+		}
+	}
+	return nil
+}
+
+// dropsMetricName returns true if e is known to return series without metric names.
+//
+// false is returned if e may return series with metric names.
+func dropsMetricName(e Expr) bool {
+	switch t := e.(type) {
+	case *NumberExpr:
+		return true
+	case *BinaryOpExpr:
+		if t.KeepMetricNames {
+			return false
+		}
+		switch strings.ToLower(t.Op) {
+		case "+", "-", "*", "/", "%", "^", "atan2":
+			return true
+		}
+		return IsBinaryOpCmp(t.Op) && t.Bool
+	case *AggrFuncExpr:
+		if !aggrFuncsDropMetricName[strings.ToLower(t.Name)] {
+			return false
+		}
+		switch strings.ToLower(t.Modifier.Op) {
+		case "":
+			return true
+		case "by":
+			for _, arg := range t.Modifier.Args {
+				if arg == "__name__" {
+					return false
+				}
+			}
+			return true
+		default:
+			return false
+		}
+	case *FuncExpr:
+		if t.KeepMetricNames {
+			return false
+		}
+		funcName := strings.ToLower(t.Name)
+		return constantMathFuncs[funcName] != nil || funcsDropMetricName[funcName]
+	default:
+		return false
+	}
+}
+
+var aggrFuncsDropMetricName = map[string]bool{
+	"avg":      true,
+	"count":    true,
+	"geomean":  true,
+	"group":    true,
+	"max":      true,
+	"median":   true,
+	"min":      true,
+	"quantile": true,
+	"stddev":   true,
+	"stdvar":   true,
+	"sum":      true,
+}
+
+var funcsDropMetricName = map[string]bool{
+	"changes":          true,
+	"clamp":            true,
+	"clamp_max":        true,
+	"clamp_min":        true,
+	"count_over_time":  true,
+	"delta":            true,
+	"deriv":            true,
+	"idelta":           true,
+	"increase":         true,
+	"irate":            true,
+	"rate":             true,
+	"resets":           true,
+	"round":            true,
+	"scalar":           true,
+	"stddev_over_time": true,
+	"stdvar_over_time": true,
+	"sum_over_time":    true,
+}
+
+// simplifyFuncExpr returns simplified fe or nil if fe cannot be simplified.
+//
+// fe isn't modified.
+func simplifyFuncExpr(fe *FuncExpr) Expr {
+	if len(fe.Args) == 0 {
+		return nil
+	}
+	inner, ok := fe.Args[0].(*FuncExpr)
+	if !ok || !strings.EqualFold(inner.Name, fe.Name) {
+		return nil
+	}
+	// The outer function decides whether metric names are dropped, so the result keeps metric names
+	// only if both functions keep them.
+	keepMetricNames := fe.KeepMetricNames && inner.KeepMetricNames
+	switch strings.ToLower(fe.Name) {
+	case "abs", "ceil", "floor", "sgn", "sort", "sort_desc":
+		// Idempotent functions: `abs(abs(x))` is equivalent to `abs(x)`.
+		if len(fe.Args) != 1 || len(inner.Args) != 1 {
+			return nil
+		}
+		return &FuncExpr{
+			Name:            inner.Name,
+			Args:            inner.Args,
+			KeepMetricNames: keepMetricNames,
+		}
+	case "clamp_min", "clamp_max":
+		// `clamp_min(clamp_min(x, a), b)` is equivalent to `clamp_min(x, max(a, b))`.
+		if len(fe.Args) != 2 || len(inner.Args) != 2 {
+			return nil
+		}
+		a, aok := inner.Args[1].(*NumberExpr)
+		b, bok := fe.Args[1].(*NumberExpr)
+		if !aok || !bok || math.IsNaN(a.N) || math.IsNaN(b.N) {
+			return nil
+		}
+		n := max(a.N, b.N)
+		if strings.EqualFold(fe.Name, "clamp_max") {
+			n = min(a.N, b.N)
+		}
+		return &FuncExpr{
+			Name: inner.Name,
+			Args: []Expr{
+				inner.Args[0],
+				&NumberExpr{
+					N: n,
+				},
+			},
+			KeepMetricNames: keepMetricNames,
+		}
+	case "label_set":
+		// `label_set(label_set(x, "a", "1"), "b", "2")` is equivalent to `label_set(x, "a", "1", "b", "2")`.
+		// Labels set by the outer function override labels with the same names set by the inner function.
+		if !isLabelSetArgs(fe.Args) || !isLabelSetArgs(inner.Args) {
+			return nil
+		}
+		outerLabels := make(map[string]bool)
+		for i := 1; i < len(fe.Args); i += 2 {
+			outerLabels[fe.Args[i].(*StringExpr).S] = true
+		}
+		args := []Expr{inner.Args[0]}
+		for i := 1; i < len(inner.Args); i += 2 {
+			if !outerLabels[inner.Args[i].(*StringExpr).S] {
+				args = append(args, inner.Args[i], inner.Args[i+1])
+			}
+		}
+		args = append(args, fe.Args[1:]...)
+		return &FuncExpr{
+			Name:            inner.Name,
+			Args:            args,
+			KeepMetricNames: keepMetricNames,
+		}
+	default:
+		return nil
+	}
+}
+
+func isLabelSetArgs(args []Expr) bool {
+	if len(args)%2 != 1 {
+		return false
+	}
+	for _, arg := range args[1:] {
+		if _, ok := arg.(*StringExpr); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// simplifyAggrFuncExpr returns simplified ae or nil if ae cannot be simplified.
+//
+// `sum(sum(x) by (a, b)) by (a)` is simplified to `sum(x) by (a)`. The same applies to min() and max().
+//
+// ae isn't modified.
+func simplifyAggrFuncExpr(ae *AggrFuncExpr) Expr {
+	if len(ae.Args) != 1 || ae.Limit > 0 {
+		return nil
+	}
+	inner, ok := ae.Args[0].(*AggrFuncExpr)
+	if !ok || len(inner.Args) != 1 || inner.Limit > 0 || !strings.EqualFold(inner.Name, ae.Name) {
+		return nil
+	}
+	switch strings.ToLower(ae.Name) {
+	case "sum", "min", "max":
+	default:
+		return nil
+	}
+	outerLabels, ok := getAggrByLabels(&ae.Modifier)
+	if !ok {
+		return nil
+	}
+	innerLabels, ok := getAggrByLabels(&inner.Modifier)
+	if !ok {
+		return nil
+	}
+	for _, label := range outerLabels {
+		if !containsString(innerLabels, label) {
+			return nil
+		}
+	}
+	return &AggrFuncExpr{
+		Name:     inner.Name,
+		Args:     inner.Args,
+		Modifier: ae.Modifier,
+	}
+}
+
+// getAggrByLabels returns labels for `by (...)` modifier.
+//
+// false is returned for other modifiers except of an empty modifier, which is equivalent to `by ()`.
+func getAggrByLabels(me *ModifierExpr) ([]string, bool) {
+	switch strings.ToLower(me.Op) {
+	case "":
+		return nil, true
+	case "by":
+		return me.Args, true
+	default:
+		return nil, false
+	}
+}
+
+// isSameExpr returns true if a and b always return the same results.
+//
+// Expressions with non-deterministic functions such as rand() are never the same, even if their string representations match.
+func isSameExpr(a, b Expr) bool {
+	if hasNonDeterministicFuncs(a) || hasNonDeterministicFuncs(b) {
+		return false
+	}
+	return string(a.AppendString(nil)) == string(b.AppendString(nil))
+}
+
+func hasNonDeterministicFuncs(e Expr) bool {
+	ok := false
+	VisitAll(e, func(expr Expr) {
+		if fe, isFunc := expr.(*FuncExpr); isFunc && isNonDeterministicFunc(fe.Name) {
+			ok = true
+		}
+	})
+	return ok
+}
+
+// isNonDeterministicFunc returns true if the function with the given funcName may return different results
+// for the same args when it is called multiple times in a query.
+func isNonDeterministicFunc(funcName string) bool {
+	switch strings.ToLower(funcName) {
+	case "now", "rand", "rand_exponential", "rand_normal":
+		return true
+	default:
+		return false
 	}
 }
@@ -388,4 +388,82 @@ func TestOptimize(t *testing.T) {
 	f(`scalar(x) * foo / bar{baz="a"}`, `(scalar(x) * foo{baz="a"}) / bar{baz="a"}`)
 	f(`SCALAR(x) * foo / bar{baz="a"}`, `(SCALAR(x) * foo{baz="a"}) / bar{baz="a"}`)
 	f(`100 * on(foo) bar{baz="z"} + a`, `(100 * on(foo) bar{baz="z"}) + a`)
+
+	// no-op arithmetic operations
+	f(`sum(x) * 1`, `sum(x)`)
+	f(`1 * sum(x) by (a)`, `sum(x) by(a)`)
+	f(`rate(x[5m]) + 0`, `rate(x[5m])`)
+	f(`0 + rate(x[5m])`, `rate(x[5m])`)
+	f(`rate(x[5m]) - 0`, `rate(x[5m])`)
+	f(`rate(x[5m]) / 1`, `rate(x[5m])`)
+	f(`rate(x[5m]) ^ 1`, `rate(x[5m])`)
+	f(`(a + b) * 1 * 1`, `a + b`)
+	f(`sum(x) by (__name__) * 1`, `sum(x) by(__name__) * 1`)
+	f(`rate(x[5m]) keep_metric_names * 1`, `rate(x[5m]) keep_metric_names * 1`)
+	f(`(rate(x[5m]) keep_metric_names * 1) keep_metric_names`, `rate(x[5m]) keep_metric_names`)
+	f(`(a and b) * 1`, `(a and b) * 1`)
+	f(`(a > b) * 1`, `(a > b) * 1`)
+	f(`(a > bool b) * 1`, `a >bool b`)
+	f(`x * 1`, `x * 1`)
+	f(`(x * 1) keep_metric_names`, `x`)
+	f(`x + 1`, `x + 1`)
+	f(`x - 0`, `x - 0`)
+	f(`0 - x`, `0 - x`)
+	f(`1 / rate(x[5m])`, `1 / rate(x[5m])`)
+	f(`sum(x) * on() 1`, `sum(x) * on() 1`)
+	f(`--rate(x[5m])`, `rate(x[5m])`)
+	f(`--x`, `0 - (0 - x)`)
+	f(`---rate(x[5m])`, `0 - rate(x[5m])`)
+	f(`(sum(x) + 0) / bar{a="b"}`, `sum(x) / bar{a="b"}`)
+
+	// duplicate operands
+	f(`x and x`, `x`)
+	f(`x{a="b"} or x{a="b"}`, `x{a="b"}`)
+	f(`x and y`, `x and y`)
+	f(`x and on(a) x`, `x and on(a) x`)
+	f(`x unless x`, `x unless x`)
+	f(`x + x`, `x + x`)
+	f(`rand() or rand()`, `rand() or rand()`)
+	f(`rand_normal(1) and rand_normal(1)`, `rand_normal(1) and rand_normal(1)`)
+	f(`(x * rand()) or (x * rand())`, `(x * rand()) or (x * rand())`)
+	f(`(now() > x) and (now() > x)`, `(now() > x) and (now() > x)`)
+	f(`rand() - rand()`, `rand() - rand()`)
+
+	// idempotent functions
+	f(`abs(abs(x))`, `abs(x)`)
+	f(`abs(abs(abs(x)))`, `abs(x)`)
+	f(`sort(sort(x))`, `sort(x)`)
+	f(`sort_desc(sort(x))`, `sort_desc(sort(x))`)
+	f(`ceil(floor(x))`, `ceil(floor(x))`)
+	f(`abs(abs(x) keep_metric_names)`, `abs(x)`)
+	f(`abs(abs(x) keep_metric_names) keep_metric_names`, `abs(x) keep_metric_names`)
+	f(`abs(abs(x)) keep_metric_names`, `abs(x)`)
+	f(`abs(abs(x)) + y{a="b"}`, `abs(x{a="b"}) + y{a="b"}`)
+
+	// nested aggregates
+	f(`sum(sum(x) by (a)) by (a)`, `sum(x) by(a)`)
+	f(`sum(sum(x) by (a, b)) by (a)`, `sum(x) by(a)`)
+	f(`sum(sum(x) by (a))`, `sum(x)`)
+	f(`sum(sum(x))`, `sum(x)`)
+	f(`max(max(x) by (a)) by (a)`, `max(x) by(a)`)
+	f(`sum(sum(x) by (a)) by (b)`, `sum(sum(x) by(a)) by(b)`)
+	f(`sum(sum(x)) by (a)`, `sum(sum(x)) by(a)`)
+	f(`sum(sum(x) without (a)) by (b)`, `sum(sum(x) without(a)) by(b)`)
+	f(`sum(max(x) by (a)) by (a)`, `sum(max(x) by(a)) by(a)`)
+	f(`count(count(x) by (a)) by (a)`, `count(count(x) by(a)) by(a)`)
+	f(`sum(sum(x) by (a)) by (a) limit 3`, `sum(sum(x) by(a)) by(a) limit 3`)
+
+	// nested label_set
+	f(`label_set(label_set(x, "a", "1"), "b", "2")`, `label_set(x, "a", "1", "b", "2")`)
+	f(`label_set(label_set(x, "a", "1", "b", "2"), "a", "3")`, `label_set(x, "b", "2", "a", "3")`)
+	f(`label_set(label_set(label_set(x, "a", "1"), "b", "2"), "c", "3")`, `label_set(x, "a", "1", "b", "2", "c", "3")`)
+	f(`label_set(label_set(x, "a"), "b", "2")`, `label_set(label_set(x, "a"), "b", "2")`)
+
+	// nested clamp_min and clamp_max
+	f(`clamp_min(clamp_min(x, 1), 2)`, `clamp_min(x, 2)`)
+	f(`clamp_min(clamp_min(x, 3), 2)`, `clamp_min(x, 3)`)
+	f(`clamp_max(clamp_max(x, 1), 2)`, `clamp_max(x, 1)`)
+	f(`clamp_max(clamp_min(x, 1), 2)`, `clamp_max(clamp_min(x, 1), 2)`)
+	f(`clamp_min(clamp_min(x, y), 2)`, `clamp_min(clamp_min(x, y), 2)`)
+	f(`clamp_min(clamp_min(x, NaN), 2)`, `clamp_min(clamp_min(x, NaN), 2)`)
 }
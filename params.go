@@ -0,0 +1,420 @@
+package metricsql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ParamExpr represents `$name` param in place of a number, e.g. `foo > $threshold`.
+//
+// See ParseWithParams for details. The param must be substituted with the actual value via Bind.
+// ParamExpr is also used for Grafana variables in place of numbers. See ParseGrafana.
+type ParamExpr struct {
+	// Name is the param name without the leading `$`.
+	Name string
+}
+
+// AppendString appends string representation of pe to dst and returns the result.
+func (pe *ParamExpr) AppendString(dst []byte) []byte {
+	return appendParam(dst, pe.Name)
+}
+
+func appendParam(dst []byte, name string) []byte {
+	if scanParamName(name) == len(name) {
+		dst = append(dst, '$')
+		return append(dst, name...)
+	}
+	// The name contains format such as `${var:regex}`
+	dst = append(dst, "${"...)
+	dst = append(dst, name...)
+	return append(dst, '}')
+}
+
+// isParamToken returns true if s is a param token returned by lexer.
+//
+// Lexer returns params in the `${name}` form, so they cannot be confused with `$__interval`.
+func isParamToken(s string) bool {
+	return len(s) > 3 && strings.HasPrefix(s, "${") && strings.HasSuffix(s, "}")
+}
+
+func getParamTokenName(s string) string {
+	return s[2 : len(s)-1]
+}
+
+// scanParam scans `$name`, `${name}` or `${name:format}` param at the start of s.
+//
+// It returns the length of the param in s and the param name including the optional `:format` suffix.
+// Zero length is returned if s doesn't start with param.
+func scanParam(s string) (int, string) {
+	if len(s) < 2 || s[0] != '$' {
+		return 0, ""
+	}
+	if s[1] == '{' {
+		n := scanParamName(s[2:])
+		if n == 0 || 2+n >= len(s) {
+			return 0, ""
+		}
+		if s[2+n] == ':' {
+			m := scanParamName(s[3+n:])
+			if m == 0 {
+				return 0, ""
+			}
+			n += m + 1
+			if 2+n >= len(s) {
+				return 0, ""
+			}
+		}
+		if s[2+n] != '}' {
+			return 0, ""
+		}
+		return n + 3, s[2 : 2+n]
+	}
+	n := scanParamName(s[1:])
+	if n == 0 {
+		return 0, ""
+	}
+	return n + 1, s[1 : 1+n]
+}
+
+func scanParamName(s string) int {
+	i := 0
+	for i < len(s) {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r)) {
+			break
+		}
+		i += size
+	}
+	return i
+}
+
+// Bind returns a copy of e with params substituted with values from params.
+//
+// e is usually obtained via ParseWithParams. Param values are type-checked:
+//
+//   - label values accept string values. The value is used as is, so it cannot break the query.
+//     It is treated as a regular expression for `=~` and `!~` filters, so it must be escaped
+//     with regexp.QuoteMeta if it must be matched literally.
+//   - durations accept string values with valid durations such as `5m` or `1h30m` and time.Duration values.
+//     Durations in lookbehind windows and steps cannot be negative.
+//   - numbers accept values of integer and floating-point types.
+//
+// Error is returned if e contains params missing in params or if param values have unexpected types.
+// Unused params are ignored. e isn't modified.
+func Bind(e Expr, params map[string]any) (Expr, error) {
+	return bindParamsWithResolver(e, mapParamResolver(params))
+}
+
+func bindParamsWithResolver(e Expr, r paramResolver) (Expr, error) {
+	eCopy := Clone(e)
+	eNew, err := bindParams(eCopy, r)
+	if err != nil {
+		return nil, err
+	}
+	return simplifyConstants(eNew), nil
+}
+
+// paramResolver returns values for placeholders in the parsed query.
+type paramResolver interface {
+	// numberValue returns the value for the param in place of a number.
+	numberValue(name string) (float64, error)
+
+	// durationValue returns the value for the param in place of a duration.
+	durationValue(name string) (string, error)
+
+	// timestampValue returns the value in seconds for the param in `@` modifier such as `foo @ $t`.
+	timestampValue(name string) (float64, error)
+
+	// labelValue returns the value for the param in place of label filter value.
+	//
+	// isRegexp is set for `=~` and `!~` filters.
+	labelValue(name string, isRegexp bool) (string, error)
+
+	// interpolateLabelValue returns s with substituted variables inside the quoted label filter value s.
+	interpolateLabelValue(s string, isRegexp bool) (string, error)
+}
+
+// atParamResolver is paramResolver for `@` modifier args.
+//
+// It returns timestamps in seconds in place of numbers.
+type atParamResolver struct {
+	paramResolver
+}
+
+func (ar atParamResolver) numberValue(name string) (float64, error) {
+	return ar.timestampValue(name)
+}
+
+// mapParamResolver is paramResolver for Bind.
+type mapParamResolver map[string]any
+
+func (mr mapParamResolver) numberValue(name string) (float64, error) {
+	return getNumberParam(mr, name)
+}
+
+func (mr mapParamResolver) timestampValue(name string) (float64, error) {
+	return getNumberParam(mr, name)
+}
+
+func (mr mapParamResolver) durationValue(name string) (string, error) {
+	v, ok := mr[name]
+	if !ok {
+		return "", fmt.Errorf("missing value for param %q", name)
+	}
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case time.Duration:
+		return strconv.FormatInt(t.Milliseconds(), 10) + "ms", nil
+	default:
+		return "", fmt.Errorf("param %q must be duration string or time.Duration; got %T", name, v)
+	}
+}
+
+func (mr mapParamResolver) labelValue(name string, _ bool) (string, error) {
+	v, ok := mr[name]
+	if !ok {
+		return "", fmt.Errorf("missing value for param %q", name)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("param %q must be string; got %T", name, v)
+	}
+	return s, nil
+}
+
+func (mr mapParamResolver) interpolateLabelValue(s string, _ bool) (string, error) {
+	// Params inside quoted strings are left as is.
+	return s, nil
+}
+
+func bindParams(e Expr, r paramResolver) (Expr, error) {
+	switch t := e.(type) {
+	case *ParamExpr:
+		n, err := r.numberValue(t.Name)
+		if err != nil {
+			return nil, err
+		}
+		ne := &NumberExpr{
+			N: n,
+		}
+		return ne, nil
+	case *MetricExpr:
+		for _, lfs := range t.LabelFilterss {
+			for i := range lfs {
+				if err := bindLabelFilterParam(&lfs[i], r); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return t, nil
+	case *DurationExpr:
+		if err := bindDurationParam(t, r, false); err != nil {
+			return nil, err
+		}
+		return t, nil
+	case *RollupExpr:
+		eNew, err := bindParams(t.Expr, r)
+		if err != nil {
+			return nil, err
+		}
+		t.Expr = eNew
+		if t.Window != nil {
+			if err := bindDurationParam(t.Window, r, true); err != nil {
+				return nil, fmt.Errorf("cannot bind window: %w", err)
+			}
+		}
+		if t.Step != nil {
+			if err := bindDurationParam(t.Step, r, true); err != nil {
+				return nil, fmt.Errorf("cannot bind step: %w", err)
+			}
+		}
+		if t.Offset != nil {
+			if err := bindDurationParam(t.Offset, r, false); err != nil {
+				return nil, fmt.Errorf("cannot bind offset: %w", err)
+			}
+		}
+		if t.At != nil {
+			atNew, err := bindParams(t.At, atParamResolver{r})
+			if err != nil {
+				return nil, err
+			}
+			t.At = atNew
+		}
+		return t, nil
+	case *FuncExpr:
+		if err := bindParamsInArgs(t.Args, r); err != nil {
+			return nil, err
+		}
+		return t, nil
+	case *AggrFuncExpr:
+		if err := bindParamsInArgs(t.Args, r); err != nil {
+			return nil, err
+		}
+		return t, nil
+	case *BinaryOpExpr:
+		left, err := bindParams(t.Left, r)
+		if err != nil {
+			return nil, err
+		}
+		right, err := bindParams(t.Right, r)
+		if err != nil {
+			return nil, err
+		}
+		t.Left = left
+		t.Right = right
+		return t, nil
+	default:
+		return e, nil
+	}
+}
+
+func bindParamsInArgs(args []Expr, r paramResolver) error {
+	for i, arg := range args {
+		argNew, err := bindParams(arg, r)
+		if err != nil {
+			return err
+		}
+		args[i] = argNew
+	}
+	return nil
+}
+
+func bindLabelFilterParam(lf *LabelFilter, r paramResolver) error {
+	var s string
+	if lf.Param == "" {
+		v, err := r.interpolateLabelValue(lf.Value, lf.IsRegexp)
+		if err != nil {
+			return fmt.Errorf("cannot interpolate value for label %q: %w", lf.Label, err)
+		}
+		if v == lf.Value {
+			return nil
+		}
+		s = v
+	} else {
+		v, err := r.labelValue(lf.Param, lf.IsRegexp)
+		if err != nil {
+			return fmt.Errorf("cannot bind value for label %q: %w", lf.Label, err)
+		}
+		s = v
+	}
+	if lf.IsRegexp {
+		if _, err := CompileRegexpAnchored(s); err != nil {
+			return fmt.Errorf("invalid regexp %q for label %q: %w", s, lf.Label, err)
+		}
+	}
+	lf.Value = s
+	lf.Param = ""
+	return nil
+}
+
+func bindDurationParam(de *DurationExpr, r paramResolver, mustBePositive bool) error {
+	if de.expr != nil {
+		// Bind params in duration arithmetic such as `$w * 2` and then verify the result in the same way as Parse does.
+		// Results depending on step are verified during evaluation.
+		if err := bindDurationArithParams(de.expr, r); err != nil {
+			return err
+		}
+		de.s = string(de.expr.AppendString(nil))
+		return checkDurationArithExpr(de, mustBePositive)
+	}
+	name, isNegative := getDurationParamName(de)
+	if name == "" {
+		return nil
+	}
+	v, err := r.durationValue(name)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(v, "$") {
+		return fmt.Errorf("param %q must contain valid duration; got %q", name, v)
+	}
+	if _, err := DurationValue(v, 0); err != nil {
+		return fmt.Errorf("param %q must contain valid duration: %w", name, err)
+	}
+	s := v
+	if isNegative {
+		if strings.HasPrefix(s, "-") {
+			s = s[1:]
+		} else {
+			s = "-" + s
+		}
+		if _, err := DurationValue(s, 0); err != nil || strings.Contains(s[1:], "-") {
+			return fmt.Errorf("cannot negate duration %q for param %q", v, name)
+		}
+	}
+	if mustBePositive && strings.HasPrefix(s, "-") {
+		return fmt.Errorf("param %q cannot contain negative duration; got %q", name, s)
+	}
+	de.s = s
+	return nil
+}
+
+func bindDurationArithParams(e Expr, r paramResolver) error {
+	switch t := e.(type) {
+	case *DurationExpr:
+		return bindDurationParam(t, r, false)
+	case *BinaryOpExpr:
+		if err := bindDurationArithParams(t.Left, r); err != nil {
+			return err
+		}
+		return bindDurationArithParams(t.Right, r)
+	default:
+		return nil
+	}
+}
+
+// getDurationParamName returns param name for de if it contains `$name` or `-$name`.
+//
+// Empty name is returned if de doesn't contain param.
+func getDurationParamName(de *DurationExpr) (string, bool) {
+	s := de.s
+	isNegative := strings.HasPrefix(s, "-")
+	if isNegative {
+		s = s[1:]
+	}
+	n, name := scanParam(s)
+	if n == 0 || n != len(s) {
+		return "", false
+	}
+	return name, isNegative
+}
+
+func getNumberParam(params map[string]any, name string) (float64, error) {
+	v, ok := params[name]
+	if !ok {
+		return 0, fmt.Errorf("missing value for param %q", name)
+	}
+	switch t := v.(type) {
+	case float64:
+		return t, nil
+	case float32:
+		return float64(t), nil
+	case int:
+		return float64(t), nil
+	case int8:
+		return float64(t), nil
+	case int16:
+		return float64(t), nil
+	case int32:
+		return float64(t), nil
+	case int64:
+		return float64(t), nil
+	case uint:
+		return float64(t), nil
+	case uint8:
+		return float64(t), nil
+	case uint16:
+		return float64(t), nil
+	case uint32:
+		return float64(t), nil
+	case uint64:
+		return float64(t), nil
+	default:
+		return 0, fmt.Errorf("param %q must be number; got %T", name, v)
+	}
+}
@@ -0,0 +1,254 @@
+package metricsql
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWithParamsSuccess(t *testing.T) {
+	another := func(s, resultExpected string) {
+		t.Helper()
+
+		e, err := ParseWithParams(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %s: %s", s, err)
+		}
+		result := string(e.AppendString(nil))
+		if result != resultExpected {
+			t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+
+		// Verify that the result is parsed into the same string
+		e, err = ParseWithParams(result)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %s: %s", result, err)
+		}
+		result2 := string(e.AppendString(nil))
+		if result2 != result {
+			t.Fatalf("unexpected result after parsing %s;\ngot\n%s\nwant\n%s", result, result2, result)
+		}
+	}
+	same := func(s string) {
+		t.Helper()
+		another(s, s)
+	}
+
+	same(`foo`)
+	same(`$x`)
+	another(`${x}`, `$x`)
+	same(`foo > $threshold`)
+	another(`foo > -$threshold`, `foo > (0 - $threshold)`)
+	same(`topk($k, foo)`)
+	same(`foo{job=$job}`)
+	another(`foo{job=${job}, instance!~$i}`, `foo{job=$job,instance!~$i}`)
+	same(`foo{job=$job or job="bar"}`)
+	same(`rate(foo[$window])`)
+	same(`rate(foo[$window:$step])`)
+	same(`rate(foo[5m:$step])`)
+	same(`foo offset $offset`)
+	same(`foo offset -$offset`)
+	same(`foo @ $ts`)
+	same(`foo[$w] offset $o @ $ts`)
+	same(`foo[$w + 1m]`)
+	same(`foo[$w * 2:$step] offset ($o - 1h)`)
+	another(`with (w = $w, f(x) = rate(x[w])) f(foo{job=$job})`, `rate(foo{job=$job}[$w])`)
+	another(`sum(rate(foo{job=$job}[$w])) by (job) * $k + 1`, `(sum(rate(foo{job=$job}[$w])) by(job) * $k) + 1`)
+	same(`foo{job=$job_1}`)
+	another(`$__interval`, `1i`)
+	another(`rate(foo[$__interval]) * $__interval`, `rate(foo) * 1i`)
+	same(`label_set(foo, "a", "$b")`)
+}
+
+func TestParseWithParamsFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+
+		e, err := ParseWithParams(s)
+		if err == nil {
+			t.Fatalf("expecting non-nil error when parsing %s; got %s", s, e.AppendString(nil))
+		}
+	}
+
+	f(`$`)
+	f(`${}`)
+	f(`${x`)
+	f(`$1x`)
+	f(`$__foo`)
+	f(`foo{$job="a"}`)
+	f(`foo{__name__=$name}`)
+	f(`foo{job=$job + "a"}`)
+	f(`foo[$w + 1m`)
+
+	// params aren't allowed in Parse
+	fParse := func(s string) {
+		t.Helper()
+
+		e, err := Parse(s)
+		if err == nil {
+			t.Fatalf("expecting non-nil error when parsing %s; got %s", s, e.AppendString(nil))
+		}
+	}
+	fParse(`$x`)
+	fParse(`foo{job=$job}`)
+	fParse(`rate(foo[$window])`)
+	fParse(`foo offset $offset`)
+}
+
+func TestBindSuccess(t *testing.T) {
+	f := func(s string, params map[string]any, resultExpected string) {
+		t.Helper()
+
+		e, err := ParseWithParams(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %s: %s", s, err)
+		}
+		sOrig := string(e.AppendString(nil))
+		eBound, err := Bind(e, params)
+		if err != nil {
+			t.Fatalf("unexpected error in Bind(%s): %s", s, err)
+		}
+		result := string(eBound.AppendString(nil))
+		if result != resultExpected {
+			t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+
+		// Make sure the original e didn't change
+		if s := string(e.AppendString(nil)); s != sOrig {
+			t.Fatalf("the original expression has been changed;\ngot\n%s\nwant\n%s", s, sOrig)
+		}
+
+		// Make sure the result can be parsed with Parse
+		eResult, err := Parse(result)
+		if err != nil {
+			t.Fatalf("cannot parse the result %s: %s", result, err)
+		}
+		if s := string(eResult.AppendString(nil)); s != result {
+			t.Fatalf("unexpected string after parsing the result;\ngot\n%s\nwant\n%s", s, result)
+		}
+	}
+
+	f(`foo`, nil, `foo`)
+	f(`foo{job=$job}`, map[string]any{
+		"job": "bar",
+	}, `foo{job="bar"}`)
+
+	// label values cannot break the query
+	f(`foo{job=$job}`, map[string]any{
+		"job": `a"} or bar{x="y`,
+	}, `foo{job="a\"} or bar{x=\"y"}`)
+	f(`foo{job=$job,instance!~$instance or x="y"}`, map[string]any{
+		"job":      "a\\b\n",
+		"instance": "foo.+|bar",
+		"unused":   123,
+	}, `foo{job="a\\b\n",instance!~"foo.+|bar" or x="y"}`)
+
+	// durations
+	f(`rate(foo[$w:$step] offset $offset)`, map[string]any{
+		"w":      "5m",
+		"step":   30 * time.Second,
+		"offset": "-1h30m",
+	}, `rate(foo[5m:30000ms] offset -1h30m)`)
+	f(`foo offset -$offset`, map[string]any{
+		"offset": "1h",
+	}, `foo offset -1h`)
+	f(`foo offset -$offset`, map[string]any{
+		"offset": "-1h",
+	}, `foo offset 1h`)
+	f(`with (w = $w) rate(foo[w])`, map[string]any{
+		"w": "2i",
+	}, `rate(foo[2i])`)
+	f(`rate(foo[$w * 2] offset -($o + 1m))`, map[string]any{
+		"w": "5m",
+		"o": time.Hour,
+	}, `rate(foo[5m * 2] offset (0s - (3600000ms + 1m)))`)
+
+	// numbers
+	f(`foo > $threshold`, map[string]any{
+		"threshold": 1.5,
+	}, `foo > 1.5`)
+	f(`topk($k, foo) @ $ts`, map[string]any{
+		"k":  int64(3),
+		"ts": uint32(1700),
+	}, `topk(3, foo) @ 1700`)
+	f(`foo * -$k + $a * 2`, map[string]any{
+		"k": 2,
+		"a": float32(0.5),
+	}, `(foo * -2) + 1`)
+}
+
+func TestBindFailure(t *testing.T) {
+	f := func(s string, params map[string]any) {
+		t.Helper()
+
+		e, err := ParseWithParams(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %s: %s", s, err)
+		}
+		eBound, err := Bind(e, params)
+		if err == nil {
+			t.Fatalf("expecting non-nil error in Bind(%s); got %s", s, eBound.AppendString(nil))
+		}
+	}
+
+	// missing params
+	f(`foo{job=$job}`, nil)
+	f(`rate(foo[$w])`, map[string]any{
+		"job": "a",
+	})
+	f(`foo > $x`, map[string]any{
+		"y": 1,
+	})
+
+	// invalid label values
+	f(`foo{job=$job}`, map[string]any{
+		"job": 123,
+	})
+	f(`foo{job=~$job}`, map[string]any{
+		"job": "(",
+	})
+
+	// invalid durations
+	f(`rate(foo[$w])`, map[string]any{
+		"w": 5,
+	})
+	f(`rate(foo[$w])`, map[string]any{
+		"w": "5 minutes",
+	})
+	f(`rate(foo[$w])`, map[string]any{
+		"w": "$__interval",
+	})
+	f(`rate(foo[$w])`, map[string]any{
+		"w": "-5m",
+	})
+	f(`rate(foo[$w])`, map[string]any{
+		"w": -5 * time.Minute,
+	})
+	f(`rate(foo[5m:$step])`, map[string]any{
+		"step": "-1m",
+	})
+	f(`foo offset -$offset`, map[string]any{
+		"offset": "1h-5m",
+	})
+
+	// invalid duration arithmetic
+	f(`rate(foo[$w / 0])`, map[string]any{
+		"w": "5m",
+	})
+	f(`rate(foo[$w - 10m])`, map[string]any{
+		"w": "5m",
+	})
+	f(`rate(foo[5m:$step - 1m])`, map[string]any{
+		"step": "30s",
+	})
+	f(`foo offset ($o % 0)`, map[string]any{
+		"o": "1h",
+	})
+
+	// invalid numbers
+	f(`foo > $x`, map[string]any{
+		"x": "1",
+	})
+	f(`foo > $x`, map[string]any{
+		"x": time.Second,
+	})
+}
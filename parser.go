@@ -13,8 +13,23 @@ import (
 //
 // MetricsQL is backwards-compatible with PromQL.
 func Parse(s string) (Expr, error) {
+	return parse(s, parseModeDefault)
+}
+
+// ParseWithParams parses MetricsQL query s, which may contain `$name` or `${name}` params.
+//
+// Params may be used in place of label values (`foo{job=$job}`), durations (`rate(foo[$window] offset $offset)`)
+// and numbers (`foo > $threshold`). Param names must consist of letters, digits and underscores.
+// Names starting with `__` are reserved.
+//
+// The returned Expr cannot be evaluated until params are substituted with actual values via Bind.
+func ParseWithParams(s string) (Expr, error) {
+	return parse(s, parseModeParams)
+}
+
+func parse(s string, mode parseMode) (Expr, error) {
 	// Parse s
-	e, err := parseInternal(s)
+	e, err := parseInternal(s, mode)
 	if err != nil {
 		return nil, err
 	}
@@ -32,22 +47,31 @@ func Parse(s string) (Expr, error) {
 	return e, nil
 }
 
-func parseInternal(s string) (Expr, error) {
+func parseInternal(s string, mode parseMode) (Expr, error) {
 	var p parser
 	p.lex.Init(s)
+	p.lex.mode = mode
 	if err := p.lex.Next(); err != nil {
 		return nil, fmt.Errorf(`cannot find the first token: %s`, err)
 	}
 	e, err := p.parseExpr()
 	if err != nil {
-		return nil, fmt.Errorf(`%s; unparsed data: %q`, err, p.lex.Context())
+		return nil, fmt.Errorf(`%s; unparsed data: %q%s`, err, p.lex.Context(), getParseErrorHintSuffix(&p.lex))
 	}
 	if !isEOF(p.lex.Token) {
-		return nil, fmt.Errorf(`unparsed data left: %q`, p.lex.Context())
+		return nil, fmt.Errorf(`unparsed data left: %q%s`, p.lex.Context(), getParseErrorHintSuffix(&p.lex))
 	}
 	return e, nil
 }
 
+func getParseErrorHintSuffix(lex *lexer) string {
+	hint := getParseErrorHint(lex)
+	if hint == "" {
+		return ""
+	}
+	return "; " + hint
+}
+
 // Expr holds any of *Expr types.
 type Expr interface {
 	// AppendString appends string representation of Expr to dst.
@@ -178,6 +202,11 @@ func simplifyConstants(e Expr) Expr {
 		return t
 	case *FuncExpr:
 		simplifyConstantsInplace(t.Args)
+		if n, ok := evalConstantTransformFunc(t); ok {
+			return &NumberExpr{
+				N: n,
+			}
+		}
 		return t
 	case *BinaryOpExpr:
 		return simplifyConstantsInBinaryExpr(t)
@@ -473,6 +502,9 @@ func (p *parser) parseSingleExprWithoutRollupSuffix() (Expr, error) {
 	if isIdentPrefix(p.lex.Token) {
 		return p.parseIdentExpr()
 	}
+	if isParamToken(p.lex.Token) {
+		return p.parseParamExpr()
+	}
 	switch p.lex.Token {
 	case "(":
 		return p.parseParensExpr()
@@ -525,6 +557,19 @@ func (p *parser) parsePositiveNumberExpr() (*NumberExpr, error) {
 	return ne, nil
 }
 
+func (p *parser) parseParamExpr() (*ParamExpr, error) {
+	if !isParamToken(p.lex.Token) {
+		return nil, fmt.Errorf(`paramExpr: unexpected token %q; want "$name"`, p.lex.Token)
+	}
+	pe := &ParamExpr{
+		Name: getParamTokenName(p.lex.Token),
+	}
+	if err := p.lex.Next(); err != nil {
+		return nil, err
+	}
+	return pe, nil
+}
+
 func (p *parser) parseStringExpr() (*StringExpr, error) {
 	var se StringExpr
 
@@ -811,6 +856,15 @@ func expandWithExpr(was []*withArgExpr, e Expr) (Expr, error) {
 		if err != nil {
 			return nil, fmt.Errorf("cannot parse offset in %s: %w", re.Expr.AppendString(nil), err)
 		}
+		if err := checkDurationArithExpr(re.Window, true); err != nil {
+			return nil, fmt.Errorf("invalid window for %s: %w", re.Expr.AppendString(nil), err)
+		}
+		if err := checkDurationArithExpr(re.Step, true); err != nil {
+			return nil, fmt.Errorf("invalid step in %s: %w", re.Expr.AppendString(nil), err)
+		}
+		if err := checkDurationArithExpr(re.Offset, false); err != nil {
+			return nil, fmt.Errorf("invalid offset in %s: %w", re.Expr.AppendString(nil), err)
+		}
 		if t.At != nil {
 			atNew, err := expandWithExpr(was, t.At)
 			if err != nil {
@@ -893,6 +947,7 @@ func expandWithExpr(was []*withArgExpr, e Expr) (Expr, error) {
 					lfeNew.Value = se.(*StringExpr)
 					lfeNew.IsNegative = lfe.IsNegative
 					lfeNew.IsRegexp = lfe.IsRegexp
+					lfeNew.Param = lfe.Param
 					lf, err := lfeNew.toLabelFilter()
 					if err != nil {
 						return nil, err
@@ -1034,6 +1089,13 @@ func expandDuration(was []*withArgExpr, d *DurationExpr) (*DurationExpr, error)
 	if d == nil {
 		return nil, nil
 	}
+	if d.expr != nil {
+		e, err := expandDurationArithExpr(was, d.expr)
+		if err != nil {
+			return nil, err
+		}
+		return newDurationArithExpr(e), nil
+	}
 	if !d.needsParsing {
 		return d, nil
 	}
@@ -1054,6 +1116,18 @@ func expandDuration(was []*withArgExpr, d *DurationExpr) (*DurationExpr, error)
 	case *NumberExpr:
 		// Convert number of seconds to DurationExpr
 		return newDurationExpr(t.s)
+	case *ParamExpr:
+		// Convert `$name` to duration param
+		return &DurationExpr{
+			s: string(appendParam(nil, t.Name)),
+		}, nil
+	case *BinaryOpExpr, *FuncExpr, *parensExpr:
+		// Convert arithmetic expression such as `5m * 2` to duration arithmetic
+		ae, err := toDurationArithExpr(e)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected value for WITH template %q; got %s; want duration: %w", d.s, e.AppendString(nil), err)
+		}
+		return newDurationArithExpr(ae), nil
 	default:
 		return nil, fmt.Errorf("unexpected value for WITH template %q; got %s; want duration", d.s, e.AppendString(nil))
 	}
@@ -1463,6 +1537,17 @@ func (p *parser) parseLabelFilterExpr() (*labelFilterExpr, error) {
 	if err := p.lex.Next(); err != nil {
 		return nil, err
 	}
+	if isParamToken(p.lex.Token) {
+		if lfe.Label == "__name__" {
+			return nil, fmt.Errorf(`labelFilterExpr: params aren't supported for __name__; got %q`, p.lex.Token)
+		}
+		lfe.Param = getParamTokenName(p.lex.Token)
+		lfe.Value = &StringExpr{}
+		if err := p.lex.Next(); err != nil {
+			return nil, err
+		}
+		return &lfe, nil
+	}
 	se, err := p.parseStringExpr()
 	if err != nil {
 		return nil, err
@@ -1484,6 +1569,9 @@ type labelFilterExpr struct {
 	IsRegexp             bool
 	IsNegative           bool
 	IsPossibleMetricName bool
+
+	// Param contains the param name if the value is set via `$name`.
+	Param string
 }
 
 func (lfe *labelFilterExpr) AppendString(dst []byte) []byte {
@@ -1492,6 +1580,9 @@ func (lfe *labelFilterExpr) AppendString(dst []byte) []byte {
 		return dst
 	}
 	dst = appendLabelFilterOp(dst, lfe.IsNegative, lfe.IsRegexp)
+	if lfe.Param != "" {
+		return appendParam(dst, lfe.Param)
+	}
 	tokens := lfe.Value.tokens
 	if len(tokens) == 0 {
 		dst = strconv.AppendQuote(dst, lfe.Value.S)
@@ -1516,7 +1607,8 @@ func (lfe *labelFilterExpr) toLabelFilter() (*LabelFilter, error) {
 	lf.Value = lfe.Value.S
 	lf.IsRegexp = lfe.IsRegexp
 	lf.IsNegative = lfe.IsNegative
-	if !lf.IsRegexp {
+	lf.Param = lfe.Param
+	if !lf.IsRegexp || lf.Param != "" {
 		return &lf, nil
 	}
 
@@ -1543,8 +1635,14 @@ func (p *parser) parseWindowAndStep() (*DurationExpr, *DurationExpr, bool, error
 			// In this case VictoriaMetrics automatically adjusts the lookbehind window
 			// to the interval between samples.
 			err = p.lex.Next()
+			if err == nil && isDurationArithOp(p.lex.Token) {
+				// $__interval is used in duration arithmetic such as `$__interval * 2`, so it cannot be skipped.
+				window, err = p.parseDurationArithExprFrom(&DurationExpr{
+					s: "1i",
+				})
+			}
 		} else {
-			window, err = p.parsePositiveDuration()
+			window, err = p.parseDurationArithExpr()
 		}
 		if err != nil {
 			return nil, nil, false, err
@@ -1564,7 +1662,7 @@ func (p *parser) parseWindowAndStep() (*DurationExpr, *DurationExpr, bool, error
 			}
 		}
 		if p.lex.Token != "]" {
-			step, err = p.parsePositiveDuration()
+			step, err = p.parseDurationArithExpr()
 			if err != nil {
 				return nil, nil, false, err
 			}
@@ -1615,6 +1713,17 @@ func (p *parser) parseDuration() (*DurationExpr, error) {
 			return nil, err
 		}
 	}
+	if p.lex.Token == "(" {
+		// Duration arithmetic must be put in parens outside lookbehind window, e.g. `offset (1h + 30m)`.
+		e, err := p.parseDurationArithOperand()
+		if err != nil {
+			return nil, err
+		}
+		if isNegative {
+			e = negateDurationArithExpr(e)
+		}
+		return newDurationArithExpr(e), nil
+	}
 	de, err := p.parsePositiveDuration()
 	if err != nil {
 		return nil, err
@@ -1625,8 +1734,141 @@ func (p *parser) parseDuration() (*DurationExpr, error) {
 	return de, nil
 }
 
+// parseDurationArithExpr parses duration, which may contain arithmetic operations such as `5m * 2` or `step() * 4`.
+func (p *parser) parseDurationArithExpr() (*DurationExpr, error) {
+	return p.parseDurationArithExprFrom(nil)
+}
+
+// parseDurationArithExprFrom parses duration arithmetic starting from the already parsed left operand.
+//
+// The left operand is parsed from the current token if left is nil.
+func (p *parser) parseDurationArithExprFrom(left Expr) (*DurationExpr, error) {
+	e, err := p.parseDurationArithSum(left)
+	if err != nil {
+		return nil, err
+	}
+	if de, ok := e.(*DurationExpr); ok && strings.HasPrefix(de.s, "-") {
+		return nil, fmt.Errorf(`duration: unexpected negative duration %q`, de.s)
+	}
+	return newDurationArithExpr(e), nil
+}
+
+func (p *parser) parseDurationArithSum(left Expr) (Expr, error) {
+	left, err := p.parseDurationArithProduct(left)
+	if err != nil {
+		return nil, err
+	}
+	for p.lex.Token == "+" || p.lex.Token == "-" {
+		op := p.lex.Token
+		if err := p.lex.Next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseDurationArithProduct(nil)
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryOpExpr{
+			Op:    op,
+			Left:  left,
+			Right: right,
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseDurationArithProduct(left Expr) (Expr, error) {
+	if left == nil {
+		e, err := p.parseDurationArithOperand()
+		if err != nil {
+			return nil, err
+		}
+		left = e
+	}
+	for p.lex.Token == "*" || p.lex.Token == "/" || p.lex.Token == "%" {
+		op := p.lex.Token
+		if err := p.lex.Next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseDurationArithOperand()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryOpExpr{
+			Op:    op,
+			Left:  left,
+			Right: right,
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseDurationArithOperand() (Expr, error) {
+	switch {
+	case p.lex.Token == "(":
+		if err := p.lex.Next(); err != nil {
+			return nil, err
+		}
+		e, err := p.parseDurationArithSum(nil)
+		if err != nil {
+			return nil, err
+		}
+		if p.lex.Token != ")" {
+			return nil, fmt.Errorf(`duration: unexpected token %q; want ")"`, p.lex.Token)
+		}
+		if err := p.lex.Next(); err != nil {
+			return nil, err
+		}
+		return e, nil
+	case p.lex.Token == "-":
+		if err := p.lex.Next(); err != nil {
+			return nil, err
+		}
+		e, err := p.parseDurationArithOperand()
+		if err != nil {
+			return nil, err
+		}
+		return negateDurationArithExpr(e), nil
+	case strings.ToLower(p.lex.Token) == "step":
+		if err := p.lex.Next(); err != nil {
+			return nil, err
+		}
+		if p.lex.Token != "(" {
+			// WITH template reference
+			de := &DurationExpr{
+				s:            "step",
+				needsParsing: true,
+			}
+			return de, nil
+		}
+		if err := p.lex.Next(); err != nil {
+			return nil, err
+		}
+		if p.lex.Token != ")" {
+			return nil, fmt.Errorf(`duration: unexpected token %q; want ")" for step()`, p.lex.Token)
+		}
+		if err := p.lex.Next(); err != nil {
+			return nil, err
+		}
+		fe := &FuncExpr{
+			Name: "step",
+		}
+		return fe, nil
+	default:
+		return p.parsePositiveDuration()
+	}
+}
+
 func (p *parser) parsePositiveDuration() (*DurationExpr, error) {
 	s := p.lex.Token
+	if isParamToken(s) {
+		if err := p.lex.Next(); err != nil {
+			return nil, err
+		}
+		de := &DurationExpr{
+			s: string(appendParam(nil, getParamTokenName(s))),
+		}
+		return de, nil
+	}
 	if isIdentPrefix(s) {
 		n := strings.IndexByte(s, ':')
 		if n >= 0 {
@@ -1671,6 +1913,11 @@ type DurationExpr struct {
 
 	// needsParsing is set to true if s isn't parsed yet with expandWithExpr()
 	needsParsing bool
+
+	// expr contains duration arithmetic such as `5m * 2` if it isn't nil. s contains string representation of expr in this case.
+	//
+	// See newDurationArithExpr for details.
+	expr Expr
 }
 
 func newDurationExpr(s string) (*DurationExpr, error) {
@@ -1693,16 +1940,39 @@ func (de *DurationExpr) AppendString(dst []byte) []byte {
 
 // NonNegativeDuration returns non-negative duration for de in milliseconds.
 //
-// Error is returned if the duration is negative.
+// Error is returned if the duration is negative or if duration arithmetic in de cannot be evaluated.
 func (de *DurationExpr) NonNegativeDuration(step int64) (int64, error) {
-	d := de.Duration(step)
+	d, err := de.DurationErr(step)
+	if err != nil {
+		return 0, err
+	}
 	if d < 0 {
+		if de.expr != nil {
+			return 0, fmt.Errorf("unexpected negative duration %dms for %s", d, de.s)
+		}
 		return 0, fmt.Errorf("unexpected negative duration %dms", d)
 	}
 	return d, nil
 }
 
+// DurationErr returns the duration from de in milliseconds.
+//
+// Error is returned if duration arithmetic in de cannot be evaluated for the given step,
+// e.g. `5m / (step() - 60s)` at 60s step.
+func (de *DurationExpr) DurationErr(step int64) (int64, error) {
+	if de == nil || de.expr == nil {
+		return de.Duration(step), nil
+	}
+	d, err := evalDurationArithExpr(de.expr, step)
+	if err != nil {
+		return 0, fmt.Errorf("cannot evaluate duration %s: %w", de.s, err)
+	}
+	return d, nil
+}
+
 // Duration returns the duration from de in milliseconds.
+//
+// Zero is returned if duration arithmetic in de cannot be evaluated for the given step. Use DurationErr for obtaining the error.
 func (de *DurationExpr) Duration(step int64) int64 {
 	if de == nil {
 		return 0
@@ -1710,6 +1980,13 @@ func (de *DurationExpr) Duration(step int64) int64 {
 	if de.needsParsing {
 		panic(fmt.Errorf("BUG: duration %q must be already parsed", de.s))
 	}
+	if de.expr != nil {
+		d, err := evalDurationArithExpr(de.expr, step)
+		if err != nil {
+			return 0
+		}
+		return d
+	}
 	d, err := DurationValue(de.s, step)
 	if err != nil {
 		panic(fmt.Errorf("BUG: cannot parse duration %q: %s", de.s, err))
@@ -2218,7 +2495,14 @@ func (re *RollupExpr) appendModifiers(dst []byte) []byte {
 	}
 	if re.Offset != nil {
 		dst = append(dst, " offset "...)
-		dst = re.Offset.AppendString(dst)
+		if re.Offset.expr != nil {
+			// Duration arithmetic must be put in parens outside lookbehind window.
+			dst = append(dst, '(')
+			dst = re.Offset.AppendString(dst)
+			dst = append(dst, ')')
+		} else {
+			dst = re.Offset.AppendString(dst)
+		}
 	}
 	if re.At != nil {
 		dst = append(dst, " @ "...)
@@ -2258,12 +2542,20 @@ type LabelFilter struct {
 
 	// IsRegexp represents whether the filter is regesp, i.e. `=~` or `!~`.
 	IsRegexp bool
+
+	// Param contains the param name if the value is set via `$name` param. See ParseWithParams.
+	//
+	// Value is empty until the param is substituted via Bind.
+	Param string
 }
 
 // AppendString appends string representation of me to dst and returns the result.
 func (lf *LabelFilter) AppendString(dst []byte) []byte {
 	dst = appendEscapedIdent(dst, lf.Label)
 	dst = appendLabelFilterOp(dst, lf.IsNegative, lf.IsRegexp)
+	if lf.Param != "" {
+		return appendParam(dst, lf.Param)
+	}
 	dst = strconv.AppendQuote(dst, lf.Value)
 	return dst
 }
@@ -374,6 +374,33 @@ func TestParseSuccess(t *testing.T) {
 	another(`"a">=bool"b"`, `0`)
 	another(`"a"<="b"`, `1`)
 	same(`"a" - "b"`)
+	another(`abs(-5)`, `5`)
+	another(`clamp_max(10, 3)`, `3`)
+	another(`clamp_min(1, 3)`, `3`)
+	another(`clamp(5, 1, 3)`, `3`)
+	another(`clamp(5, 3, 1)`, `NaN`)
+	another(`ln(1) * 100`, `0`)
+	another(`pi()`, `3.141592653589793`)
+	another(`scalar(5)`, `5`)
+	another(`vector(1) + 1`, `2`)
+	another(`round(3.14159, 0.01)`, `3.14`)
+	another(`round(2.5)`, `3`)
+	another(`round(-2.5)`, `-3`)
+	another(`round(17, 5)`, `15`)
+	another(`sgn(-3) + SGN(0) + sgn(2)`, `0`)
+	another(`sqrt(abs(-16)) + floor(2.7) + ceil(2.2)`, `9`)
+	another(`abs(-5) keep_metric_names`, `5`)
+	same(`abs(NaN)`)
+	same(`abs(x)`)
+	same(`clamp_max(x, 3)`)
+	same(`abs(1, 2)`)
+	same(`time()`)
+	same(`now()`)
+	same(`rand()`)
+	same(`rand(1)`)
+	same(`step() + 1`)
+	same(`abs(start())`)
+	same(`end() - 1`)
 	another(`x / a keep_metric_names`, `(x / a) keep_metric_names`)
 	same(`(a + b) keep_metric_names`)
 	another(`((a) + (b)) keep_metric_names`, `(a + b) keep_metric_names`)
@@ -641,6 +668,30 @@ func TestParseSuccess(t *testing.T) {
 	another(`increase(m[$__rate_interval] offset -$__rate_interval) + -$__rate_interval`, `increase(m offset -1i) + (0 - 1i)`)
 	another(`rate(m[$__rate_interval:5m])`, `rate(m[:5m])`)
 	another(`rate(m[$__interval:5m])`, `rate(m[:5m])`)
+
+	// duration arithmetic
+	same(`rate(x[5m * 2])`)
+	another(`rate(x[5m*2])`, `rate(x[5m * 2])`)
+	same(`rate(x[(1h + 30m) / 2])`)
+	another(`rate(x[1h+30m/2])`, `rate(x[1h + (30m / 2)])`)
+	same(`rate(x[step() * 4])`)
+	another(`rate(x[STEP()*4:step()])`, `rate(x[step() * 4:step()])`)
+	same(`x[5m * 2:1m + 30s]`)
+	same(`rate(x[1i * 2])`)
+	another(`rate(x[$__interval * 2])`, `rate(x[1i * 2])`)
+	another(`rate(x[$__rate_interval + 1m])`, `rate(x[1i + 1m])`)
+	same(`x offset (1h + 30m)`)
+	another(`x offset (1h)`, `x offset 1h`)
+	another(`x offset -(1h + 30m)`, `x offset (0s - (1h + 30m))`)
+	another(`x offset (-1h + 30m)`, `x offset (-1h + 30m)`)
+	same(`x[5m * 2] offset (step() % 1m)`)
+	another(`with (w = 5m) rate(x[w * 2])`, `rate(x[5m * 2])`)
+	another(`with (w = 5m * 2) rate(x[w])`, `rate(x[5m * 2])`)
+	another(`with (w = 5m + 1m) rate(x[w * 2])`, `rate(x[(5m + 1m) * 2])`)
+	another(`with (f(w) = rate(x[w * 2] offset (w + 1h))) f(5m)`, `rate(x[5m * 2] offset (5m + 1h))`)
+	another(`with (w = step() * 4) rate(x[w])`, `rate(x[step() * 4])`)
+	another(`with (w = 300) rate(x[w / 2])`, `rate(x[300 / 2])`)
+	another(`with (step = 5m) rate(x[step * 2])`, `rate(x[5m * 2])`)
 }
 
 func TestParseError(t *testing.T) {
@@ -1013,4 +1064,19 @@ func TestParseError(t *testing.T) {
 	f(`with (x={a="b" or c="d"}) x{d="e" or z="c"}`)
 	f(`with (x={a="b" or c="d"}) {x,d="e"}`)
 	f(`with (x={a="b" or c="d"}) {x,d="e" or z="c"}`)
+
+	// invalid duration arithmetic
+	f(`rate(x[5m *])`)
+	f(`rate(x[(5m + 1m])`)
+	f(`rate(x[5m - 10m])`)
+	f(`rate(x[5m-10m])`)
+	f(`rate(x[5m:1m-2m])`)
+	f(`with (w = 5m-10m) rate(x[w])`)
+	f(`rate(x[5m / 0])`)
+	f(`rate(x[5m:1m - 2m])`)
+	f(`rate(x[5m * foo()])`)
+	f(`rate(x[step(1)])`)
+	f(`x offset (1h / 0)`)
+	f(`with (w = 5m > 1m) rate(x[w * 2])`)
+	f(`with (w = abs(5m)) rate(x[w])`)
 }
@@ -1,26 +1,103 @@
 package metricsql
 
+import (
+	"bytes"
+	"strings"
+)
+
 // Prettify returns prettified representation of MetricsQL query q.
 func Prettify(q string) (string, error) {
-	e, err := parseInternal(q)
+	return PrettifyWithOptions(q, PrettifyOptions{})
+}
+
+// PrettifyOptions contains options for PrettifyWithOptions.
+//
+// The zero value contains the options used by Prettify.
+type PrettifyOptions struct {
+	// MaxLineLen is the maximum length of a single line including indentation.
+	//
+	// Lines are limited to 80 chars if MaxLineLen is zero. Actual lines may exceed the maximum length in some cases.
+	MaxLineLen int
+
+	// Indent is the string used for a single indentation level. Two spaces are used if Indent is empty.
+	Indent string
+
+	// StartIndent is the number of indentation levels to put in front of every line.
+	//
+	// This is useful when the prettified query is embedded into YAML or other indented documents.
+	StartIndent int
+
+	// BinaryOpPosition is the position of binary operators when binary operations are split into multiple lines.
+	BinaryOpPosition BinaryOpPosition
+
+	// CompactWith keeps `WITH (...)` definitions on a single line if they fit MaxLineLen.
+	//
+	// Every definition is put on a separate line if CompactWith isn't set.
+	CompactWith bool
+
+	// TrailingComma adds a comma after the last function arg when function args are split into multiple lines.
+	TrailingComma bool
+
+	// AllowParams allows `$name` and `${name}` params in the prettified query in the same way as ParseWithParams does.
+	//
+	// Queries with params are rejected if AllowParams isn't set, since they cannot be parsed with Parse.
+	AllowParams bool
+}
+
+// BinaryOpPosition is the position of binary operators in prettified queries.
+type BinaryOpPosition int
+
+const (
+	// BinaryOpOwnLine puts binary operators on a separate line between the operands.
+	BinaryOpOwnLine BinaryOpPosition = iota
+
+	// BinaryOpLineStart puts binary operators at the start of the line with the right operand.
+	BinaryOpLineStart
+
+	// BinaryOpLineEnd puts binary operators at the end of the line with the left operand.
+	BinaryOpLineEnd
+)
+
+// PrettifyWithOptions returns prettified representation of MetricsQL query q according to opts.
+func PrettifyWithOptions(q string, opts PrettifyOptions) (string, error) {
+	mode := parseModeDefault
+	if opts.AllowParams {
+		mode = parseModeParams
+	}
+	e, err := parseInternal(q, mode)
 	if err != nil {
 		return "", err
 	}
 	e = removeParensExpr(e)
-	b := appendPrettifiedExpr(nil, e, 0, false)
-	return string(b), nil
+	return PrettifyExpr(e, opts), nil
+}
+
+// PrettifyExpr returns prettified representation of e according to opts.
+//
+// Unlike Prettify, it doesn't parse the query, so it may be used for formatting arbitrary expression trees,
+// such as trees returned by Optimize or trees built manually. The result isn't guaranteed to be a valid MetricsQL query
+// if e is invalid, e.g. if it contains unknown functions.
+func PrettifyExpr(e Expr, opts PrettifyOptions) string {
+	if opts.MaxLineLen <= 0 {
+		opts.MaxLineLen = maxPrettifiedLineLen
+	}
+	if opts.Indent == "" {
+		opts.Indent = "  "
+	}
+	b := appendPrettifiedExpr(nil, &opts, e, opts.StartIndent, false)
+	return string(b)
 }
 
-// maxPrettifiedLineLen is the maximum length of a single line returned by Prettify().
+// maxPrettifiedLineLen is the default maximum length of a single line returned by Prettify().
 //
 // Actual lines may exceed the maximum length in some cases.
 const maxPrettifiedLineLen = 80
 
-func appendPrettifiedExpr(dst []byte, e Expr, indent int, needParens bool) []byte {
+func appendPrettifiedExpr(dst []byte, opts *PrettifyOptions, e Expr, indent int, needParens bool) []byte {
 	dstLen := len(dst)
 
 	// Try appending e to dst and check whether its length exceeds the maximum allowed line length.
-	dst = appendIndent(dst, indent)
+	dst = appendIndent(dst, opts, indent)
 	if needParens {
 		dst = append(dst, '(')
 	}
@@ -28,35 +105,47 @@ func appendPrettifiedExpr(dst []byte, e Expr, indent int, needParens bool) []byt
 	if needParens {
 		dst = append(dst, ')')
 	}
-	if len(dst)-dstLen <= maxPrettifiedLineLen {
-		// There is no need in splitting the e string representation, since its' length doesn't exceed maxPrettifiedLineLen.
+	if len(dst)-dstLen <= opts.MaxLineLen {
+		// There is no need in splitting the e string representation, since its' length doesn't exceed opts.MaxLineLen.
 		return dst
 	}
 
-	// The e string representation exceeds maxPrettifiedLineLen. Split it into multiple lines.
+	// The e string representation exceeds opts.MaxLineLen. Split it into multiple lines.
 	dst = dst[:dstLen]
 	if needParens {
-		dst = appendIndent(dst, indent)
+		dst = appendIndent(dst, opts, indent)
 		dst = append(dst, "(\n"...)
 		indent++
 	}
 	switch t := e.(type) {
 	case *withExpr:
+		if opts.CompactWith {
+			// Try putting all the WITH expressions on a single line
+			n := len(dst)
+			dst = appendIndent(dst, opts, indent)
+			dst = appendWithArgExprs(dst, t.Was)
+			if len(dst)-n <= opts.MaxLineLen {
+				dst = append(dst, '\n')
+				dst = appendPrettifiedExpr(dst, opts, t.Expr, indent, false)
+				break
+			}
+			dst = dst[:n]
+		}
 		// Put every WITH expression on a separate line
-		dst = appendIndent(dst, indent)
+		dst = appendIndent(dst, opts, indent)
 		dst = append(dst, "WITH (\n"...)
 		indent++
 		for _, wa := range t.Was {
-			dst = appendPrettifiedExpr(dst, wa, indent, false)
+			dst = appendPrettifiedExpr(dst, opts, wa, indent, false)
 			dst = append(dst, ",\n"...)
 		}
 		indent--
-		dst = appendIndent(dst, indent)
+		dst = appendIndent(dst, opts, indent)
 		dst = append(dst, ")\n"...)
-		dst = appendPrettifiedExpr(dst, t.Expr, indent, false)
+		dst = appendPrettifiedExpr(dst, opts, t.Expr, indent, false)
 	case *withArgExpr:
 		// Wrap long withArgExpr into `(...)`
-		dst = appendIndent(dst, indent)
+		dst = appendIndent(dst, opts, indent)
 		dst = appendEscapedIdent(dst, t.Name)
 		if len(t.Args) > 0 {
 			dst = append(dst, '(')
@@ -68,9 +157,9 @@ func appendPrettifiedExpr(dst []byte, e Expr, indent int, needParens bool) []byt
 			dst = append(dst, ')')
 		}
 		dst = append(dst, " = (\n"...)
-		dst = appendPrettifiedExpr(dst, t.Expr, indent+1, false)
+		dst = appendPrettifiedExpr(dst, opts, t.Expr, indent+1, false)
 		dst = append(dst, '\n')
-		dst = appendIndent(dst, indent)
+		dst = appendIndent(dst, opts, indent)
 		dst = append(dst, ')')
 	case *BinaryOpExpr:
 		// Split:
@@ -82,21 +171,42 @@ func appendPrettifiedExpr(dst []byte, e Expr, indent int, needParens bool) []byt
 		//   foo
 		//     op
 		//   bar
+		//
+		// The operator is put at the start or at the end of the line if opts.BinaryOpPosition is set.
 		if t.KeepMetricNames {
-			dst = appendIndent(dst, indent)
+			dst = appendIndent(dst, opts, indent)
 			dst = append(dst, "(\n"...)
 			indent++
 		}
-		dst = appendPrettifiedExpr(dst, t.Left, indent, t.needLeftParens())
-		dst = append(dst, '\n')
-		dst = appendIndent(dst, indent+1)
-		dst = t.appendModifiers(dst)
-		dst = append(dst, '\n')
-		dst = appendPrettifiedExpr(dst, t.Right, indent, t.needRightParens())
+		dst = appendPrettifiedExpr(dst, opts, t.Left, indent, t.needLeftParens())
+		switch opts.BinaryOpPosition {
+		case BinaryOpLineStart:
+			dst = append(dst, '\n')
+			n := len(dst)
+			dst = appendPrettifiedExpr(dst, opts, t.Right, indent, t.needRightParens())
+			// Put the operator in front of the right operand.
+			right := append([]byte{}, dst[n:]...)
+			right = bytes.TrimPrefix(right, []byte(strings.Repeat(opts.Indent, indent)))
+			dst = appendIndent(dst[:n], opts, indent)
+			dst = t.appendModifiers(dst)
+			dst = append(dst, ' ')
+			dst = append(dst, right...)
+		case BinaryOpLineEnd:
+			dst = append(dst, ' ')
+			dst = t.appendModifiers(dst)
+			dst = append(dst, '\n')
+			dst = appendPrettifiedExpr(dst, opts, t.Right, indent, t.needRightParens())
+		default:
+			dst = append(dst, '\n')
+			dst = appendIndent(dst, opts, indent+1)
+			dst = t.appendModifiers(dst)
+			dst = append(dst, '\n')
+			dst = appendPrettifiedExpr(dst, opts, t.Right, indent, t.needRightParens())
+		}
 		if t.KeepMetricNames {
 			indent--
 			dst = append(dst, '\n')
-			dst = appendIndent(dst, indent)
+			dst = appendIndent(dst, opts, indent)
 			dst = append(dst, ") keep_metric_names"...)
 		}
 	case *RollupExpr:
@@ -109,7 +219,7 @@ func appendPrettifiedExpr(dst []byte, e Expr, indent int, needParens bool) []byt
 		//   (
 		//     q
 		//   )[d:s] offset off @ x
-		dst = appendPrettifiedExpr(dst, t.Expr, indent, t.needParens())
+		dst = appendPrettifiedExpr(dst, opts, t.Expr, indent, t.needParens())
 		dst = t.appendModifiers(dst)
 	case *AggrFuncExpr:
 		// Split:
@@ -123,9 +233,9 @@ func appendPrettifiedExpr(dst []byte, e Expr, indent int, needParens bool) []byt
 		//     ...
 		//     argN
 		//   ) modifiers
-		dst = appendIndent(dst, indent)
+		dst = appendIndent(dst, opts, indent)
 		dst = appendEscapedIdent(dst, t.Name)
-		dst = appendPrettifiedFuncArgs(dst, indent, t.Args)
+		dst = appendPrettifiedFuncArgs(dst, opts, indent, t.Args)
 		dst = t.appendModifiers(dst)
 	case *FuncExpr:
 		// Split:
@@ -139,9 +249,9 @@ func appendPrettifiedExpr(dst []byte, e Expr, indent int, needParens bool) []byt
 		//     ...
 		//     argN
 		//   ) modifiers
-		dst = appendIndent(dst, indent)
+		dst = appendIndent(dst, opts, indent)
 		dst = appendEscapedIdent(dst, t.Name)
-		dst = appendPrettifiedFuncArgs(dst, indent, t.Args)
+		dst = appendPrettifiedFuncArgs(dst, opts, indent, t.Args)
 		dst = t.appendModifiers(dst)
 	case *MetricExpr:
 		// Split:
@@ -157,6 +267,11 @@ func appendPrettifiedExpr(dst []byte, e Expr, indent int, needParens bool) []byt
 		//       or
 		//     filtersN
 		//   }
+		if len(t.labelFilterss) == 0 {
+			// The expression has been obtained via Parse or has been built manually.
+			dst = appendPrettifiedExpandedMetricExpr(dst, opts, t, indent)
+			break
+		}
 		lfss := t.labelFilterss
 		offset := 0
 		metricName := getMetricNameFromLabelFilterss(lfss)
@@ -165,7 +280,7 @@ func appendPrettifiedExpr(dst []byte, e Expr, indent int, needParens bool) []byt
 		if metricName != "" {
 			offset = 1
 		}
-		dst = appendIndent(dst, indent)
+		dst = appendIndent(dst, opts, indent)
 		if !metricNamehasEscapedChars {
 			dst = appendEscapedIdent(dst, metricName)
 		}
@@ -186,57 +301,100 @@ func appendPrettifiedExpr(dst []byte, e Expr, indent int, needParens bool) []byt
 				if len(lfs) == 0 {
 					continue
 				}
-				dst = appendPrettifiedLabelFilters(dst, indent+1, lfs)
+				dst = appendPrettifiedLabelFilters(dst, opts, indent+1, lfs)
 				dst = append(dst, '\n')
 				if i+1 < len(lfss) && len(lfss[i+1]) > offset {
-					dst = appendIndent(dst, indent+2)
+					dst = appendIndent(dst, opts, indent+2)
 					dst = append(dst, "or\n"...)
 				}
 			}
-			dst = appendIndent(dst, indent)
+			dst = appendIndent(dst, opts, indent)
 			dst = append(dst, '}')
 		}
 	default:
 		// marshal other expressions as is
+		dst = appendIndent(dst, opts, indent)
 		dst = t.AppendString(dst)
 	}
 	if needParens {
 		indent--
 		dst = append(dst, '\n')
-		dst = appendIndent(dst, indent)
+		dst = appendIndent(dst, opts, indent)
 		dst = append(dst, ')')
 	}
 	return dst
 }
 
-func appendPrettifiedFuncArgs(dst []byte, indent int, args []Expr) []byte {
+func appendPrettifiedFuncArgs(dst []byte, opts *PrettifyOptions, indent int, args []Expr) []byte {
 	dst = append(dst, "(\n"...)
 	for i, arg := range args {
-		dst = appendPrettifiedExpr(dst, arg, indent+1, false)
-		if i+1 < len(args) {
+		dst = appendPrettifiedExpr(dst, opts, arg, indent+1, false)
+		if i+1 < len(args) || opts.TrailingComma {
 			dst = append(dst, ',')
 		}
 		dst = append(dst, '\n')
 	}
-	dst = appendIndent(dst, indent)
+	dst = appendIndent(dst, opts, indent)
 	dst = append(dst, ')')
 	return dst
 }
 
-func appendPrettifiedLabelFilters(dst []byte, indent int, lfs []*labelFilterExpr) []byte {
+func appendPrettifiedExpandedMetricExpr(dst []byte, opts *PrettifyOptions, me *MetricExpr, indent int) []byte {
+	dst = appendIndent(dst, opts, indent)
+	lfss := me.LabelFilterss
+	if len(lfss) == 0 || me.isOnlyMetricName() {
+		return me.AppendString(dst)
+	}
+	offset := 0
+	if metricName := me.getMetricName(); metricName != "" {
+		offset = 1
+		dst = appendEscapedIdent(dst, metricName)
+	}
+	dst = append(dst, "{\n"...)
+	for i, lfs := range lfss {
+		lfs = lfs[offset:]
+		if len(lfs) == 0 {
+			continue
+		}
+		lfPtrs := make([]*LabelFilter, len(lfs))
+		for j := range lfs {
+			lfPtrs[j] = &lfs[j]
+		}
+		dst = appendPrettifiedLabelFilters(dst, opts, indent+1, lfPtrs)
+		dst = append(dst, '\n')
+		if i+1 < len(lfss) && len(lfss[i+1]) > offset {
+			dst = appendIndent(dst, opts, indent+2)
+			dst = append(dst, "or\n"...)
+		}
+	}
+	dst = appendIndent(dst, opts, indent)
+	dst = append(dst, '}')
+	return dst
+}
+
+type labelFilterAppender interface {
+	AppendString(dst []byte) []byte
+}
+
+func appendPrettifiedLabelFilters[T labelFilterAppender](dst []byte, opts *PrettifyOptions, indent int, lfs []T) []byte {
 	dstLen := len(dst)
 
 	// Try marshaling lfs into a single line
-	dst = appendIndent(dst, indent)
-	dst = appendLabelFilterExprs(dst, lfs)
-	if len(dst)-dstLen <= maxPrettifiedLineLen {
+	dst = appendIndent(dst, opts, indent)
+	for i, lf := range lfs {
+		dst = lf.AppendString(dst)
+		if i+1 < len(lfs) {
+			dst = append(dst, ',')
+		}
+	}
+	if len(dst)-dstLen <= opts.MaxLineLen {
 		return dst
 	}
 
 	// Too long line - split it into multiple lines
 	dst = dst[:dstLen]
 	for i := range lfs {
-		dst = appendIndent(dst, indent)
+		dst = appendIndent(dst, opts, indent)
 		dst = lfs[i].AppendString(dst)
 		if i+1 < len(lfs) {
 			dst = append(dst, ",\n"...)
@@ -245,9 +403,21 @@ func appendPrettifiedLabelFilters(dst []byte, indent int, lfs []*labelFilterExpr
 	return dst
 }
 
-func appendIndent(dst []byte, indent int) []byte {
+func appendIndent(dst []byte, opts *PrettifyOptions, indent int) []byte {
 	for range indent {
-		dst = append(dst, "  "...)
+		dst = append(dst, opts.Indent...)
 	}
 	return dst
 }
+
+func appendWithArgExprs(dst []byte, was []*withArgExpr) []byte {
+	dst = append(dst, "WITH ("...)
+	for i, wa := range was {
+		dst = wa.AppendString(dst)
+		if i+1 < len(was) {
+			dst = append(dst, ", "...)
+		}
+	}
+	dst = append(dst, ')')
+	return dst
+}
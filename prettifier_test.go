@@ -20,6 +20,10 @@ func TestPrettifyError(t *testing.T) {
 
 	f(`foo{`)
 	f(`invalid query`)
+
+	// params are rejected in the same way as Parse does
+	f(`foo{a=$v} > $n`)
+	f(`rate(foo[$window])`)
 }
 
 func TestPrettifyOkParseError(t *testing.T) {
@@ -283,3 +287,202 @@ x + sum(y)`)
 
 	another(`10 - (3 + 3 + 4)`, `10 - ((3 + 3) + 4)`)
 }
+
+func TestPrettifyWithOptions(t *testing.T) {
+	f := func(q string, opts PrettifyOptions, resultExpected string) {
+		t.Helper()
+
+		result, err := PrettifyWithOptions(q, opts)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", q, err)
+		}
+		if result != resultExpected {
+			t.Fatalf("unexpected query after prettifying;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+
+		// Verify that the prettified result is successfully parsed into the same string as the original query
+		parseFunc := Parse
+		if opts.AllowParams {
+			parseFunc = ParseWithParams
+		}
+		e, err := parseFunc(q)
+		if err != nil {
+			t.Fatalf("cannot parse original string: %s", err)
+		}
+		eResult, err := parseFunc(result)
+		if err != nil {
+			t.Fatalf("cannot parse prettified result: %s", err)
+		}
+		sExpected := e.AppendString(nil)
+		sGot := eResult.AppendString(nil)
+		if string(sExpected) != string(sGot) {
+			t.Fatalf("unexpected prettified string after parsing;\ngot\n%s\nwant\n%s", sGot, sExpected)
+		}
+	}
+
+	q := `sum(rate(http_requests_total{job="api",instance="foo"}[5m])) by (job) / on(job) group_left sum(rate(http_requests_total[5m])) by (job)`
+
+	// default options
+	f(q, PrettifyOptions{}, `sum(rate(http_requests_total{job="api",instance="foo"}[5m])) by(job)
+  / on(job) group_left()
+sum(rate(http_requests_total[5m])) by(job)`)
+
+	// line width
+	f(q, PrettifyOptions{MaxLineLen: 140}, `sum(rate(http_requests_total{job="api",instance="foo"}[5m])) by(job) / on(job) group_left() sum(rate(http_requests_total[5m])) by(job)`)
+	f(q, PrettifyOptions{MaxLineLen: 50}, `sum(
+  rate(
+    http_requests_total{job="api",instance="foo"}[5m]
+  )
+) by(job)
+  / on(job) group_left()
+sum(rate(http_requests_total[5m])) by(job)`)
+
+	// indent
+	f(q, PrettifyOptions{Indent: "\t", StartIndent: 2}, "\t\tsum(rate(http_requests_total{job=\"api\",instance=\"foo\"}[5m])) by(job)\n"+
+		"\t\t\t/ on(job) group_left()\n"+
+		"\t\tsum(rate(http_requests_total[5m])) by(job)")
+	f(`foo{bar="baz"}`, PrettifyOptions{StartIndent: 3}, `      foo{bar="baz"}`)
+
+	// binary operator position
+	f(q, PrettifyOptions{BinaryOpPosition: BinaryOpLineStart}, `sum(rate(http_requests_total{job="api",instance="foo"}[5m])) by(job)
+/ on(job) group_left() sum(rate(http_requests_total[5m])) by(job)`)
+	f(q, PrettifyOptions{BinaryOpPosition: BinaryOpLineEnd}, `sum(rate(http_requests_total{job="api",instance="foo"}[5m])) by(job) / on(job) group_left()
+sum(rate(http_requests_total[5m])) by(job)`)
+	f(`sum(rate(http_requests_total{job="api"}[5m])) + sum(rate(http_requests_total{job="api",instance="foo"}[5m]))`,
+		PrettifyOptions{BinaryOpPosition: BinaryOpLineStart, MaxLineLen: 50}, `sum(rate(http_requests_total{job="api"}[5m]))
++ sum(
+  rate(
+    http_requests_total{job="api",instance="foo"}[5m]
+  )
+)`)
+
+	// trailing comma
+	f(q, PrettifyOptions{TrailingComma: true, MaxLineLen: 50}, `sum(
+  rate(
+    http_requests_total{job="api",instance="foo"}[5m],
+  ),
+) by(job)
+  / on(job) group_left()
+sum(rate(http_requests_total[5m])) by(job)`)
+
+	// WITH definitions
+	q = `with (a = rate(x[5m]), b = rate(y[5m])) sum(a) by (job) / sum(b) by (job) + sum(a + b) by (instance, job, pod, container, namespace)`
+	f(q, PrettifyOptions{}, `WITH (
+  a = rate(x[5m]),
+  b = rate(y[5m]),
+)
+(sum(a) by(job) / sum(b) by(job))
+  +
+sum(a + b) by(instance,job,pod,container,namespace)`)
+	f(q, PrettifyOptions{CompactWith: true}, `WITH (a = rate(x[5m]), b = rate(y[5m]))
+(sum(a) by(job) / sum(b) by(job))
+  +
+sum(a + b) by(instance,job,pod,container,namespace)`)
+	f(q, PrettifyOptions{CompactWith: true, MaxLineLen: 30}, `WITH (
+  a = rate(x[5m]),
+  b = rate(y[5m]),
+)
+(
+  sum(a) by(job)
+    /
+  sum(b) by(job)
+)
+  +
+sum(
+  a + b
+) by(instance,job,pod,container,namespace)`)
+
+	// params
+	f(`foo{a=$v} > $n`, PrettifyOptions{AllowParams: true}, `foo{a=$v} > $n`)
+	f(`rate(foo[${window}] offset $offset)`, PrettifyOptions{AllowParams: true}, `rate(foo[$window] offset $offset)`)
+}
+
+func TestPrettifyExpr(t *testing.T) {
+	// PrettifyExpr for parsed query must return the same result as Prettify
+	fParsed := func(q string) {
+		t.Helper()
+
+		resultExpected, err := Prettify(q)
+		if err != nil {
+			t.Fatalf("unexpected error when prettifying %q: %s", q, err)
+		}
+		e, err := Parse(q)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", q, err)
+		}
+		result := PrettifyExpr(e, PrettifyOptions{})
+		if result != resultExpected {
+			t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+	fParsed(`foo`)
+	fParsed(`{}`)
+	fParsed(`foo{bar="baz"} + rate(x{y="x"}[5m] offset 1h)`)
+	fParsed(`sum(rate(http_requests_total{job="api",instance="foo"}[5m])) by (job) / on(job) group_left sum(rate(http_requests_total[5m])) by (job)`)
+	fParsed(`process_cpu_seconds_total{aaaaaaaaaaaaaaaaaaaaaaaaaaaaa="bbbbbbbbbbbbbbbbbbbbbbbbbbbbb",ccccccccccccccccccccccccccccccccc="dddddddddddddddddddddddddddd"}`)
+	fParsed(`foo{aaaaaaaaaaaaaaaaaaaaaaaaaaaaaa="bbbbbbbbbbbbbbbbbbbbbbbbbbb" or cccccccccccccccccccccccccccccc="dddddddddddddddddddddddddddd"}`)
+	fParsed(`{aaaaaaaaaaaaaaaaaaaaaaaaaaaaaa="bbbbbbbbbbbbbbbbbbbbbbbbbbb" or cccccccccccccccccccccccccccccc="dddddddddddddddddddddddddddd"}`)
+	fParsed(`(a + b) keep_metric_names + label_set(rate(xxxxxxxxxxxxxxxxxxxxxxxxxxxxx[5m]), "aaaaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbbbbbbbbbbbbb")`)
+
+	f := func(e Expr, opts PrettifyOptions, resultExpected string) {
+		t.Helper()
+
+		sOrig := string(e.AppendString(nil))
+		result := PrettifyExpr(e, opts)
+		if result != resultExpected {
+			t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+		// Make sure e didn't change
+		s := string(e.AppendString(nil))
+		if s != sOrig {
+			t.Fatalf("the original expression has been changed;\ngot\n%s\nwant\n%s", s, sOrig)
+		}
+	}
+
+	// optimized expression
+	e, err := Parse(`sum(rate(http_requests_total{job="api"}[5m])) * 1 / on(instance) sum(rate(http_requests_total{instance="foo"}[5m])) by (instance)`)
+	if err != nil {
+		t.Fatalf("cannot parse query: %s", err)
+	}
+	f(Optimize(e), PrettifyOptions{}, `sum(rate(http_requests_total{job="api"}[5m]))
+  / on(instance)
+sum(rate(http_requests_total{instance="foo"}[5m])) by(instance)`)
+
+	// manually built expression with unknown function
+	me := &MetricExpr{
+		LabelFilterss: [][]LabelFilter{
+			{
+				{Label: "__name__", Value: "http_requests_total"},
+				{Label: "job", Value: "api"},
+			},
+			{
+				{Label: "__name__", Value: "http_requests_total"},
+				{Label: "instance", Value: "foo.*", IsRegexp: true},
+			},
+		},
+	}
+	fe := &FuncExpr{
+		Name: "my_custom_func",
+		Args: []Expr{
+			&RollupExpr{
+				Expr: me,
+				Window: &DurationExpr{
+					s: "5m",
+				},
+			},
+			&NumberExpr{
+				N: 42,
+			},
+		},
+	}
+	f(fe, PrettifyOptions{}, `my_custom_func(http_requests_total{job="api" or instance=~"foo.*"}[5m], 42)`)
+	f(fe, PrettifyOptions{MaxLineLen: 30, TrailingComma: true}, `my_custom_func(
+  http_requests_total{
+    job="api"
+      or
+    instance=~"foo.*"
+  }[5m],
+  42,
+)`)
+	f(&StringExpr{S: "some long string"}, PrettifyOptions{MaxLineLen: 10, StartIndent: 1}, `  "some long string"`)
+}
@@ -0,0 +1,481 @@
+package metricsql
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// RecordingRule represents a recording rule, which stores the results of Expr under the Record metric name.
+type RecordingRule struct {
+	// Record is the name of the metric for the rule results.
+	Record string
+
+	// Expr is MetricsQL expression for the rule.
+	Expr string
+}
+
+// RecordingRulesRewriter rewrites queries, so they use metrics produced by recording rules
+// instead of calculating the same expressions from the raw data.
+//
+// RecordingRulesRewriter is safe for concurrent use.
+type RecordingRulesRewriter struct {
+	rules []*recordingRule
+}
+
+type recordingRule struct {
+	record string
+	expr   Expr
+
+	// preserved contains labels from the input series, which are preserved in the rule output.
+	//
+	// Filters on these labels can be applied to the rule output instead of the input series.
+	preserved *preservedLabels
+}
+
+// NewRecordingRulesRewriter returns rewriter for the given rules.
+//
+// Rules are matched in the given order, so the first matching rule wins if multiple rules match the same expression.
+func NewRecordingRulesRewriter(rules []RecordingRule) (*RecordingRulesRewriter, error) {
+	rrs := make([]*recordingRule, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Record == "" {
+			return nil, fmt.Errorf("missing record name for the rule %q", rule.Expr)
+		}
+		e, err := Parse(rule.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse expression for the rule %q: %w", rule.Record, err)
+		}
+		rrs = append(rrs, &recordingRule{
+			record:    rule.Record,
+			expr:      e,
+			preserved: getPreservedLabels(e),
+		})
+	}
+	rr := &RecordingRulesRewriter{
+		rules: rrs,
+	}
+	return rr, nil
+}
+
+// Rewrite returns a copy of e where sub-expressions matching recording rules are substituted with the recorded metrics.
+//
+// Sub-expressions are compared structurally after WITH expansion, so label filters order, function names case
+// and modifier args order do not matter. For example, the rule `job:requests:rate5m = sum(rate(requests_total[5m])) by (job)`
+// is applied to the following queries:
+//
+//	sum(rate(requests_total{job="api"}[5m])) by (job)  ->  job:requests:rate5m{job="api"}
+//	sum(rate(requests_total[5m]))                     ->  sum(job:requests:rate5m)
+//	max(sum(rate(requests_total[5m])) by (job))       ->  max(job:requests:rate5m)
+//
+// Additional label filters are moved to the recorded metric only if the rule preserves the filtered labels.
+// Outer `sum`, `min`, `max`, `count` and `group` aggregations are applied to the recorded metric if they group
+// by a subset of the labels from `by(...)` modifier of the same aggregation in the rule.
+func (rr *RecordingRulesRewriter) Rewrite(e Expr) Expr {
+	if len(rr.rules) == 0 {
+		return e
+	}
+	eCopy := Clone(e)
+	return rr.rewrite(eCopy)
+}
+
+func (rr *RecordingRulesRewriter) rewrite(e Expr) Expr {
+	if eNew := rr.substitute(e); eNew != nil {
+		return eNew
+	}
+	switch t := e.(type) {
+	case *RollupExpr:
+		t.Expr = rr.rewrite(t.Expr)
+		if t.At != nil {
+			t.At = rr.rewrite(t.At)
+		}
+	case *FuncExpr:
+		rr.rewriteArgs(t.Args)
+	case *AggrFuncExpr:
+		rr.rewriteArgs(t.Args)
+	case *BinaryOpExpr:
+		t.Left = rr.rewrite(t.Left)
+		t.Right = rr.rewrite(t.Right)
+	}
+	return e
+}
+
+func (rr *RecordingRulesRewriter) rewriteArgs(args []Expr) {
+	for i, arg := range args {
+		args[i] = rr.rewrite(arg)
+	}
+}
+
+// substitute returns e with the applied recording rule.
+//
+// nil is returned if no rules match e.
+func (rr *RecordingRulesRewriter) substitute(e Expr) Expr {
+	for _, rule := range rr.rules {
+		var rm ruleMatcher
+		if rm.match(rule.expr, e) && rm.canPushdown(rule) {
+			return rm.newRecordedMetricExpr(rule)
+		}
+	}
+	ae, ok := e.(*AggrFuncExpr)
+	if !ok {
+		return nil
+	}
+	for _, rule := range rr.rules {
+		if eNew := substituteReaggregation(rule, ae); eNew != nil {
+			return eNew
+		}
+	}
+	return nil
+}
+
+// substituteReaggregation returns `aggr(record) by (...)` if ae can be calculated by aggregating the results of the rule.
+//
+// nil is returned otherwise.
+func substituteReaggregation(rule *recordingRule, ae *AggrFuncExpr) Expr {
+	reaggrFuncName := getReaggregationFuncName(ae.Name)
+	if reaggrFuncName == "" || len(ae.Args) != 1 {
+		return nil
+	}
+	ruleAe, ok := rule.expr.(*AggrFuncExpr)
+	if !ok || !strings.EqualFold(ruleAe.Name, ae.Name) || len(ruleAe.Args) != 1 || ruleAe.Limit > 0 {
+		return nil
+	}
+	if !strings.EqualFold(ruleAe.Modifier.Op, "by") {
+		return nil
+	}
+	switch strings.ToLower(ae.Modifier.Op) {
+	case "":
+	case "by":
+		ruleLabels := make(map[string]bool, len(ruleAe.Modifier.Args))
+		for _, label := range ruleAe.Modifier.Args {
+			ruleLabels[label] = true
+		}
+		for _, label := range ae.Modifier.Args {
+			if !ruleLabels[label] {
+				return nil
+			}
+		}
+	default:
+		return nil
+	}
+	var rm ruleMatcher
+	if !rm.match(ruleAe.Args[0], ae.Args[0]) || !rm.canPushdown(rule) {
+		return nil
+	}
+	return &AggrFuncExpr{
+		Name: reaggrFuncName,
+		Args: []Expr{
+			rm.newRecordedMetricExpr(rule),
+		},
+		Modifier: ae.Modifier,
+		Limit:    ae.Limit,
+	}
+}
+
+// getReaggregationFuncName returns the name of aggregate function, which must be applied to the results
+// of aggrFuncName in order to get the results of aggrFuncName over a subset of grouping labels.
+//
+// An empty string is returned if aggrFuncName cannot be calculated from partial results.
+func getReaggregationFuncName(aggrFuncName string) string {
+	switch strings.ToLower(aggrFuncName) {
+	case "sum", "count":
+		return "sum"
+	case "min":
+		return "min"
+	case "max":
+		return "max"
+	case "group":
+		return "group"
+	default:
+		return ""
+	}
+}
+
+// ruleMatcher matches recording rule expressions against query expressions.
+//
+// Query selectors may contain additional label filters compared to the rule selectors.
+// These filters must be the same across all the selectors in the query expression.
+type ruleMatcher struct {
+	hasExtraFilters bool
+	extraFilters    []LabelFilter
+	extraFiltersKey string
+}
+
+func (rm *ruleMatcher) canPushdown(rule *recordingRule) bool {
+	for _, lf := range rm.extraFilters {
+		if !rule.preserved.contains(lf.Label) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rm *ruleMatcher) newRecordedMetricExpr(rule *recordingRule) *MetricExpr {
+	me := newMetricExpr(rule.record)
+	lfs := append(me.LabelFilterss[0], rm.extraFilters...)
+	sortLabelFilters(lfs)
+	me.LabelFilterss[0] = lfs
+	return me
+}
+
+func (rm *ruleMatcher) match(r, q Expr) bool {
+	switch rt := r.(type) {
+	case *MetricExpr:
+		qt, ok := q.(*MetricExpr)
+		return ok && rm.matchMetricExpr(rt, qt)
+	case *RollupExpr:
+		qt, ok := q.(*RollupExpr)
+		if !ok || rt.InheritStep != qt.InheritStep {
+			return false
+		}
+		if !durationExprsEqual(rt.Window, qt.Window) || !durationExprsEqual(rt.Step, qt.Step) || !durationExprsEqual(rt.Offset, qt.Offset) {
+			return false
+		}
+		if (rt.At == nil) != (qt.At == nil) || rt.At != nil && !rm.match(rt.At, qt.At) {
+			return false
+		}
+		return rm.match(rt.Expr, qt.Expr)
+	case *FuncExpr:
+		qt, ok := q.(*FuncExpr)
+		if !ok || !strings.EqualFold(rt.Name, qt.Name) || rt.KeepMetricNames != qt.KeepMetricNames {
+			return false
+		}
+		return rm.matchArgs(rt.Args, qt.Args)
+	case *AggrFuncExpr:
+		qt, ok := q.(*AggrFuncExpr)
+		if !ok || !strings.EqualFold(rt.Name, qt.Name) || rt.Limit != qt.Limit || !modifierExprsEqual(&rt.Modifier, &qt.Modifier) {
+			return false
+		}
+		return rm.matchArgs(rt.Args, qt.Args)
+	case *BinaryOpExpr:
+		qt, ok := q.(*BinaryOpExpr)
+		if !ok || !strings.EqualFold(rt.Op, qt.Op) || rt.Bool != qt.Bool || rt.KeepMetricNames != qt.KeepMetricNames {
+			return false
+		}
+		if !modifierExprsEqual(&rt.GroupModifier, &qt.GroupModifier) || !modifierExprsEqual(&rt.JoinModifier, &qt.JoinModifier) {
+			return false
+		}
+		if (rt.JoinModifierPrefix == nil) != (qt.JoinModifierPrefix == nil) || rt.JoinModifierPrefix != nil && rt.JoinModifierPrefix.S != qt.JoinModifierPrefix.S {
+			return false
+		}
+		return rm.match(rt.Left, qt.Left) && rm.match(rt.Right, qt.Right)
+	case *NumberExpr:
+		qt, ok := q.(*NumberExpr)
+		return ok && (rt.N == qt.N || math.IsNaN(rt.N) && math.IsNaN(qt.N))
+	case *StringExpr:
+		qt, ok := q.(*StringExpr)
+		return ok && rt.S == qt.S
+	case *DurationExpr:
+		qt, ok := q.(*DurationExpr)
+		return ok && durationExprsEqual(rt, qt)
+	default:
+		return false
+	}
+}
+
+func (rm *ruleMatcher) matchArgs(rArgs, qArgs []Expr) bool {
+	if len(rArgs) != len(qArgs) {
+		return false
+	}
+	for i := range rArgs {
+		if !rm.match(rArgs[i], qArgs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rm *ruleMatcher) matchMetricExpr(r, q *MetricExpr) bool {
+	if len(r.LabelFilterss) != 1 || len(q.LabelFilterss) != 1 {
+		// Selectors with `or` filters must be identical.
+		return string(r.AppendString(nil)) == string(q.AppendString(nil))
+	}
+	rlfs := getLabelFiltersMap(r.LabelFilterss[0])
+	var extraFilters []LabelFilter
+	var b []byte
+	for _, lf := range q.LabelFilterss[0] {
+		b = lf.AppendString(b[:0])
+		if _, ok := rlfs[string(b)]; ok {
+			delete(rlfs, string(b))
+			continue
+		}
+		if lf.Label == "__name__" {
+			return false
+		}
+		extraFilters = append(extraFilters, lf)
+	}
+	if len(rlfs) > 0 {
+		// q misses some filters from r.
+		return false
+	}
+	sortLabelFilters(extraFilters)
+	b = appendLabelFilters(b[:0], extraFilters)
+	if rm.hasExtraFilters {
+		return rm.extraFiltersKey == string(b)
+	}
+	rm.hasExtraFilters = true
+	rm.extraFilters = extraFilters
+	rm.extraFiltersKey = string(b)
+	return true
+}
+
+func modifierExprsEqual(a, b *ModifierExpr) bool {
+	if !strings.EqualFold(a.Op, b.Op) || len(a.Args) != len(b.Args) {
+		return false
+	}
+	m := make(map[string]bool, len(a.Args))
+	for _, arg := range a.Args {
+		m[arg] = true
+	}
+	for _, arg := range b.Args {
+		if !m[arg] {
+			return false
+		}
+	}
+	return true
+}
+
+func durationExprsEqual(a, b *DurationExpr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.s == b.s {
+		return true
+	}
+	if a.expr != nil || b.expr != nil {
+		// Duration arithmetic may be non-finite for some steps, so compare it only by string representation.
+		return false
+	}
+	// Compare durations for distinct steps, so `1i` isn't equal to `1m`, while `60s` is equal to `1m`.
+	for _, step := range []int64{1, 7} {
+		da, errA := a.DurationErr(step)
+		db, errB := b.DurationErr(step)
+		if errA != nil || errB != nil || da != db {
+			return false
+		}
+	}
+	return true
+}
+
+// preservedLabels represents a set of input labels, which are preserved by some expression.
+type preservedLabels struct {
+	// If all is set, then all the labels except of labels are preserved.
+	// Otherwise only labels are preserved.
+	all    bool
+	labels map[string]bool
+}
+
+func (pl *preservedLabels) contains(label string) bool {
+	if pl.all {
+		return !pl.labels[label]
+	}
+	return pl.labels[label]
+}
+
+func newPreservedLabels(all bool, labels []string) *preservedLabels {
+	m := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		m[label] = true
+	}
+	return &preservedLabels{
+		all:    all,
+		labels: m,
+	}
+}
+
+func intersectPreservedLabels(a, b *preservedLabels) *preservedLabels {
+	m := make(map[string]bool)
+	switch {
+	case a.all && b.all:
+		for label := range a.labels {
+			m[label] = true
+		}
+		for label := range b.labels {
+			m[label] = true
+		}
+		return &preservedLabels{
+			all:    true,
+			labels: m,
+		}
+	case !a.all:
+		for label := range a.labels {
+			if b.contains(label) {
+				m[label] = true
+			}
+		}
+	default:
+		for label := range b.labels {
+			if a.contains(label) {
+				m[label] = true
+			}
+		}
+	}
+	return &preservedLabels{
+		labels: m,
+	}
+}
+
+// getPreservedLabels returns labels from the input series, which are preserved in the output of e,
+// so filters on these labels can be applied either to the input series or to the output of e with the same result.
+func getPreservedLabels(e Expr) *preservedLabels {
+	switch t := e.(type) {
+	case *MetricExpr, *NumberExpr, *StringExpr:
+		return newPreservedLabels(true, nil)
+	case *RollupExpr:
+		return getPreservedLabels(t.Expr)
+	case *FuncExpr:
+		if !canPreserveLabels(t.Name) {
+			return newPreservedLabels(false, nil)
+		}
+		pl := newPreservedLabels(true, nil)
+		if strings.HasPrefix(strings.ToLower(t.Name), "histogram_") {
+			// Histogram functions merge buckets into a single series.
+			pl = newPreservedLabels(true, []string{"le", "vmrange"})
+		}
+		for _, arg := range t.Args {
+			pl = intersectPreservedLabels(pl, getPreservedLabels(arg))
+		}
+		return pl
+	case *AggrFuncExpr:
+		var pl *preservedLabels
+		switch strings.ToLower(t.Modifier.Op) {
+		case "by":
+			pl = newPreservedLabels(false, t.Modifier.Args)
+		case "without":
+			pl = newPreservedLabels(true, t.Modifier.Args)
+		default:
+			return newPreservedLabels(false, nil)
+		}
+		for _, arg := range t.Args {
+			pl = intersectPreservedLabels(pl, getPreservedLabels(arg))
+		}
+		return pl
+	case *BinaryOpExpr:
+		pl := intersectPreservedLabels(getPreservedLabels(t.Left), getPreservedLabels(t.Right))
+		switch strings.ToLower(t.GroupModifier.Op) {
+		case "on":
+			pl = intersectPreservedLabels(pl, newPreservedLabels(false, t.GroupModifier.Args))
+		case "ignoring":
+			pl = intersectPreservedLabels(pl, newPreservedLabels(true, t.GroupModifier.Args))
+		}
+		return pl
+	default:
+		return newPreservedLabels(false, nil)
+	}
+}
+
+// canPreserveLabels returns true if the function with the given funcName calculates output series independently
+// per each input series without changing their labels.
+func canPreserveLabels(funcName string) bool {
+	funcName = strings.ToLower(funcName)
+	if strings.HasPrefix(funcName, "label_") || strings.HasPrefix(funcName, "labels_") || strings.HasPrefix(funcName, "rand") {
+		return false
+	}
+	switch funcName {
+	case "absent", "absent_over_time", "buckets_limit", "count_values_over_time", "drop_common_labels", "end", "limit_offset",
+		"now", "pi", "prometheus_buckets", "scalar", "start", "step", "time", "vector":
+		return false
+	default:
+		return IsRollupFunc(funcName) || IsTransformFunc(funcName)
+	}
+}
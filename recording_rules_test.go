@@ -0,0 +1,111 @@
+package metricsql
+
+import (
+	"testing"
+)
+
+func TestRecordingRulesRewriter(t *testing.T) {
+	rules := []RecordingRule{
+		{
+			Record: "job:http_requests:rate5m",
+			Expr:   `sum(rate(http_requests_total[5m])) by (job)`,
+		},
+		{
+			Record: "instance:cpu:rate5m",
+			Expr:   `rate(node_cpu_seconds_total{mode!="idle"}[5m])`,
+		},
+		{
+			Record: "job_path:errors:ratio5m",
+			Expr:   `sum(rate(errors_total[5m])) by (job, path) / sum(rate(requests_total[5m])) by (job, path)`,
+		},
+		{
+			Record: "job:up:count",
+			Expr:   `count(up == 1) by (job)`,
+		},
+		{
+			Record: "job:latency:p99",
+			Expr:   `histogram_quantile(0.99, sum(rate(latency_bucket[5m])) by (job, le))`,
+		},
+	}
+	rr, err := NewRecordingRulesRewriter(rules)
+	if err != nil {
+		t.Fatalf("cannot create rewriter: %s", err)
+	}
+	f := func(q, resultExpected string) {
+		t.Helper()
+		e, err := Parse(q)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", q, err)
+		}
+		sOrig := string(e.AppendString(nil))
+		eNew := rr.Rewrite(e)
+		result := string(eNew.AppendString(nil))
+		if result != resultExpected {
+			t.Fatalf("unexpected result for Rewrite(%s);\ngot\n%s\nwant\n%s", q, result, resultExpected)
+		}
+		// Verify that the original e didn't change after Rewrite() call
+		if s := string(e.AppendString(nil)); s != sOrig {
+			t.Fatalf("the original expression has been changed;\ngot\n%s\nwant\n%s", s, sOrig)
+		}
+	}
+
+	// no matching rules
+	f(`foo`, `foo`)
+	f(`rate(http_requests_total[5m])`, `rate(http_requests_total[5m])`)
+	f(`sum(rate(http_requests_total[1m])) by (job)`, `sum(rate(http_requests_total[1m])) by(job)`)
+	f(`sum(rate(http_requests_total[5m])) by (job, instance)`, `sum(rate(http_requests_total[5m])) by(job,instance)`)
+	f(`sum(rate(http_requests_total[5m] offset 1h)) by (job)`, `sum(rate(http_requests_total[5m] offset 1h)) by(job)`)
+
+	// exact matches
+	f(`sum(rate(http_requests_total[5m])) by (job)`, `job:http_requests:rate5m`)
+	f(`SUM by (job) (RATE(http_requests_total[300s]))`, `job:http_requests:rate5m`)
+	f(`rate(node_cpu_seconds_total{mode!="idle"}[5m])`, `instance:cpu:rate5m`)
+	f(`sum(rate(errors_total[5m])) by (path, job) / sum(rate(requests_total[5m])) by (job, path)`, `job_path:errors:ratio5m`)
+	f(`count(up == 1) by (job)`, `job:up:count`)
+	f(`WITH (r(m) = sum(rate(m[5m])) by (job)) r(http_requests_total) / 2`, `job:http_requests:rate5m / 2`)
+
+	// sub-expressions
+	f(`sum(rate(http_requests_total[5m])) by (job) > 10`, `job:http_requests:rate5m > 10`)
+	f(`max(sum(rate(http_requests_total[5m])) by (job))`, `max(job:http_requests:rate5m)`)
+	f(`avg(rate(node_cpu_seconds_total{mode!="idle"}[5m])) by (instance) * 100`, `avg(instance:cpu:rate5m) by(instance) * 100`)
+
+	// extra filters
+	f(`sum(rate(http_requests_total{job="api"}[5m])) by (job)`, `job:http_requests:rate5m{job="api"}`)
+	f(`sum(rate(http_requests_total{instance="x"}[5m])) by (job)`, `sum(rate(http_requests_total{instance="x"}[5m])) by(job)`)
+	f(`rate(node_cpu_seconds_total{mode!="idle",instance=~"foo.+",cpu="0"}[5m])`, `instance:cpu:rate5m{cpu="0",instance=~"foo.+"}`)
+	f(`rate(node_cpu_seconds_total[5m])`, `rate(node_cpu_seconds_total[5m])`)
+	f(`sum(rate(errors_total{job="a"}[5m])) by (job, path) / sum(rate(requests_total{job="a"}[5m])) by (job, path)`, `job_path:errors:ratio5m{job="a"}`)
+	f(`sum(rate(errors_total{job="a"}[5m])) by (job, path) / sum(rate(requests_total[5m])) by (job, path)`, `sum(rate(errors_total{job="a"}[5m])) by(job,path) / sum(rate(requests_total[5m])) by(job,path)`)
+	f(`histogram_quantile(0.99, sum(rate(latency_bucket{job="x"}[5m])) by (job, le))`, `job:latency:p99{job="x"}`)
+	f(`histogram_quantile(0.99, sum(rate(latency_bucket{le="10"}[5m])) by (job, le))`, `histogram_quantile(0.99, sum(rate(latency_bucket{le="10"}[5m])) by(job,le))`)
+
+	// outer aggregations
+	f(`sum(rate(http_requests_total[5m]))`, `sum(job:http_requests:rate5m)`)
+	f(`sum(rate(http_requests_total{job=~"a|b"}[5m]))`, `sum(job:http_requests:rate5m{job=~"a|b"})`)
+	f(`sum(rate(http_requests_total{instance="a"}[5m]))`, `sum(rate(http_requests_total{instance="a"}[5m]))`)
+	f(`sum(rate(errors_total[5m])) by (job) / sum(rate(requests_total[5m])) by (job)`, `sum(rate(errors_total[5m])) by(job) / sum(rate(requests_total[5m])) by(job)`)
+	f(`count(up == 1)`, `sum(job:up:count)`)
+	f(`max(rate(http_requests_total[5m]))`, `max(rate(http_requests_total[5m]))`)
+	f(`sum(rate(http_requests_total[5m])) without (job)`, `sum(rate(http_requests_total[5m])) without(job)`)
+}
+
+func TestNewRecordingRulesRewriterFailure(t *testing.T) {
+	f := func(rule RecordingRule) {
+		t.Helper()
+		rr, err := NewRecordingRulesRewriter([]RecordingRule{rule})
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		if rr != nil {
+			t.Fatalf("expecting nil rewriter")
+		}
+	}
+
+	f(RecordingRule{
+		Expr: `sum(foo)`,
+	})
+	f(RecordingRule{
+		Record: "foo:bar",
+		Expr:   `sum(`,
+	})
+}
@@ -1,6 +1,8 @@
 package metricsql
 
 import (
+	"container/list"
+	"fmt"
 	"regexp"
 	"sync"
 	"sync/atomic"
@@ -9,58 +11,58 @@ import (
 )
 
 // CompileRegexpAnchored returns compiled regexp `^re$`.
+//
+// The regexp is cached in the default regexp cache. See SetDefaultRegexpCache.
 func CompileRegexpAnchored(re string) (*regexp.Regexp, error) {
-	reAnchored := "^(?:" + re + ")$"
-	return CompileRegexp(reAnchored)
+	return GetDefaultRegexpCache().CompileRegexpAnchored(re)
 }
 
 // CompileRegexp returns compile regexp re.
+//
+// The regexp is cached in the default regexp cache. See SetDefaultRegexpCache.
 func CompileRegexp(re string) (*regexp.Regexp, error) {
-	rcv := regexpCacheV.Get(re)
-	if rcv != nil {
-		return rcv.r, rcv.err
-	}
-	r, err := regexp.Compile(re)
-	rcv = &regexpCacheValue{
-		r:   r,
-		err: err,
-	}
-	regexpCacheV.Put(re, rcv)
-	return rcv.r, rcv.err
+	return GetDefaultRegexpCache().CompileRegexp(re)
 }
 
-// regexpCacheCharsMax limits the max number of chars stored in regexp cache across all entries.
+// RegexpCacheCharsMaxDefault is the default limit on the number of chars stored in RegexpCache across all entries.
 //
 // We limit by number of chars since calculating the exact size of each regexp is problematic,
 // while using chars seems like universal approach for short and long regexps.
-const regexpCacheCharsMax = 1e6
+const RegexpCacheCharsMaxDefault = 1e6
 
-var regexpCacheV = func() *regexpCache {
-	rc := newRegexpCache(regexpCacheCharsMax)
-	metrics.NewGauge(`vm_cache_requests_total{type="promql/regexp"}`, func() float64 {
-		return float64(rc.Requests())
-	})
-	metrics.NewGauge(`vm_cache_misses_total{type="promql/regexp"}`, func() float64 {
-		return float64(rc.Misses())
-	})
-	metrics.NewGauge(`vm_cache_entries{type="promql/regexp"}`, func() float64 {
-		return float64(rc.Len())
-	})
-	metrics.NewGauge(`vm_cache_chars_current{type="promql/regexp"}`, func() float64 {
-		return float64(rc.CharsCurrent())
-	})
-	metrics.NewGauge(`vm_cache_chars_max{type="promql/regexp"}`, func() float64 {
-		return float64(rc.charsLimit)
-	})
-	return rc
-}()
+var defaultRegexpCache atomic.Pointer[RegexpCache]
 
-type regexpCacheValue struct {
-	r   *regexp.Regexp
-	err error
+func init() {
+	defaultRegexpCache.Store(NewRegexpCache(RegexpCacheCharsMaxDefault))
+
+	// Metrics for the default cache are registered only once, so they track the current default cache
+	// after it is replaced via SetDefaultRegexpCache.
+	registerRegexpCacheMetrics(metrics.GetDefaultSet(), "", GetDefaultRegexpCache)
+}
+
+// GetDefaultRegexpCache returns the default regexp cache used by CompileRegexp and CompileRegexpAnchored.
+func GetDefaultRegexpCache() *RegexpCache {
+	return defaultRegexpCache.Load()
 }
 
-type regexpCache struct {
+// SetDefaultRegexpCache replaces the default regexp cache used by CompileRegexp and CompileRegexpAnchored with rc.
+//
+// This allows tuning the cache limits. Metrics for the default cache are exposed
+// at the default metrics set under `vm_cache_*{type="promql/regexp"}` names.
+func SetDefaultRegexpCache(rc *RegexpCache) {
+	if rc == nil {
+		panic(fmt.Errorf("BUG: rc cannot be nil"))
+	}
+	defaultRegexpCache.Store(rc)
+}
+
+// RegexpCache caches compiled regexps.
+//
+// The cache is limited by the total number of chars in cached regexps. Least recently used regexps are evicted
+// when the limit is exceeded.
+//
+// RegexpCache is safe to use from concurrently running goroutines.
+type RegexpCache struct {
 	// Move atomic counters to the top of struct for 8-byte alignment on 32-bit arch.
 	// See https://github.com/VictoriaMetrics/VictoriaMetrics/issues/212
 	requests uint64
@@ -70,48 +72,154 @@ type regexpCache struct {
 	// is used for memory usage estimation.
 	charsCurrent int
 
-	// charsLimit is the maximum number of chars the regexpCache can store.
+	// charsLimit is the maximum number of chars the RegexpCache can store.
 	charsLimit int
 
-	m  map[string]*regexpCacheValue
-	mu sync.RWMutex
+	// m maps regexps to ll elements with *regexpCacheEntry values.
+	m map[string]*list.Element
+
+	// ll contains cache entries ordered from the most recently used to the least recently used.
+	ll *list.List
+
+	mu sync.Mutex
+}
+
+type regexpCacheEntry struct {
+	regexp string
+	rcv    *regexpCacheValue
+}
+
+type regexpCacheValue struct {
+	r   *regexp.Regexp
+	err error
 }
 
-func newRegexpCache(charsLimit int) *regexpCache {
-	return &regexpCache{
-		m:          make(map[string]*regexpCacheValue),
+// NewRegexpCache returns new RegexpCache, which can store up to charsLimit chars across all the regexps.
+//
+// The cache may exceed charsLimit by a single regexp.
+func NewRegexpCache(charsLimit int) *RegexpCache {
+	return &RegexpCache{
+		m:          make(map[string]*list.Element),
+		ll:         list.New(),
 		charsLimit: charsLimit,
 	}
 }
 
-func (rc *regexpCache) Requests() uint64 {
+// CompileRegexpAnchored returns compiled regexp `^re$` from rc.
+func (rc *RegexpCache) CompileRegexpAnchored(re string) (*regexp.Regexp, error) {
+	reAnchored := "^(?:" + re + ")$"
+	return rc.CompileRegexp(reAnchored)
+}
+
+// CompileRegexp returns compiled regexp re from rc.
+//
+// The regexp is compiled and stored in rc if it is missing there.
+func (rc *RegexpCache) CompileRegexp(re string) (*regexp.Regexp, error) {
+	rcv := rc.get(re)
+	if rcv != nil {
+		return rcv.r, rcv.err
+	}
+	r, err := regexp.Compile(re)
+	rcv = &regexpCacheValue{
+		r:   r,
+		err: err,
+	}
+	rc.put(re, rcv)
+	return rcv.r, rcv.err
+}
+
+// RegisterMetrics registers rc metrics at s.
+//
+// The metrics are registered under `vm_cache_*{type="promql/regexp"}` names. extraLabels are added to the metrics
+// if they are non-empty. They must be in Prometheus format, e.g. `tenant="foo",env="prod"`.
+//
+// RegisterMetrics panics if the metrics with the same names and labels are already registered at s.
+// Use s.UnregisterAllMetrics or a separate metrics.Set per cache for unregistering the metrics.
+func (rc *RegexpCache) RegisterMetrics(s *metrics.Set, extraLabels string) {
+	registerRegexpCacheMetrics(s, extraLabels, func() *RegexpCache {
+		return rc
+	})
+}
+
+func registerRegexpCacheMetrics(s *metrics.Set, extraLabels string, getCache func() *RegexpCache) {
+	labels := `type="promql/regexp"`
+	if extraLabels != "" {
+		labels += "," + extraLabels
+	}
+	s.NewGauge(`vm_cache_requests_total{`+labels+`}`, func() float64 {
+		return float64(getCache().Requests())
+	})
+	s.NewGauge(`vm_cache_misses_total{`+labels+`}`, func() float64 {
+		return float64(getCache().Misses())
+	})
+	s.NewGauge(`vm_cache_entries{`+labels+`}`, func() float64 {
+		return float64(getCache().Len())
+	})
+	s.NewGauge(`vm_cache_chars_current{`+labels+`}`, func() float64 {
+		return float64(getCache().CharsCurrent())
+	})
+	s.NewGauge(`vm_cache_chars_max{`+labels+`}`, func() float64 {
+		return float64(getCache().CharsLimit())
+	})
+}
+
+// Requests returns the number of requests to rc.
+func (rc *RegexpCache) Requests() uint64 {
 	return atomic.LoadUint64(&rc.requests)
 }
 
-func (rc *regexpCache) Misses() uint64 {
+// Misses returns the number of cache misses for rc.
+func (rc *RegexpCache) Misses() uint64 {
 	return atomic.LoadUint64(&rc.misses)
 }
 
-func (rc *regexpCache) Len() int {
-	rc.mu.RLock()
+// Len returns the number of regexps in rc.
+func (rc *RegexpCache) Len() int {
+	rc.mu.Lock()
 	n := len(rc.m)
-	rc.mu.RUnlock()
+	rc.mu.Unlock()
 	return n
 }
 
-func (rc *regexpCache) CharsCurrent() int {
-	rc.mu.RLock()
+// CharsCurrent returns the number of chars in regexps stored in rc.
+func (rc *RegexpCache) CharsCurrent() int {
+	rc.mu.Lock()
 	n := rc.charsCurrent
-	rc.mu.RUnlock()
-	return int(n)
+	rc.mu.Unlock()
+	return n
+}
+
+// CharsLimit returns the limit on the number of chars in regexps stored in rc.
+func (rc *RegexpCache) CharsLimit() int {
+	rc.mu.Lock()
+	n := rc.charsLimit
+	rc.mu.Unlock()
+	return n
+}
+
+// SetCharsLimit sets the limit on the number of chars in regexps stored in rc.
+//
+// Least recently used regexps are evicted from rc if it exceeds the new limit.
+func (rc *RegexpCache) SetCharsLimit(charsLimit int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.charsLimit = charsLimit
+	for rc.charsCurrent > rc.charsLimit && rc.ll.Len() > 0 {
+		rc.removeOldest()
+	}
 }
 
-func (rc *regexpCache) Get(regexp string) *regexpCacheValue {
+func (rc *RegexpCache) get(regexp string) *regexpCacheValue {
 	atomic.AddUint64(&rc.requests, 1)
 
-	rc.mu.RLock()
-	rcv := rc.m[regexp]
-	rc.mu.RUnlock()
+	rc.mu.Lock()
+	var rcv *regexpCacheValue
+	if e := rc.m[regexp]; e != nil {
+		rc.ll.MoveToFront(e)
+		rcv = e.Value.(*regexpCacheEntry).rcv
+	}
+	rc.mu.Unlock()
 
 	if rcv == nil {
 		atomic.AddUint64(&rc.misses, 1)
@@ -119,30 +227,41 @@ func (rc *regexpCache) Get(regexp string) *regexpCacheValue {
 	return rcv
 }
 
-func (rc *regexpCache) Put(regexp string, rcv *regexpCacheValue) {
+func (rc *RegexpCache) put(regexp string, rcv *regexpCacheValue) {
 	rc.mu.Lock()
 	defer rc.mu.Unlock()
 
 	// rcv may already be registered by a concurrent goroutine
-	if _, exists := rc.m[regexp]; exists {
-		rc.m[regexp] = rcv
+	if e := rc.m[regexp]; e != nil {
+		e.Value.(*regexpCacheEntry).rcv = rcv
+		rc.ll.MoveToFront(e)
 		return
 	}
 	if rc.charsCurrent > rc.charsLimit {
-		// Remove items accounting for 10% chars from the cache.
+		// Remove the least recently used items accounting for 10% chars from the cache.
 		overflow := int(float64(rc.charsLimit) * 0.1)
-		for k := range rc.m {
-			delete(rc.m, k)
-
-			size := len(k)
-			overflow -= size
-			rc.charsCurrent -= size
-
+		for rc.ll.Len() > 0 {
+			overflow -= rc.removeOldest()
 			if overflow <= 0 {
 				break
 			}
 		}
 	}
-	rc.m[regexp] = rcv
+	rc.m[regexp] = rc.ll.PushFront(&regexpCacheEntry{
+		regexp: regexp,
+		rcv:    rcv,
+	})
 	rc.charsCurrent += len(regexp)
 }
+
+// removeOldest removes the least recently used entry from rc and returns its size in chars.
+//
+// rc.mu must be locked by the caller.
+func (rc *RegexpCache) removeOldest() int {
+	e := rc.ll.Back()
+	rce := rc.ll.Remove(e).(*regexpCacheEntry)
+	delete(rc.m, rce.regexp)
+	size := len(rce.regexp)
+	rc.charsCurrent -= size
+	return size
+}
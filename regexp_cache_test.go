@@ -1,16 +1,20 @@
 package metricsql
 
 import (
+	"bytes"
 	"fmt"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/VictoriaMetrics/metrics"
 )
 
 func TestRegexpCacheConcurrent(t *testing.T) {
 	goroutines := 5
 	maxChars := 1000
-	rc := newRegexpCache(maxChars)
+	rc := NewRegexpCache(maxChars)
 	resultCh := make(chan error, goroutines)
 	for range goroutines {
 		go func() {
@@ -34,10 +38,10 @@ func TestRegexpCacheConcurrent(t *testing.T) {
 	}
 }
 
-func testRegexpCache(rc *regexpCache) error {
+func testRegexpCache(rc *RegexpCache) error {
 	for i := range 10000 {
 		key := fmt.Sprintf("foo|regexp-%d", i)
-		rcv := rc.Get(key)
+		rcv := rc.get(key)
 		if rcv != nil {
 			if rcv.err != nil {
 				return fmt.Errorf("unexpected error obtained for key %q: %w", key, rcv.err)
@@ -51,7 +55,7 @@ func testRegexpCache(rc *regexpCache) error {
 				r:   r,
 				err: err,
 			}
-			rc.Put(key, rcv)
+			rc.put(key, rcv)
 		}
 	}
 	return nil
@@ -60,15 +64,15 @@ func testRegexpCache(rc *regexpCache) error {
 func TestRegexpCache(t *testing.T) {
 	fn := func(maxChars int, regexps []string, expectedEntries, expectedChars int) {
 		t.Helper()
-		rc := newRegexpCache(maxChars)
+		rc := NewRegexpCache(maxChars)
 		for _, re := range regexps {
 			r, err := regexp.Compile(re)
 			rcv := &regexpCacheValue{
 				r:   r,
 				err: err,
 			}
-			rc.Put(re, rcv)
-			rcv1 := rc.Get(re)
+			rc.put(re, rcv)
+			rcv1 := rc.get(re)
 			if rcv1 != rcv {
 				t.Fatalf("unexpected result for regexp %q; got\n%v\nwant\n%v", re, rcv1, rcv)
 			}
@@ -79,7 +83,7 @@ func TestRegexpCache(t *testing.T) {
 		if misses := rc.Misses(); misses != 0 {
 			t.Fatalf("unexpected number of misses; got %d; want 0", misses)
 		}
-		rcv := rc.Get("non-existing-regexp")
+		rcv := rc.get("non-existing-regexp")
 		if rcv != nil {
 			t.Fatalf("expecting nil entry; got %v", rcv)
 		}
@@ -107,3 +111,121 @@ func TestRegexpCache(t *testing.T) {
 	fn(100, []string{"abc", "abc", "abc"}, 1, 3)
 	fn(100, []string{"abc", "def", "abc", "def"}, 2, 6)
 }
+
+func TestRegexpCacheLRU(t *testing.T) {
+	rc := NewRegexpCache(6)
+	for _, re := range []string{"aa", "bb", "cc"} {
+		if _, err := rc.CompileRegexp(re); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// Access "aa", so "bb" becomes the least recently used regexp.
+	if _, err := rc.CompileRegexp("aa"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Overflow the cache by a single regexp, so the next regexp triggers eviction.
+	for _, re := range []string{"dd", "ee"} {
+		if _, err := rc.CompileRegexp(re); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if n := rc.Len(); n != 4 {
+		t.Fatalf("unexpected number of entries; got %d; want 4", n)
+	}
+	misses := rc.Misses()
+	for _, re := range []string{"aa", "cc", "dd", "ee"} {
+		if _, err := rc.CompileRegexp(re); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if n := rc.Misses(); n != misses {
+		t.Fatalf("unexpected misses for recently used regexps; got %d; want %d", n, misses)
+	}
+	if rcv := rc.get("bb"); rcv != nil {
+		t.Fatalf("the least recently used regexp must be evicted")
+	}
+}
+
+func TestRegexpCacheSetCharsLimit(t *testing.T) {
+	rc := NewRegexpCache(100)
+	for _, re := range []string{"aa", "bb", "cc", "dd"} {
+		if _, err := rc.CompileRegexp(re); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	rc.SetCharsLimit(4)
+	if n := rc.CharsLimit(); n != 4 {
+		t.Fatalf("unexpected chars limit; got %d; want 4", n)
+	}
+	if n := rc.CharsCurrent(); n != 4 {
+		t.Fatalf("unexpected charsCurrent; got %d; want 4", n)
+	}
+	if rc.get("cc") == nil || rc.get("dd") == nil {
+		t.Fatalf("the most recently used regexps must be kept")
+	}
+	if rc.get("aa") != nil || rc.get("bb") != nil {
+		t.Fatalf("the least recently used regexps must be evicted")
+	}
+}
+
+func TestRegexpCacheCompileRegexpError(t *testing.T) {
+	rc := NewRegexpCache(100)
+	for range 2 {
+		if _, err := rc.CompileRegexpAnchored("a("); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+	if n := rc.Misses(); n != 1 {
+		t.Fatalf("unexpected number of misses; got %d; want 1", n)
+	}
+	re, err := rc.CompileRegexpAnchored("foo|bar")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if re.MatchString("foobar") || !re.MatchString("bar") {
+		t.Fatalf("regexp must be anchored")
+	}
+}
+
+func TestRegexpCacheRegisterMetrics(t *testing.T) {
+	rc := NewRegexpCache(100)
+	if _, err := rc.CompileRegexp("foo"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s := metrics.NewSet()
+	rc.RegisterMetrics(s, `tenant="a"`)
+
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	result := bb.String()
+	for _, line := range []string{
+		`vm_cache_requests_total{type="promql/regexp",tenant="a"} 1`,
+		`vm_cache_misses_total{type="promql/regexp",tenant="a"} 1`,
+		`vm_cache_entries{type="promql/regexp",tenant="a"} 1`,
+		`vm_cache_chars_current{type="promql/regexp",tenant="a"} 3`,
+		`vm_cache_chars_max{type="promql/regexp",tenant="a"} 100`,
+	} {
+		if !strings.Contains(result, line+"\n") {
+			t.Fatalf("missing %q in metrics:\n%s", line, result)
+		}
+	}
+}
+
+func TestSetDefaultRegexpCache(t *testing.T) {
+	rcOrig := GetDefaultRegexpCache()
+	defer SetDefaultRegexpCache(rcOrig)
+
+	rc := NewRegexpCache(100)
+	SetDefaultRegexpCache(rc)
+	if GetDefaultRegexpCache() != rc {
+		t.Fatalf("unexpected default regexp cache")
+	}
+	if _, err := CompileRegexpAnchored("foo"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := rc.Requests(); n != 1 {
+		t.Fatalf("unexpected number of requests to the default cache; got %d; want 1", n)
+	}
+}
@@ -0,0 +1,496 @@
+package metricsql
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+// RegexpInfo contains the results of the analysis of regexp from `=~` or `!~` label filter.
+//
+// See AnalyzeRegexp for details.
+type RegexpInfo struct {
+	// Values contains the finite set of values matching the regexp in sorted order, e.g. `["api", "db", "web"]` for `api|web|db`.
+	//
+	// Values is nil if the regexp matches too many values.
+	Values []string
+
+	// Prefix is the literal prefix of all the values matching the regexp, e.g. `/v1/` for `/v1/.*`.
+	Prefix string
+
+	// Suffix is the literal suffix of all the values matching the regexp, e.g. `.json` for `.*\.json`.
+	Suffix string
+
+	// MatchesAll is set if the regexp matches any value including empty value, e.g. `.*`.
+	MatchesAll bool
+
+	// MatchesNonEmpty is set if the regexp matches any non-empty value, e.g. `.+` or `.*`.
+	MatchesNonEmpty bool
+
+	kind regexpMatchKind
+
+	// dotSkipsNewline is set if `.` in the regexp doesn't match `\n`, e.g. there is no `(?s)` flag.
+	// Fast paths for such regexps cannot be used for values with newlines.
+	dotSkipsNewline bool
+
+	// literal contains the prefix, the suffix or the substring depending on kind.
+	literal string
+
+	re *regexp.Regexp
+}
+
+type regexpMatchKind int
+
+const (
+	regexpMatchRegexp regexpMatchKind = iota
+	regexpMatchAll
+	regexpMatchNonEmpty
+	regexpMatchValues
+	regexpMatchPrefix
+	regexpMatchPrefixNonEmpty
+	regexpMatchSuffix
+	regexpMatchContains
+)
+
+// maxRegexpValues is the maximum number of values, which may be returned in RegexpInfo.Values.
+const maxRegexpValues = 100
+
+// AnalyzeRegexp analyzes regexp expr from `=~` or `!~` label filter.
+//
+// The regexp is anchored to the start and the end of the label value in the same way as CompileRegexpAnchored does.
+// MatchesAll and MatchesNonEmpty treat `.` as any char, since label values usually contain no newlines,
+// while RegexpInfo.Match returns the same results as the compiled regexp for values with newlines.
+func AnalyzeRegexp(expr string) (*RegexpInfo, error) {
+	re, err := CompileRegexpAnchored(expr)
+	if err != nil {
+		return nil, err
+	}
+	sre, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	sre = unwrapRegexpCapture(sre.Simplify())
+
+	ri := &RegexpInfo{
+		re: re,
+	}
+	if values, ok := getRegexpValues(sre, maxRegexpValues); ok {
+		values = uniqSortedStrings(values)
+		ri.Values = values
+		ri.Prefix = getCommonPrefix(values)
+		ri.Suffix = getCommonSuffix(values)
+		ri.kind = regexpMatchValues
+		return ri, nil
+	}
+	ri.Prefix, ri.Suffix = getRegexpPrefixSuffix(sre)
+	switch {
+	case isRegexpDotStar(sre):
+		ri.MatchesAll = true
+		ri.MatchesNonEmpty = true
+		ri.kind = regexpMatchAll
+	case isRegexpDotPlus(sre):
+		ri.MatchesNonEmpty = true
+		ri.kind = regexpMatchNonEmpty
+	case sre.Op == syntax.OpConcat:
+		ri.kind, ri.literal = getRegexpConcatMatchKind(sre.Sub)
+	}
+	ri.dotSkipsNewline = hasRegexpOp(sre, syntax.OpAnyCharNotNL)
+	return ri, nil
+}
+
+// AnalyzeRegexp analyzes the regexp in lf. See AnalyzeRegexp for details.
+//
+// Error is returned if lf isn't `=~` or `!~` filter.
+func (lf *LabelFilter) AnalyzeRegexp() (*RegexpInfo, error) {
+	if !lf.IsRegexp {
+		return nil, fmt.Errorf("label filter %s doesn't contain regexp", lf.AppendString(nil))
+	}
+	if lf.Param != "" {
+		return nil, fmt.Errorf("label filter %s contains unbound param", lf.AppendString(nil))
+	}
+	return AnalyzeRegexp(lf.Value)
+}
+
+// Match returns true if the regexp matches the given label value.
+//
+// Match is faster than regexp matching for regexps with a finite set of values, literal prefix or suffix,
+// and for `.*` and `.+`. It doesn't allocate memory for such regexps.
+// The result must be inverted for `!~` filters.
+func (ri *RegexpInfo) Match(value string) bool {
+	if ri.dotSkipsNewline && strings.IndexByte(value, '\n') >= 0 {
+		// `.` doesn't match newlines, so fall back to the regexp.
+		return ri.re.MatchString(value)
+	}
+	switch ri.kind {
+	case regexpMatchAll:
+		return true
+	case regexpMatchNonEmpty:
+		return len(value) > 0
+	case regexpMatchValues:
+		n := sort.SearchStrings(ri.Values, value)
+		return n < len(ri.Values) && ri.Values[n] == value
+	case regexpMatchPrefix:
+		return strings.HasPrefix(value, ri.literal)
+	case regexpMatchPrefixNonEmpty:
+		return len(value) > len(ri.literal) && strings.HasPrefix(value, ri.literal)
+	case regexpMatchSuffix:
+		return strings.HasSuffix(value, ri.literal)
+	case regexpMatchContains:
+		return strings.Contains(value, ri.literal)
+	default:
+		return ri.re.MatchString(value)
+	}
+}
+
+func getRegexpConcatMatchKind(subs []*syntax.Regexp) (regexpMatchKind, string) {
+	switch len(subs) {
+	case 2:
+		if lit, ok := getRegexpLiteral(subs[0]); ok {
+			if isRegexpDotStar(subs[1]) {
+				// `prefix.*`
+				return regexpMatchPrefix, lit
+			}
+			if isRegexpDotPlus(subs[1]) {
+				// `prefix.+`
+				return regexpMatchPrefixNonEmpty, lit
+			}
+		}
+		if lit, ok := getRegexpLiteral(subs[1]); ok && isRegexpDotStar(subs[0]) {
+			// `.*suffix`
+			return regexpMatchSuffix, lit
+		}
+	case 3:
+		if lit, ok := getRegexpLiteral(subs[1]); ok && isRegexpDotStar(subs[0]) && isRegexpDotStar(subs[2]) {
+			// `.*substring.*`
+			return regexpMatchContains, lit
+		}
+	}
+	return regexpMatchRegexp, ""
+}
+
+// getRegexpValues returns the finite set of values matching sre.
+//
+// false is returned if sre matches more than limit values.
+func getRegexpValues(sre *syntax.Regexp, limit int) ([]string, bool) {
+	switch sre.Op {
+	case syntax.OpEmptyMatch:
+		return []string{""}, true
+	case syntax.OpLiteral:
+		lit, ok := getRegexpLiteral(sre)
+		if !ok {
+			return nil, false
+		}
+		return []string{lit}, true
+	case syntax.OpCapture:
+		return getRegexpValues(sre.Sub[0], limit)
+	case syntax.OpCharClass:
+		n := 0
+		for i := 0; i < len(sre.Rune); i += 2 {
+			n += int(sre.Rune[i+1]-sre.Rune[i]) + 1
+			if n > limit {
+				return nil, false
+			}
+		}
+		values := make([]string, 0, n)
+		for i := 0; i < len(sre.Rune); i += 2 {
+			for r := sre.Rune[i]; r <= sre.Rune[i+1]; r++ {
+				values = append(values, string(r))
+			}
+		}
+		return values, true
+	case syntax.OpQuest:
+		values, ok := getRegexpValues(sre.Sub[0], limit-1)
+		if !ok {
+			return nil, false
+		}
+		return append(values, ""), true
+	case syntax.OpAlternate:
+		var values []string
+		for _, sub := range sre.Sub {
+			a, ok := getRegexpValues(sub, limit-len(values))
+			if !ok {
+				return nil, false
+			}
+			values = append(values, a...)
+		}
+		return values, true
+	case syntax.OpConcat:
+		values := []string{""}
+		for _, sub := range sre.Sub {
+			a, ok := getRegexpValues(sub, limit)
+			if !ok || len(values)*len(a) > limit {
+				return nil, false
+			}
+			product := make([]string, 0, len(values)*len(a))
+			for _, prefix := range values {
+				for _, suffix := range a {
+					product = append(product, prefix+suffix)
+				}
+			}
+			values = product
+		}
+		return values, true
+	default:
+		return nil, false
+	}
+}
+
+func getRegexpPrefixSuffix(sre *syntax.Regexp) (string, string) {
+	if sre.Op != syntax.OpConcat {
+		return "", ""
+	}
+	var prefix, suffix string
+	for _, sub := range sre.Sub {
+		lit, ok := getRegexpLiteral(sub)
+		if !ok {
+			break
+		}
+		prefix += lit
+	}
+	for i := len(sre.Sub) - 1; i >= 0; i-- {
+		lit, ok := getRegexpLiteral(sre.Sub[i])
+		if !ok {
+			break
+		}
+		suffix = lit + suffix
+	}
+	return prefix, suffix
+}
+
+func getRegexpLiteral(sre *syntax.Regexp) (string, bool) {
+	sre = unwrapRegexpCapture(sre)
+	if sre.Op != syntax.OpLiteral || sre.Flags&syntax.FoldCase != 0 {
+		return "", false
+	}
+	return string(sre.Rune), true
+}
+
+func isRegexpDotStar(sre *syntax.Regexp) bool {
+	sre = unwrapRegexpCapture(sre)
+	return sre.Op == syntax.OpStar && isRegexpAnyChar(sre.Sub[0])
+}
+
+func isRegexpDotPlus(sre *syntax.Regexp) bool {
+	sre = unwrapRegexpCapture(sre)
+	return sre.Op == syntax.OpPlus && isRegexpAnyChar(sre.Sub[0])
+}
+
+func isRegexpAnyChar(sre *syntax.Regexp) bool {
+	return sre.Op == syntax.OpAnyChar || sre.Op == syntax.OpAnyCharNotNL
+}
+
+func hasRegexpOp(sre *syntax.Regexp, op syntax.Op) bool {
+	if sre.Op == op {
+		return true
+	}
+	for _, sub := range sre.Sub {
+		if hasRegexpOp(sub, op) {
+			return true
+		}
+	}
+	return false
+}
+
+func unwrapRegexpCapture(sre *syntax.Regexp) *syntax.Regexp {
+	for sre.Op == syntax.OpCapture {
+		sre = sre.Sub[0]
+	}
+	return sre
+}
+
+func uniqSortedStrings(a []string) []string {
+	sort.Strings(a)
+	result := a[:0]
+	for i, s := range a {
+		if i > 0 && s == a[i-1] {
+			continue
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+func getCommonPrefix(a []string) string {
+	if len(a) == 0 {
+		return ""
+	}
+	prefix := a[0]
+	for _, s := range a[1:] {
+		n := 0
+		for n < len(prefix) && n < len(s) && prefix[n] == s[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return prefix
+}
+
+func getCommonSuffix(a []string) string {
+	if len(a) == 0 {
+		return ""
+	}
+	suffix := a[0]
+	for _, s := range a[1:] {
+		n := 0
+		for n < len(suffix) && n < len(s) && suffix[len(suffix)-1-n] == s[len(s)-1-n] {
+			n++
+		}
+		suffix = suffix[len(suffix)-n:]
+	}
+	return suffix
+}
+
+// maxRegexpFilterOrGroups is the maximum number of `or` groups and `!=` filters OptimizeRegexpFilters may generate.
+const maxRegexpFilterOrGroups = 16
+
+// OptimizeRegexpFilters returns a copy of e with `=~` and `!~` label filters rewritten into cheaper forms.
+//
+// It performs the following rewrites:
+//
+//   - `{a=~"v"}` and `{a!~"v"}` are converted to `{a="v"}` and `{a!="v"}` for literal v.
+//   - `{a=~"v1|v2",b="c"}` is converted to `{a="v1",b="c" or a="v2",b="c"}`.
+//   - `{a!~"v1|v2"}` is converted to `{a!="v1",a!="v2"}`.
+//   - `{a=~".*",b="c"}` is converted to `{b="c"}`.
+//   - `{a=~".+"}` and `{a!~".+"}` are converted to `{a!=""}` and `{a=""}`.
+//
+// The number of generated `or` groups and `!=` filters is limited, so regexps with many values are kept as is.
+// Label filters with params are kept as is. e isn't modified.
+func OptimizeRegexpFilters(e Expr) Expr {
+	if !canOptimizeRegexpFilters(e) {
+		return e
+	}
+	eCopy := Clone(e)
+	VisitAll(eCopy, func(expr Expr) {
+		if me, ok := expr.(*MetricExpr); ok {
+			if lfss := optimizeRegexpLabelFilterss(me.LabelFilterss); lfss != nil {
+				me.LabelFilterss = lfss
+			}
+		}
+	})
+	return eCopy
+}
+
+func canOptimizeRegexpFilters(e Expr) bool {
+	ok := false
+	VisitAll(e, func(expr Expr) {
+		if ok {
+			return
+		}
+		if me, isMetricExpr := expr.(*MetricExpr); isMetricExpr {
+			ok = optimizeRegexpLabelFilterss(me.LabelFilterss) != nil
+		}
+	})
+	return ok
+}
+
+// optimizeRegexpLabelFilterss returns optimized lfss or nil if lfss cannot be optimized.
+//
+// lfss isn't modified.
+func optimizeRegexpLabelFilterss(lfss [][]LabelFilter) [][]LabelFilter {
+	var result [][]LabelFilter
+	changed := false
+	for i, lfs := range lfss {
+		maxGroups := maxRegexpFilterOrGroups - len(result) - (len(lfss) - i - 1)
+		groups, ok := optimizeRegexpLabelFilters(lfs, maxGroups)
+		if !ok {
+			result = append(result, lfs)
+			continue
+		}
+		result = append(result, groups...)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return result
+}
+
+// optimizeRegexpLabelFilters returns `or` groups equivalent to lfs.
+//
+// false is returned if lfs cannot be optimized.
+func optimizeRegexpLabelFilters(lfs []LabelFilter, maxGroups int) ([][]LabelFilter, bool) {
+	groups := [][]LabelFilter{nil}
+	changed := false
+	var lfDropped *LabelFilter
+	for i := range lfs {
+		lf := &lfs[i]
+		ri, err := lf.AnalyzeRegexp()
+		if err != nil {
+			// lf isn't a regexp filter or it contains a param.
+			groups = appendLabelFilterToGroups(groups, *lf)
+			continue
+		}
+		switch {
+		case ri.MatchesAll && !lf.IsNegative:
+			// `=~".*"` matches all the series.
+			lfDropped = lf
+		case ri.MatchesNonEmpty && !ri.MatchesAll:
+			// `=~".+"` is equivalent to `!=""`, while `!~".+"` is equivalent to `=""`.
+			groups = appendLabelFilterToGroups(groups, LabelFilter{
+				Label:      lf.Label,
+				IsNegative: !lf.IsNegative,
+			})
+		case len(ri.Values) == 1:
+			groups = appendLabelFilterToGroups(groups, LabelFilter{
+				Label:      lf.Label,
+				Value:      ri.Values[0],
+				IsNegative: lf.IsNegative,
+			})
+		case len(ri.Values) > 1 && lf.IsNegative && len(ri.Values) <= maxRegexpFilterOrGroups:
+			for _, v := range ri.Values {
+				groups = appendLabelFilterToGroups(groups, LabelFilter{
+					Label:      lf.Label,
+					Value:      v,
+					IsNegative: true,
+				})
+			}
+		case len(ri.Values) > 1 && !lf.IsNegative && len(groups)*len(ri.Values) <= maxGroups:
+			groupsNew := make([][]LabelFilter, 0, len(groups)*len(ri.Values))
+			for _, v := range ri.Values {
+				lfNew := LabelFilter{
+					Label: lf.Label,
+					Value: v,
+				}
+				for _, group := range groups {
+					groupNew := append([]LabelFilter{}, group...)
+					groupsNew = append(groupsNew, appendLabelFilterToGroup(groupNew, lfNew))
+				}
+			}
+			groups = groupsNew
+		default:
+			groups = appendLabelFilterToGroups(groups, *lf)
+			continue
+		}
+		changed = true
+	}
+	if !changed {
+		return nil, false
+	}
+	for i, group := range groups {
+		if len(group) == 0 {
+			// Keep `=~".*"` if it is the only filter in the group, since `{}` isn't a valid series selector.
+			groups[i] = append(group, *lfDropped)
+		}
+	}
+	return groups, true
+}
+
+func appendLabelFilterToGroups(groups [][]LabelFilter, lf LabelFilter) [][]LabelFilter {
+	for i := range groups {
+		groups[i] = appendLabelFilterToGroup(groups[i], lf)
+	}
+	return groups
+}
+
+// appendLabelFilterToGroup appends lf to group, while keeping `__name__` filter at the first place.
+func appendLabelFilterToGroup(group []LabelFilter, lf LabelFilter) []LabelFilter {
+	if !lf.isMetricNameFilter() || (len(group) > 0 && group[0].isMetricNameFilter()) {
+		return append(group, lf)
+	}
+	group = append(group, LabelFilter{})
+	copy(group[1:], group)
+	group[0] = lf
+	return group
+}
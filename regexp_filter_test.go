@@ -0,0 +1,238 @@
+package metricsql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAnalyzeRegexpSuccess(t *testing.T) {
+	f := func(expr string, valuesExpected []string, prefixExpected, suffixExpected string, matchesAllExpected, matchesNonEmptyExpected bool) {
+		t.Helper()
+		ri, err := AnalyzeRegexp(expr)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", expr, err)
+		}
+		if !reflect.DeepEqual(ri.Values, valuesExpected) {
+			t.Fatalf("unexpected values for %q; got %q; want %q", expr, ri.Values, valuesExpected)
+		}
+		if ri.Prefix != prefixExpected {
+			t.Fatalf("unexpected prefix for %q; got %q; want %q", expr, ri.Prefix, prefixExpected)
+		}
+		if ri.Suffix != suffixExpected {
+			t.Fatalf("unexpected suffix for %q; got %q; want %q", expr, ri.Suffix, suffixExpected)
+		}
+		if ri.MatchesAll != matchesAllExpected {
+			t.Fatalf("unexpected MatchesAll for %q; got %v; want %v", expr, ri.MatchesAll, matchesAllExpected)
+		}
+		if ri.MatchesNonEmpty != matchesNonEmptyExpected {
+			t.Fatalf("unexpected MatchesNonEmpty for %q; got %v; want %v", expr, ri.MatchesNonEmpty, matchesNonEmptyExpected)
+		}
+	}
+
+	// finite set of values
+	f(``, []string{""}, "", "", false, false)
+	f(`foo`, []string{"foo"}, "foo", "foo", false, false)
+	f(`foo\.bar`, []string{"foo.bar"}, "foo.bar", "foo.bar", false, false)
+	f(`web|api|db`, []string{"api", "db", "web"}, "", "", false, false)
+	f(`(web|api)`, []string{"api", "web"}, "", "", false, false)
+	f(`foo|foo|bar`, []string{"bar", "foo"}, "", "", false, false)
+	f(`api-(prod|dev)`, []string{"api-dev", "api-prod"}, "api-", "", false, false)
+	f(`(a|b)(c|d)x`, []string{"acx", "adx", "bcx", "bdx"}, "", "x", false, false)
+	f(`foo[0-2]`, []string{"foo0", "foo1", "foo2"}, "foo", "", false, false)
+	f(`foo(bar)?`, []string{"foo", "foobar"}, "foo", "", false, false)
+	f(`foo|`, []string{"", "foo"}, "", "", false, false)
+
+	// prefix and suffix
+	f(`foo.*`, nil, "foo", "", false, false)
+	f(`foo.+`, nil, "foo", "", false, false)
+	f(`.*foo`, nil, "", "foo", false, false)
+	f(`foo.*bar`, nil, "foo", "bar", false, false)
+	f(`.*foo.*`, nil, "", "", false, false)
+	f(`foo[0-9]+`, nil, "foo", "", false, false)
+
+	// any value
+	f(`.*`, nil, "", "", true, true)
+	f(`(.*)`, nil, "", "", true, true)
+	f(`.+`, nil, "", "", false, true)
+
+	// case-insensitive regexps
+	f(`(?i)foo`, nil, "", "", false, false)
+	f(`(?i)foo.*`, nil, "", "", false, false)
+
+	// too many values
+	f(`[a-z][a-z]`, nil, "", "", false, false)
+	f(`[^a]`, nil, "", "", false, false)
+}
+
+func TestAnalyzeRegexpFailure(t *testing.T) {
+	f := func(expr string) {
+		t.Helper()
+		ri, err := AnalyzeRegexp(expr)
+		if err == nil {
+			t.Fatalf("expecting non-nil error for %q", expr)
+		}
+		if ri != nil {
+			t.Fatalf("expecting nil RegexpInfo for %q; got %v", expr, ri)
+		}
+	}
+	f(`(`)
+	f(`a)(b`)
+	f(`[a-`)
+	f(`a**`)
+}
+
+func TestLabelFilterAnalyzeRegexp(t *testing.T) {
+	lf := &LabelFilter{
+		Label:    "job",
+		Value:    "api|web",
+		IsRegexp: true,
+	}
+	ri, err := lf.AnalyzeRegexp()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(ri.Values, []string{"api", "web"}) {
+		t.Fatalf("unexpected values; got %q", ri.Values)
+	}
+
+	lf = &LabelFilter{
+		Label: "job",
+		Value: "api|web",
+	}
+	if _, err := lf.AnalyzeRegexp(); err == nil {
+		t.Fatalf("expecting non-nil error for non-regexp filter")
+	}
+
+	lf = &LabelFilter{
+		Label:    "job",
+		IsRegexp: true,
+		Param:    "job",
+	}
+	if _, err := lf.AnalyzeRegexp(); err == nil {
+		t.Fatalf("expecting non-nil error for filter with param")
+	}
+}
+
+func TestRegexpInfoMatch(t *testing.T) {
+	f := func(expr, value string, resultExpected bool) {
+		t.Helper()
+		ri, err := AnalyzeRegexp(expr)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", expr, err)
+		}
+		result := ri.Match(value)
+		if result != resultExpected {
+			t.Fatalf("unexpected result for Match(%q) on %q; got %v; want %v", value, expr, result, resultExpected)
+		}
+		re, err := CompileRegexpAnchored(expr)
+		if err != nil {
+			t.Fatalf("cannot compile %q: %s", expr, err)
+		}
+		if re.MatchString(value) != resultExpected {
+			t.Fatalf("BUG: regexp %q must return %v for %q", expr, resultExpected, value)
+		}
+	}
+
+	f(`.*`, "", true)
+	f(`.*`, "foo", true)
+	f(`.+`, "", false)
+	f(`.+`, "foo", true)
+	f(`api|web`, "api", true)
+	f(`api|web`, "web", true)
+	f(`api|web`, "db", false)
+	f(`api|web`, "", false)
+	f(`api|web`, "apiweb", false)
+	f(`foo.*`, "foo", true)
+	f(`foo.*`, "foobar", true)
+	f(`foo.*`, "barfoo", false)
+	f(`foo.+`, "foo", false)
+	f(`foo.+`, "foobar", true)
+	f(`.*foo`, "barfoo", true)
+	f(`.*foo`, "foobar", false)
+	f(`.*foo.*`, "afoob", true)
+	f(`.*foo.*`, "fo", false)
+	f(`foo[0-9]+`, "foo12", true)
+	f(`foo[0-9]+`, "foo", false)
+	f(`(?i)foo`, "FOO", true)
+	f(`(?i)foo`, "bar", false)
+}
+
+func TestRegexpInfoMatchNoAllocs(t *testing.T) {
+	f := func(expr, value string) {
+		t.Helper()
+		ri, err := AnalyzeRegexp(expr)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", expr, err)
+		}
+		allocs := testing.AllocsPerRun(100, func() {
+			ri.Match(value)
+		})
+		if allocs != 0 {
+			t.Fatalf("unexpected allocations for Match(%q) on %q; got %v; want 0", value, expr, allocs)
+		}
+	}
+	f(`api|web|db`, "web")
+	f(`foo.*`, "foobar")
+	f(`.*foo`, "barfoo")
+	f(`.+`, "foo")
+}
+
+func TestOptimizeRegexpFilters(t *testing.T) {
+	f := func(q, resultExpected string) {
+		t.Helper()
+		e, err := Parse(q)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", q, err)
+		}
+		qOrig := string(e.AppendString(nil))
+		eOptimized := OptimizeRegexpFilters(e)
+		result := string(eOptimized.AppendString(nil))
+		if result != resultExpected {
+			t.Fatalf("unexpected result for %q\ngot\n%s\nwant\n%s", q, result, resultExpected)
+		}
+		if qNew := string(e.AppendString(nil)); qNew != qOrig {
+			t.Fatalf("the original expression has been modified;\ngot\n%s\nwant\n%s", qNew, qOrig)
+		}
+		if _, err := Parse(result); err != nil {
+			t.Fatalf("cannot parse the optimized query %q: %s", result, err)
+		}
+	}
+
+	// nothing to optimize
+	f(`foo`, `foo`)
+	f(`foo{bar="baz"}`, `foo{bar="baz"}`)
+	f(`foo{bar=~"a.+b"}`, `foo{bar=~"a.+b"}`)
+	f(`foo{bar=~"(?i)baz"}`, `foo{bar=~"(?i)baz"}`)
+	f(`foo{bar!~".*"}`, `foo{bar!~".*"}`)
+	f(`foo{bar=~"[a-z]+"}`, `foo{bar=~"[a-z]+"}`)
+
+	// literal values
+	f(`foo{bar=~"baz"}`, `foo{bar="baz"}`)
+	f(`foo{bar!~"baz"}`, `foo{bar!="baz"}`)
+	f(`foo{bar=~"b\\.z"}`, `foo{bar="b.z"}`)
+	f(`foo{bar=~""}`, `foo{bar=""}`)
+	f(`{__name__=~"foo",bar="baz"}`, `foo{bar="baz"}`)
+
+	// finite sets
+	f(`foo{job=~"web|api"}`, `foo{job="api" or job="web"}`)
+	f(`foo{job=~"web|api",env="prod"}`, `foo{job="api",env="prod" or job="web",env="prod"}`)
+	f(`foo{job!~"web|api"}`, `foo{job!="api",job!="web"}`)
+	f(`foo{job=~"a|b",env=~"x|y"}`, `foo{job="a",env="x" or job="b",env="x" or job="a",env="y" or job="b",env="y"}`)
+	f(`foo{job=~"a|b" or env=~"x"}`, `foo{job="a" or job="b" or env="x"}`)
+	f(`{__name__=~"foo|bar",x="y"}`, `{__name__="bar",x="y" or __name__="foo",x="y"}`)
+
+	// any value
+	f(`foo{bar=~".*"}`, `foo`)
+	f(`foo{bar=~".*",baz="x"}`, `foo{baz="x"}`)
+	f(`{bar=~".*"}`, `{bar=~".*"}`)
+	f(`{bar=~".*",baz=~".*"}`, `{baz=~".*"}`)
+	f(`foo{bar=~".+"}`, `foo{bar!=""}`)
+	f(`foo{bar!~".+"}`, `foo{bar=""}`)
+
+	// nested expressions
+	f(`sum(rate(foo{job=~"api"}[5m])) by (job) / bar{x=~".*"}`, `sum(rate(foo{job="api"}[5m])) by(job) / bar`)
+
+	// too many or groups
+	f(`foo{a=~"[a-z]"}`, `foo{a=~"[a-z]"}`)
+	f(`foo{a=~"[a-f]",b=~"[a-f]"}`, `foo{a="a",b=~"[a-f]" or a="b",b=~"[a-f]" or a="c",b=~"[a-f]" or a="d",b=~"[a-f]" or a="e",b=~"[a-f]" or a="f",b=~"[a-f]"}`)
+}
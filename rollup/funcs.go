@@ -0,0 +1,1180 @@
+package rollup
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+var funcs = map[string]Func{
+	"absent_over_time":       rollupAbsent,
+	"ascent_over_time":       rollupAscent,
+	"avg_over_time":          rollupAvg,
+	"changes":                rollupChanges,
+	"changes_prometheus":     rollupChangesPrometheus,
+	"count_eq_over_time":     newRollupCountFilter(eqFilter),
+	"count_gt_over_time":     newRollupCountFilter(gtFilter),
+	"count_le_over_time":     newRollupCountFilter(leFilter),
+	"count_ne_over_time":     newRollupCountFilter(neFilter),
+	"count_over_time":        rollupCount,
+	"decreases_over_time":    rollupDecreases,
+	"default_rollup":         rollupDefault,
+	"delta":                  rollupDelta,
+	"delta_prometheus":       rollupDeltaPrometheus,
+	"deriv":                  rollupDeriv,
+	"deriv_fast":             rollupDerivFast,
+	"descent_over_time":      rollupDescent,
+	"distinct_over_time":     rollupDistinct,
+	"duration_over_time":     rollupDuration,
+	"first_over_time":        rollupFirst,
+	"geomean_over_time":      rollupGeomean,
+	"hoeffding_bound_lower":  rollupHoeffdingBoundLower,
+	"hoeffding_bound_upper":  rollupHoeffdingBoundUpper,
+	"holt_winters":           rollupHoltWinters,
+	"idelta":                 rollupIdelta,
+	"ideriv":                 rollupIderiv,
+	"increase":               rollupDelta,
+	"increase_prometheus":    rollupDeltaPrometheus,
+	"increase_pure":          rollupIncreasePure,
+	"increases_over_time":    rollupIncreases,
+	"integrate":              rollupIntegrate,
+	"irate":                  rollupIderiv,
+	"lag":                    rollupLag,
+	"last_over_time":         rollupDefault,
+	"lifetime":               rollupLifetime,
+	"mad_over_time":          rollupMAD,
+	"max_over_time":          rollupMax,
+	"median_over_time":       rollupMedian,
+	"min_over_time":          rollupMin,
+	"mode_over_time":         rollupMode,
+	"outlier_iqr_over_time":  rollupOutlierIQR,
+	"predict_linear":         rollupPredictLinear,
+	"present_over_time":      rollupPresent,
+	"quantile_over_time":     rollupQuantile,
+	"range_over_time":        rollupRange,
+	"rate":                   rollupDerivFast,
+	"rate_over_sum":          rollupRateOverSum,
+	"rate_prometheus":        rollupRatePrometheus,
+	"resets":                 rollupResets,
+	"scrape_interval":        rollupScrapeInterval,
+	"share_eq_over_time":     newRollupShareFilter(eqFilter),
+	"share_gt_over_time":     newRollupShareFilter(gtFilter),
+	"share_le_over_time":     newRollupShareFilter(leFilter),
+	"stddev_over_time":       rollupStddev,
+	"stdvar_over_time":       rollupStdvar,
+	"sum_eq_over_time":       newRollupSumFilter(eqFilter),
+	"sum_gt_over_time":       newRollupSumFilter(gtFilter),
+	"sum_le_over_time":       newRollupSumFilter(leFilter),
+	"sum_over_time":          rollupSum,
+	"sum2_over_time":         rollupSum2,
+	"tfirst_over_time":       rollupTfirst,
+	"timestamp":              rollupTlast,
+	"timestamp_with_name":    rollupTlast,
+	"tlast_change_over_time": rollupTlastChange,
+	"tlast_over_time":        rollupTlast,
+	"tmax_over_time":         rollupTmax,
+	"tmin_over_time":         rollupTmin,
+	"zscore_over_time":       rollupZScore,
+}
+
+var multiFuncs = map[string][]NamedFunc{
+	"rollup": {
+		{Name: "min", Func: rollupMin},
+		{Name: "max", Func: rollupMax},
+		{Name: "avg", Func: rollupAvg},
+	},
+	"rollup_candlestick": {
+		{Name: "open", Func: rollupOpen},
+		{Name: "close", Func: rollupClose},
+		{Name: "low", Func: rollupLow},
+		{Name: "high", Func: rollupHigh},
+	},
+	"rollup_delta":           newRollupMulti(getDeltas),
+	"rollup_deriv":           newRollupMulti(getDerivs),
+	"rollup_increase":        newRollupMulti(getDeltas),
+	"rollup_rate":            newRollupMulti(getDerivs),
+	"rollup_scrape_interval": newRollupMulti(getScrapeIntervals),
+	"histogram_over_time":    newHistogramFuncs(),
+}
+
+// getParam returns the param at the given index for w.
+//
+// NaN is returned if the param is missing.
+func getParam(w *Window, idx int) float64 {
+	if idx >= len(w.Params) {
+		return nan
+	}
+	return w.Params[idx]
+}
+
+func rollupAbsent(w *Window) float64 {
+	if len(w.Values) == 0 {
+		return 1
+	}
+	return nan
+}
+
+func rollupPresent(w *Window) float64 {
+	if len(w.Values) == 0 {
+		return nan
+	}
+	return 1
+}
+
+func rollupDefault(w *Window) float64 {
+	values := w.Values
+	if len(values) == 0 {
+		return nan
+	}
+	return values[len(values)-1]
+}
+
+func rollupFirst(w *Window) float64 {
+	values := w.Values
+	if len(values) == 0 {
+		return nan
+	}
+	return values[0]
+}
+
+func rollupTfirst(w *Window) float64 {
+	timestamps := w.Timestamps
+	if len(timestamps) == 0 {
+		return nan
+	}
+	return float64(timestamps[0]) / 1e3
+}
+
+// rollupTlast returns the timestamp in seconds for the last sample on the window.
+func rollupTlast(w *Window) float64 {
+	timestamps := w.Timestamps
+	if len(timestamps) == 0 {
+		return nan
+	}
+	return float64(timestamps[len(timestamps)-1]) / 1e3
+}
+
+// rollupTlastChange returns the timestamp in seconds for the last change on the window.
+func rollupTlastChange(w *Window) float64 {
+	values := w.Values
+	timestamps := w.Timestamps
+	if len(values) == 0 {
+		return nan
+	}
+	vLast := values[len(values)-1]
+	for i := len(values) - 2; i >= 0; i-- {
+		if values[i] != vLast {
+			return float64(timestamps[i+1]) / 1e3
+		}
+	}
+	if math.IsNaN(w.PrevValue) || w.PrevValue != vLast {
+		return float64(timestamps[0]) / 1e3
+	}
+	return nan
+}
+
+// rollupTmin returns the timestamp in seconds for the first minimum value on the window.
+func rollupTmin(w *Window) float64 {
+	values := w.Values
+	if len(values) == 0 {
+		return nan
+	}
+	minValue := values[0]
+	minTimestamp := w.Timestamps[0]
+	for i, v := range values {
+		if v < minValue {
+			minValue = v
+			minTimestamp = w.Timestamps[i]
+		}
+	}
+	return float64(minTimestamp) / 1e3
+}
+
+// rollupTmax returns the timestamp in seconds for the first maximum value on the window.
+func rollupTmax(w *Window) float64 {
+	values := w.Values
+	if len(values) == 0 {
+		return nan
+	}
+	maxValue := values[0]
+	maxTimestamp := w.Timestamps[0]
+	for i, v := range values {
+		if v > maxValue {
+			maxValue = v
+			maxTimestamp = w.Timestamps[i]
+		}
+	}
+	return float64(maxTimestamp) / 1e3
+}
+
+func rollupAvg(w *Window) float64 {
+	values := w.Values
+	if len(values) == 0 {
+		return nan
+	}
+	return rollupSum(w) / float64(len(values))
+}
+
+func rollupSum(w *Window) float64 {
+	values := w.Values
+	if len(values) == 0 {
+		return nan
+	}
+	sum := float64(0)
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+
+func rollupSum2(w *Window) float64 {
+	values := w.Values
+	if len(values) == 0 {
+		return nan
+	}
+	sum := float64(0)
+	for _, v := range values {
+		sum += v * v
+	}
+	return sum
+}
+
+func rollupGeomean(w *Window) float64 {
+	values := w.Values
+	if len(values) == 0 {
+		return nan
+	}
+	p := 1.0
+	for _, v := range values {
+		p *= v
+	}
+	return math.Pow(p, 1/float64(len(values)))
+}
+
+// rollupRateOverSum returns the sum of values on the window divided by the window duration in seconds.
+func rollupRateOverSum(w *Window) float64 {
+	if len(w.Values) == 0 {
+		return nan
+	}
+	return rollupSum(w) / (float64(w.Window) / 1e3)
+}
+
+func rollupMin(w *Window) float64 {
+	values := w.Values
+	if len(values) == 0 {
+		return nan
+	}
+	minValue := values[0]
+	for _, v := range values[1:] {
+		minValue = math.Min(minValue, v)
+	}
+	return minValue
+}
+
+func rollupMax(w *Window) float64 {
+	values := w.Values
+	if len(values) == 0 {
+		return nan
+	}
+	maxValue := values[0]
+	for _, v := range values[1:] {
+		maxValue = math.Max(maxValue, v)
+	}
+	return maxValue
+}
+
+func rollupRange(w *Window) float64 {
+	return rollupMax(w) - rollupMin(w)
+}
+
+func rollupCount(w *Window) float64 {
+	values := w.Values
+	if len(values) == 0 {
+		return nan
+	}
+	return float64(len(values))
+}
+
+func rollupDistinct(w *Window) float64 {
+	values := w.Values
+	if len(values) == 0 {
+		return nan
+	}
+	m := make(map[float64]struct{}, len(values))
+	for _, v := range values {
+		m[v] = struct{}{}
+	}
+	return float64(len(m))
+}
+
+// rollupMode returns the most frequent value on the window.
+//
+// The smallest value is returned if there are multiple most frequent values.
+func rollupMode(w *Window) float64 {
+	if len(w.Values) == 0 {
+		return nan
+	}
+	a := append([]float64{}, w.Values...)
+	sort.Float64s(a)
+	mode := a[0]
+	maxCount := 0
+	count := 0
+	for i, v := range a {
+		if i > 0 && v == a[i-1] {
+			count++
+		} else {
+			count = 1
+		}
+		if count > maxCount {
+			maxCount = count
+			mode = v
+		}
+	}
+	return mode
+}
+
+func rollupStddev(w *Window) float64 {
+	return math.Sqrt(rollupStdvar(w))
+}
+
+func rollupStdvar(w *Window) float64 {
+	values := w.Values
+	if len(values) == 0 {
+		return nan
+	}
+	avg := rollupAvg(w)
+	sum := float64(0)
+	for _, v := range values {
+		d := v - avg
+		sum += d * d
+	}
+	return sum / float64(len(values))
+}
+
+// rollupZScore returns z-score for the last value on the window.
+func rollupZScore(w *Window) float64 {
+	values := w.Values
+	if len(values) == 0 {
+		return nan
+	}
+	return (values[len(values)-1] - rollupAvg(w)) / rollupStddev(w)
+}
+
+func rollupQuantile(w *Window) float64 {
+	if len(w.Values) == 0 {
+		return nan
+	}
+	return Quantile(getParam(w, 0), w.Values)
+}
+
+func rollupMedian(w *Window) float64 {
+	if len(w.Values) == 0 {
+		return nan
+	}
+	return Quantile(0.5, w.Values)
+}
+
+// rollupMAD returns median absolute deviation for values on the window.
+func rollupMAD(w *Window) float64 {
+	values := w.Values
+	if len(values) == 0 {
+		return nan
+	}
+	median := Quantile(0.5, values)
+	ds := make([]float64, len(values))
+	for i, v := range values {
+		ds[i] = math.Abs(v - median)
+	}
+	return Quantile(0.5, ds)
+}
+
+// rollupOutlierIQR returns the last value on the window if it is outside [q25-1.5*iqr ... q75+1.5*iqr],
+// where iqr is the interquartile range. Otherwise NaN is returned.
+func rollupOutlierIQR(w *Window) float64 {
+	values := w.Values
+	if len(values) < 2 {
+		return nan
+	}
+	q25 := Quantile(0.25, values)
+	q75 := Quantile(0.75, values)
+	iqr := 1.5 * (q75 - q25)
+	v := values[len(values)-1]
+	if v > q75+iqr || v < q25-iqr {
+		return v
+	}
+	return nan
+}
+
+func eqFilter(v, limit float64) bool {
+	return v == limit
+}
+
+func neFilter(v, limit float64) bool {
+	return v != limit
+}
+
+func gtFilter(v, limit float64) bool {
+	return v > limit
+}
+
+func leFilter(v, limit float64) bool {
+	return v <= limit
+}
+
+// newRollupCountFilter returns a function, which counts values on the window matching f with the first param.
+func newRollupCountFilter(f func(v, limit float64) bool) Func {
+	return func(w *Window) float64 {
+		if len(w.Values) == 0 {
+			return nan
+		}
+		limit := getParam(w, 0)
+		n := 0
+		for _, v := range w.Values {
+			if f(v, limit) {
+				n++
+			}
+		}
+		return float64(n)
+	}
+}
+
+// newRollupShareFilter returns a function, which returns the share of values on the window matching f with the first param.
+func newRollupShareFilter(f func(v, limit float64) bool) Func {
+	countFilter := newRollupCountFilter(f)
+	return func(w *Window) float64 {
+		n := countFilter(w)
+		return n / float64(len(w.Values))
+	}
+}
+
+// newRollupSumFilter returns a function, which sums values on the window matching f with the first param.
+func newRollupSumFilter(f func(v, limit float64) bool) Func {
+	return func(w *Window) float64 {
+		if len(w.Values) == 0 {
+			return nan
+		}
+		limit := getParam(w, 0)
+		sum := float64(0)
+		for _, v := range w.Values {
+			if f(v, limit) {
+				sum += v
+			}
+		}
+		return sum
+	}
+}
+
+// rollupDelta returns the difference between the last sample on the window and the last sample before the window.
+//
+// It is used for both delta() and increase(). Counter resets must be removed for increase() before the call.
+func rollupDelta(w *Window) float64 {
+	values := w.Values
+	prevValue := w.PrevValue
+	if math.IsNaN(prevValue) {
+		if len(values) == 0 {
+			return nan
+		}
+		if !math.IsNaN(w.RealPrevValue) {
+			// Assume that the value didn't change during the gap before the window.
+			prevValue = w.RealPrevValue
+		} else {
+			// Assume that the previous non-existing value was 0 only if the first value
+			// doesn't exceed too much the delta with the next value.
+			d := float64(10)
+			if len(values) > 1 {
+				d = values[1] - values[0]
+			} else if !math.IsNaN(w.RealNextValue) {
+				d = w.RealNextValue - values[0]
+			}
+			if math.Abs(values[0]) < 10*(math.Abs(d)+1) {
+				prevValue = 0
+			} else {
+				prevValue = values[0]
+				values = values[1:]
+			}
+		}
+	}
+	if len(values) == 0 {
+		// Assume that the value didn't change on the window.
+		return 0
+	}
+	return values[len(values)-1] - prevValue
+}
+
+// rollupDeltaPrometheus returns the difference between the last and the first sample on the window like Prometheus does.
+//
+// It is used for both delta_prometheus() and increase_prometheus().
+func rollupDeltaPrometheus(w *Window) float64 {
+	values := w.Values
+	if len(values) < 2 {
+		return nan
+	}
+	return values[len(values)-1] - values[0]
+}
+
+// rollupRatePrometheus returns increase_prometheus() divided by the window duration in seconds.
+func rollupRatePrometheus(w *Window) float64 {
+	return rollupDeltaPrometheus(w) / (float64(w.Window) / 1e3)
+}
+
+// rollupIncreasePure works like rollupDelta, but always assumes the counter starts from 0 if there are no previous samples.
+func rollupIncreasePure(w *Window) float64 {
+	values := w.Values
+	prevValue := w.PrevValue
+	if math.IsNaN(prevValue) {
+		if len(values) == 0 {
+			return nan
+		}
+		prevValue = 0
+	}
+	if len(values) == 0 {
+		// Assume that the value didn't change on the window.
+		return 0
+	}
+	return values[len(values)-1] - prevValue
+}
+
+// rollupDerivFast returns the per-second rate of change between the last sample before the window
+// and the last sample on the window.
+func rollupDerivFast(w *Window) float64 {
+	values := w.Values
+	timestamps := w.Timestamps
+	prevValue := w.PrevValue
+	prevTimestamp := w.PrevTimestamp
+	if math.IsNaN(prevValue) {
+		if len(values) < 2 {
+			// It is impossible to calculate the rate on a single sample.
+			return nan
+		}
+		prevValue = values[0]
+		prevTimestamp = timestamps[0]
+	} else if len(values) == 0 {
+		return nan
+	}
+	vEnd := values[len(values)-1]
+	tEnd := timestamps[len(timestamps)-1]
+	vDelta := vEnd - prevValue
+	tDelta := float64(tEnd-prevTimestamp) / 1e3
+	return vDelta / tDelta
+}
+
+// rollupIderiv returns the per-second rate of change between the last two samples.
+func rollupIderiv(w *Window) float64 {
+	values := w.Values
+	timestamps := w.Timestamps
+	if len(values) < 2 {
+		if len(values) == 0 || math.IsNaN(w.PrevValue) {
+			return nan
+		}
+		return (values[0] - w.PrevValue) / (float64(timestamps[0]-w.PrevTimestamp) / 1e3)
+	}
+	vEnd := values[len(values)-1]
+	tEnd := timestamps[len(timestamps)-1]
+	vStart := values[len(values)-2]
+	tStart := timestamps[len(timestamps)-2]
+	return (vEnd - vStart) / (float64(tEnd-tStart) / 1e3)
+}
+
+func rollupIdelta(w *Window) float64 {
+	values := w.Values
+	if len(values) == 0 {
+		if math.IsNaN(w.PrevValue) {
+			return nan
+		}
+		return 0
+	}
+	lastValue := values[len(values)-1]
+	values = values[:len(values)-1]
+	if len(values) == 0 {
+		if math.IsNaN(w.PrevValue) {
+			// Assume that the value didn't change on the given interval.
+			return 0
+		}
+		return lastValue - w.PrevValue
+	}
+	return lastValue - values[len(values)-1]
+}
+
+// rollupDeriv returns the per-second derivative calculated via linear regression over samples on the window.
+func rollupDeriv(w *Window) float64 {
+	_, k := linearRegression(w.Values, w.Timestamps, w.CurrTimestamp)
+	return k
+}
+
+// rollupPredictLinear predicts the value in Params[0] seconds after CurrTimestamp via linear regression.
+func rollupPredictLinear(w *Window) float64 {
+	v, k := linearRegression(w.Values, w.Timestamps, w.CurrTimestamp)
+	if math.IsNaN(v) {
+		return nan
+	}
+	return v + k*getParam(w, 0)
+}
+
+// linearRegression returns the value at interceptTime and the per-second slope for the linear regression
+// over the given samples.
+func linearRegression(values []float64, timestamps []int64, interceptTime int64) (float64, float64) {
+	if len(values) == 0 {
+		return nan, nan
+	}
+	if areConstValues(values) {
+		return values[0], 0
+	}
+	// See https://en.wikipedia.org/wiki/Simple_linear_regression#Numerical_example
+	var vSum, tSum, tvSum, ttSum float64
+	for i, v := range values {
+		dt := float64(timestamps[i]-interceptTime) / 1e3
+		vSum += v
+		tSum += dt
+		tvSum += dt * v
+		ttSum += dt * dt
+	}
+	k := float64(0)
+	n := float64(len(values))
+	tDiff := ttSum - tSum*tSum/n
+	if math.Abs(tDiff) >= 1e-6 {
+		// Prevent from incorrect division for too small tDiff values.
+		k = (tvSum - tSum*vSum/n) / tDiff
+	}
+	v := vSum/n - k*tSum/n
+	return v, k
+}
+
+func areConstValues(values []float64) bool {
+	for _, v := range values[1:] {
+		if v != values[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// rollupHoltWinters returns the smoothed value for samples on the window via double exponential smoothing.
+//
+// Params[0] is the smoothing factor and Params[1] is the trend factor. Both must be in the range (0...1).
+func rollupHoltWinters(w *Window) float64 {
+	values := w.Values
+	if len(values) == 0 {
+		return w.PrevValue
+	}
+	sf := getParam(w, 0)
+	tf := getParam(w, 1)
+	if sf <= 0 || sf >= 1 || tf <= 0 || tf >= 1 || math.IsNaN(sf) || math.IsNaN(tf) {
+		return nan
+	}
+	// See https://en.wikipedia.org/wiki/Exponential_smoothing#Double_exponential_smoothing .
+	s0 := w.PrevValue
+	if math.IsNaN(s0) {
+		s0 = values[0]
+		values = values[1:]
+		if len(values) == 0 {
+			return s0
+		}
+	}
+	b0 := values[0] - s0
+	for _, v := range values {
+		s1 := sf*v + (1-sf)*(s0+b0)
+		b1 := tf*(s1-s0) + (1-tf)*b0
+		s0 = s1
+		b0 = b1
+	}
+	return s0
+}
+
+func rollupHoeffdingBoundLower(w *Window) float64 {
+	bound, avg := hoeffdingBound(w)
+	return avg - bound
+}
+
+func rollupHoeffdingBoundUpper(w *Window) float64 {
+	bound, avg := hoeffdingBound(w)
+	return avg + bound
+}
+
+// hoeffdingBound returns Hoeffding bound for phi in Params[0] together with the average value on the window.
+//
+// See https://en.wikipedia.org/wiki/Hoeffding%27s_inequality
+func hoeffdingBound(w *Window) (float64, float64) {
+	values := w.Values
+	if len(values) == 0 {
+		return nan, nan
+	}
+	if len(values) == 1 {
+		return 0, values[0]
+	}
+	vAvg := rollupAvg(w)
+	vRange := rollupRange(w)
+	if vRange <= 0 {
+		return 0, vAvg
+	}
+	phi := getParam(w, 0)
+	if math.IsNaN(phi) || phi < 0 || phi > 1 {
+		return nan, nan
+	}
+	bound := vRange * math.Sqrt(math.Log(1/(1-phi))/(2*float64(len(values))))
+	return bound, vAvg
+}
+
+// rollupIntegrate returns the integral over samples on the window using the previous value for every interval.
+func rollupIntegrate(w *Window) float64 {
+	values := w.Values
+	timestamps := w.Timestamps
+	prevValue := w.PrevValue
+	prevTimestamp := w.CurrTimestamp - w.Window
+	if math.IsNaN(prevValue) {
+		if len(values) == 0 {
+			return nan
+		}
+		prevValue = values[0]
+		prevTimestamp = timestamps[0]
+		values = values[1:]
+		timestamps = timestamps[1:]
+	}
+	sum := float64(0)
+	for i, v := range values {
+		dt := float64(timestamps[i]-prevTimestamp) / 1e3
+		sum += prevValue * dt
+		prevTimestamp = timestamps[i]
+		prevValue = v
+	}
+	dt := float64(w.CurrTimestamp-prevTimestamp) / 1e3
+	sum += prevValue * dt
+	return sum
+}
+
+func rollupChanges(w *Window) float64 {
+	values := w.Values
+	prevValue := w.PrevValue
+	n := 0
+	if math.IsNaN(prevValue) {
+		if len(values) == 0 {
+			return nan
+		}
+		// Count the first sample as a change, since it changes the series from non-existing to existing.
+		prevValue = values[0]
+		values = values[1:]
+		n++
+	}
+	for _, v := range values {
+		if v != prevValue {
+			if math.Abs(v-prevValue) < 1e-12*math.Abs(v) {
+				// This may be a precision error.
+				continue
+			}
+			n++
+			prevValue = v
+		}
+	}
+	return float64(n)
+}
+
+// rollupChangesPrometheus counts changes between samples on the window like Prometheus does,
+// e.g. it ignores the sample before the window.
+func rollupChangesPrometheus(w *Window) float64 {
+	values := w.Values
+	if len(values) == 0 {
+		return nan
+	}
+	prevValue := values[0]
+	n := 0
+	for _, v := range values[1:] {
+		if v != prevValue {
+			if math.Abs(v-prevValue) < 1e-12*math.Abs(v) {
+				// This may be a precision error.
+				continue
+			}
+			n++
+			prevValue = v
+		}
+	}
+	return float64(n)
+}
+
+func rollupResets(w *Window) float64 {
+	values := w.Values
+	if len(values) == 0 {
+		if math.IsNaN(w.PrevValue) {
+			return nan
+		}
+		return 0
+	}
+	prevValue := w.PrevValue
+	if math.IsNaN(prevValue) {
+		prevValue = values[0]
+		values = values[1:]
+	}
+	n := 0
+	for _, v := range values {
+		if v < prevValue {
+			n++
+		}
+		prevValue = v
+	}
+	return float64(n)
+}
+
+func rollupAscent(w *Window) float64 {
+	return sumDeltas(w, func(d float64) bool {
+		return d > 0
+	})
+}
+
+func rollupDescent(w *Window) float64 {
+	return -sumDeltas(w, func(d float64) bool {
+		return d < 0
+	})
+}
+
+func rollupIncreases(w *Window) float64 {
+	return countDeltas(w, func(d float64) bool {
+		return d > 0
+	})
+}
+
+func rollupDecreases(w *Window) float64 {
+	return countDeltas(w, func(d float64) bool {
+		return d < 0
+	})
+}
+
+// sumDeltas returns the sum of deltas between adjacent samples accepted by f.
+//
+// The sample before the window is taken into account if it exists.
+func sumDeltas(w *Window, f func(d float64) bool) float64 {
+	values := w.Values
+	prevValue := w.PrevValue
+	if math.IsNaN(prevValue) {
+		if len(values) == 0 {
+			return nan
+		}
+		prevValue = values[0]
+		values = values[1:]
+	}
+	sum := float64(0)
+	for _, v := range values {
+		if d := v - prevValue; f(d) {
+			sum += d
+		}
+		prevValue = v
+	}
+	return sum
+}
+
+// countDeltas returns the number of deltas between adjacent samples accepted by f.
+//
+// The sample before the window is taken into account if it exists.
+func countDeltas(w *Window, f func(d float64) bool) float64 {
+	values := w.Values
+	prevValue := w.PrevValue
+	if math.IsNaN(prevValue) {
+		if len(values) == 0 {
+			return nan
+		}
+		prevValue = values[0]
+		values = values[1:]
+	}
+	n := 0
+	for _, v := range values {
+		if f(v - prevValue) {
+			n++
+		}
+		prevValue = v
+	}
+	return float64(n)
+}
+
+// rollupDuration returns the duration in seconds when the series was present on the window.
+//
+// Params[0] contains the maximum interval in seconds between adjacent samples when the series is considered present.
+func rollupDuration(w *Window) float64 {
+	timestamps := w.Timestamps
+	if len(timestamps) == 0 {
+		return nan
+	}
+	maxInterval := getParam(w, 0)
+	if math.IsNaN(maxInterval) {
+		return nan
+	}
+	dMax := int64(maxInterval * 1e3)
+	tPrev := timestamps[0]
+	dSum := int64(0)
+	for _, t := range timestamps[1:] {
+		if d := t - tPrev; d <= dMax {
+			dSum += d
+		}
+		tPrev = t
+	}
+	return float64(dSum) / 1e3
+}
+
+// rollupLag returns the duration in seconds between CurrTimestamp and the last sample.
+func rollupLag(w *Window) float64 {
+	timestamps := w.Timestamps
+	if len(timestamps) == 0 {
+		if math.IsNaN(w.PrevValue) {
+			return nan
+		}
+		return float64(w.CurrTimestamp-w.PrevTimestamp) / 1e3
+	}
+	return float64(w.CurrTimestamp-timestamps[len(timestamps)-1]) / 1e3
+}
+
+// rollupLifetime returns the duration in seconds between the first and the last sample.
+func rollupLifetime(w *Window) float64 {
+	timestamps := w.Timestamps
+	if math.IsNaN(w.PrevValue) {
+		if len(timestamps) < 2 {
+			return nan
+		}
+		return float64(timestamps[len(timestamps)-1]-timestamps[0]) / 1e3
+	}
+	if len(timestamps) == 0 {
+		return nan
+	}
+	return float64(timestamps[len(timestamps)-1]-w.PrevTimestamp) / 1e3
+}
+
+// rollupScrapeInterval returns the average interval in seconds between samples.
+func rollupScrapeInterval(w *Window) float64 {
+	timestamps := w.Timestamps
+	if math.IsNaN(w.PrevValue) {
+		if len(timestamps) < 2 {
+			return nan
+		}
+		return float64(timestamps[len(timestamps)-1]-timestamps[0]) / 1e3 / float64(len(timestamps)-1)
+	}
+	if len(timestamps) == 0 {
+		return nan
+	}
+	return float64(timestamps[len(timestamps)-1]-w.PrevTimestamp) / 1e3 / float64(len(timestamps))
+}
+
+// getCandlestickValues returns values on the window excluding the sample at CurrTimestamp,
+// which belongs to the next candle.
+func getCandlestickValues(w *Window) []float64 {
+	timestamps := w.Timestamps
+	for len(timestamps) > 0 && timestamps[len(timestamps)-1] >= w.CurrTimestamp {
+		timestamps = timestamps[:len(timestamps)-1]
+	}
+	return w.Values[:len(timestamps)]
+}
+
+// getFirstValueForCandlestick returns the previous value if it belongs to the current candle.
+func getFirstValueForCandlestick(w *Window) float64 {
+	if w.PrevTimestamp+w.Window >= w.CurrTimestamp {
+		return w.PrevValue
+	}
+	return nan
+}
+
+func rollupOpen(w *Window) float64 {
+	if v := getFirstValueForCandlestick(w); !math.IsNaN(v) {
+		return v
+	}
+	values := getCandlestickValues(w)
+	if len(values) == 0 {
+		return nan
+	}
+	return values[0]
+}
+
+func rollupClose(w *Window) float64 {
+	values := getCandlestickValues(w)
+	if len(values) == 0 {
+		return getFirstValueForCandlestick(w)
+	}
+	return values[len(values)-1]
+}
+
+func rollupLow(w *Window) float64 {
+	values := getCandlestickValues(w)
+	minValue := getFirstValueForCandlestick(w)
+	if math.IsNaN(minValue) {
+		if len(values) == 0 {
+			return nan
+		}
+		minValue = values[0]
+		values = values[1:]
+	}
+	for _, v := range values {
+		minValue = math.Min(minValue, v)
+	}
+	return minValue
+}
+
+func rollupHigh(w *Window) float64 {
+	values := getCandlestickValues(w)
+	maxValue := getFirstValueForCandlestick(w)
+	if math.IsNaN(maxValue) {
+		if len(values) == 0 {
+			return nan
+		}
+		maxValue = values[0]
+		values = values[1:]
+	}
+	for _, v := range values {
+		maxValue = math.Max(maxValue, v)
+	}
+	return maxValue
+}
+
+// newRollupMulti returns min, max and avg outputs over values obtained via f from the window.
+func newRollupMulti(f func(w *Window) []float64) []NamedFunc {
+	newFunc := func(rf Func) Func {
+		return func(w *Window) float64 {
+			return rf(&Window{
+				Values: f(w),
+			})
+		}
+	}
+	return []NamedFunc{
+		{Name: "min", Func: newFunc(rollupMin)},
+		{Name: "max", Func: newFunc(rollupMax)},
+		{Name: "avg", Func: newFunc(rollupAvg)},
+	}
+}
+
+// getDeltas returns deltas between adjacent samples on the window including the sample before the window.
+func getDeltas(w *Window) []float64 {
+	return getAdjacentDiffs(w, func(dv float64, _ int64) float64 {
+		return dv
+	})
+}
+
+// getDerivs returns per-second derivatives between adjacent samples on the window including the sample before the window.
+func getDerivs(w *Window) []float64 {
+	return getAdjacentDiffs(w, func(dv float64, dt int64) float64 {
+		return dv / (float64(dt) / 1e3)
+	})
+}
+
+// getScrapeIntervals returns intervals in seconds between adjacent samples on the window including the sample before the window.
+func getScrapeIntervals(w *Window) []float64 {
+	return getAdjacentDiffs(w, func(_ float64, dt int64) float64 {
+		return float64(dt) / 1e3
+	})
+}
+
+func getAdjacentDiffs(w *Window, f func(dv float64, dt int64) float64) []float64 {
+	values := w.Values
+	timestamps := w.Timestamps
+	prevValue := w.PrevValue
+	prevTimestamp := w.PrevTimestamp
+	if math.IsNaN(prevValue) {
+		if len(values) == 0 {
+			return nil
+		}
+		prevValue = values[0]
+		prevTimestamp = timestamps[0]
+		values = values[1:]
+		timestamps = timestamps[1:]
+	}
+	dst := make([]float64, len(values))
+	for i, v := range values {
+		dst[i] = f(v-prevValue, timestamps[i]-prevTimestamp)
+		prevValue = v
+		prevTimestamp = timestamps[i]
+	}
+	return dst
+}
+
+// newQuantilesFuncs returns outputs for `quantiles_over_time("phiLabel", phi1, ..., phiN, m[d])`.
+//
+// args must contain phiLabel string followed by float64 phis. nil is returned if args are invalid.
+func newQuantilesFuncs(args []any) []NamedFunc {
+	if len(args) < 2 {
+		return nil
+	}
+	phiLabel, ok := args[0].(string)
+	if !ok || phiLabel == "" {
+		return nil
+	}
+	nfs := make([]NamedFunc, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		phi, ok := arg.(float64)
+		if !ok {
+			return nil
+		}
+		nfs = append(nfs, NamedFunc{
+			Name:  strconv.FormatFloat(phi, 'g', -1, 64),
+			Label: phiLabel,
+			Func: func(w *Window) float64 {
+				return Quantile(phi, w.Values)
+			},
+		})
+	}
+	return nfs
+}
+
+// Bucket layout for VictoriaMetrics histograms. It must be kept in sync with github.com/VictoriaMetrics/metrics.Histogram.
+const (
+	vmrangeE10Min            = -9
+	vmrangeE10Max            = 18
+	vmrangeBucketsPerDecimal = 18
+	vmrangeBucketsCount      = (vmrangeE10Max - vmrangeE10Min) * vmrangeBucketsPerDecimal
+)
+
+// newHistogramFuncs returns outputs for histogram_over_time() per every VictoriaMetrics histogram bucket.
+//
+// Outputs are named after `vmrange` label values for the buckets in the same way as VictoriaMetrics histograms do.
+// Every output returns the number of samples on the window, which hit the bucket, or NaN if there are no such samples.
+func newHistogramFuncs() []NamedFunc {
+	nfs := make([]NamedFunc, 0, vmrangeBucketsCount+2)
+	v := math.Pow10(vmrangeE10Min)
+	start := formatVMRangeBound(v)
+	nfs = append(nfs, newHistogramFunc(-1, "0..."+start))
+	bucketMultiplier := math.Pow(10, 1.0/vmrangeBucketsPerDecimal)
+	for i := 0; i < vmrangeBucketsCount; i++ {
+		v *= bucketMultiplier
+		end := formatVMRangeBound(v)
+		nfs = append(nfs, newHistogramFunc(i, start+"..."+end))
+		start = end
+	}
+	nfs = append(nfs, newHistogramFunc(vmrangeBucketsCount, formatVMRangeBound(math.Pow10(vmrangeE10Max))+"...+Inf"))
+	return nfs
+}
+
+func newHistogramFunc(bucketIdx int, vmrange string) NamedFunc {
+	return NamedFunc{
+		Name:  vmrange,
+		Label: "vmrange",
+		Func: func(w *Window) float64 {
+			n := 0
+			for _, v := range w.Values {
+				if math.IsNaN(v) || v < 0 {
+					// VictoriaMetrics histograms ignore NaN and negative values.
+					continue
+				}
+				if getVMRangeBucketIdx(v) == bucketIdx {
+					n++
+				}
+			}
+			if n == 0 {
+				return nan
+			}
+			return float64(n)
+		},
+	}
+}
+
+// getVMRangeBucketIdx returns the index of VictoriaMetrics histogram bucket for non-negative v.
+//
+// -1 is returned for values below 1e-9, while vmrangeBucketsCount is returned for values above 1e18.
+func getVMRangeBucketIdx(v float64) int {
+	bucketIdx := (math.Log10(v) - vmrangeE10Min) * vmrangeBucketsPerDecimal
+	if bucketIdx < 0 {
+		return -1
+	}
+	if bucketIdx >= vmrangeBucketsCount {
+		return vmrangeBucketsCount
+	}
+	idx := int(bucketIdx)
+	if bucketIdx == float64(idx) && idx > 0 {
+		// 10^n values belong to the lower bucket according to Prometheus logic for `le`-based histograms.
+		idx--
+	}
+	return idx
+}
+
+func formatVMRangeBound(v float64) string {
+	return strconv.FormatFloat(v, 'e', 3, 64)
+}
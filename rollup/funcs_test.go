@@ -0,0 +1,417 @@
+package rollup
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	testTimestamps = []int64{10_000, 20_000, 30_000, 40_000, 50_000, 60_000}
+	testValues     = []float64{2, 4, 3, 7, 7, 5}
+)
+
+// newTestWindow returns a window (10s ... 60s] over test samples with the previous sample at 10s.
+func newTestWindow(params ...float64) *Window {
+	cfg := &Config{
+		Window:          50_000,
+		Step:            10_000,
+		MaxPrevInterval: 20_000,
+	}
+	w := cfg.NewWindow(testTimestamps, testValues, 60_000)
+	w.Params = params
+	return w
+}
+
+func isEqualValue(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	if a == b {
+		return true
+	}
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(b))
+}
+
+func TestGetFunc(t *testing.T) {
+	f := func(funcName string, params []float64, resultExpected float64) {
+		t.Helper()
+		rf := GetFunc(funcName)
+		if rf == nil {
+			t.Fatalf("missing function %q", funcName)
+		}
+		result := rf(newTestWindow(params...))
+		if !isEqualValue(result, resultExpected) {
+			t.Fatalf("unexpected result for %s(%v); got %v; want %v", funcName, params, result, resultExpected)
+		}
+	}
+
+	f("absent_over_time", nil, nan)
+	f("present_over_time", nil, 1)
+	f("default_rollup", nil, 5)
+	f("last_over_time", nil, 5)
+	f("first_over_time", nil, 4)
+	f("count_over_time", nil, 5)
+	f("sum_over_time", nil, 26)
+	f("sum2_over_time", nil, 148)
+	f("avg_over_time", nil, 5.2)
+	f("min_over_time", nil, 3)
+	f("max_over_time", nil, 7)
+	f("range_over_time", nil, 4)
+	f("median_over_time", nil, 5)
+	f("quantile_over_time", []float64{0.25}, 4)
+	f("quantile_over_time", nil, nan)
+	f("stdvar_over_time", nil, 2.56)
+	f("stddev_over_time", nil, 1.6)
+	f("zscore_over_time", nil, -0.125)
+	f("mad_over_time", nil, 2)
+	f("mode_over_time", nil, 7)
+	f("distinct_over_time", nil, 4)
+	f("geomean_over_time", nil, math.Pow(4*3*7*7*5, 0.2))
+	f("outlier_iqr_over_time", nil, nan)
+	f("rate_over_sum", nil, 0.52)
+
+	// functions with filters
+	f("count_eq_over_time", []float64{7}, 2)
+	f("count_ne_over_time", []float64{7}, 3)
+	f("count_gt_over_time", []float64{4}, 3)
+	f("count_le_over_time", []float64{4}, 2)
+	f("share_eq_over_time", []float64{7}, 0.4)
+	f("share_gt_over_time", []float64{4}, 0.6)
+	f("share_le_over_time", []float64{4}, 0.4)
+	f("sum_eq_over_time", []float64{7}, 14)
+	f("sum_gt_over_time", []float64{4}, 19)
+	f("sum_le_over_time", []float64{4}, 7)
+
+	// functions, which take into account the previous sample
+	f("delta", nil, 3)
+	f("increase", nil, 3)
+	f("increase_pure", nil, 3)
+	f("delta_prometheus", nil, 1)
+	f("increase_prometheus", nil, 1)
+	f("rate_prometheus", nil, 0.02)
+	f("rate", nil, 0.06)
+	f("deriv_fast", nil, 0.06)
+	f("irate", nil, -0.2)
+	f("ideriv", nil, -0.2)
+	f("idelta", nil, -2)
+	f("deriv", nil, 0.06)
+	f("predict_linear", []float64{60}, 10)
+	f("changes", nil, 4)
+	f("changes_prometheus", nil, 3)
+	f("resets", nil, 2)
+	f("ascent_over_time", nil, 6)
+	f("descent_over_time", nil, 3)
+	f("increases_over_time", nil, 2)
+	f("decreases_over_time", nil, 2)
+	f("integrate", nil, 230)
+	f("holt_winters", []float64{0.5, 0.5}, 6.8984375)
+	f("holt_winters", []float64{1.5, 0.5}, nan)
+	f("hoeffding_bound_upper", []float64{0.9}, 5.2+4*math.Sqrt(math.Log(10)/10))
+	f("hoeffding_bound_lower", []float64{0.9}, 5.2-4*math.Sqrt(math.Log(10)/10))
+
+	// time-related functions
+	f("lag", nil, 0)
+	f("lifetime", nil, 50)
+	f("scrape_interval", nil, 10)
+	f("duration_over_time", []float64{15}, 40)
+	f("duration_over_time", []float64{5}, 0)
+	f("timestamp", nil, 60)
+	f("timestamp_with_name", nil, 60)
+	f("tlast_over_time", nil, 60)
+	f("tfirst_over_time", nil, 20)
+	f("tmin_over_time", nil, 30)
+	f("tmax_over_time", nil, 40)
+	f("tlast_change_over_time", nil, 60)
+
+	// the function name is case-insensitive
+	f("Rate", nil, 0.06)
+}
+
+func TestGetFuncEmptyWindow(t *testing.T) {
+	f := func(funcName string, prevValue, resultExpected float64) {
+		t.Helper()
+		rf := GetFunc(funcName)
+		if rf == nil {
+			t.Fatalf("missing function %q", funcName)
+		}
+		w := &Window{
+			PrevValue:     prevValue,
+			PrevTimestamp: 0,
+			RealPrevValue: nan,
+			RealNextValue: nan,
+			CurrTimestamp: 60_000,
+			Window:        30_000,
+			Step:          30_000,
+		}
+		result := rf(w)
+		if !isEqualValue(result, resultExpected) {
+			t.Fatalf("unexpected result for %s with prevValue=%v; got %v; want %v", funcName, prevValue, result, resultExpected)
+		}
+	}
+	f("absent_over_time", nan, 1)
+	f("present_over_time", nan, nan)
+	f("sum_over_time", nan, nan)
+	f("count_over_time", nan, nan)
+	f("share_gt_over_time", nan, nan)
+	f("delta", nan, nan)
+	f("delta", 10, 0)
+	f("increase_pure", 10, 0)
+	f("idelta", 10, 0)
+	f("resets", 10, 0)
+	f("rate", nan, nan)
+	f("irate", 10, nan)
+	f("holt_winters", 10, 10)
+	f("lag", 10, 60)
+	f("lag", nan, nan)
+	f("lifetime", 10, nan)
+	f("changes", nan, nan)
+	f("changes", 10, 0)
+}
+
+func TestRollupDeltaWithoutPrevValue(t *testing.T) {
+	f := func(values []float64, realPrevValue, realNextValue, resultExpected float64) {
+		t.Helper()
+		w := &Window{
+			Values:        values,
+			Timestamps:    make([]int64, len(values)),
+			PrevValue:     nan,
+			RealPrevValue: realPrevValue,
+			RealNextValue: realNextValue,
+		}
+		result := rollupDelta(w)
+		if !isEqualValue(result, resultExpected) {
+			t.Fatalf("unexpected result for %v; got %v; want %v", values, result, resultExpected)
+		}
+	}
+
+	// the counter starts from zero
+	f([]float64{5, 10}, nan, nan, 10)
+
+	// the counter has been started before the first sample
+	f([]float64{1000, 1010}, nan, nan, 10)
+	f([]float64{1000}, nan, 1010, 0)
+
+	// the value didn't change during the gap before the window
+	f([]float64{1000, 1010}, 990, nan, 20)
+}
+
+func TestUsesPrevSample(t *testing.T) {
+	// Windows over test samples with the previous sample on, inside and after the window
+	// and with the previous sample equal to the values on the window.
+	cfg := &Config{
+		Step:            10_000,
+		MaxPrevInterval: 20_000,
+	}
+	var windows []*Window
+	for _, window := range []int64{40_000, 5_000} {
+		cfg.Window = window
+		for _, t := range []int64{60_000, 50_000, 65_000} {
+			w := cfg.NewWindow(testTimestamps, testValues, t)
+			w.Params = []float64{0.5, 0.5}
+			windows = append(windows, w)
+		}
+	}
+
+	// dependsOnPrevSample returns true if rf returns different results with and without the previous sample.
+	dependsOnPrevSample := func(rf Func) bool {
+		for _, w := range windows {
+			wNoPrev := *w
+			wNoPrev.PrevValue = nan
+			wNoPrev.PrevTimestamp = w.CurrTimestamp - w.Window - cfg.MaxPrevInterval
+			wNoPrev.RealPrevValue = nan
+			if !isEqualValue(rf(w), rf(&wNoPrev)) {
+				return true
+			}
+		}
+		return false
+	}
+	f := func(funcName string, rfs []Func) {
+		t.Helper()
+		result := false
+		for _, rf := range rfs {
+			if dependsOnPrevSample(rf) {
+				result = true
+			}
+		}
+		if result != UsesPrevSample(funcName) {
+			t.Fatalf("unexpected UsesPrevSample(%q); got %v; want %v", funcName, UsesPrevSample(funcName), result)
+		}
+	}
+	for funcName, rf := range funcs {
+		f(funcName, []Func{rf})
+	}
+	for funcName := range multiFuncs {
+		var rfs []Func
+		for _, nf := range GetMultiFunc(funcName, "phi", 0.5) {
+			rfs = append(rfs, nf.Func)
+		}
+		f(funcName, rfs)
+	}
+	for funcName := range funcsUsePrevSample {
+		if GetFunc(funcName) == nil && GetMultiFunc(funcName) == nil {
+			t.Fatalf("unknown function %q in funcsUsePrevSample", funcName)
+		}
+	}
+}
+
+func TestGetMultiFunc(t *testing.T) {
+	f := func(funcName string, resultExpected map[string]float64) {
+		t.Helper()
+		nfs := GetMultiFunc(funcName)
+		if len(nfs) != len(resultExpected) {
+			t.Fatalf("unexpected number of outputs for %s; got %d; want %d", funcName, len(nfs), len(resultExpected))
+		}
+		w := newTestWindow()
+		for _, nf := range nfs {
+			vExpected, ok := resultExpected[nf.Name]
+			if !ok {
+				t.Fatalf("unexpected output %q for %s", nf.Name, funcName)
+			}
+			if v := nf.Func(w); !isEqualValue(v, vExpected) {
+				t.Fatalf("unexpected %q output for %s; got %v; want %v", nf.Name, funcName, v, vExpected)
+			}
+		}
+	}
+	f("rollup", map[string]float64{
+		"min": 3,
+		"max": 7,
+		"avg": 5.2,
+	})
+	f("rollup_candlestick", map[string]float64{
+		"open":  2,
+		"close": 7,
+		"low":   2,
+		"high":  7,
+	})
+	f("rollup_delta", map[string]float64{
+		"min": -2,
+		"max": 4,
+		"avg": 0.6,
+	})
+	f("rollup_deriv", map[string]float64{
+		"min": -0.2,
+		"max": 0.4,
+		"avg": 0.06,
+	})
+	f("rollup_scrape_interval", map[string]float64{
+		"min": 10,
+		"max": 10,
+		"avg": 10,
+	})
+
+	if GetMultiFunc("rate") != nil {
+		t.Fatalf("rate() mustn't be a multi-output function")
+	}
+	if GetFunc("rollup") != nil {
+		t.Fatalf("rollup() must be a multi-output function")
+	}
+}
+
+func TestGetMultiFuncQuantiles(t *testing.T) {
+	f := func(args []any, resultExpected map[string]float64) {
+		t.Helper()
+		nfs := GetMultiFunc("quantiles_over_time", args...)
+		if len(nfs) != len(resultExpected) {
+			t.Fatalf("unexpected number of outputs for args %v; got %d; want %d", args, len(nfs), len(resultExpected))
+		}
+		w := newTestWindow()
+		for _, nf := range nfs {
+			if nf.Label != args[0] {
+				t.Fatalf("unexpected label for args %v; got %q; want %q", args, nf.Label, args[0])
+			}
+			vExpected, ok := resultExpected[nf.Name]
+			if !ok {
+				t.Fatalf("unexpected output %q for args %v", nf.Name, args)
+			}
+			if v := nf.Func(w); !isEqualValue(v, vExpected) {
+				t.Fatalf("unexpected %q output for args %v; got %v; want %v", nf.Name, args, v, vExpected)
+			}
+		}
+	}
+	f([]any{"phi", 0.5}, map[string]float64{
+		"0.5": 5,
+	})
+	f([]any{"quantile", 0.0, 0.25, 1.0}, map[string]float64{
+		"0":    3,
+		"0.25": 4,
+		"1":    7,
+	})
+
+	// invalid args
+	f(nil, nil)
+	f([]any{"phi"}, nil)
+	f([]any{0.5, 0.9}, nil)
+	f([]any{"", 0.5}, nil)
+	f([]any{"phi", "0.5"}, nil)
+}
+
+func TestGetMultiFuncHistogram(t *testing.T) {
+	nfs := GetMultiFunc("histogram_over_time")
+	if len(nfs) != vmrangeBucketsCount+2 {
+		t.Fatalf("unexpected number of outputs; got %d; want %d", len(nfs), vmrangeBucketsCount+2)
+	}
+	if nfs[0].Name != "0...1.000e-09" {
+		t.Fatalf("unexpected name for the first output; got %q; want %q", nfs[0].Name, "0...1.000e-09")
+	}
+	if nf := nfs[len(nfs)-1]; nf.Name != "1.000e+18...+Inf" {
+		t.Fatalf("unexpected name for the last output; got %q; want %q", nf.Name, "1.000e+18...+Inf")
+	}
+
+	// The results must match VictoriaMetrics histograms.
+	values := []float64{0, 1e-10, 1e-9, 1, 1.5, 1.5, 10, 100, 123.456, 1e18, 1e20, -1, nan}
+	var h metrics.Histogram
+	for _, v := range values {
+		h.Update(v)
+	}
+	resultExpected := make(map[string]float64)
+	h.VisitNonZeroBuckets(func(vmrange string, count uint64) {
+		resultExpected[vmrange] = float64(count)
+	})
+	w := &Window{
+		Values: values,
+	}
+	result := make(map[string]float64)
+	for _, nf := range nfs {
+		if nf.Label != "vmrange" {
+			t.Fatalf("unexpected label for %q output; got %q; want %q", nf.Name, nf.Label, "vmrange")
+		}
+		if v := nf.Func(w); !math.IsNaN(v) {
+			result[nf.Name] = v
+		}
+	}
+	if !reflect.DeepEqual(result, resultExpected) {
+		t.Fatalf("unexpected result\ngot\n%v\nwant\n%v", result, resultExpected)
+	}
+
+	// Empty window
+	for _, nf := range nfs {
+		if v := nf.Func(&Window{}); !math.IsNaN(v) {
+			t.Fatalf("expecting NaN for %q output on empty window; got %v", nf.Name, v)
+		}
+	}
+}
+
+func TestIsUnsupported(t *testing.T) {
+	f := func(funcName string, resultExpected bool) {
+		t.Helper()
+		if result := IsUnsupported(funcName); result != resultExpected {
+			t.Fatalf("unexpected IsUnsupported(%q); got %v; want %v", funcName, result, resultExpected)
+		}
+		if resultExpected && (GetFunc(funcName) != nil || GetMultiFunc(funcName) != nil) {
+			t.Fatalf("unsupported function %q mustn't have an implementation", funcName)
+		}
+	}
+	f("aggr_over_time", true)
+	f("count_values_over_time", true)
+	f("stale_samples_over_time", true)
+	f("Stale_Samples_Over_Time", true)
+
+	f("histogram_over_time", false)
+	f("quantiles_over_time", false)
+	f("rate", false)
+	f("rollup", false)
+	f("foobar", false)
+}
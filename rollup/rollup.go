@@ -0,0 +1,402 @@
+// Package rollup contains reference implementations of MetricsQL rollup functions.
+//
+// Rollup functions are calculated over samples on the lookbehind window (CurrTimestamp-Window ... CurrTimestamp]
+// together with the sample before the window. The implementations follow VictoriaMetrics semantics.
+//
+// The following MetricsQL rollup functions aren't supported:
+//
+//   - aggr_over_time - it applies multiple rollup functions named in its args;
+//   - count_values_over_time - it returns a series per distinct sample value;
+//   - stale_samples_over_time - it counts staleness markers, which aren't tracked by this package.
+//
+// Use IsUnsupported for detecting these functions.
+//
+// Usage:
+//
+//	rf := rollup.GetFunc("rate")
+//	if rf == nil {
+//	    // unsupported function
+//	}
+//	if rollup.RemovesCounterResets("rate") {
+//	    values = rollup.RemoveCounterResets(values)
+//	}
+//	cfg := &rollup.Config{
+//	    Window:          5 * 60_000,
+//	    Step:            60_000,
+//	    MaxPrevInterval: rollup.GetMaxPrevInterval(rollup.GetScrapeInterval(timestamps, 60_000)),
+//	}
+//	for _, t := range points {
+//	    v := rf(cfg.NewWindow(timestamps, values, t))
+//	}
+package rollup
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+var nan = math.NaN()
+
+// Window contains samples on the lookbehind window (CurrTimestamp-Window ... CurrTimestamp]
+// together with the context needed for rollup functions.
+//
+// All the timestamps are in milliseconds.
+type Window struct {
+	// Values and Timestamps contain samples on the lookbehind window.
+	//
+	// Timestamps must be sorted in ascending order.
+	Values     []float64
+	Timestamps []int64
+
+	// PrevValue is the value of the last sample before the lookbehind window.
+	//
+	// It is NaN if there is no such sample or if it is too far from the window.
+	PrevValue float64
+
+	// PrevTimestamp is the timestamp for PrevValue.
+	PrevTimestamp int64
+
+	// RealPrevValue is the value of the last sample before the lookbehind window without distance limits.
+	//
+	// It is NaN if there is no such sample.
+	RealPrevValue float64
+
+	// RealNextValue is the value of the first sample after the lookbehind window.
+	//
+	// It is NaN if there is no such sample.
+	RealNextValue float64
+
+	// CurrTimestamp is the timestamp for the calculated value.
+	CurrTimestamp int64
+
+	// Window is the lookbehind window duration.
+	Window int64
+
+	// Step is the interval between points the rollup function is calculated at.
+	Step int64
+
+	// Params contains values for non-rollup args of the rollup function in the order they are passed to the function.
+	//
+	// For example, Params contains [phi] for `quantile_over_time(phi, m[d])`.
+	Params []float64
+}
+
+// Config contains the configuration for creating Window.
+type Config struct {
+	// Window is the lookbehind window duration in milliseconds. Step is used if Window is zero.
+	Window int64
+
+	// Step is the interval between points in milliseconds.
+	Step int64
+
+	// MaxPrevInterval is the maximum distance in milliseconds between the start of the window and the previous sample
+	// stored in Window.PrevValue. It is usually obtained via GetMaxPrevInterval.
+	MaxPrevInterval int64
+
+	// LookbackDelta is the maximum distance in milliseconds between the start of the window and the previous sample
+	// stored in Window.RealPrevValue. There is no limit if LookbackDelta is zero.
+	LookbackDelta int64
+}
+
+// NewWindow returns Window for the given samples at currTimestamp.
+//
+// timestamps must be sorted in ascending order. The returned Window refers to timestamps and values.
+func (c *Config) NewWindow(timestamps []int64, values []float64, currTimestamp int64) *Window {
+	window := c.Window
+	if window <= 0 {
+		window = c.Step
+	}
+	tStart := currTimestamp - window
+	i := sort.Search(len(timestamps), func(n int) bool {
+		return timestamps[n] > tStart
+	})
+	j := sort.Search(len(timestamps), func(n int) bool {
+		return timestamps[n] > currTimestamp
+	})
+	w := &Window{
+		Values:        values[i:j],
+		Timestamps:    timestamps[i:j],
+		PrevValue:     nan,
+		PrevTimestamp: tStart - c.MaxPrevInterval,
+		RealPrevValue: nan,
+		RealNextValue: nan,
+		CurrTimestamp: currTimestamp,
+		Window:        window,
+		Step:          c.Step,
+	}
+	if i > 0 {
+		if timestamps[i-1] > w.PrevTimestamp {
+			w.PrevValue = values[i-1]
+			w.PrevTimestamp = timestamps[i-1]
+		}
+		if c.LookbackDelta == 0 || tStart-timestamps[i-1] < c.LookbackDelta {
+			w.RealPrevValue = values[i-1]
+		}
+	}
+	if j < len(values) {
+		w.RealNextValue = values[j]
+	}
+	return w
+}
+
+// Func calculates the rollup value for w.
+//
+// NaN is returned if the value cannot be calculated.
+type Func func(w *Window) float64
+
+// NamedFunc is a named output for rollup functions, which return multiple series such as rollup_candlestick().
+type NamedFunc struct {
+	// Name is the output name. VictoriaMetrics puts it into the label with the Label name.
+	Name string
+
+	// Label is the label name for Name. The `rollup` label is used if Label is empty.
+	//
+	// For example, Label is `vmrange` for histogram_over_time() outputs.
+	Label string
+
+	// Func calculates the output value.
+	Func Func
+}
+
+// GetFunc returns the function for the given rollup function name.
+//
+// nil is returned if funcName is unsupported or if it returns multiple series. Use GetMultiFunc in the latter case.
+func GetFunc(funcName string) Func {
+	return funcs[strings.ToLower(funcName)]
+}
+
+// GetMultiFunc returns functions for every output of the given rollup function, which returns multiple series
+// such as rollup(), rollup_candlestick() or histogram_over_time().
+//
+// args must contain constant non-rollup args for functions with outputs depending on them. For example, args must contain
+// phiLabel string followed by float64 phis for `quantiles_over_time("phiLabel", phi1, ..., phiN, m[d])`.
+// args are ignored for other functions.
+//
+// nil is returned if funcName doesn't return multiple series or if args are invalid.
+func GetMultiFunc(funcName string, args ...any) []NamedFunc {
+	funcName = strings.ToLower(funcName)
+	if funcName == "quantiles_over_time" {
+		return newQuantilesFuncs(args)
+	}
+	return multiFuncs[funcName]
+}
+
+// IsUnsupported returns true if funcName is a MetricsQL rollup function, which isn't supported by this package.
+//
+// See the package doc for the list of unsupported functions.
+func IsUnsupported(funcName string) bool {
+	return unsupportedFuncs[strings.ToLower(funcName)]
+}
+
+var unsupportedFuncs = map[string]bool{
+	"aggr_over_time":          true,
+	"count_values_over_time":  true,
+	"stale_samples_over_time": true,
+}
+
+// RemovesCounterResets returns true if funcName works with counters, so counter resets must be removed
+// from the input samples via RemoveCounterResets before calling the function.
+func RemovesCounterResets(funcName string) bool {
+	return funcsRemoveCounterResets[strings.ToLower(funcName)]
+}
+
+// CanAdjustWindow returns true if funcName may extend the implicit lookbehind window to MaxPrevInterval,
+// so it returns results for steps smaller than the scrape interval.
+func CanAdjustWindow(funcName string) bool {
+	return funcsCanAdjustWindow[strings.ToLower(funcName)]
+}
+
+// KeepsMetricName returns true if funcName keeps metric names for the output series.
+func KeepsMetricName(funcName string) bool {
+	return funcsKeepMetricName[strings.ToLower(funcName)]
+}
+
+// UsesPrevSample returns true if funcName uses the last sample before the lookbehind window
+// via Window.PrevValue, Window.PrevTimestamp or Window.RealPrevValue.
+//
+// The caller must provide samples up to Config.MaxPrevInterval before the window for such functions.
+// delta() and increase() may also use the sample up to Config.LookbackDelta before the window.
+func UsesPrevSample(funcName string) bool {
+	return funcsUsePrevSample[strings.ToLower(funcName)]
+}
+
+var funcsRemoveCounterResets = map[string]bool{
+	"increase":            true,
+	"increase_prometheus": true,
+	"increase_pure":       true,
+	"irate":               true,
+	"rate":                true,
+	"rate_prometheus":     true,
+	"rollup_increase":     true,
+	"rollup_rate":         true,
+}
+
+var funcsCanAdjustWindow = map[string]bool{
+	"default_rollup":         true,
+	"deriv":                  true,
+	"deriv_fast":             true,
+	"ideriv":                 true,
+	"irate":                  true,
+	"rate":                   true,
+	"rate_over_sum":          true,
+	"rollup":                 true,
+	"rollup_candlestick":     true,
+	"rollup_deriv":           true,
+	"rollup_rate":            true,
+	"rollup_scrape_interval": true,
+	"scrape_interval":        true,
+	"timestamp":              true,
+}
+
+var funcsUsePrevSample = map[string]bool{
+	"ascent_over_time":       true,
+	"changes":                true,
+	"decreases_over_time":    true,
+	"delta":                  true,
+	"descent_over_time":      true,
+	"deriv_fast":             true,
+	"holt_winters":           true,
+	"idelta":                 true,
+	"ideriv":                 true,
+	"increase":               true,
+	"increase_pure":          true,
+	"increases_over_time":    true,
+	"integrate":              true,
+	"irate":                  true,
+	"lag":                    true,
+	"lifetime":               true,
+	"rate":                   true,
+	"resets":                 true,
+	"rollup_candlestick":     true,
+	"rollup_delta":           true,
+	"rollup_deriv":           true,
+	"rollup_increase":        true,
+	"rollup_rate":            true,
+	"rollup_scrape_interval": true,
+	"scrape_interval":        true,
+	"tlast_change_over_time": true,
+}
+
+var funcsKeepMetricName = map[string]bool{
+	"avg_over_time":         true,
+	"default_rollup":        true,
+	"first_over_time":       true,
+	"geomean_over_time":     true,
+	"hoeffding_bound_lower": true,
+	"hoeffding_bound_upper": true,
+	"holt_winters":          true,
+	"last_over_time":        true,
+	"max_over_time":         true,
+	"median_over_time":      true,
+	"min_over_time":         true,
+	"mode_over_time":        true,
+	"predict_linear":        true,
+	"quantile_over_time":    true,
+	"quantiles_over_time":   true,
+	"rollup":                true,
+	"rollup_candlestick":    true,
+	"timestamp_with_name":   true,
+}
+
+// RemoveCounterResets returns a copy of values with removed counter resets.
+//
+// A small decrease relative to the previous value is treated as a partial counter reset
+// caused by HA pairs of scrapers.
+func RemoveCounterResets(values []float64) []float64 {
+	dst := make([]float64, len(values))
+	if len(values) == 0 {
+		return dst
+	}
+	correction := float64(0)
+	prevValue := values[0]
+	for i, v := range values {
+		d := v - prevValue
+		if d < 0 {
+			if (-d * 8) < prevValue {
+				// This is likely a partial counter reset from HA pairs of scrapers.
+				correction += prevValue - v
+			} else {
+				correction += prevValue
+			}
+		}
+		prevValue = v
+		dst[i] = v + correction
+	}
+	return dst
+}
+
+// GetScrapeInterval estimates the scrape interval in milliseconds for the given timestamps.
+//
+// defaultInterval is returned if the scrape interval cannot be estimated.
+func GetScrapeInterval(timestamps []int64, defaultInterval int64) int64 {
+	if len(timestamps) < 2 {
+		return defaultInterval
+	}
+	// Estimate scrape interval as 0.6 quantile for the first 20 intervals.
+	tsPrev := timestamps[0]
+	timestamps = timestamps[1:]
+	if len(timestamps) > 20 {
+		timestamps = timestamps[:20]
+	}
+	intervals := make([]float64, 0, len(timestamps))
+	for _, ts := range timestamps {
+		intervals = append(intervals, float64(ts-tsPrev))
+		tsPrev = ts
+	}
+	scrapeInterval := int64(Quantile(0.6, intervals))
+	if scrapeInterval <= 0 {
+		return defaultInterval
+	}
+	return scrapeInterval
+}
+
+// GetMaxPrevInterval returns the maximum distance from the lookbehind window to the previous sample
+// for the given scrapeInterval in milliseconds.
+func GetMaxPrevInterval(scrapeInterval int64) int64 {
+	// Increase scrapeInterval more for smaller scrape intervals in order to hide possible gaps
+	// when high jitter is present.
+	switch {
+	case scrapeInterval <= 2_000:
+		return scrapeInterval + 4*scrapeInterval
+	case scrapeInterval <= 4_000:
+		return scrapeInterval + 2*scrapeInterval
+	case scrapeInterval <= 8_000:
+		return scrapeInterval + scrapeInterval
+	case scrapeInterval <= 16_000:
+		return scrapeInterval + scrapeInterval/2
+	case scrapeInterval <= 32_000:
+		return scrapeInterval + scrapeInterval/4
+	default:
+		return scrapeInterval + scrapeInterval/8
+	}
+}
+
+// Quantile returns phi-quantile over non-NaN values.
+//
+// values aren't modified.
+func Quantile(phi float64, values []float64) float64 {
+	a := make([]float64, 0, len(values))
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			a = append(a, v)
+		}
+	}
+	if len(a) == 0 || math.IsNaN(phi) {
+		return nan
+	}
+	if phi < 0 {
+		return math.Inf(-1)
+	}
+	if phi > 1 {
+		return math.Inf(1)
+	}
+	sort.Float64s(a)
+	vIdx := phi * float64(len(a)-1)
+	idx := int(vIdx)
+	if idx+1 >= len(a) {
+		return a[len(a)-1]
+	}
+	weight := vIdx - float64(idx)
+	return a[idx]*(1-weight) + a[idx+1]*weight
+}
@@ -0,0 +1,118 @@
+package rollup
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestConfigNewWindow(t *testing.T) {
+	f := func(cfg *Config, currTimestamp int64, resultExpected string) {
+		t.Helper()
+		w := cfg.NewWindow(testTimestamps, testValues, currTimestamp)
+		result := fmt.Sprintf("values=%v timestamps=%v prev=%v@%d realPrev=%v realNext=%v window=%d",
+			w.Values, w.Timestamps, w.PrevValue, w.PrevTimestamp, w.RealPrevValue, w.RealNextValue, w.Window)
+		if result != resultExpected {
+			t.Fatalf("unexpected window\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+
+	// the previous sample is close to the window
+	f(&Config{
+		Window:          20_000,
+		MaxPrevInterval: 15_000,
+	}, 40_000, "values=[3 7] timestamps=[30000 40000] prev=4@20000 realPrev=4 realNext=7 window=20000")
+
+	// the previous sample is too far from the window
+	f(&Config{
+		Window:          20_000,
+		MaxPrevInterval: 5_000,
+	}, 45_000, "values=[3 7] timestamps=[30000 40000] prev=NaN@20000 realPrev=4 realNext=7 window=20000")
+
+	// the previous sample is outside lookback delta
+	f(&Config{
+		Window:          20_000,
+		MaxPrevInterval: 5_000,
+		LookbackDelta:   1_000,
+	}, 45_000, "values=[3 7] timestamps=[30000 40000] prev=NaN@20000 realPrev=NaN realNext=7 window=20000")
+
+	// step is used as window
+	f(&Config{
+		Step:            10_000,
+		MaxPrevInterval: 15_000,
+	}, 60_000, "values=[5] timestamps=[60000] prev=7@50000 realPrev=7 realNext=NaN window=10000")
+
+	// no samples before the window
+	f(&Config{
+		Window:          20_000,
+		MaxPrevInterval: 15_000,
+	}, 15_000, "values=[2] timestamps=[10000] prev=NaN@-20000 realPrev=NaN realNext=4 window=20000")
+}
+
+func TestRemoveCounterResets(t *testing.T) {
+	f := func(values []float64, resultExpected string) {
+		t.Helper()
+		result := fmt.Sprintf("%v", RemoveCounterResets(values))
+		if result != resultExpected {
+			t.Fatalf("unexpected result for %v; got %s; want %s", values, result, resultExpected)
+		}
+	}
+	f(nil, "[]")
+	f([]float64{1, 2, 3}, "[1 2 3]")
+
+	// full counter reset
+	f([]float64{100, 130, 10, 40}, "[100 130 140 170]")
+
+	// partial counter reset
+	f([]float64{100, 130, 125, 140}, "[100 130 130 145]")
+}
+
+func TestGetScrapeInterval(t *testing.T) {
+	f := func(timestamps []int64, resultExpected int64) {
+		t.Helper()
+		result := GetScrapeInterval(timestamps, 42)
+		if result != resultExpected {
+			t.Fatalf("unexpected scrape interval for %v; got %d; want %d", timestamps, result, resultExpected)
+		}
+	}
+	f(nil, 42)
+	f([]int64{10}, 42)
+	f([]int64{10, 10}, 42)
+	f([]int64{0, 10_000, 20_000, 30_000}, 10_000)
+	f([]int64{0, 10_000, 15_000, 25_000, 35_000}, 10_000)
+}
+
+func TestGetMaxPrevInterval(t *testing.T) {
+	f := func(scrapeInterval, resultExpected int64) {
+		t.Helper()
+		result := GetMaxPrevInterval(scrapeInterval)
+		if result != resultExpected {
+			t.Fatalf("unexpected result for %d; got %d; want %d", scrapeInterval, result, resultExpected)
+		}
+	}
+	f(1_000, 5_000)
+	f(4_000, 12_000)
+	f(8_000, 16_000)
+	f(10_000, 15_000)
+	f(30_000, 37_500)
+	f(80_000, 90_000)
+}
+
+func TestQuantile(t *testing.T) {
+	f := func(phi float64, values []float64, resultExpected float64) {
+		t.Helper()
+		result := Quantile(phi, values)
+		if !isEqualValue(result, resultExpected) {
+			t.Fatalf("unexpected quantile(%v, %v); got %v; want %v", phi, values, result, resultExpected)
+		}
+	}
+	f(0.5, nil, nan)
+	f(0.5, []float64{nan}, nan)
+	f(nan, []float64{1}, nan)
+	f(-1, []float64{1}, math.Inf(-1))
+	f(2, []float64{1}, math.Inf(1))
+	f(0, []float64{3, 1, 2}, 1)
+	f(1, []float64{3, 1, 2}, 3)
+	f(0.5, []float64{3, nan, 1, 2}, 2)
+	f(0.25, []float64{4, 1, 3, 2}, 1.75)
+}
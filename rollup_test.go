@@ -0,0 +1,16 @@
+package metricsql
+
+import (
+	"testing"
+
+	"github.com/VictoriaMetrics/metricsql/rollup"
+)
+
+func TestRollupFuncsImplemented(t *testing.T) {
+	for funcName := range rollupFuncs {
+		// Pass args for functions with outputs depending on args such as quantiles_over_time().
+		if rollup.GetFunc(funcName) == nil && rollup.GetMultiFunc(funcName, "phi", 0.5) == nil && !rollup.IsUnsupported(funcName) {
+			t.Fatalf("rollup function %q must be either implemented or marked as unsupported in the rollup package", funcName)
+		}
+	}
+}
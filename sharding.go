@@ -0,0 +1,438 @@
+package metricsql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ShardingPlan contains expressions for evaluating some expression on horizontally sharded storage.
+//
+// See AnalyzeSharding for details.
+type ShardingPlan struct {
+	// ShardExprs contains expressions, which must be evaluated independently on every shard.
+	ShardExprs []Expr
+
+	// MergeExpr is the expression, which calculates the final result from per-shard results.
+	//
+	// It refers to the results of ShardExprs[i] collected from all the shards via selectors
+	// with the metric name returned by ShardResultName(i). The caller must replace the metric name
+	// of the collected series with ShardResultName(i) and keep the rest of their labels as is.
+	// MergeExpr must be evaluated on the same points as ShardExprs. It uses only the per-shard result at every point,
+	// so gaps in per-shard results aren't filled with the previous values.
+	//
+	// Every series returned by ShardExprs contains the shard label, so the series collected from distinct shards
+	// never clash. The original metric names are stored in a helper label by ShardExprs and are restored by MergeExpr.
+	MergeExpr Expr
+}
+
+// IsShardLocal returns true if the original expression can be evaluated on every shard
+// and the final result is just a union of per-shard results.
+func (sp *ShardingPlan) IsShardLocal() bool {
+	return len(sp.ShardExprs) == 1 && getShardResultName(sp.MergeExpr) == ShardResultName(0)
+}
+
+// ShardResultName returns the metric name, which refers to the results of ShardingPlan.ShardExprs[i] inside ShardingPlan.MergeExpr.
+func ShardResultName(i int) string {
+	return fmt.Sprintf("__shard_result_%d__", i)
+}
+
+// shardMetricNameLabel is the label for the original metric name of the series returned by ShardingPlan.ShardExprs.
+const shardMetricNameLabel = "__shard_metric_name__"
+
+// getShardResultName returns the metric name for the reference to per-shard results in e.
+//
+// An empty string is returned if e isn't a reference to per-shard results.
+func getShardResultName(e Expr) string {
+	if fe, ok := e.(*FuncExpr); ok && fe.Name == "label_del" && len(fe.Args) == 2 {
+		// Skip the restoring of the original metric name. See shardAnalyzer.addShardExpr.
+		if fe, ok := fe.Args[0].(*FuncExpr); ok && fe.Name == "label_replace" && len(fe.Args) == 5 {
+			e = fe.Args[0]
+		}
+	}
+	fe, ok := e.(*FuncExpr)
+	if !ok || fe.Name != "last_over_time" || len(fe.Args) != 1 {
+		return ""
+	}
+	re, ok := fe.Args[0].(*RollupExpr)
+	if !ok {
+		return ""
+	}
+	me, ok := re.Expr.(*MetricExpr)
+	if !ok {
+		return ""
+	}
+	return me.getMetricName()
+}
+
+// AnalyzeSharding returns a plan for evaluating e on storage, where every series is stored on a single shard
+// identified by the value of shardLabel label.
+//
+// Sub-expressions, which select series and calculate the result per every series, per every group of series
+// containing shardLabel in the grouping labels or per every pair of series matched on shardLabel,
+// are evaluated on every shard as is. The original metric names of their results are preserved via a helper label.
+//
+// The following aggregate functions are pushed down to shards, where partial aggregates are grouped by shardLabel too:
+//
+//	sum(q) by (...)    ->  sum(sum(q) by (..., shardLabel)) by (...)
+//	min(q) by (...)    ->  min(min(q) by (..., shardLabel)) by (...)
+//	max(q) by (...)    ->  max(max(q) by (..., shardLabel)) by (...)
+//	count(q) by (...)  ->  sum(count(q) by (..., shardLabel)) by (...)
+//	group(q) by (...)  ->  group(group(q) by (..., shardLabel)) by (...)
+//	avg(q) by (...)    ->  sum(sum(q) by (..., shardLabel)) by (...) / sum(count(q) by (..., shardLabel)) by (...)
+//	topk(k, q)         ->  topk(k, topk(k, q))
+//	bottomk(k, q)      ->  bottomk(k, bottomk(k, q))
+//
+// Other functions and operations are evaluated over the merged per-shard results.
+//
+// An error is returned if e cannot be evaluated this way. For example, rollups over subqueries
+// with cross-shard aggregations cannot be evaluated over per-shard results.
+func AnalyzeSharding(e Expr, shardLabel string) (*ShardingPlan, error) {
+	if shardLabel == "" {
+		return nil, fmt.Errorf("shardLabel cannot be empty")
+	}
+	sa := &shardAnalyzer{
+		shardLabel: shardLabel,
+	}
+	eCopy := Clone(e)
+	mergeExpr, err := sa.plan(eCopy)
+	if err != nil {
+		return nil, err
+	}
+	sp := &ShardingPlan{
+		ShardExprs: sa.shardExprs,
+		MergeExpr:  mergeExpr,
+	}
+	return sp, nil
+}
+
+type shardAnalyzer struct {
+	shardLabel string
+	shardExprs []Expr
+}
+
+// addShardExpr adds e to shard expressions and returns the reference to its per-shard results for the merge expression.
+//
+// If keepsMetricName is set, then the original metric names for e results are saved in shardMetricNameLabel
+// and are restored in the returned reference, since the caller replaces them with ShardResultName.
+func (sa *shardAnalyzer) addShardExpr(e Expr, keepsMetricName bool) Expr {
+	n := len(sa.shardExprs)
+	// The per-shard result at every point is selected via `last_over_time(m[1i])`, since the bare selector m
+	// would fill gaps in per-shard results with the previous values.
+	me := &FuncExpr{
+		Name: "last_over_time",
+		Args: []Expr{
+			&RollupExpr{
+				Expr: newMetricExpr(ShardResultName(n)),
+				Window: &DurationExpr{
+					s: "1i",
+				},
+			},
+		},
+	}
+	if !keepsMetricName {
+		sa.shardExprs = append(sa.shardExprs, e)
+		return me
+	}
+	sa.shardExprs = append(sa.shardExprs, newLabelReplaceExpr(e, shardMetricNameLabel, "__name__", "(.+)"))
+	// The empty shardMetricNameLabel removes the metric name from the results.
+	return &FuncExpr{
+		Name: "label_del",
+		Args: []Expr{
+			newLabelReplaceExpr(me, "__name__", shardMetricNameLabel, "(.*)"),
+			&StringExpr{
+				S: shardMetricNameLabel,
+			},
+		},
+	}
+}
+
+// newLabelReplaceExpr returns `label_replace(e, dstLabel, "$1", srcLabel, regex)`.
+func newLabelReplaceExpr(e Expr, dstLabel, srcLabel, regex string) *FuncExpr {
+	return &FuncExpr{
+		Name: "label_replace",
+		Args: []Expr{
+			e,
+			&StringExpr{
+				S: dstLabel,
+			},
+			&StringExpr{
+				S: "$1",
+			},
+			&StringExpr{
+				S: srcLabel,
+			},
+			&StringExpr{
+				S: regex,
+			},
+		},
+	}
+}
+
+func (sa *shardAnalyzer) plan(e Expr) (Expr, error) {
+	if sa.isPartitioned(e) {
+		return sa.addShardExpr(e, true), nil
+	}
+	switch t := e.(type) {
+	case *NumberExpr, *StringExpr:
+		return e, nil
+	case *AggrFuncExpr:
+		if eNew := sa.pushdownAggrFunc(t); eNew != nil {
+			return eNew, nil
+		}
+		if err := sa.planArgs(t.Args); err != nil {
+			return nil, err
+		}
+		return t, nil
+	case *FuncExpr:
+		if IsRollupFunc(t.Name) {
+			return nil, fmt.Errorf("cannot evaluate rollup function over per-shard results in %s", t.AppendString(nil))
+		}
+		if err := sa.planArgs(t.Args); err != nil {
+			return nil, err
+		}
+		return t, nil
+	case *BinaryOpExpr:
+		left, err := sa.plan(t.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := sa.plan(t.Right)
+		if err != nil {
+			return nil, err
+		}
+		t.Left = left
+		t.Right = right
+		return t, nil
+	default:
+		return nil, fmt.Errorf("cannot evaluate %s over per-shard results", e.AppendString(nil))
+	}
+}
+
+func (sa *shardAnalyzer) planArgs(args []Expr) error {
+	for i, arg := range args {
+		argNew, err := sa.plan(arg)
+		if err != nil {
+			return err
+		}
+		args[i] = argNew
+	}
+	return nil
+}
+
+// pushdownAggrFunc returns merge expression for ae if ae can be calculated from partial per-shard aggregates.
+//
+// nil is returned otherwise.
+func (sa *shardAnalyzer) pushdownAggrFunc(ae *AggrFuncExpr) Expr {
+	funcName := strings.ToLower(ae.Name)
+	var arg Expr
+	switch funcName {
+	case "sum", "min", "max", "count", "group", "avg":
+		if len(ae.Args) != 1 {
+			return nil
+		}
+		arg = ae.Args[0]
+	case "topk", "bottomk":
+		if len(ae.Args) != 2 || !isConstantExpr(ae.Args[0]) {
+			return nil
+		}
+		arg = ae.Args[1]
+	default:
+		return nil
+	}
+	if !sa.isPartitioned(arg) {
+		return nil
+	}
+	newAggr := func(name string, args ...Expr) *AggrFuncExpr {
+		return &AggrFuncExpr{
+			Name:     name,
+			Args:     args,
+			Modifier: ae.Modifier,
+		}
+	}
+	// Partial aggregates are grouped by shardLabel too, so partial aggregates from distinct shards don't clash.
+	newPartialAggr := func(name string, args ...Expr) *AggrFuncExpr {
+		return &AggrFuncExpr{
+			Name:     name,
+			Args:     args,
+			Modifier: sa.getPartialModifier(&ae.Modifier),
+		}
+	}
+	withLimit := func(e *AggrFuncExpr) *AggrFuncExpr {
+		e.Limit = ae.Limit
+		return e
+	}
+	switch funcName {
+	case "sum", "min", "max", "group":
+		r := sa.addShardExpr(newPartialAggr(funcName, arg), false)
+		return withLimit(newAggr(funcName, r))
+	case "count":
+		r := sa.addShardExpr(newPartialAggr(funcName, arg), false)
+		return withLimit(newAggr("sum", r))
+	case "avg":
+		rSum := sa.addShardExpr(newPartialAggr("sum", arg), false)
+		rCount := sa.addShardExpr(newPartialAggr("count", Clone(arg)), false)
+		return &BinaryOpExpr{
+			Op:    "/",
+			Left:  withLimit(newAggr("sum", rSum)),
+			Right: withLimit(newAggr("sum", rCount)),
+		}
+	default:
+		// topk, bottomk
+		// They select the original series on every shard, so per-shard results keep shardLabel and metric names.
+		k := ae.Args[0]
+		r := sa.addShardExpr(newAggr(funcName, k, arg), true)
+		return withLimit(newAggr(funcName, Clone(k), r))
+	}
+}
+
+// getPartialModifier returns the grouping modifier for partial per-shard aggregates, which adds shardLabel to me.
+func (sa *shardAnalyzer) getPartialModifier(me *ModifierExpr) ModifierExpr {
+	switch strings.ToLower(me.Op) {
+	case "by":
+		args := append([]string{}, me.Args...)
+		return ModifierExpr{
+			Op:   me.Op,
+			Args: append(args, sa.shardLabel),
+		}
+	case "without":
+		var args []string
+		for _, arg := range me.Args {
+			if arg != sa.shardLabel {
+				args = append(args, arg)
+			}
+		}
+		return ModifierExpr{
+			Op:   me.Op,
+			Args: args,
+		}
+	default:
+		return ModifierExpr{
+			Op:   "by",
+			Args: []string{sa.shardLabel},
+		}
+	}
+}
+
+// isPartitioned returns true if every output series of e is calculated from input series belonging to a single shard
+// and keeps the shardLabel of these input series.
+//
+// Such expressions can be evaluated on every shard independently, while the final result is a union of per-shard results.
+func (sa *shardAnalyzer) isPartitioned(e Expr) bool {
+	switch t := e.(type) {
+	case *MetricExpr:
+		return true
+	case *RollupExpr:
+		if t.At != nil && !isConstantExpr(t.At) {
+			return false
+		}
+		return sa.isPartitioned(t.Expr)
+	case *FuncExpr:
+		if !sa.keepsShardLabel(t) {
+			return false
+		}
+		return sa.areArgsPartitioned(t.Args)
+	case *AggrFuncExpr:
+		if !sa.isShardLabelInGroup(&t.Modifier, false) {
+			return false
+		}
+		return sa.areArgsPartitioned(t.Args)
+	case *BinaryOpExpr:
+		lc := isConstantExpr(t.Left)
+		rc := isConstantExpr(t.Right)
+		switch {
+		case lc && rc:
+			return false
+		case lc:
+			return sa.isPartitioned(t.Right)
+		case rc:
+			return sa.isPartitioned(t.Left)
+		}
+		if !sa.isShardLabelInGroup(&t.GroupModifier, true) {
+			return false
+		}
+		return sa.isPartitioned(t.Left) && sa.isPartitioned(t.Right)
+	default:
+		return false
+	}
+}
+
+// areArgsPartitioned returns true if args contain at least a single partitioned arg, while the rest of args are constants.
+func (sa *shardAnalyzer) areArgsPartitioned(args []Expr) bool {
+	hasPartitioned := false
+	for _, arg := range args {
+		if isConstantExpr(arg) {
+			continue
+		}
+		if !sa.isPartitioned(arg) {
+			return false
+		}
+		hasPartitioned = true
+	}
+	return hasPartitioned
+}
+
+// isShardLabelInGroup returns true if the grouping defined by me includes shardLabel.
+//
+// If emptyMeansAll is set, then an empty me means grouping by all the labels.
+func (sa *shardAnalyzer) isShardLabelInGroup(me *ModifierExpr, emptyMeansAll bool) bool {
+	switch strings.ToLower(me.Op) {
+	case "by", "on":
+		return containsString(me.Args, sa.shardLabel)
+	case "without", "ignoring":
+		return !containsString(me.Args, sa.shardLabel)
+	default:
+		return emptyMeansAll
+	}
+}
+
+// keepsShardLabel returns true if fe calculates output series independently per every input series or per every group
+// of input series with the same shardLabel, while keeping the shardLabel in the output series.
+func (sa *shardAnalyzer) keepsShardLabel(fe *FuncExpr) bool {
+	funcName := strings.ToLower(fe.Name)
+	switch funcName {
+	case "label_keep":
+		if len(fe.Args) == 0 {
+			return false
+		}
+		for _, arg := range fe.Args[1:] {
+			if se, ok := arg.(*StringExpr); ok && se.S == sa.shardLabel {
+				return true
+			}
+		}
+		return false
+	case "label_copy", "label_del", "label_join", "label_lowercase", "label_map", "label_match", "label_mismatch",
+		"label_move", "label_replace", "label_set", "label_transform", "label_uppercase", "labels_equal":
+		// These functions keep the shardLabel unless it is mentioned in args.
+		for _, arg := range fe.Args {
+			if se, ok := arg.(*StringExpr); ok && se.S == sa.shardLabel {
+				return false
+			}
+		}
+		return true
+	case "sort", "sort_desc", "sort_by_label", "sort_by_label_desc", "sort_by_label_numeric", "sort_by_label_numeric_desc":
+		// The union of per-shard results loses the order of series.
+		return false
+	case "", "union", "vector":
+		return true
+	default:
+		return canPreserveLabels(funcName)
+	}
+}
+
+func isConstantExpr(e Expr) bool {
+	switch e.(type) {
+	case *NumberExpr, *StringExpr, *DurationExpr:
+		return true
+	default:
+		return false
+	}
+}
+
+func containsString(a []string, s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package metricsql
+
+import (
+	"testing"
+)
+
+func TestAnalyzeShardingSuccess(t *testing.T) {
+	f := func(q, shardLabel string, shardExprsExpected []string, mergeExprExpected string) {
+		t.Helper()
+		e, err := Parse(q)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", q, err)
+		}
+		qOrig := string(e.AppendString(nil))
+		sp, err := AnalyzeSharding(e, shardLabel)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", q, err)
+		}
+		if len(sp.ShardExprs) != len(shardExprsExpected) {
+			t.Fatalf("unexpected number of shard exprs for %q; got %d; want %d", q, len(sp.ShardExprs), len(shardExprsExpected))
+		}
+		for i, se := range sp.ShardExprs {
+			s := string(se.AppendString(nil))
+			if s != shardExprsExpected[i] {
+				t.Fatalf("unexpected shard expr #%d for %q\ngot\n%s\nwant\n%s", i, q, s, shardExprsExpected[i])
+			}
+		}
+		mergeExpr := string(sp.MergeExpr.AppendString(nil))
+		if mergeExpr != mergeExprExpected {
+			t.Fatalf("unexpected merge expr for %q\ngot\n%s\nwant\n%s", q, mergeExpr, mergeExprExpected)
+		}
+
+		// Make sure the original expression isn't modified
+		if s := string(e.AppendString(nil)); s != qOrig {
+			t.Fatalf("the original expression has been modified; got %s; want %s", s, qOrig)
+		}
+	}
+
+	// keepName returns the shard expression, which saves the metric names for q results.
+	keepName := func(q string) string {
+		return `label_replace(` + q + `, "__shard_metric_name__", "$1", "__name__", "(.+)")`
+	}
+	// ref returns the reference to per-shard results with the restored metric names.
+	ref := func(name string) string {
+		return `label_del(label_replace(` + name + `, "__name__", "$1", "__shard_metric_name__", "(.*)"), "__shard_metric_name__")`
+	}
+	ref0 := ref(`last_over_time(__shard_result_0__[1i])`)
+	ref1 := ref(`last_over_time(__shard_result_1__[1i])`)
+
+	// shard-local expressions
+	f(`foo`, "shard", []string{keepName(`foo`)}, ref0)
+	f(`rate(foo[5m])`, "shard", []string{keepName(`rate(foo[5m])`)}, ref0)
+	f(`sum(rate(foo[5m])) by (job, shard)`, "shard", []string{keepName(`sum(rate(foo[5m])) by(job,shard)`)}, ref0)
+	f(`sum(foo) without (job)`, "shard", []string{keepName(`sum(foo) without(job)`)}, ref0)
+	f(`foo / on(shard, job) bar`, "shard", []string{keepName(`foo / on(shard,job) bar`)}, ref0)
+	f(`foo * 2 > bar`, "shard", []string{keepName(`(foo * 2) > bar`)}, ref0)
+	f(`histogram_quantile(0.9, sum(rate(foo_bucket[5m])) by (le, shard))`, "shard", []string{keepName(`histogram_quantile(0.9, sum(rate(foo_bucket[5m])) by(le,shard))`)}, ref0)
+	f(`label_set(foo, "a", "b")`, "shard", []string{keepName(`label_set(foo, "a", "b")`)}, ref0)
+	f(`label_keep(foo, "a", "shard")`, "shard", []string{keepName(`label_keep(foo, "a", "shard")`)}, ref0)
+	f(`max_over_time(sum(foo) by (shard)[1h:1m])`, "shard", []string{keepName(`max_over_time((sum(foo) by(shard))[1h:1m])`)}, ref0)
+
+	// aggregate pushdown
+	f(`sum(foo)`, "shard", []string{`sum(foo) by(shard)`}, `sum(last_over_time(__shard_result_0__[1i]))`)
+	f(`sum(rate(foo[5m])) by (job)`, "shard", []string{`sum(rate(foo[5m])) by(job,shard)`}, `sum(last_over_time(__shard_result_0__[1i])) by(job)`)
+	f(`sum(foo) without (shard)`, "shard", []string{`sum(foo) without()`}, `sum(last_over_time(__shard_result_0__[1i])) without(shard)`)
+	f(`sum(foo) without (job, shard)`, "shard", []string{`sum(foo) without(job)`}, `sum(last_over_time(__shard_result_0__[1i])) without(job,shard)`)
+	f(`min(foo) by (job)`, "shard", []string{`min(foo) by(job,shard)`}, `min(last_over_time(__shard_result_0__[1i])) by(job)`)
+	f(`max(foo)`, "shard", []string{`max(foo) by(shard)`}, `max(last_over_time(__shard_result_0__[1i]))`)
+	f(`group(foo) by (job)`, "shard", []string{`group(foo) by(job,shard)`}, `group(last_over_time(__shard_result_0__[1i])) by(job)`)
+	f(`count(foo) by (job) limit 10`, "shard", []string{`count(foo) by(job,shard)`}, `sum(last_over_time(__shard_result_0__[1i])) by(job) limit 10`)
+	f(`avg(foo) by (job)`, "shard", []string{`sum(foo) by(job,shard)`, `count(foo) by(job,shard)`}, `sum(last_over_time(__shard_result_0__[1i])) by(job) / sum(last_over_time(__shard_result_1__[1i])) by(job)`)
+	f(`topk(3, rate(foo[5m])) by (job)`, "shard", []string{keepName(`topk(3, rate(foo[5m])) by(job)`)}, `topk(3, `+ref0+`) by(job)`)
+	f(`bottomk(3, foo)`, "shard", []string{keepName(`bottomk(3, foo)`)}, `bottomk(3, `+ref0+`)`)
+
+	// evaluation over merged results
+	f(`sum(foo) / sum(bar)`, "shard", []string{`sum(foo) by(shard)`, `sum(bar) by(shard)`}, `sum(last_over_time(__shard_result_0__[1i])) / sum(last_over_time(__shard_result_1__[1i]))`)
+	f(`foo / on(job) bar`, "shard", []string{keepName(`foo`), keepName(`bar`)}, ref0+` / on(job) `+ref1)
+	f(`quantile(0.9, rate(foo[5m]))`, "shard", []string{keepName(`rate(foo[5m])`)}, `quantile(0.9, `+ref0+`)`)
+	f(`sum(sum(foo) by (job, instance)) by (job)`, "shard", []string{`sum(foo) by(job,instance,shard)`}, `sum(sum(last_over_time(__shard_result_0__[1i])) by(job,instance)) by(job)`)
+	f(`abs(sum(foo))`, "shard", []string{`sum(foo) by(shard)`}, `abs(sum(last_over_time(__shard_result_0__[1i])))`)
+	f(`sort_desc(foo)`, "shard", []string{keepName(`foo`)}, `sort_desc(`+ref0+`)`)
+	f(`label_set(foo, "shard", "x")`, "shard", []string{keepName(`foo`)}, `label_set(`+ref0+`, "shard", "x")`)
+	f(`label_keep(foo, "a")`, "shard", []string{keepName(`foo`)}, `label_keep(`+ref0+`, "a")`)
+	f(`label_keep()`, "shard", nil, `label_keep()`)
+	f(`sum(label_keep())`, "shard", nil, `sum(label_keep())`)
+	f(`1 + 2 * time()`, "shard", nil, `1 + (2 * time())`)
+}
+
+func TestAnalyzeShardingFailure(t *testing.T) {
+	f := func(q, shardLabel string) {
+		t.Helper()
+		e, err := Parse(q)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", q, err)
+		}
+		sp, err := AnalyzeSharding(e, shardLabel)
+		if err == nil {
+			t.Fatalf("expecting non-nil error for %q", q)
+		}
+		if sp != nil {
+			t.Fatalf("expecting nil plan for %q", q)
+		}
+	}
+
+	f(`foo`, "")
+	f(`max_over_time(sum(foo)[1h:1m])`, "shard")
+	f(`rate(sum(foo) by (job))`, "shard")
+	f(`foo @ end()`, "shard")
+}
+
+func TestShardingPlanIsShardLocal(t *testing.T) {
+	f := func(q string, resultExpected bool) {
+		t.Helper()
+		e, err := Parse(q)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", q, err)
+		}
+		sp, err := AnalyzeSharding(e, "shard")
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", q, err)
+		}
+		if result := sp.IsShardLocal(); result != resultExpected {
+			t.Fatalf("unexpected IsShardLocal() for %q; got %v; want %v", q, result, resultExpected)
+		}
+	}
+
+	f(`foo`, true)
+	f(`sum(foo) by (shard)`, true)
+	f(`sum(foo)`, false)
+	f(`foo + on(job) bar`, false)
+	f(`topk(3, foo)`, false)
+	f(`1`, false)
+}
@@ -0,0 +1,174 @@
+package metricsql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CommonSubexpr is a subexpression, which occurs multiple times in a query.
+type CommonSubexpr struct {
+	// Expr is the subexpression.
+	Expr Expr
+
+	// Count is the number of occurrences of Expr in the query.
+	Count int
+}
+
+// FindCommonSubexprs returns subexpressions, which occur at least twice in e.
+//
+// Subexpressions are compared by their string representation. Only the outermost repeated subexpressions are returned,
+// e.g. `rate(x{a="b"}[5m])` is returned for `rate(x{a="b"}[5m]) / rate(x{a="b"}[5m])` without `x{a="b"}[5m]`.
+// Numbers, strings, plain metric names such as `foo` and functions without args such as `time()` are never returned,
+// since they are trivial.
+//
+// The returned subexpressions are ordered by their first occurrence in e. They refer to e.
+func FindCommonSubexprs(e Expr) []CommonSubexpr {
+	counts := make(map[string]int)
+	visitSubexprs(e, func(expr Expr) bool {
+		if isTrivialSubexpr(expr) {
+			return true
+		}
+		counts[string(expr.AppendString(nil))]++
+		return true
+	})
+
+	var cses []CommonSubexpr
+	seen := make(map[string]bool)
+	visitSubexprs(e, func(expr Expr) bool {
+		if isTrivialSubexpr(expr) {
+			return true
+		}
+		key := string(expr.AppendString(nil))
+		n := counts[key]
+		if n < 2 {
+			return true
+		}
+		if !seen[key] {
+			seen[key] = true
+			cses = append(cses, CommonSubexpr{
+				Expr:  expr,
+				Count: n,
+			})
+		}
+		// Do not descend into the repeated subexpression, since its children are repeated too.
+		return false
+	})
+	return cses
+}
+
+// ExtractCommonSubexprs returns string representation of e, where subexpressions returned by FindCommonSubexprs
+// are moved into `WITH (...)` templates.
+//
+// For example, `rate(x[5m]) / (rate(x[5m]) + 1)` is converted to `WITH (q1 = rate(x[5m])) q1 / (q1 + 1)`.
+// Template names are chosen so they do not clash with identifiers in e.
+// The returned query can be parsed with Parse or formatted with Prettify. e isn't modified.
+//
+// String representation of e is returned if e has no common subexpressions.
+func ExtractCommonSubexprs(e Expr) string {
+	q := string(e.AppendString(nil))
+	cses := FindCommonSubexprs(e)
+	if len(cses) == 0 {
+		return q
+	}
+	names := make(map[string]string, len(cses))
+	was := make([]*withArgExpr, 0, len(cses))
+	n := 0
+	for _, cse := range cses {
+		var name string
+		for {
+			n++
+			name = fmt.Sprintf("q%d", n)
+			if !strings.Contains(q, name) {
+				break
+			}
+		}
+		names[string(cse.Expr.AppendString(nil))] = name
+		was = append(was, &withArgExpr{
+			Name: name,
+			Expr: Clone(cse.Expr),
+		})
+	}
+	we := &withExpr{
+		Was:  was,
+		Expr: replaceSubexprs(Clone(e), names),
+	}
+	return string(we.AppendString(nil))
+}
+
+// replaceSubexprs replaces subexpressions in e with references to templates from names.
+//
+// names maps string representation of subexpressions to template names. e is modified in place.
+func replaceSubexprs(e Expr, names map[string]string) Expr {
+	if !isTrivialSubexpr(e) {
+		if name, ok := names[string(e.AppendString(nil))]; ok {
+			return &MetricExpr{
+				LabelFilterss: [][]LabelFilter{{{
+					Label: "__name__",
+					Value: name,
+				}}},
+			}
+		}
+	}
+	switch t := e.(type) {
+	case *RollupExpr:
+		t.Expr = replaceSubexprs(t.Expr, names)
+		if t.At != nil {
+			t.At = replaceSubexprs(t.At, names)
+		}
+	case *FuncExpr:
+		replaceSubexprsInArgs(t.Args, names)
+	case *AggrFuncExpr:
+		replaceSubexprsInArgs(t.Args, names)
+	case *BinaryOpExpr:
+		t.Left = replaceSubexprs(t.Left, names)
+		t.Right = replaceSubexprs(t.Right, names)
+	}
+	return e
+}
+
+func replaceSubexprsInArgs(args []Expr, names map[string]string) {
+	for i, arg := range args {
+		args[i] = replaceSubexprs(arg, names)
+	}
+}
+
+// visitSubexprs calls f for e and its subexpressions in pre-order.
+//
+// Subexpressions of the expression aren't visited if f returns false for it.
+func visitSubexprs(e Expr, f func(expr Expr) bool) {
+	if !f(e) {
+		return
+	}
+	switch t := e.(type) {
+	case *RollupExpr:
+		visitSubexprs(t.Expr, f)
+		if t.At != nil {
+			visitSubexprs(t.At, f)
+		}
+	case *FuncExpr:
+		for _, arg := range t.Args {
+			visitSubexprs(arg, f)
+		}
+	case *AggrFuncExpr:
+		for _, arg := range t.Args {
+			visitSubexprs(arg, f)
+		}
+	case *BinaryOpExpr:
+		visitSubexprs(t.Left, f)
+		visitSubexprs(t.Right, f)
+	}
+}
+
+func isTrivialSubexpr(e Expr) bool {
+	switch t := e.(type) {
+	case *NumberExpr, *StringExpr, *DurationExpr:
+		return true
+	case *MetricExpr:
+		return t.IsEmpty() || t.isOnlyMetricName()
+	case *FuncExpr:
+		// Functions without args such as time() or end() are as short as template references.
+		return len(t.Args) == 0
+	default:
+		return false
+	}
+}
@@ -0,0 +1,87 @@
+package metricsql
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestFindCommonSubexprs(t *testing.T) {
+	f := func(q, resultExpected string) {
+		t.Helper()
+		e, err := Parse(q)
+		if err != nil {
+			t.Fatalf("unexpected error in Parse(%s): %s", q, err)
+		}
+		cses := FindCommonSubexprs(e)
+		var a []string
+		for _, cse := range cses {
+			a = append(a, fmt.Sprintf("%s:%d", cse.Expr.AppendString(nil), cse.Count))
+		}
+		result := strings.Join(a, "; ")
+		if result != resultExpected {
+			t.Fatalf("unexpected result for FindCommonSubexprs(%s);\ngot\n%s\nwant\n%s", q, result, resultExpected)
+		}
+	}
+
+	// no common subexpressions
+	f(`foo`, ``)
+	f(`foo + foo`, ``)
+	f(`1 + 2 * foo`, ``)
+	f(`rate(x[5m]) / rate(x[10m])`, ``)
+	f(`label_set(x, "a", "b") + label_set(y, "a", "b")`, ``)
+
+	// common subexpressions
+	f(`rate(x{a="b"}[5m]) / rate(x{a="b"}[5m])`, `rate(x{a="b"}[5m]):2`)
+	f(`x{a="b"} + x{a="b"} * x{a="b"}`, `x{a="b"}:3`)
+	f(`sum(rate(x[5m])) / (sum(rate(x[5m])) + rate(x[5m]))`, `sum(rate(x[5m])):2; rate(x[5m]):3`)
+	f(`abs(a + b) / (a + b) - abs(a + b)`, `abs(a + b):2; a + b:3`)
+	f(`(a + b) / sum(a + b) by (c) or sum(a + b) by (c)`, `a + b:3; sum(a + b) by(c):2`)
+	f(`foo @ end() + bar @ end()`, ``)
+	f(`foo @ (a{x="y"} + 1) + a{x="y"}`, `a{x="y"}:2`)
+	f(`x[5m:1m] offset 1h + x[5m:1m] offset 1h`, `x[5m:1m] offset 1h:2`)
+}
+
+func TestExtractCommonSubexprs(t *testing.T) {
+	f := func(q, resultExpected string) {
+		t.Helper()
+		e, err := Parse(q)
+		if err != nil {
+			t.Fatalf("unexpected error in Parse(%s): %s", q, err)
+		}
+		sOrig := string(e.AppendString(nil))
+		result := ExtractCommonSubexprs(e)
+		if result != resultExpected {
+			t.Fatalf("unexpected result for ExtractCommonSubexprs(%s);\ngot\n%s\nwant\n%s", q, result, resultExpected)
+		}
+		// Make sure the original e didn't change
+		s := string(e.AppendString(nil))
+		if s != sOrig {
+			t.Fatalf("the original expression has been changed;\ngot\n%s\nwant\n%s", s, sOrig)
+		}
+		// Make sure the result is equivalent to the original query
+		eResult, err := Parse(result)
+		if err != nil {
+			t.Fatalf("cannot parse the result %s: %s", result, err)
+		}
+		s = string(eResult.AppendString(nil))
+		if s != sOrig {
+			t.Fatalf("unexpected expression after parsing the result %s;\ngot\n%s\nwant\n%s", result, s, sOrig)
+		}
+		if _, err := Prettify(result); err != nil {
+			t.Fatalf("cannot prettify the result %s: %s", result, err)
+		}
+	}
+
+	f(`foo`, `foo`)
+	f(`rate(x[5m]) / rate(x[10m])`, `rate(x[5m]) / rate(x[10m])`)
+	f(`rate(x{a="b"}[5m]) / (rate(x{a="b"}[5m]) + 1)`, `WITH (q1 = rate(x{a="b"}[5m])) q1 / (q1 + 1)`)
+	f(`sum(rate(x[5m])) / (sum(rate(x[5m])) + rate(x[5m]))`, `WITH (q1 = sum(rate(x[5m])), q2 = rate(x[5m])) q1 / (q1 + q2)`)
+	f(`rate(x{a="b"}[5m]) + x{a="b"}`, `WITH (q1 = x{a="b"}) rate(q1[5m]) + q1`)
+	f(`rate(x{a="b"}[5m]) + x{a="b"} + x{a="b"}`, `WITH (q1 = x{a="b"}) (rate(q1[5m]) + q1) + q1`)
+	f(`sum(a{x="y"}) by (c) / a{x="y"}`, `WITH (q1 = a{x="y"}) sum(q1) by(c) / q1`)
+	f(`sum(x[5m:1m]) + min(x[5m:1m])`, `WITH (q1 = x[5m:1m]) sum(q1) + min(q1)`)
+
+	// template names must not clash with identifiers in the query
+	f(`q1 + abs(q2{a="b"}) * abs(q2{a="b"})`, `WITH (q3 = abs(q2{a="b"})) q1 + (q3 * q3)`)
+}
@@ -0,0 +1,167 @@
+package metricsql
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxSuggestions is the maximum number of suggestions returned in "did you mean" hints.
+const maxSuggestions = 3
+
+// keywords contains MetricsQL keywords, which may be misspelled in queries.
+var keywords = []string{
+	"and", "atan2", "bool", "by", "default", "group_left", "group_right", "if", "ifnot", "ignoring",
+	"keep_metric_names", "limit", "offset", "on", "or", "prefix", "unless", "without",
+}
+
+// getUnsupportedFunctionHint returns a hint for the unsupported function with the given funcName.
+//
+// An empty string is returned if there is no hint for funcName.
+func getUnsupportedFunctionHint(funcName string) string {
+	if aggrFuncName, modifier, ok := splitAggrFuncWithModifier(funcName); ok {
+		return fmt.Sprintf("use `%s(...) %s (...)` instead", aggrFuncName, modifier)
+	}
+	return getDidYouMeanHint(funcName, getFuncNames())
+}
+
+// getParseErrorHint returns a hint for the parse error occurred at the current lex token.
+//
+// An empty string is returned if there is no hint.
+func getParseErrorHint(lex *lexer) string {
+	tokens := append(lex.prevTokens[:len(lex.prevTokens):len(lex.prevTokens)], lex.Token)
+
+	// Detect `foo offset 5m [5m]`
+	if n := len(tokens); n >= 3 && tokens[n-1] == "[" && isOffset(tokens[n-3]) {
+		return "`offset` must be put after `[...]`, e.g. `rate(m[5m] offset 1h)`"
+	}
+
+	// Detect `sum_by (job) (x)`
+	for i, token := range tokens {
+		if i+1 >= len(tokens) || tokens[i+1] != "(" {
+			continue
+		}
+		if aggrFuncName, modifier, ok := splitAggrFuncWithModifier(token); ok {
+			return fmt.Sprintf("use `%s(...) %s (...)` instead of `%s(...)`", aggrFuncName, modifier, token)
+		}
+	}
+
+	// Detect misspelled keywords such as `sum(x) bye (job)`
+	if isIdentPrefix(lex.Token) {
+		return getDidYouMeanHint(lex.Token, keywords)
+	}
+	return ""
+}
+
+// splitAggrFuncWithModifier splits `aggr_by` and `aggr_without` into aggregate function name and modifier.
+func splitAggrFuncWithModifier(s string) (string, string, bool) {
+	s = strings.ToLower(s)
+	for _, modifier := range []string{"by", "without"} {
+		aggrFuncName, ok := strings.CutSuffix(s, "_"+modifier)
+		if ok && aggrFuncs[aggrFuncName] {
+			return aggrFuncName, modifier, true
+		}
+	}
+	return "", "", false
+}
+
+// getDidYouMeanHint returns `did you mean ...?` hint with candidates close to s.
+//
+// An empty string is returned if there are no close candidates.
+func getDidYouMeanHint(s string, candidates []string) string {
+	suggestions := getSuggestions(s, candidates)
+	if len(suggestions) == 0 {
+		return ""
+	}
+	quoted := make([]string, len(suggestions))
+	for i, suggestion := range suggestions {
+		quoted[i] = fmt.Sprintf("%q", suggestion)
+	}
+	return fmt.Sprintf("did you mean %s?", strings.Join(quoted, " or "))
+}
+
+// getSuggestions returns up to maxSuggestions candidates with the minimum edit distance to s.
+//
+// Candidates are compared with s case-insensitively.
+// Candidates equal to s aren't returned.
+func getSuggestions(s string, candidates []string) []string {
+	s = strings.ToLower(s)
+	maxDistance := len(s) / 3
+	if maxDistance < 1 {
+		maxDistance = 1
+	}
+	type suggestion struct {
+		name     string
+		distance int
+	}
+	var ss []suggestion
+	for _, candidate := range candidates {
+		if candidate == "" || candidate == s {
+			continue
+		}
+		d := editDistance(s, candidate)
+		if d <= maxDistance {
+			ss = append(ss, suggestion{
+				name:     candidate,
+				distance: d,
+			})
+		}
+	}
+	sort.Slice(ss, func(i, j int) bool {
+		if ss[i].distance != ss[j].distance {
+			return ss[i].distance < ss[j].distance
+		}
+		return ss[i].name < ss[j].name
+	})
+	// Return only the closest candidates.
+	n := 0
+	for n < len(ss) && n < maxSuggestions && ss[n].distance == ss[0].distance {
+		n++
+	}
+	ss = ss[:n]
+	result := make([]string, len(ss))
+	for i, s := range ss {
+		result[i] = s.name
+	}
+	return result
+}
+
+// editDistance returns Damerau-Levenshtein distance between a and b (optimal string alignment variant),
+// so transpositions such as `rtae` -> `rate` count as a single edit.
+func editDistance(a, b string) int {
+	ra := []rune(a)
+	rb := []rune(b)
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d := min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				d = min(d, prev2[j-2]+1)
+			}
+			curr[j] = d
+		}
+		prev2, prev, curr = prev, curr, prev2
+	}
+	return prev[len(rb)]
+}
+
+// getFuncNames returns names for all the supported functions.
+func getFuncNames() []string {
+	funcNames := make([]string, 0, len(rollupFuncs)+len(transformFuncs)+len(aggrFuncs))
+	for _, m := range []map[string]bool{rollupFuncs, transformFuncs, aggrFuncs} {
+		for funcName := range m {
+			funcNames = append(funcNames, funcName)
+		}
+	}
+	return funcNames
+}
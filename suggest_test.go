@@ -0,0 +1,70 @@
+package metricsql
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	f := func(a, b string, dExpected int) {
+		t.Helper()
+		d := editDistance(a, b)
+		if d != dExpected {
+			t.Fatalf("unexpected editDistance(%q, %q); got %d; want %d", a, b, d, dExpected)
+		}
+		d = editDistance(b, a)
+		if d != dExpected {
+			t.Fatalf("unexpected editDistance(%q, %q); got %d; want %d", b, a, d, dExpected)
+		}
+	}
+
+	f("", "", 0)
+	f("", "abc", 3)
+	f("rate", "rate", 0)
+	f("rat", "rate", 1)
+	f("rtae", "rate", 1)
+	f("irate", "rate", 1)
+	f("sum", "max", 3)
+	f("温度", "温", 1)
+}
+
+func TestParseErrorHints(t *testing.T) {
+	f := func(q, hintExpected string) {
+		t.Helper()
+		_, err := Parse(q)
+		if err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", q)
+		}
+		errStr := err.Error()
+		if hintExpected == "" {
+			if strings.Contains(errStr, "did you mean") || strings.Contains(errStr, "instead") {
+				t.Fatalf("unexpected hint in the error for %q: %s", q, errStr)
+			}
+			return
+		}
+		if !strings.HasSuffix(errStr, hintExpected) {
+			t.Fatalf("unexpected error for %q;\ngot\n%s\nwant suffix\n%s", q, errStr, hintExpected)
+		}
+	}
+
+	// unsupported functions
+	f(`rat(foo[5m])`, `unsupported function "rat"; did you mean "rad" or "rate"?`)
+	f(`RTAE(foo[5m])`, `unsupported function "RTAE"; did you mean "rate"?`)
+	f(`histogram_quantle(0.9, foo)`, `unsupported function "histogram_quantle"; did you mean "histogram_quantile"?`)
+	f(`sum(clamp_mn(foo, 0))`, `unsupported function "clamp_mn"; did you mean "clamp_min"?`)
+	f(`topk_mx(3, foo)`, `did you mean "topk_max"?`)
+	f(`sum_by(foo)`, `unsupported function "sum_by"; use `+"`sum(...) by (...)`"+` instead`)
+	f(`xyzabc(foo)`, ``)
+
+	// PromQL-isms
+	f(`sum_by(job)(foo)`, "use `sum(...) by (...)` instead of `sum_by(...)`")
+	f(`count_without (job) (foo)`, "use `count(...) without (...)` instead of `count_without(...)`")
+	f(`rate(foo offset 5m [5m])`, "`offset` must be put after `[...]`, e.g. `rate(m[5m] offset 1h)`")
+
+	// misspelled keywords
+	f(`sum(foo) bye (job)`, `did you mean "by"?`)
+	f(`sum(foo) withut (job)`, `did you mean "without"?`)
+	f(`foo unles bar`, `did you mean "unless"?`)
+	f(`rate(foo) keep_metric_name`, `did you mean "keep_metric_names"?`)
+	f(`foo bar`, ``)
+}
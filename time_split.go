@@ -0,0 +1,393 @@
+package metricsql
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/VictoriaMetrics/metricsql/rollup"
+)
+
+// TimeSplitInfo contains the result of AnalyzeTimeSplit.
+type TimeSplitInfo struct {
+	// Splittable is set to true if the expression can be evaluated independently on adjacent time ranges
+	// and the results can be merged into the result over the union of these ranges.
+	Splittable bool
+
+	// Reason contains human-readable explanation why the expression isn't splittable.
+	//
+	// It is empty if Splittable is true.
+	Reason string
+
+	// Lookback is the duration in milliseconds before the start of every time range,
+	// which must contain raw samples needed for calculating the expression on this range.
+	//
+	// Rollup functions without explicit lookbehind window are assumed to use the step as the window.
+	// Lookback doesn't include the distance to the last raw sample before the lookbehind window. See UsesPrevSample.
+	// Negative offsets reduce the Lookback, but not below zero.
+	Lookback int64
+
+	// UsesPrevSample is set to true if the expression contains rollup functions over series selectors such as rate()
+	// and increase(), which use the last raw sample before the lookbehind window. See rollup.UsesPrevSample.
+	//
+	// This sample may be up to rollup.GetMaxPrevInterval(scrapeInterval) before the window, while delta() and increase()
+	// may use it up to the lookback delta before the window. These distances depend on the selected series,
+	// so the caller must add them to Lookback if UsesPrevSample is set.
+	UsesPrevSample bool
+
+	// Lookahead is the duration in milliseconds after the end of every time range,
+	// which must contain raw samples needed for calculating the expression on this range.
+	//
+	// It is non-zero only for expressions with negative offsets such as `rate(foo[5m] offset -1h)`.
+	// delta() and increase() may also use the first raw sample after the lookbehind window for series,
+	// which have no samples before the window. Such samples aren't accounted in Lookahead.
+	Lookahead int64
+}
+
+// AnalyzeTimeSplit returns whether e can be evaluated independently on adjacent time ranges with the given step
+// in milliseconds, so the results can be merged into a single result.
+//
+// This is needed for caching results of range queries split into time-aligned sub-ranges.
+//
+// e isn't splittable if it contains `@ start()`, `@ end()`, `start()`, `end()`, functions whose results
+// at some point depend on other points on the selected time range such as `range_*`, `running_*` and `keep_last_value`,
+// or functions with non-deterministic results such as `rand()` and `now()`.
+func AnalyzeTimeSplit(e Expr, step int64) *TimeSplitInfo {
+	var tsi TimeSplitInfo
+	if reason := getTimeSplitBlocker(e); reason != "" {
+		tsi.Reason = reason
+		return &tsi
+	}
+	dr, err := getDataRange(e, step)
+	if err != nil {
+		tsi.Reason = err.Error()
+		return &tsi
+	}
+	tsi.Splittable = true
+	tsi.Lookback = max(dr.lookback, 0)
+	tsi.Lookahead = max(dr.lookahead, 0)
+	tsi.UsesPrevSample = dr.usesPrevSample
+	return &tsi
+}
+
+// getTimeSplitBlocker returns the reason why e cannot be split by time.
+//
+// An empty string is returned if e can be split by time.
+func getTimeSplitBlocker(e Expr) string {
+	var reason string
+	VisitAll(e, func(expr Expr) {
+		if reason != "" {
+			return
+		}
+		switch t := expr.(type) {
+		case *RollupExpr:
+			if t.At != nil && dependsOnTimeRange(t.At) {
+				reason = fmt.Sprintf("`@` modifier in %s depends on the selected time range", t.AppendString(nil))
+			}
+		case *FuncExpr:
+			funcName := strings.ToLower(t.Name)
+			if IsRollupFunc(funcName) {
+				// All the rollup functions calculate results independently per each point on the selected time range
+				// by using only raw samples on the lookbehind window for the point.
+				return
+			}
+			r, ok := timeSplitTransformFuncs[funcName]
+			if !ok {
+				reason = fmt.Sprintf("unknown function %q", t.Name)
+			} else if r != "" {
+				reason = fmt.Sprintf("%s() %s", funcName, r)
+			}
+		case *AggrFuncExpr:
+			funcName := strings.ToLower(t.Name)
+			if r := timeSplitAggrFuncs[funcName]; r != "" {
+				reason = fmt.Sprintf("%s() %s", funcName, r)
+			}
+		}
+	})
+	return reason
+}
+
+func dependsOnTimeRange(e Expr) bool {
+	result := false
+	VisitAll(e, func(expr Expr) {
+		if fe, ok := expr.(*FuncExpr); ok {
+			switch strings.ToLower(fe.Name) {
+			case "start", "end":
+				result = true
+			}
+		}
+	})
+	return result
+}
+
+// dataRange is the time range of raw samples relative to a point, which is needed for calculating an expression at this point.
+type dataRange struct {
+	// lookback is the duration in milliseconds before the point.
+	lookback int64
+
+	// lookahead is the duration in milliseconds after the point.
+	lookahead int64
+
+	// usesPrevSample is set if the calculation uses the last raw sample before the lookbehind window.
+	usesPrevSample bool
+}
+
+func (dr *dataRange) union(x dataRange) {
+	dr.lookback = max(dr.lookback, x.lookback)
+	dr.lookahead = max(dr.lookahead, x.lookahead)
+	dr.usesPrevSample = dr.usesPrevSample || x.usesPrevSample
+}
+
+// getDataRange returns the range of raw samples around every point, which is needed for calculating e at this point.
+//
+// Error is returned if durations in e cannot be evaluated for the given step.
+func getDataRange(e Expr, step int64) (dataRange, error) {
+	switch t := e.(type) {
+	case *MetricExpr:
+		// The selector without explicit window is implicitly wrapped into default_rollup(m[step]).
+		return dataRange{lookback: step}, nil
+	case *RollupExpr:
+		window := step
+		if t.Window != nil {
+			d, err := t.Window.NonNegativeDuration(step)
+			if err != nil {
+				return dataRange{}, fmt.Errorf("cannot evaluate window in %s: %w", t.AppendString(nil), err)
+			}
+			window = d
+		}
+		offset, err := t.Offset.DurationErr(step)
+		if err != nil {
+			return dataRange{}, fmt.Errorf("cannot evaluate offset in %s: %w", t.AppendString(nil), err)
+		}
+		// The expression is calculated on the (t-offset-window ... t-offset] range for every point t.
+		dr := dataRange{
+			lookback:  window + offset,
+			lookahead: -offset,
+		}
+		if _, ok := t.Expr.(*MetricExpr); ok && !t.ForSubquery() {
+			return dr, nil
+		}
+		// Subquery needs the data range for its inner expression calculated with the subquery step.
+		subStep, err := getSubqueryStep(t, step)
+		if err != nil {
+			return dataRange{}, err
+		}
+		subDR, err := getDataRange(t.Expr, subStep)
+		if err != nil {
+			return dataRange{}, err
+		}
+		dr.lookback += subDR.lookback
+		dr.lookahead += subDR.lookahead
+		dr.usesPrevSample = subDR.usesPrevSample
+		return dr, nil
+	case *FuncExpr:
+		funcName := strings.ToLower(t.Name)
+		idx := GetRollupArgIdx(t)
+		var dr dataRange
+		for i, arg := range t.Args {
+			argDR, err := getDataRange(arg, step)
+			if err != nil {
+				return dataRange{}, err
+			}
+			if i == idx {
+				re, isRollup := arg.(*RollupExpr)
+				_, isSelector := arg.(*MetricExpr)
+				if !isRollup && !isSelector {
+					// Non-selector arg for rollup function is implicitly converted into a subquery arg[step:step].
+					argDR.lookback += step
+				}
+				if rollup.UsesPrevSample(funcName) {
+					if isSelector || isRollup && !re.ForSubquery() {
+						// The function uses the last raw sample before the lookbehind window.
+						// The distance to this sample depends on the scrape interval, so it must be added by the caller.
+						argDR.usesPrevSample = true
+					} else {
+						// The function uses the last subquery point before the lookbehind window.
+						subStep, err := getSubqueryStep(re, step)
+						if err != nil {
+							return dataRange{}, err
+						}
+						argDR.lookback += subStep
+					}
+				}
+			}
+			dr.union(argDR)
+		}
+		return dr, nil
+	case *AggrFuncExpr:
+		return getMaxDataRange(t.Args, step)
+	case *BinaryOpExpr:
+		return getMaxDataRange([]Expr{t.Left, t.Right}, step)
+	default:
+		return dataRange{}, nil
+	}
+}
+
+func getMaxDataRange(args []Expr, step int64) (dataRange, error) {
+	var dr dataRange
+	for _, arg := range args {
+		argDR, err := getDataRange(arg, step)
+		if err != nil {
+			return dataRange{}, err
+		}
+		dr.union(argDR)
+	}
+	return dr, nil
+}
+
+// getSubqueryStep returns the step for the subquery re evaluated with the given step.
+//
+// re may be nil for non-selector args of rollup functions, which are implicitly converted into subqueries with the given step.
+func getSubqueryStep(re *RollupExpr, step int64) (int64, error) {
+	if re == nil || re.Step == nil {
+		return step, nil
+	}
+	d, err := re.Step.NonNegativeDuration(step)
+	if err != nil {
+		return 0, fmt.Errorf("cannot evaluate step in %s: %w", re.AppendString(nil), err)
+	}
+	if d == 0 {
+		return step, nil
+	}
+	return d, nil
+}
+
+// timeSplitTransformFuncs contains all the transform functions.
+//
+// An empty value means the function calculates the result at every point independently of other points
+// on the selected time range. Otherwise the value contains the reason why the function cannot be split by time.
+//
+// This map must contain all the functions from transformFuncs.
+var timeSplitTransformFuncs = map[string]string{
+	"":                           "",
+	"abs":                        "",
+	"absent":                     "",
+	"acos":                       "",
+	"acosh":                      "",
+	"asin":                       "",
+	"asinh":                      "",
+	"atan":                       "",
+	"atanh":                      "",
+	"bitmap_and":                 "",
+	"bitmap_or":                  "",
+	"bitmap_xor":                 "",
+	"buckets_limit":              "selects buckets by their values over the selected time range",
+	"ceil":                       "",
+	"clamp":                      "",
+	"clamp_max":                  "",
+	"clamp_min":                  "",
+	"cos":                        "",
+	"cosh":                       "",
+	"day_of_month":               "",
+	"day_of_week":                "",
+	"day_of_year":                "",
+	"days_in_month":              "",
+	"deg":                        "",
+	"drop_common_labels":         "drops labels common for all the series on the selected time range",
+	"drop_empty_series":          "",
+	"end":                        "returns the end of the selected time range",
+	"exp":                        "",
+	"floor":                      "",
+	"histogram_avg":              "",
+	"histogram_fraction":         "",
+	"histogram_quantile":         "",
+	"histogram_quantiles":        "",
+	"histogram_share":            "",
+	"histogram_stddev":           "",
+	"histogram_stdvar":           "",
+	"hour":                       "",
+	"interpolate":                "fills gaps with values from adjacent points on the selected time range",
+	"keep_last_value":            "fills gaps with values from previous points on the selected time range",
+	"keep_next_value":            "fills gaps with values from next points on the selected time range",
+	"label_copy":                 "",
+	"label_del":                  "",
+	"label_graphite_group":       "",
+	"label_join":                 "",
+	"label_keep":                 "",
+	"label_lowercase":            "",
+	"label_map":                  "",
+	"label_match":                "",
+	"label_mismatch":             "",
+	"label_move":                 "",
+	"label_replace":              "",
+	"label_set":                  "",
+	"label_transform":            "",
+	"label_uppercase":            "",
+	"label_value":                "",
+	"labels_equal":               "",
+	"limit_offset":               "selects series depending on all the series on the selected time range",
+	"ln":                         "",
+	"log2":                       "",
+	"log10":                      "",
+	"minute":                     "",
+	"month":                      "",
+	"now":                        "returns the query evaluation time",
+	"pi":                         "",
+	"prometheus_buckets":         "",
+	"rad":                        "",
+	"rand":                       "returns non-deterministic results",
+	"rand_exponential":           "returns non-deterministic results",
+	"rand_normal":                "returns non-deterministic results",
+	"range_avg":                  "calculates the result over all the points on the selected time range",
+	"range_first":                "calculates the result over all the points on the selected time range",
+	"range_last":                 "calculates the result over all the points on the selected time range",
+	"range_linear_regression":    "calculates the result over all the points on the selected time range",
+	"range_mad":                  "calculates the result over all the points on the selected time range",
+	"range_max":                  "calculates the result over all the points on the selected time range",
+	"range_min":                  "calculates the result over all the points on the selected time range",
+	"range_normalize":            "calculates the result over all the points on the selected time range",
+	"range_quantile":             "calculates the result over all the points on the selected time range",
+	"range_stddev":               "calculates the result over all the points on the selected time range",
+	"range_stdvar":               "calculates the result over all the points on the selected time range",
+	"range_sum":                  "calculates the result over all the points on the selected time range",
+	"range_trim_outliers":        "calculates the result over all the points on the selected time range",
+	"range_trim_spikes":          "calculates the result over all the points on the selected time range",
+	"range_trim_zscore":          "calculates the result over all the points on the selected time range",
+	"range_zscore":               "calculates the result over all the points on the selected time range",
+	"remove_resets":              "accumulates counter resets from the start of the selected time range",
+	"round":                      "",
+	"running_avg":                "accumulates the result from the start of the selected time range",
+	"running_max":                "accumulates the result from the start of the selected time range",
+	"running_min":                "accumulates the result from the start of the selected time range",
+	"running_sum":                "accumulates the result from the start of the selected time range",
+	"scalar":                     "",
+	"sgn":                        "",
+	"sin":                        "",
+	"sinh":                       "",
+	"smooth_exponential":         "accumulates the result from the start of the selected time range",
+	"sort":                       "orders series by their last value on the selected time range",
+	"sort_by_label":              "",
+	"sort_by_label_desc":         "",
+	"sort_by_label_numeric":      "",
+	"sort_by_label_numeric_desc": "",
+	"sort_desc":                  "orders series by their last value on the selected time range",
+	"sqrt":                       "",
+	"start":                      "returns the start of the selected time range",
+	"step":                       "",
+	"tan":                        "",
+	"tanh":                       "",
+	"time":                       "",
+	"timezone_offset":            "",
+	"union":                      "",
+	"vector":                     "",
+	"year":                       "",
+}
+
+// timeSplitAggrFuncs contains aggregate functions, which cannot be split by time,
+// together with the reason why they cannot be split by time.
+//
+// Other aggregate functions calculate results at every point independently of other points on the selected time range.
+var timeSplitAggrFuncs = map[string]string{
+	"bottomk_avg":    "selects series by their values over the selected time range",
+	"bottomk_last":   "selects series by their values over the selected time range",
+	"bottomk_max":    "selects series by their values over the selected time range",
+	"bottomk_median": "selects series by their values over the selected time range",
+	"bottomk_min":    "selects series by their values over the selected time range",
+	"outliers_iqr":   "selects series by their values over the selected time range",
+	"outliers_mad":   "selects series by their values over the selected time range",
+	"outliersk":      "selects series by their values over the selected time range",
+	"topk_avg":       "selects series by their values over the selected time range",
+	"topk_last":      "selects series by their values over the selected time range",
+	"topk_max":       "selects series by their values over the selected time range",
+	"topk_median":    "selects series by their values over the selected time range",
+	"topk_min":       "selects series by their values over the selected time range",
+}
@@ -0,0 +1,154 @@
+package metricsql
+
+import (
+	"testing"
+)
+
+func TestAnalyzeTimeSplit(t *testing.T) {
+	f := func(q string, step int64, splittableExpected bool, lookbackExpected int64) {
+		t.Helper()
+		e, err := Parse(q)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", q, err)
+		}
+		tsi := AnalyzeTimeSplit(e, step)
+		if tsi.Splittable != splittableExpected {
+			t.Fatalf("unexpected Splittable for %q; got %v; want %v; reason: %s", q, tsi.Splittable, splittableExpected, tsi.Reason)
+		}
+		if tsi.Splittable && tsi.Reason != "" {
+			t.Fatalf("unexpected non-empty reason for splittable %q: %s", q, tsi.Reason)
+		}
+		if !tsi.Splittable && tsi.Reason == "" {
+			t.Fatalf("missing reason for non-splittable %q", q)
+		}
+		if tsi.Lookback != lookbackExpected {
+			t.Fatalf("unexpected Lookback for %q; got %d; want %d", q, tsi.Lookback, lookbackExpected)
+		}
+	}
+
+	// splittable expressions
+	f(`1`, 1000, true, 0)
+	f(`time()`, 1000, true, 0)
+	f(`foo`, 1000, true, 1000)
+	f(`rate(foo)`, 15000, true, 15000)
+	f(`rate(foo[5m])`, 1000, true, 300_000)
+	f(`rate(foo[5m] offset 1h)`, 1000, true, 3_900_000)
+	f(`rate(foo[5m] offset -1h)`, 1000, true, 0)
+	f(`sum(rate(foo[5m])) by (job) / sum(rate(bar[1h])) by (job)`, 1000, true, 3_600_000)
+	f(`max_over_time(rate(foo[5m])[1h:1m])`, 1000, true, 3_900_000)
+	f(`max_over_time(rate(foo)[1h:1m])`, 1000, true, 3_660_000)
+	f(`rate(sum(foo))`, 1000, true, 3000)
+	f(`rate(foo[5i])`, 1000, true, 5000)
+	f(`max_over_time(foo[5m])`, 1000, true, 300_000)
+	f(`increase(foo[1h] offset 30m)`, 1000, true, 5_400_000)
+	f(`histogram_quantile(0.9, sum(rate(foo_bucket[5m])) by (le))`, 1000, true, 300_000)
+	f(`label_set(foo[5m] @ 1234, "a", "b")`, 1000, true, 300_000)
+	f(`topk(3, foo) + bottomk(2, bar)`, 1000, true, 1000)
+	f(`sort_by_label(foo, "job")`, 1000, true, 1000)
+
+	// non-splittable expressions
+	f(`foo @ end()`, 1000, false, 0)
+	f(`rate(foo[5m] @ start())`, 1000, false, 0)
+	f(`rate(foo[5m] @ (end() - 1h))`, 1000, false, 0)
+	f(`time() - start()`, 1000, false, 0)
+	f(`range_max(foo)`, 1000, false, 0)
+	f(`running_sum(rate(foo[5m]))`, 1000, false, 0)
+	f(`keep_last_value(foo)`, 1000, false, 0)
+	f(`sort_desc(foo)`, 1000, false, 0)
+	f(`foo + rand()`, 1000, false, 0)
+	f(`topk_max(3, foo)`, 1000, false, 0)
+	f(`WITH (f(x) = range_median(x)) f(foo)`, 1000, false, 0)
+	f(`rate(foo[5m / (step() - step())])`, 1000, false, 0)
+	f(`foo offset (1h / (step() - 60s))`, 60_000, false, 0)
+}
+
+func TestAnalyzeTimeSplitLookahead(t *testing.T) {
+	f := func(q string, step, lookbackExpected, lookaheadExpected int64) {
+		t.Helper()
+		e, err := Parse(q)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", q, err)
+		}
+		tsi := AnalyzeTimeSplit(e, step)
+		if !tsi.Splittable {
+			t.Fatalf("expecting splittable %q; reason: %s", q, tsi.Reason)
+		}
+		if tsi.Lookback != lookbackExpected {
+			t.Fatalf("unexpected Lookback for %q; got %d; want %d", q, tsi.Lookback, lookbackExpected)
+		}
+		if tsi.Lookahead != lookaheadExpected {
+			t.Fatalf("unexpected Lookahead for %q; got %d; want %d", q, tsi.Lookahead, lookaheadExpected)
+		}
+	}
+
+	// no negative offsets
+	f(`foo`, 1000, 1000, 0)
+	f(`rate(foo[5m] offset 1h)`, 1000, 3_900_000, 0)
+
+	// negative offsets
+	f(`foo offset -1m`, 1000, 0, 60_000)
+	f(`rate(foo[5m] offset -1h)`, 1000, 0, 3_600_000)
+	f(`rate(foo[5m] offset -1m)`, 1000, 240_000, 60_000)
+	f(`rate(foo[5m]) + bar offset -10m`, 1000, 300_000, 600_000)
+	f(`max_over_time(foo[1h:1m] offset -30m)`, 1000, 1_860_000, 1_800_000)
+	f(`max_over_time((foo offset -5m)[1h:1m])`, 1000, 3_360_000, 300_000)
+}
+
+func TestAnalyzeTimeSplitUsesPrevSample(t *testing.T) {
+	f := func(q string, step, lookbackExpected int64, usesPrevSampleExpected bool) {
+		t.Helper()
+		e, err := Parse(q)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", q, err)
+		}
+		tsi := AnalyzeTimeSplit(e, step)
+		if !tsi.Splittable {
+			t.Fatalf("expecting splittable %q; reason: %s", q, tsi.Reason)
+		}
+		if tsi.Lookback != lookbackExpected {
+			t.Fatalf("unexpected Lookback for %q; got %d; want %d", q, tsi.Lookback, lookbackExpected)
+		}
+		if tsi.UsesPrevSample != usesPrevSampleExpected {
+			t.Fatalf("unexpected UsesPrevSample for %q; got %v; want %v", q, tsi.UsesPrevSample, usesPrevSampleExpected)
+		}
+	}
+
+	// functions without the previous sample
+	f(`foo`, 1000, 1000, false)
+	f(`max_over_time(foo[5m])`, 1000, 300_000, false)
+	f(`delta_prometheus(foo[5m])`, 1000, 300_000, false)
+	f(`time() - 1`, 1000, 0, false)
+
+	// functions with the previous raw sample
+	f(`rate(foo[5m])`, 1000, 300_000, true)
+	f(`IDERIV(foo[5m])`, 1000, 300_000, true)
+	f(`lag(foo[5m])`, 1000, 300_000, true)
+	f(`holt_winters(foo[5m], 0.5, 0.5)`, 1000, 300_000, true)
+	f(`rollup_candlestick(foo[5m])`, 1000, 300_000, true)
+	f(`tlast_change_over_time(foo[5m])`, 1000, 300_000, true)
+	f(`sum(increases_over_time(foo)) + bar`, 1000, 1000, true)
+	f(`max_over_time(rate(foo[5m])[1h:1m])`, 1000, 3_900_000, true)
+
+	// functions with the previous subquery point
+	f(`rate(sum(foo))`, 1000, 3000, false)
+	f(`rate(sum(foo)[5m:1m])`, 1000, 420_000, false)
+	f(`integrate(foo[5m:])`, 1000, 302_000, false)
+}
+
+func TestTimeSplitTransformFuncs(t *testing.T) {
+	for funcName := range transformFuncs {
+		if _, ok := timeSplitTransformFuncs[funcName]; !ok {
+			t.Fatalf("missing %q function in timeSplitTransformFuncs", funcName)
+		}
+	}
+	for funcName := range timeSplitTransformFuncs {
+		if !transformFuncs[funcName] {
+			t.Fatalf("unknown %q function in timeSplitTransformFuncs", funcName)
+		}
+	}
+	for funcName := range timeSplitAggrFuncs {
+		if !aggrFuncs[funcName] {
+			t.Fatalf("unknown %q function in timeSplitAggrFuncs", funcName)
+		}
+	}
+}
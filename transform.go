@@ -1,6 +1,9 @@
 package metricsql
 
 import (
+	"fmt"
+	"math"
+	"strconv"
 	"strings"
 )
 
@@ -126,3 +129,171 @@ func IsTransformFunc(funcName string) bool {
 	return transformFuncs[s]
 
 }
+
+// GetTransformArgIdx returns the argument index for the given fe, which accepts the series argument.
+//
+// The index of the first series arg is returned for functions with multiple series args such as union().
+// -1 is returned if fe isn't a transform function or if it doesn't accept series args such as time().
+func GetTransformArgIdx(fe *FuncExpr) int {
+	funcName := strings.ToLower(fe.Name)
+	if !transformFuncs[funcName] {
+		return -1
+	}
+	switch funcName {
+	case "end", "now", "pi", "start", "step", "time", "timezone_offset":
+		return -1
+	case "limit_offset", "histogram_fraction":
+		return 2
+	case "buckets_limit", "histogram_quantile", "histogram_share", "range_quantile",
+		"range_trim_outliers", "range_trim_spikes", "range_trim_zscore":
+		return 1
+	case "histogram_quantiles":
+		return len(fe.Args) - 1
+	default:
+		return 0
+	}
+}
+
+// evalConstantTransformFunc returns the result of the deterministic transform function fe with constant args.
+//
+// false is returned if fe cannot be evaluated at parse time. Functions, which depend on the query time range
+// or return random values such as time(), now(), step() or rand(), are never evaluated.
+// Functions with NaN args aren't evaluated too, so NaN handling is left to the query engine.
+func evalConstantTransformFunc(fe *FuncExpr) (float64, bool) {
+	args := make([]float64, len(fe.Args))
+	for i, arg := range fe.Args {
+		ne, ok := arg.(*NumberExpr)
+		if !ok || math.IsNaN(ne.N) {
+			return 0, false
+		}
+		args[i] = ne.N
+	}
+	funcName := strings.ToLower(fe.Name)
+	if f := constantMathFuncs[funcName]; f != nil {
+		if len(args) != 1 {
+			return 0, false
+		}
+		return f(args[0]), true
+	}
+	switch funcName {
+	case "pi":
+		if len(args) != 0 {
+			return 0, false
+		}
+		return math.Pi, true
+	case "scalar", "vector":
+		if len(args) != 1 {
+			return 0, false
+		}
+		return args[0], true
+	case "clamp":
+		if len(args) != 3 {
+			return 0, false
+		}
+		v, minV, maxV := args[0], args[1], args[2]
+		if minV > maxV {
+			// VictoriaMetrics returns empty result in this case.
+			return nan, true
+		}
+		if v > maxV {
+			return maxV, true
+		}
+		if v < minV {
+			return minV, true
+		}
+		return v, true
+	case "clamp_max":
+		if len(args) != 2 {
+			return 0, false
+		}
+		if args[0] > args[1] {
+			return args[1], true
+		}
+		return args[0], true
+	case "clamp_min":
+		if len(args) != 2 {
+			return 0, false
+		}
+		if args[0] < args[1] {
+			return args[1], true
+		}
+		return args[0], true
+	case "round":
+		if len(args) < 1 || len(args) > 2 {
+			return 0, false
+		}
+		nearest := float64(1)
+		if len(args) == 2 {
+			nearest = args[1]
+		}
+		return RoundToNearest(args[0], nearest), true
+	default:
+		return 0, false
+	}
+}
+
+var constantMathFuncs = map[string]func(v float64) float64{
+	"abs":   math.Abs,
+	"acos":  math.Acos,
+	"acosh": math.Acosh,
+	"asin":  math.Asin,
+	"asinh": math.Asinh,
+	"atan":  math.Atan,
+	"atanh": math.Atanh,
+	"ceil":  math.Ceil,
+	"cos":   math.Cos,
+	"cosh":  math.Cosh,
+	"deg": func(v float64) float64 {
+		return v * 180 / math.Pi
+	},
+	"exp":   math.Exp,
+	"floor": math.Floor,
+	"ln":    math.Log,
+	"log2":  math.Log2,
+	"log10": math.Log10,
+	"rad": func(v float64) float64 {
+		return v * math.Pi / 180
+	},
+	"sgn": func(v float64) float64 {
+		if v < 0 {
+			return -1
+		}
+		if v > 0 {
+			return 1
+		}
+		return 0
+	},
+	"sin":  math.Sin,
+	"sinh": math.Sinh,
+	"sqrt": math.Sqrt,
+	"tan":  math.Tan,
+	"tanh": math.Tanh,
+}
+
+// RoundToNearest rounds v to the nearest multiple of nearest in the same way as round(v, nearest) does in VictoriaMetrics.
+//
+// The result is truncated to the number of decimal digits in nearest, so round(3.14159, 0.01) returns exactly 3.14.
+func RoundToNearest(v, nearest float64) float64 {
+	p10 := math.Pow10(-decimalExponent(nearest))
+	v += 0.5 * math.Copysign(nearest, v)
+	v -= math.Mod(v, nearest)
+	v, _ = math.Modf(v * p10)
+	return v / p10
+}
+
+// decimalExponent returns the exponent e for the shortest decimal representation m*10^e of v with integer m.
+func decimalExponent(v float64) int {
+	if v == 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0
+	}
+	s := strconv.FormatFloat(math.Abs(v), 'e', -1, 64)
+	mantissa, expStr, _ := strings.Cut(s, "e")
+	e, err := strconv.Atoi(expStr)
+	if err != nil {
+		panic(fmt.Errorf("BUG: cannot parse exponent in %q: %w", s, err))
+	}
+	if _, frac, ok := strings.Cut(mantissa, "."); ok {
+		e -= len(frac)
+	}
+	return e
+}
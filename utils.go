@@ -146,7 +146,11 @@ func checkSupportedFunctions(e Expr) error {
 		}
 
 		if !IsSupportedFunction(fe.Name) {
-			err = fmt.Errorf("unsupported function %q", fe.Name)
+			if hint := getUnsupportedFunctionHint(fe.Name); hint != "" {
+				err = fmt.Errorf("unsupported function %q; %s", fe.Name, hint)
+			} else {
+				err = fmt.Errorf("unsupported function %q", fe.Name)
+			}
 		}
 	})
 	return err